@@ -0,0 +1,184 @@
+// Command migrate-storage copies every blob script content is stored in from
+// the configured storage (STORAGE_TYPE, S3_*, LOCAL_STORAGE_PATH) to the
+// mirror storage (MIRROR_STORAGE_TYPE, MIRROR_S3_*,
+// MIRROR_LOCAL_STORAGE_PATH). It reads the same environment as the server.
+//
+// To move to a new backend: set the MIRROR_ variables on the server, so new
+// blobs are written to both, run this until it reports no failures, then
+// point the STORAGE_ variables at the new backend and unset the MIRROR_ ones.
+//
+// Each blob is checked against the checksum of its script version before it
+// is copied and read back afterwards. Copied blobs are recorded in the state
+// file, so an interrupted run picks up where it stopped.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"shebang.run/internal/config"
+	"shebang.run/internal/database"
+	"shebang.run/internal/storage"
+)
+
+func main() {
+	statePath := flag.String("state", "migrate-storage.state", "file recording the blobs already copied")
+	flag.Parse()
+
+	cfg := config.Load()
+	if cfg.MirrorStorage == nil {
+		log.Fatalf("MIRROR_STORAGE_TYPE is not set; there is nowhere to copy to")
+	}
+
+	db, err := database.Connect(cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("Failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	src, err := openStorage(cfg.Storage(), cfg.StorageCompression)
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+	dst, err := openStorage(*cfg.MirrorStorage, cfg.StorageCompression)
+	if err != nil {
+		log.Fatalf("Failed to initialize mirror storage: %v", err)
+	}
+
+	done, err := loadState(*statePath)
+	if err != nil {
+		log.Fatalf("Failed to read state file: %v", err)
+	}
+	state, err := os.OpenFile(*statePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Fatalf("Failed to open state file: %v", err)
+	}
+	defer state.Close()
+
+	blobs, err := db.ListStoredBlobs()
+	if err != nil {
+		log.Fatalf("Failed to list blobs: %v", err)
+	}
+
+	ctx := context.Background()
+	var copied, skipped, unverified, failed int
+	for _, blob := range blobs {
+		if done[blob.Key] {
+			skipped++
+			continue
+		}
+
+		verified, err := copyBlob(ctx, src, dst, blob)
+		if err != nil {
+			log.Printf("%s: %v", blob.Key, err)
+			failed++
+			continue
+		}
+		if !verified {
+			unverified++
+		}
+		if _, err := fmt.Fprintln(state, blob.Key); err != nil {
+			log.Fatalf("Failed to record progress: %v", err)
+		}
+		copied++
+	}
+
+	log.Printf("%d blobs: %d copied (%d of them encrypted under legacy keys, checked only against the copy), %d already copied, %d failed",
+		len(blobs), copied, unverified, skipped, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// openStorage opens the backend the way the server does, so compressed blobs
+// are read back as script content and written compressed
+func openStorage(backend config.StorageBackendConfig, compression string) (storage.Storage, error) {
+	store, err := storage.Open(backend)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewCompressedStorage(store, compression)
+}
+
+// loadState returns the blobs a previous run copied
+func loadState(statePath string) (map[string]bool, error) {
+	done := make(map[string]bool)
+	f, err := os.Open(statePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return done, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if key := strings.TrimSpace(scanner.Text()); key != "" {
+			done[key] = true
+		}
+	}
+	return done, scanner.Err()
+}
+
+// copyBlob checks the blob before copying it and the copy afterwards.
+// Plaintext is checked against its version's checksum and content-addressed
+// blobs against their key; encrypted blobs stored under legacy keys have
+// nothing to check against, which verified reports.
+func copyBlob(ctx context.Context, src, dst storage.Storage, blob database.StoredBlob) (verified bool, err error) {
+	data, err := readBlob(ctx, src, blob.Key)
+	if err != nil {
+		return false, fmt.Errorf("reading: %w", err)
+	}
+	sum := sha256Hex(data)
+
+	switch {
+	case !blob.Encrypted:
+		if sum != blob.Checksum {
+			return false, fmt.Errorf("checksum mismatch: content %s, version %s", sum, blob.Checksum)
+		}
+		verified = true
+	case strings.HasPrefix(blob.Key, "sha256/"):
+		if sum != path.Base(blob.Key) {
+			return false, fmt.Errorf("checksum mismatch: content %s", sum)
+		}
+		verified = true
+	}
+
+	if err := dst.Put(ctx, blob.Key, bytes.NewReader(data), int64(len(data))); err != nil {
+		return false, fmt.Errorf("writing: %w", err)
+	}
+	copied, err := readBlob(ctx, dst, blob.Key)
+	if err != nil {
+		return false, fmt.Errorf("reading back: %w", err)
+	}
+	if sha256Hex(copied) != sum {
+		return false, errors.New("copy differs from the original")
+	}
+	return verified, nil
+}
+
+func readBlob(ctx context.Context, store storage.Storage, key string) ([]byte, error) {
+	reader, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
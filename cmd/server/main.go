@@ -3,14 +3,17 @@ package main
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"shebang.run/internal/ai"
 	"shebang.run/internal/api"
+	"shebang.run/internal/auth"
 	"shebang.run/internal/config"
 	"shebang.run/internal/crypto"
 	"shebang.run/internal/database"
 	"shebang.run/internal/jobs"
 	"shebang.run/internal/kms"
+	"shebang.run/internal/mailer"
 	"shebang.run/internal/middleware"
 	"shebang.run/internal/storage"
 
@@ -21,6 +24,25 @@ import (
 
 func main() {
 	cfg := config.Load()
+	var err error
+
+	// Session tokens are signed with an asymmetric key when one is configured,
+	// otherwise with JWT_SECRET, which must not be the placeholder
+	var jwtKeys *auth.KeySet
+	if cfg.JWTSigningKeyFile != "" {
+		jwtKeys, err = auth.LoadKeySet(cfg.JWTSigningKeyFile, cfg.JWTVerificationKeyFiles)
+		if err != nil {
+			log.Fatalf("Failed to load JWT signing keys: %v", err)
+		}
+	} else {
+		if cfg.JWTSecret == config.DefaultJWTSecret {
+			if !cfg.DevMode {
+				log.Fatalf("JWT_SECRET is the default placeholder; set JWT_SIGNING_KEY_FILE or JWT_SECRET (or DEV_MODE=true for local development)")
+			}
+			log.Printf("Warning: signing tokens with the default JWT_SECRET (DEV_MODE)")
+		}
+		jwtKeys = auth.NewHMACKeySet(cfg.JWTSecret)
+	}
 
 	db, err := database.Connect(cfg.DatabaseURL)
 	if err != nil {
@@ -33,16 +55,42 @@ func main() {
 		log.Fatalf("Failed to initialize schema: %v", err)
 	}
 
-	var store storage.Storage
-	if cfg.StorageType == "s3" {
-		store, err = storage.NewS3Storage(cfg.S3Endpoint, cfg.S3AccessKey, cfg.S3SecretKey, cfg.S3Bucket, false)
-	} else {
-		store, err = storage.NewLocalStorage(cfg.LocalStoragePath)
+	store, err := storage.Open(cfg.Storage())
+	if err != nil {
+		log.Fatalf("Failed to initialize storage: %v", err)
+	}
+	if cfg.StorageType == "s3" && !cfg.S3UseSSL {
+		log.Printf("Warning: S3 traffic is unencrypted; set S3_USE_SSL=true unless the endpoint is on a trusted network")
 	}
+	// While migrating, new blobs are written to the mirror too; cmd/migrate-storage
+	// copies the ones written before
+	if cfg.MirrorStorage != nil {
+		mirror, err := storage.Open(*cfg.MirrorStorage)
+		if err != nil {
+			log.Fatalf("Failed to initialize mirror storage: %v", err)
+		}
+		store = storage.NewMirrorStorage(store, mirror)
+	}
+	// Blobs are compressed as they are written; blobs already stored are
+	// read whatever their codec, including with compression turned off
+	store, err = storage.NewCompressedStorage(store, cfg.StorageCompression)
 	if err != nil {
 		log.Fatalf("Failed to initialize storage: %v", err)
 	}
 
+	// Rate limit buckets live in Redis when several instances must share them
+	if cfg.RateLimitStore == "redis" {
+		limitStore, err := middleware.NewRedisRateLimitStore(cfg.RedisURL)
+		if err != nil {
+			log.Fatalf("Failed to connect to rate limit store: %v", err)
+		}
+		middleware.UseRateLimitStore(limitStore)
+	}
+	// Client addresses come from X-Real-IP only behind a trusted proxy
+	if err := middleware.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// Initialize KMS
 	var keyManager kms.KeyManager
 	if cfg.MasterKeySource == "env" {
@@ -59,20 +107,36 @@ func main() {
 		udekManager = crypto.NewUDEKManager(db.DB, keyManager)
 	}
 
-	authHandler := api.NewAuthHandler(db, cfg)
+	// Password reset and verification emails; the log mailer writes them to
+	// MAIL_DIR or the server log for local development
+	var mail mailer.Mailer
+	if cfg.Mailer == "smtp" {
+		mail, err = mailer.NewSMTPMailer(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUsername, cfg.SMTPPassword, cfg.MailFrom)
+	} else {
+		mail, err = mailer.NewLogMailer(cfg.MailDir, cfg.MailFrom)
+	}
+	if err != nil {
+		log.Fatalf("Failed to initialize mailer: %v", err)
+	}
+
+	authHandler := api.NewAuthHandler(db, cfg, jwtKeys, mail)
 	keyHandler := api.NewKeyHandler(db)
 	scriptHandler := api.NewScriptHandler(db, store, cfg)
-	publicHandler := api.NewPublicHandler(db, store, cfg)
-	adminHandler := api.NewAdminHandler(db, cfg)
+	publicHandler := api.NewPublicHandler(db, store, cfg, jwtKeys)
+	adminHandler := api.NewAdminHandler(db, cfg, store)
 	accountHandler := api.NewAccountHandler(db, cfg)
 	setupHandler := api.NewSetupHandler(db)
 	communityHandler := api.NewCommunityHandler(db)
-	shareHandler := api.NewShareHandler(db.DB)
+	shareHandler := api.NewShareHandler(db)
+	groupHandler := api.NewGroupHandler(db)
+	orgHandler := api.NewOrgHandler(db)
+	accessRequestHandler := api.NewAccessRequestHandler(db)
+	notificationHandler := api.NewNotificationHandler(db)
 	webHandler := api.NewWebHandler()
 	
 	var secretsHandler *api.SecretsHandler
 	if udekManager != nil {
-		secretsHandler = api.NewSecretsHandler(db.DB, udekManager)
+		secretsHandler = api.NewSecretsHandler(db, udekManager)
 	}
 
 	// Initialize AI providers
@@ -101,12 +165,18 @@ func main() {
 
 	// Start background jobs
 	jobs.StartSubscriptionChecker(db.DB)
+	jobs.StartStorageReconciler(db)
+	if cfg.BlobGCIntervalHours > 0 {
+		jobs.StartBlobGC(db, store, time.Duration(cfg.BlobGCIntervalHours)*time.Hour, time.Duration(cfg.BlobGCGraceHours)*time.Hour, cfg.BlobGCDryRun)
+	}
+	if cfg.ScrubIntervalHours > 0 {
+		jobs.StartScrubber(db, store, time.Duration(cfg.ScrubIntervalHours)*time.Hour, cfg.ScrubBlobsPerSecond)
+	}
 
 	r := chi.NewRouter()
 	
 	r.Use(chimiddleware.Logger)
 	r.Use(chimiddleware.Recoverer)
-	r.Use(chimiddleware.RealIP)
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
@@ -114,6 +184,8 @@ func main() {
 		AllowCredentials: true,
 	}))
 
+	r.Get("/.well-known/jwks.json", authHandler.JWKS)
+
 	r.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
@@ -162,6 +234,9 @@ func main() {
 		r.Get("/secrets", webHandler.Secrets)
 		r.Get("/select-username", webHandler.SelectUsername)
 		r.Get("/account", webHandler.Account)
+		r.Get("/device", webHandler.Device)
+		r.Get("/reset-password", webHandler.ResetPassword)
+		r.Get("/verify-email", webHandler.VerifyEmail)
 		r.Get("/script-editor", webHandler.ScriptEditor)
 		r.Get("/privacy", webHandler.Privacy)
 		r.Get("/gdpr", webHandler.GDPR)
@@ -172,46 +247,62 @@ func main() {
 	})
 
 	r.Route("/api/auth", func(r chi.Router) {
-		r.Use(middleware.RateLimitMiddleware(cfg.DefaultRateLimit, db))
-		r.Post("/register", authHandler.Register)
+		r.Use(middleware.RateLimitMiddleware(cfg.DefaultRateLimit, cfg.RateLimitBurst, db))
+		r.With(middleware.RateLimitCost(5)).Post("/register", authHandler.Register)
 		r.Post("/login", authHandler.Login)
+		r.Post("/login/mfa", authHandler.LoginMFA)
+		r.Post("/login/mfa/passkey/begin", authHandler.BeginMFAPasskey)
+		r.Post("/login/mfa/passkey/finish", authHandler.FinishMFAPasskey)
+		r.Post("/passkey/begin", authHandler.BeginPasskeyLogin)
+		r.Post("/passkey/finish", authHandler.FinishPasskeyLogin)
 		r.Get("/check-username", authHandler.CheckUsername)
-		r.With(middleware.AuthMiddleware(cfg.JWTSecret, db)).Post("/set-username", authHandler.SetUsername)
-		r.Get("/oauth/github", func(w http.ResponseWriter, r *http.Request) {
-			authHandler.OAuthLogin(w, r, "github")
-		})
-		r.Get("/oauth/github/callback", func(w http.ResponseWriter, r *http.Request) {
-			authHandler.OAuthCallback(w, r, "github")
-		})
-		r.Get("/oauth/google", func(w http.ResponseWriter, r *http.Request) {
-			authHandler.OAuthLogin(w, r, "google")
-		})
-		r.Get("/oauth/google/callback", func(w http.ResponseWriter, r *http.Request) {
-			authHandler.OAuthCallback(w, r, "google")
-		})
+		r.With(middleware.AuthMiddleware(jwtKeys, db)).Post("/set-username", authHandler.SetUsername)
+		r.Post("/refresh", authHandler.Refresh)
+		r.Post("/password/forgot", authHandler.ForgotPassword)
+		r.Post("/password/reset", authHandler.ResetPassword)
+		r.Post("/verify-email", authHandler.VerifyEmail)
+		r.With(middleware.AuthMiddleware(jwtKeys, db)).Post("/logout", authHandler.Logout)
+		r.Get("/providers", authHandler.ListOAuthProviders)
+		r.Get("/oauth/{provider}", authHandler.OAuthLogin)
+		r.Get("/oauth/{provider}/callback", authHandler.OAuthCallback)
+		r.Post("/device/code", authHandler.DeviceCode)
+		r.Post("/device/token", authHandler.DeviceToken)
+		r.With(middleware.AuthMiddleware(jwtKeys, db)).Get("/device", authHandler.GetDeviceAuthorization)
+		r.With(middleware.AuthMiddleware(jwtKeys, db)).Post("/device/approve", authHandler.ApproveDevice)
+		r.With(middleware.AuthMiddleware(jwtKeys, db)).Post("/device/deny", authHandler.DenyDevice)
 	})
 
 	r.Route("/api/keys", func(r chi.Router) {
-		r.Use(middleware.RateLimitMiddleware(cfg.DefaultRateLimit, db))
-		r.Use(middleware.AuthMiddleware(cfg.JWTSecret, db))
+		r.Use(middleware.AuthMiddleware(jwtKeys, db))
+		r.Use(middleware.RateLimitMiddleware(cfg.DefaultRateLimit, cfg.RateLimitBurst, db))
+		r.Use(middleware.RequireScope("keys:read", "keys:write"))
 		r.Get("/", keyHandler.List)
-		r.Post("/generate", keyHandler.Generate)
+		r.With(middleware.RateLimitCost(10)).Post("/generate", keyHandler.Generate)
 		r.Post("/import", keyHandler.Import)
 		r.Delete("/{id}", keyHandler.Delete)
 	})
 
 	r.Route("/api/scripts", func(r chi.Router) {
-		r.Use(middleware.RateLimitMiddleware(cfg.DefaultRateLimit, db))
-		r.Use(middleware.AuthMiddleware(cfg.JWTSecret, db))
+		r.Use(middleware.AuthMiddleware(jwtKeys, db))
+		r.Use(middleware.RateLimitMiddleware(cfg.DefaultRateLimit, cfg.RateLimitBurst, db))
+		r.Use(middleware.RequireScope("scripts:read", "scripts:write"))
 		r.Use(middleware.TierMiddleware(db))
 		r.Get("/", scriptHandler.List)
-		r.Post("/", scriptHandler.Create)
+		r.With(middleware.RateLimitCost(5)).Post("/", scriptHandler.Create)
 		r.Get("/{id}", scriptHandler.Get)
 		r.Get("/{id}/encrypted", scriptHandler.GetEncryptedContent)
-		r.Put("/{id}", scriptHandler.Update)
+		r.With(middleware.RateLimitCost(5)).Put("/{id}", scriptHandler.Update)
 		r.Delete("/{id}", scriptHandler.Delete)
+		r.Get("/{id}/share", scriptHandler.ListShareTokens)
 		r.Post("/{id}/share", scriptHandler.GenerateShareToken)
+		r.Get("/{id}/share/{token}/log", scriptHandler.GetShareTokenLog)
 		r.Delete("/{id}/share/{token}", scriptHandler.RevokeShareToken)
+		r.Get("/{id}/versions", scriptHandler.ListVersions)
+		r.Get("/{id}/tags", scriptHandler.ListTags)
+		r.Put("/{id}/tags/{tag}", scriptHandler.SetTag)
+		r.Delete("/{id}/tags/{tag}", scriptHandler.DeleteTag)
+		r.Get("/{id}/rate-limit", scriptHandler.GetFetchRateLimit)
+		r.Put("/{id}/rate-limit", scriptHandler.SetFetchRateLimit)
 		
 		// New ACL-based sharing
 		r.Get("/{id}/access", shareHandler.GetAccess)
@@ -221,28 +312,114 @@ func main() {
 	
 	// User search for sharing
 	r.Route("/api/users", func(r chi.Router) {
-		r.Use(middleware.AuthMiddleware(cfg.JWTSecret, db))
+		r.Use(middleware.AuthMiddleware(jwtKeys, db))
+		r.Use(middleware.RequireScope("scripts:read", "scripts:write"))
 		r.Get("/search", shareHandler.SearchUsers)
 	})
 	
+	// User groups
+	r.Route("/api/groups", func(r chi.Router) {
+		r.Use(middleware.AuthMiddleware(jwtKeys, db))
+		r.Use(middleware.RateLimitMiddleware(cfg.DefaultRateLimit, cfg.RateLimitBurst, db))
+		r.Use(middleware.RequireScope("groups:read", "groups:write"))
+		r.Get("/", groupHandler.List)
+		r.Post("/", groupHandler.Create)
+		r.Get("/{id}", groupHandler.Get)
+		r.Put("/{id}", groupHandler.Update)
+		r.Delete("/{id}", groupHandler.Delete)
+		r.Post("/{id}/members", groupHandler.AddMembers)
+		r.Delete("/{id}/members/{username}", groupHandler.RemoveMember)
+	})
+	
+	// Organizations
+	r.Route("/api/orgs", func(r chi.Router) {
+		r.Use(middleware.AuthMiddleware(jwtKeys, db))
+		r.Use(middleware.RateLimitMiddleware(cfg.DefaultRateLimit, cfg.RateLimitBurst, db))
+		r.With(middleware.RequireScope("orgs:read", "orgs:write")).Get("/", orgHandler.List)
+		r.With(middleware.RequireScope("orgs:read", "orgs:write")).Post("/", orgHandler.Create)
+		r.Route("/{org}", func(r chi.Router) {
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.RequireScope("orgs:read", "orgs:write"))
+				r.Get("/", orgHandler.Get)
+				r.Put("/", orgHandler.Update)
+				r.Delete("/", orgHandler.Delete)
+				r.Get("/members", orgHandler.ListMembers)
+				r.Post("/members", orgHandler.SetMember)
+				r.Put("/members/{username}", orgHandler.SetMember)
+				r.Delete("/members/{username}", orgHandler.RemoveMember)
+			})
+			
+			// Organization-owned resources reuse the personal handlers, scoped by {org}
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.RequireScope("scripts:read", "scripts:write"))
+				r.Use(middleware.TierMiddleware(db))
+				r.Get("/scripts", scriptHandler.List)
+				r.Post("/scripts", scriptHandler.Create)
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(middleware.RequireScope("keys:read", "keys:write"))
+				r.Get("/keys", keyHandler.List)
+				r.Post("/keys/generate", keyHandler.Generate)
+				r.Post("/keys/import", keyHandler.Import)
+				r.Delete("/keys/{id}", keyHandler.Delete)
+			})
+			if secretsHandler != nil {
+				r.Group(func(r chi.Router) {
+					r.Use(middleware.RequireScope("secrets:read", "secrets:write"))
+					r.Get("/secrets", secretsHandler.List)
+					r.Post("/secrets", secretsHandler.Create)
+					r.Get("/secrets/{name}/value", secretsHandler.GetValue)
+					r.Delete("/secrets/{name}", secretsHandler.Delete)
+					r.Get("/secrets/{name}/audit", secretsHandler.GetAuditLog)
+				})
+			}
+		})
+	})
+	
+	// Access requests and notifications
+	r.Route("/api/access-requests", func(r chi.Router) {
+		r.Use(middleware.AuthMiddleware(jwtKeys, db))
+		r.Use(middleware.RateLimitMiddleware(cfg.DefaultRateLimit, cfg.RateLimitBurst, db))
+		r.Use(middleware.RequireScope("scripts:read", "scripts:write"))
+		r.Get("/", accessRequestHandler.List)
+		r.Post("/", accessRequestHandler.Create)
+		r.Get("/{id}", accessRequestHandler.Get)
+		r.Post("/{id}/approve", accessRequestHandler.Approve)
+		r.Post("/{id}/deny", accessRequestHandler.Deny)
+		r.Delete("/{id}", accessRequestHandler.Cancel)
+	})
+	
+	r.Route("/api/notifications", func(r chi.Router) {
+		r.Use(middleware.AuthMiddleware(jwtKeys, db))
+		r.Use(middleware.RateLimitMiddleware(cfg.DefaultRateLimit, cfg.RateLimitBurst, db))
+		r.Use(middleware.RequireScope("account", "account"))
+		r.Get("/", notificationHandler.List)
+		r.Post("/read", notificationHandler.MarkAllRead)
+		r.Post("/{id}/read", notificationHandler.MarkRead)
+	})
+	
 	// Shared scripts
 	r.Route("/api/shared", func(r chi.Router) {
-		r.Use(middleware.AuthMiddleware(cfg.JWTSecret, db))
+		r.Use(middleware.AuthMiddleware(jwtKeys, db))
+		r.Use(middleware.RequireScope("scripts:read", "scripts:write"))
 		r.Get("/scripts", shareHandler.ListSharedScripts)
 	})
 
 	// AI generation
 	if aiHandler != nil {
 		r.Route("/api/ai", func(r chi.Router) {
-			r.Use(middleware.AuthMiddleware(cfg.JWTSecret, db))
+			r.Use(middleware.AuthMiddleware(jwtKeys, db))
+			r.Use(middleware.RateLimitMiddleware(cfg.DefaultRateLimit, cfg.RateLimitBurst, db))
+			r.Use(middleware.RequireScope("ai", "ai"))
 			r.Use(middleware.TierMiddleware(db))
-			r.Post("/generate", aiHandler.Generate)
+			r.With(middleware.RateLimitCost(10)).Post("/generate", aiHandler.Generate)
 			r.Get("/usage", aiHandler.GetUsage)
 		})
 	}
 
 	r.Route("/api/admin", func(r chi.Router) {
-		r.Use(middleware.AuthMiddleware(cfg.JWTSecret, db))
+		r.Use(middleware.AuthMiddleware(jwtKeys, db))
+		r.Use(middleware.RequireScope("admin", "admin"))
 		r.Use(middleware.AdminMiddleware)
 		r.Get("/users", adminHandler.ListUsers)
 		r.Get("/tiers", adminHandler.ListTiers)
@@ -250,28 +427,59 @@ func main() {
 		r.Put("/users/{id}/password", adminHandler.ResetUserPassword)
 		r.Delete("/users/{id}", adminHandler.DeleteUser)
 		r.Get("/config", adminHandler.GetConfig)
+		r.Get("/settings/mfa", adminHandler.GetMFAPolicy)
+		r.Put("/settings/mfa", adminHandler.SetMFAPolicy)
+		r.Delete("/users/{id}/mfa", adminHandler.ResetUserMFA)
+		r.Get("/settings/admin-auth", adminHandler.GetAdminAuthPolicy)
+		r.Put("/settings/admin-auth", adminHandler.SetAdminAuthPolicy)
+		r.Get("/lockouts", adminHandler.ListLockouts)
+		r.Delete("/lockouts/{kind}/{key}", adminHandler.Unlock)
+		r.Get("/audit/auth", adminHandler.GetAuthAuditLog)
+		r.Get("/settings/email-verification", adminHandler.GetEmailVerificationPolicy)
+		r.Put("/settings/email-verification", adminHandler.SetEmailVerificationPolicy)
+		r.Get("/orgs", orgHandler.AdminListOrgs)
+		r.Put("/orgs/{id}/tier", orgHandler.AdminSetTier)
+		r.Post("/storage/gc", adminHandler.CollectBlobGarbage)
+		r.Get("/storage/scrub-failures", adminHandler.ListScrubFailures)
 	})
 
 	r.Route("/api/account", func(r chi.Router) {
-		r.Use(middleware.AuthMiddleware(cfg.JWTSecret, db))
+		r.Use(middleware.AuthMiddleware(jwtKeys, db))
+		r.Use(middleware.RequireScope("account", "account"))
 		r.Get("/tier", accountHandler.GetTier)
 		r.Put("/password", accountHandler.ChangePassword)
+		r.Get("/email", authHandler.GetEmailStatus)
+		r.Post("/email/verification", authHandler.ResendEmailVerification)
 		r.Get("/export", accountHandler.ExportData)
 		r.Delete("/", accountHandler.DeleteAccount)
 		r.Get("/tokens", accountHandler.ListAPITokens)
 		r.Post("/tokens", accountHandler.CreateAPIToken)
 		r.Delete("/tokens/{id}", accountHandler.DeleteAPIToken)
+		r.Get("/sessions", accountHandler.ListSessions)
+		r.Delete("/sessions", accountHandler.RevokeAllSessions)
+		r.Delete("/sessions/{id}", accountHandler.RevokeSession)
+		r.Get("/mfa", accountHandler.GetMFAStatus)
+		r.Delete("/mfa", accountHandler.DisableMFA)
+		r.Post("/mfa/totp", accountHandler.StartMFAEnrollment)
+		r.Post("/mfa/totp/verify", accountHandler.VerifyMFAEnrollment)
+		r.Post("/mfa/recovery-codes", accountHandler.RegenerateRecoveryCodes)
+		r.Get("/mfa/passkeys", accountHandler.ListPasskeys)
+		r.Post("/mfa/passkeys/register/begin", authHandler.BeginPasskeyRegistration)
+		r.Post("/mfa/passkeys/register/finish", authHandler.FinishPasskeyRegistration)
+		r.Delete("/mfa/passkeys/{id}", accountHandler.DeletePasskey)
 	})
 
 	r.Route("/api/community", func(r chi.Router) {
-		r.Use(middleware.AuthMiddleware(cfg.JWTSecret, db))
+		r.Use(middleware.AuthMiddleware(jwtKeys, db))
+		r.Use(middleware.RequireScope("scripts:read", "scripts:write"))
 		r.Get("/scripts", communityHandler.ListPublicScripts)
 	})
 
 	// Secrets management
 	if secretsHandler != nil {
 		r.Route("/api/secrets", func(r chi.Router) {
-			r.Use(middleware.AuthMiddleware(cfg.JWTSecret, db))
+			r.Use(middleware.AuthMiddleware(jwtKeys, db))
+			r.Use(middleware.RequireScope("secrets:read", "secrets:write"))
 			r.Use(middleware.TierMiddleware(db))
 			r.Get("/", secretsHandler.List)
 			r.Post("/", secretsHandler.Create)
@@ -281,9 +489,12 @@ func main() {
 		})
 	}
 
-	r.Get("/{username}/{script}", publicHandler.GetScript)
-	r.Get("/{username}/{script}/meta", publicHandler.GetMetadata)
-	r.Get("/{username}/{script}/verify", publicHandler.VerifySignature)
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.PublicFetchRateLimitMiddleware(cfg.PublicFetchRateLimit))
+		r.Get("/{username}/{script}", publicHandler.GetScript)
+		r.Get("/{username}/{script}/meta", publicHandler.GetMetadata)
+		r.Get("/{username}/{script}/verify", publicHandler.VerifySignature)
+	})
 
 	log.Printf("Server starting on port %s", cfg.ServerPort)
 	if err := http.ListenAndServe(":"+cfg.ServerPort, r); err != nil {
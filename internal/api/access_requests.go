@@ -0,0 +1,392 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"shebang.run/internal/auth"
+	"shebang.run/internal/database"
+	"shebang.run/internal/middleware"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type AccessRequestHandler struct {
+	db *database.DB
+}
+
+func NewAccessRequestHandler(db *database.DB) *AccessRequestHandler {
+	return &AccessRequestHandler{db: db}
+}
+
+type CreateAccessRequestRequest struct {
+	Script string `json:"script"` // "namespace/name", as in the fetch URL
+	Role   string `json:"role"`
+	Reason string `json:"reason"`
+}
+
+type DecideAccessRequestRequest struct {
+	Role      string     `json:"role"` // defaults to the requested role
+	ExpiresAt *time.Time `json:"expires_at"`
+	Note      string     `json:"note"`
+}
+
+type AccessRequestResponse struct {
+	ID           int64   `json:"id"`
+	Script       string  `json:"script"`
+	ScriptID     int64   `json:"script_id"`
+	Requester    string  `json:"requester"`
+	Role         string  `json:"role"`
+	Reason       string  `json:"reason"`
+	Status       string  `json:"status"`
+	DecisionNote string  `json:"decision_note,omitempty"`
+	ExpiresAt    *string `json:"expires_at"`
+	CreatedAt    string  `json:"created_at"`
+	DecidedAt    *string `json:"decided_at"`
+}
+
+func newAccessRequestResponse(ar *database.AccessRequest) AccessRequestResponse {
+	resp := AccessRequestResponse{
+		ID:           ar.ID,
+		Script:       ar.Namespace + "/" + ar.ScriptName,
+		ScriptID:     ar.ScriptID,
+		Requester:    ar.Requester,
+		Role:         ar.Role,
+		Reason:       ar.Reason,
+		Status:       ar.Status,
+		DecisionNote: ar.DecisionNote,
+		CreatedAt:    ar.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+	if ar.ExpiresAt != nil {
+		t := ar.ExpiresAt.Format("2006-01-02T15:04:05Z")
+		resp.ExpiresAt = &t
+	}
+	if ar.DecidedAt != nil {
+		t := ar.DecidedAt.Format("2006-01-02T15:04:05Z")
+		resp.DecidedAt = &t
+	}
+	return resp
+}
+
+// notify records a notification for each user; failures are not fatal to
+// the request that triggered them
+func (h *AccessRequestHandler) notify(userIDs []int64, kind, message, link string) {
+	for _, id := range userIDs {
+		h.db.CreateNotification(id, kind, message, link)
+	}
+}
+
+// Create files a request for access to a script the caller cannot read
+func (h *AccessRequestHandler) Create(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateAccessRequestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	parts := strings.SplitN(strings.Trim(req.Script, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.Error(w, "script must be namespace/name", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = "viewer"
+	}
+	if !database.ValidCollaboratorRole(req.Role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	script, err := findScript(h.db, parts[0], parts[1])
+	if err != nil {
+		http.Error(w, "Script not found", http.StatusNotFound)
+		return
+	}
+	if script.Visibility == "public" && req.Role == "viewer" {
+		http.Error(w, "Script is public", http.StatusBadRequest)
+		return
+	}
+
+	perm, err := h.db.GetScriptPermission(script, claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to check access", http.StatusInternalServerError)
+		return
+	}
+	if perm >= database.CollaboratorPermission(req.Role) {
+		http.Error(w, "You already have access to this script", http.StatusConflict)
+		return
+	}
+
+	pending, err := h.db.HasPendingAccessRequest(script.ID, claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to check existing requests", http.StatusInternalServerError)
+		return
+	}
+	if pending {
+		http.Error(w, "You already have a pending request for this script", http.StatusConflict)
+		return
+	}
+
+	ar, err := h.db.CreateAccessRequest(script.ID, claims.UserID, req.Role, req.Reason)
+	if err != nil {
+		http.Error(w, "Failed to create access request", http.StatusInternalServerError)
+		return
+	}
+
+	if managers, err := h.db.GetScriptManagerIDs(script.ID); err == nil {
+		h.notify(managers, "access_request",
+			fmt.Sprintf("%s requested %s access to %s/%s", claims.Username, ar.Role, ar.Namespace, ar.ScriptName),
+			fmt.Sprintf("/api/access-requests/%d", ar.ID))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newAccessRequestResponse(ar))
+}
+
+// List returns the caller's queue (box=incoming, the default) or their own
+// requests (box=outgoing); status defaults to pending, "all" lists everything
+func (h *AccessRequestHandler) List(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "":
+		status = "pending"
+	case "all":
+		status = ""
+	case "pending", "approved", "denied", "cancelled":
+	default:
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+
+	var requests []*database.AccessRequest
+	var err error
+	switch r.URL.Query().Get("box") {
+	case "", "incoming":
+		requests, err = h.db.GetIncomingAccessRequests(claims.UserID, status)
+	case "outgoing":
+		requests, err = h.db.GetOutgoingAccessRequests(claims.UserID, status)
+	default:
+		http.Error(w, "Invalid box", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch access requests", http.StatusInternalServerError)
+		return
+	}
+
+	response := []AccessRequestResponse{}
+	for _, ar := range requests {
+		response = append(response, newAccessRequestResponse(ar))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// loadRequest resolves the {id} URL parameter to a request visible to the
+// caller, either as its requester or as a manager of the script
+func (h *AccessRequestHandler) loadRequest(w http.ResponseWriter, r *http.Request, claims *auth.Claims) (*database.AccessRequest, bool, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid request ID", http.StatusBadRequest)
+		return nil, false, false
+	}
+
+	ar, err := h.db.GetAccessRequestByID(id)
+	if err != nil {
+		http.Error(w, "Access request not found", http.StatusNotFound)
+		return nil, false, false
+	}
+
+	isManager := false
+	if script, err := h.db.GetScriptByID(ar.ScriptID); err == nil && claims.CanUseScript(script.ID) {
+		perm, err := h.db.GetScriptPermission(script, claims.UserID)
+		isManager = err == nil && perm >= database.ScriptPermManage
+	}
+
+	if !isManager && ar.RequesterID != claims.UserID {
+		http.Error(w, "Access request not found", http.StatusNotFound)
+		return nil, false, false
+	}
+	return ar, isManager, true
+}
+
+func (h *AccessRequestHandler) Get(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ar, _, ok := h.loadRequest(w, r, claims)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newAccessRequestResponse(ar))
+}
+
+// Approve grants the requester access, optionally with an expiry and a
+// different role than requested
+func (h *AccessRequestHandler) Approve(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ar, isManager, ok := h.loadRequest(w, r, claims)
+	if !ok {
+		return
+	}
+	if !isManager {
+		http.Error(w, "Only script maintainers can decide access requests", http.StatusForbidden)
+		return
+	}
+
+	var req DecideAccessRequestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.Role == "" {
+		req.Role = ar.Role
+	}
+	if !database.ValidCollaboratorRole(req.Role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.ApproveAccessRequest(ar.ID, claims.UserID, req.Role, req.Note, req.ExpiresAt); err != nil {
+		if err.Error() == "access request already decided" {
+			http.Error(w, "Access request already decided", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to approve access request", http.StatusInternalServerError)
+		return
+	}
+
+	message := fmt.Sprintf("Your request for %s access to %s/%s was approved", req.Role, ar.Namespace, ar.ScriptName)
+	if req.ExpiresAt != nil {
+		message += " until " + req.ExpiresAt.UTC().Format("2006-01-02T15:04:05Z")
+	}
+	h.notify([]int64{ar.RequesterID}, "access_approved", message, fmt.Sprintf("/%s/%s", ar.Namespace, ar.ScriptName))
+	h.notifyOtherManagers(ar, claims.UserID, "approved")
+
+	h.respondWithRequest(w, ar.ID)
+}
+
+func (h *AccessRequestHandler) Deny(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ar, isManager, ok := h.loadRequest(w, r, claims)
+	if !ok {
+		return
+	}
+	if !isManager {
+		http.Error(w, "Only script maintainers can decide access requests", http.StatusForbidden)
+		return
+	}
+
+	var req DecideAccessRequestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.CloseAccessRequest(ar.ID, "denied", claims.UserID, req.Note); err != nil {
+		http.Error(w, "Access request already decided", http.StatusConflict)
+		return
+	}
+
+	message := fmt.Sprintf("Your request for access to %s/%s was denied", ar.Namespace, ar.ScriptName)
+	if req.Note != "" {
+		message += ": " + req.Note
+	}
+	h.notify([]int64{ar.RequesterID}, "access_denied", message, fmt.Sprintf("/api/access-requests/%d", ar.ID))
+	h.notifyOtherManagers(ar, claims.UserID, "denied")
+
+	h.respondWithRequest(w, ar.ID)
+}
+
+// Cancel withdraws the caller's own pending request
+func (h *AccessRequestHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ar, _, ok := h.loadRequest(w, r, claims)
+	if !ok {
+		return
+	}
+	if ar.RequesterID != claims.UserID {
+		http.Error(w, "Only the requester can cancel a request", http.StatusForbidden)
+		return
+	}
+
+	if err := h.db.CloseAccessRequest(ar.ID, "cancelled", claims.UserID, ""); err != nil {
+		http.Error(w, "Access request already decided", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// notifyOtherManagers tells the remaining managers a request was handled so
+// it does not linger in their queue
+func (h *AccessRequestHandler) notifyOtherManagers(ar *database.AccessRequest, decidedBy int64, outcome string) {
+	managers, err := h.db.GetScriptManagerIDs(ar.ScriptID)
+	if err != nil {
+		return
+	}
+
+	var others []int64
+	for _, id := range managers {
+		if id != decidedBy {
+			others = append(others, id)
+		}
+	}
+	h.notify(others, "access_request_"+outcome,
+		fmt.Sprintf("%s's request for access to %s/%s was %s", ar.Requester, ar.Namespace, ar.ScriptName, outcome),
+		fmt.Sprintf("/api/access-requests/%d", ar.ID))
+}
+
+func (h *AccessRequestHandler) respondWithRequest(w http.ResponseWriter, id int64) {
+	ar, err := h.db.GetAccessRequestByID(id)
+	if err != nil {
+		http.Error(w, "Failed to fetch access request", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newAccessRequestResponse(ar))
+}
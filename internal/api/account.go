@@ -2,9 +2,11 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"shebang.run/internal/auth"
@@ -48,6 +50,11 @@ func (h *AccountHandler) ChangePassword(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	if user.OAuthProvider == auth.LDAPProviderName {
+		http.Error(w, "Your password is managed by your organization's directory", http.StatusBadRequest)
+		return
+	}
+
 	if !auth.CheckPassword(req.CurrentPassword, user.PasswordHash) {
 		http.Error(w, "Current password is incorrect", http.StatusUnauthorized)
 		return
@@ -65,10 +72,23 @@ func (h *AccountHandler) ChangePassword(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Sign out everywhere else; the session that changed the password stays
+	if _, err := h.db.RevokeUserSessions(claims.UserID, claims.SessionID); err != nil {
+		log.Printf("Failed to revoke sessions for user %d: %v", claims.UserID, err)
+	}
+	h.db.DeleteEmailTokens(claims.UserID, auth.EmailTokenPasswordReset)
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status":"ok"}`))
 }
 
+// TierResponse is the caller's tier with the bytes their personal scripts
+// use of its max_storage_bytes
+type TierResponse struct {
+	*database.Tier
+	StorageUsed int64 `json:"storage_used"`
+}
+
 func (h *AccountHandler) GetTier(w http.ResponseWriter, r *http.Request) {
 	claims, ok := middleware.GetUserFromContext(r.Context())
 	if !ok {
@@ -81,9 +101,14 @@ func (h *AccountHandler) GetTier(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to get tier", http.StatusInternalServerError)
 		return
 	}
+	storageUsed, _, err := h.db.GetStorageUsage(claims.UserID, nil)
+	if err != nil {
+		http.Error(w, "Failed to get storage usage", http.StatusInternalServerError)
+		return
+	}
 	
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(tier)
+	json.NewEncoder(w).Encode(TierResponse{Tier: tier, StorageUsed: storageUsed})
 }
 
 func (h *AccountHandler) ExportData(w http.ResponseWriter, r *http.Request) {
@@ -116,7 +141,18 @@ func (h *AccountHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err := h.db.Exec("DELETE FROM users WHERE id = ?", claims.UserID)
+	// Organization resources survive their members, but not an orphaned organization
+	orgs, err := h.db.GetSolelyOwnedOrgs(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
+		return
+	}
+	if len(orgs) > 0 {
+		http.Error(w, fmt.Sprintf("You are the only owner of: %s. Transfer ownership or delete these organizations first.", strings.Join(orgs, ", ")), http.StatusConflict)
+		return
+	}
+
+	_, err = h.db.Exec("DELETE FROM users WHERE id = ?", claims.UserID)
 	if err != nil {
 		http.Error(w, "Failed to delete account", http.StatusInternalServerError)
 		return
@@ -131,10 +167,34 @@ type APITokenResponse struct {
 	Name        string `json:"name"`
 	ClientID    string `json:"client_id"`
 	ClientSecret string `json:"client_secret,omitempty"` // Only shown on creation
+	Scopes      []string `json:"scopes"`
+	ScriptIDs   []int64  `json:"script_ids,omitempty"`
+	ExpiresAt   *string  `json:"expires_at"`
+	Expired     bool     `json:"expired"`
 	CreatedAt   string `json:"created_at"`
 	LastUsed    string `json:"last_used,omitempty"`
 }
 
+func newAPITokenResponse(t *database.APIToken) APITokenResponse {
+	resp := APITokenResponse{
+		ID:        t.ID,
+		Name:      t.Name,
+		ClientID:  t.ClientID,
+		Scopes:    t.Scopes,
+		ScriptIDs: t.ScriptIDs,
+		Expired:   t.Expired(),
+		CreatedAt: t.CreatedAt,
+	}
+	if t.ExpiresAt != nil {
+		expiresAt := t.ExpiresAt.Format("2006-01-02T15:04:05Z")
+		resp.ExpiresAt = &expiresAt
+	}
+	if t.LastUsed.Valid {
+		resp.LastUsed = t.LastUsed.String
+	}
+	return resp
+}
+
 func (h *AccountHandler) ListAPITokens(w http.ResponseWriter, r *http.Request) {
 	claims, ok := middleware.GetUserFromContext(r.Context())
 	if !ok {
@@ -152,23 +212,31 @@ func (h *AccountHandler) ListAPITokens(w http.ResponseWriter, r *http.Request) {
 
 	var response []APITokenResponse
 	for _, t := range tokens {
-		lastUsed := ""
-		if t.LastUsed.Valid {
-			lastUsed = t.LastUsed.String
-		}
-		response = append(response, APITokenResponse{
-			ID:        t.ID,
-			Name:      t.Name,
-			ClientID:  t.ClientID,
-			CreatedAt: t.CreatedAt,
-			LastUsed:  lastUsed,
-		})
+		response = append(response, newAPITokenResponse(t))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// checkGrantableScopes checks that the caller may grant each scope to a new
+// API token, returning an error message and status if not
+func checkGrantableScopes(claims *auth.Claims, scopes []string) (string, int) {
+	for _, scope := range scopes {
+		if !auth.ValidScope(scope) {
+			return fmt.Sprintf("Unknown scope: %s", scope), http.StatusBadRequest
+		}
+		// A token can never be used to mint a more powerful one
+		if !claims.HasScope(scope) {
+			return fmt.Sprintf("Cannot grant scope you do not hold: %s", scope), http.StatusForbidden
+		}
+		if scope == "admin" && !claims.IsAdmin {
+			return "Only admins can grant the admin scope", http.StatusForbidden
+		}
+	}
+	return "", 0
+}
+
 func (h *AccountHandler) CreateAPIToken(w http.ResponseWriter, r *http.Request) {
 	claims, ok := middleware.GetUserFromContext(r.Context())
 	if !ok {
@@ -178,7 +246,10 @@ func (h *AccountHandler) CreateAPIToken(w http.ResponseWriter, r *http.Request)
 	}
 
 	var req struct {
-		Name string `json:"name"`
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ScriptIDs []int64    `json:"script_ids"`
+		ExpiresAt *time.Time `json:"expires_at"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		log.Printf("CreateAPIToken decode error: %v", err)
@@ -190,26 +261,49 @@ func (h *AccountHandler) CreateAPIToken(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Name is required", http.StatusBadRequest)
 		return
 	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	if msg, status := checkGrantableScopes(claims, req.Scopes); msg != "" {
+		http.Error(w, msg, status)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+	if len(req.ScriptIDs) == 0 && len(claims.ScriptIDs) > 0 {
+		req.ScriptIDs = claims.ScriptIDs
+	}
+	for _, id := range req.ScriptIDs {
+		script, err := h.db.GetScriptByID(id)
+		if err != nil || !claims.CanUseScript(id) {
+			http.Error(w, fmt.Sprintf("Script %d not found", id), http.StatusBadRequest)
+			return
+		}
+		if perm, err := h.db.GetScriptPermission(script, claims.UserID); err != nil || perm < database.ScriptPermRead {
+			http.Error(w, fmt.Sprintf("Script %d not found", id), http.StatusBadRequest)
+			return
+		}
+	}
 
-	// Generate client ID and secret
+	// Generate client ID and secret; only a hash of the secret is stored
 	clientID, _ := auth.GenerateRandomToken(32)
 	clientSecret, _ := auth.GenerateRandomToken(48)
 
-	token, err := h.db.CreateAPIToken(claims.UserID, req.Name, clientID, clientSecret)
+	token, err := h.db.CreateAPIToken(claims.UserID, req.Name, clientID, auth.HashToken(clientSecret), req.Scopes, req.ScriptIDs, req.ExpiresAt)
 	if err != nil {
 		log.Printf("CreateAPIToken error for user %d: %v", claims.UserID, err)
 		http.Error(w, "Failed to create token", http.StatusInternalServerError)
 		return
 	}
 
+	response := newAPITokenResponse(token)
+	response.ClientSecret = clientSecret // Only shown once
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(APITokenResponse{
-		ID:           token.ID,
-		Name:         token.Name,
-		ClientID:     token.ClientID,
-		ClientSecret: token.ClientSecret, // Only shown once
-		CreatedAt:    token.CreatedAt,
-	})
+	json.NewEncoder(w).Encode(response)
 }
 
 func (h *AccountHandler) DeleteAPIToken(w http.ResponseWriter, r *http.Request) {
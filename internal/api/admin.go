@@ -2,25 +2,31 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"shebang.run/internal/auth"
 	"shebang.run/internal/config"
 	"shebang.run/internal/database"
+	"shebang.run/internal/jobs"
 	"shebang.run/internal/middleware"
+	"shebang.run/internal/storage"
 
 	"github.com/go-chi/chi/v5"
 )
 
 type AdminHandler struct {
-	db  *database.DB
-	cfg *config.Config
+	db      *database.DB
+	cfg     *config.Config
+	storage storage.Storage
 }
 
-func NewAdminHandler(db *database.DB, cfg *config.Config) *AdminHandler {
-	return &AdminHandler{db: db, cfg: cfg}
+func NewAdminHandler(db *database.DB, cfg *config.Config, storage storage.Storage) *AdminHandler {
+	return &AdminHandler{db: db, cfg: cfg, storage: storage}
 }
 
 type UserListResponse struct {
@@ -31,6 +37,7 @@ type UserListResponse struct {
 	TierID    int64  `json:"tier_id"`
 	TierName  string `json:"tier_name"`
 	RateLimit *int   `json:"rate_limit"`
+	MFAEnabled bool  `json:"mfa_enabled"`
 	CreatedAt string `json:"created_at"`
 }
 
@@ -84,6 +91,8 @@ func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
 			tierName = "Unknown"
 		}
 		
+		mfaEnabled, _ := h.db.IsMFAEnabled(u.ID)
+		
 		response = append(response, UserListResponse{
 			ID:        u.ID,
 			Username:  u.Username,
@@ -92,6 +101,7 @@ func (h *AdminHandler) ListUsers(w http.ResponseWriter, r *http.Request) {
 			TierID:    u.TierID,
 			TierName:  tierName,
 			RateLimit: u.RateLimit,
+			MFAEnabled: mfaEnabled,
 			CreatedAt: u.CreatedAt.Format("2006-01-02T15:04:05Z"),
 		})
 	}
@@ -155,6 +165,10 @@ func (h *AdminHandler) SetUserLimits(w http.ResponseWriter, r *http.Request) {
 		`, expiresAt, userID)
 	}
 
+	if req.RateLimit != nil || req.TierID != nil {
+		middleware.InvalidateRateLimit(userID)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status":"ok"}`))
 }
@@ -228,6 +242,16 @@ func (h *AdminHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	orgs, err := h.db.GetSolelyOwnedOrgs(userID)
+	if err != nil {
+		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
+		return
+	}
+	if len(orgs) > 0 {
+		http.Error(w, fmt.Sprintf("User is the only owner of: %s. Assign another owner first.", strings.Join(orgs, ", ")), http.StatusConflict)
+		return
+	}
+
 	_, err = h.db.Exec("DELETE FROM users WHERE id = ?", userID)
 	if err != nil {
 		http.Error(w, "Failed to delete user", http.StatusInternalServerError)
@@ -237,3 +261,331 @@ func (h *AdminHandler) DeleteUser(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{"status":"ok"}`))
 }
+
+type MFAPolicyRequest struct {
+	Policy string `json:"policy"`
+}
+
+// GetMFAPolicy returns who must use two-factor authentication: off, admins or all
+func (h *AdminHandler) GetMFAPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := h.db.GetSetting(database.SettingMFAPolicy, database.MFAPolicyOff)
+	if err != nil {
+		http.Error(w, "Failed to get MFA policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFAPolicyRequest{Policy: policy})
+}
+
+// SetMFAPolicy changes the MFA policy. Users it newly applies to are limited
+// to enrolling from their next token refresh on.
+func (h *AdminHandler) SetMFAPolicy(w http.ResponseWriter, r *http.Request) {
+	var req MFAPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Policy {
+	case database.MFAPolicyOff, database.MFAPolicyAdmins, database.MFAPolicyAll:
+	default:
+		http.Error(w, "Policy must be off, admins or all", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.SetSetting(database.SettingMFAPolicy, req.Policy); err != nil {
+		http.Error(w, "Failed to set MFA policy", http.StatusInternalServerError)
+		return
+	}
+
+	claims, _ := middleware.GetUserFromContext(r.Context())
+	log.Printf("Admin %s set MFA policy to %s", claims.Username, req.Policy)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
+
+type AdminAuthPolicyRequest struct {
+	Policy string `json:"policy"`
+}
+
+// GetAdminAuthPolicy returns how admins must sign in to use admin rights:
+// any or passkey
+func (h *AdminHandler) GetAdminAuthPolicy(w http.ResponseWriter, r *http.Request) {
+	policy, err := h.db.GetSetting(database.SettingAdminAuthPolicy, database.AdminAuthPolicyAny)
+	if err != nil {
+		http.Error(w, "Failed to get admin sign-in policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AdminAuthPolicyRequest{Policy: policy})
+}
+
+// SetAdminAuthPolicy changes the admin sign-in policy. Requiring passkeys is
+// only accepted from a passkey session, so the admin making the change is
+// known to be able to meet it. Other sessions lose admin rights from their
+// next token refresh on.
+func (h *AdminHandler) SetAdminAuthPolicy(w http.ResponseWriter, r *http.Request) {
+	claims, _ := middleware.GetUserFromContext(r.Context())
+
+	var req AdminAuthPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	switch req.Policy {
+	case database.AdminAuthPolicyAny:
+	case database.AdminAuthPolicyPasskey:
+		if claims.AuthMethod != database.AuthMethodPasskey {
+			http.Error(w, "Sign in with a passkey before requiring one for the admin console", http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "Policy must be any or passkey", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.SetSetting(database.SettingAdminAuthPolicy, req.Policy); err != nil {
+		http.Error(w, "Failed to set admin sign-in policy", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Admin %s set admin sign-in policy to %s", claims.Username, req.Policy)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
+
+type EmailVerificationPolicyRequest struct {
+	RequireForPublic bool `json:"require_for_public"`
+}
+
+// GetEmailVerificationPolicy returns whether users must verify their email
+// address before publishing public scripts
+func (h *AdminHandler) GetEmailVerificationPolicy(w http.ResponseWriter, r *http.Request) {
+	value, err := h.db.GetSetting(database.SettingPublicRequiresVerifiedEmail, "false")
+	if err != nil {
+		http.Error(w, "Failed to get email verification policy", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EmailVerificationPolicyRequest{RequireForPublic: value == "true"})
+}
+
+// SetEmailVerificationPolicy changes the policy. Scripts that are already
+// public stay public.
+func (h *AdminHandler) SetEmailVerificationPolicy(w http.ResponseWriter, r *http.Request) {
+	claims, _ := middleware.GetUserFromContext(r.Context())
+
+	var req EmailVerificationPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.SetSetting(database.SettingPublicRequiresVerifiedEmail, strconv.FormatBool(req.RequireForPublic)); err != nil {
+		http.Error(w, "Failed to set email verification policy", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Admin %s set verified email required for public scripts to %t", claims.Username, req.RequireForPublic)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
+
+// ResetUserMFA removes a user's second factors (TOTP and passkeys), e.g.
+// after a lost device, and signs them out everywhere
+func (h *AdminHandler) ResetUserMFA(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.ResetMFA(userID); err != nil {
+		http.Error(w, "Two-factor authentication is not configured for this user", http.StatusNotFound)
+		return
+	}
+	h.db.RevokeUserSessions(userID, 0)
+
+	claims, _ := middleware.GetUserFromContext(r.Context())
+	log.Printf("Admin %s reset MFA for user %d", claims.Username, userID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type LockoutResponse struct {
+	Kind          string `json:"kind"` // account or ip
+	Key           string `json:"key"`  // username or IP address
+	Failures      int    `json:"failures"`
+	LastFailureAt string `json:"last_failure_at"`
+	LockedUntil   string `json:"locked_until"`
+}
+
+type AuthAuditResponse struct {
+	ID        int64  `json:"id"`
+	Event     string `json:"event"`
+	UserID    *int64 `json:"user_id"`
+	Subject   string `json:"subject"`
+	IPAddress string `json:"ip_address"`
+	Detail    string `json:"detail"`
+	CreatedAt string `json:"created_at"`
+}
+
+// ListLockouts returns the accounts and IPs currently locked out of signing in
+func (h *AdminHandler) ListLockouts(w http.ResponseWriter, r *http.Request) {
+	lockouts, err := h.db.ListLoginLockouts(time.Now(), loginFailureWindow)
+	if err != nil {
+		http.Error(w, "Failed to list lockouts", http.StatusInternalServerError)
+		return
+	}
+
+	response := []LockoutResponse{}
+	for _, f := range lockouts {
+		response = append(response, LockoutResponse{
+			Kind:          f.Kind,
+			Key:           f.Key,
+			Failures:      f.Failures,
+			LastFailureAt: f.LastFailureAt.Format("2006-01-02T15:04:05Z"),
+			LockedUntil:   f.LockedUntil.Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Unlock lifts a lockout and resets its failure count
+func (h *AdminHandler) Unlock(w http.ResponseWriter, r *http.Request) {
+	claims, _ := middleware.GetUserFromContext(r.Context())
+
+	kind := chi.URLParam(r, "kind")
+	key := chi.URLParam(r, "key")
+	var event string
+	switch kind {
+	case database.LoginKindAccount:
+		event = database.AuditAccountUnlocked
+		key = loginAccountKey(key)
+	case database.LoginKindIP:
+		event = database.AuditIPUnlocked
+	default:
+		http.Error(w, "Kind must be account or ip", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.ClearLoginFailures(kind, key); err != nil {
+		http.Error(w, "No lockout found", http.StatusNotFound)
+		return
+	}
+
+	var userID *int64
+	if kind == database.LoginKindAccount {
+		if user, err := h.db.GetUserByUsername(key); err == nil {
+			userID = &user.ID
+		}
+	}
+	if err := h.db.CreateAuthAuditEntry(event, userID, key, loginIP(r), "unlocked by "+claims.Username); err != nil {
+		log.Printf("Failed to audit unlock of %s %s: %v", kind, key, err)
+	}
+	log.Printf("Admin %s unlocked sign-in for %s %s", claims.Username, kind, key)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetAuthAuditLog returns recent security events, newest first
+func (h *AdminHandler) GetAuthAuditLog(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l <= 1000 {
+		limit = l
+	}
+
+	entries, err := h.db.GetAuthAuditLog(limit)
+	if err != nil {
+		http.Error(w, "Failed to get audit log", http.StatusInternalServerError)
+		return
+	}
+
+	response := []AuthAuditResponse{}
+	for _, e := range entries {
+		response = append(response, AuthAuditResponse{
+			ID:        e.ID,
+			Event:     e.Event,
+			UserID:    e.UserID,
+			Subject:   e.Subject,
+			IPAddress: e.IPAddress,
+			Detail:    e.Detail,
+			CreatedAt: e.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// CollectBlobGarbage runs the orphaned blob collector now. It is a dry run
+// reporting what would be deleted unless dry_run=false is given.
+func (h *AdminHandler) CollectBlobGarbage(w http.ResponseWriter, r *http.Request) {
+	dryRun := r.URL.Query().Get("dry_run") != "false"
+	grace := time.Duration(h.cfg.BlobGCGraceHours) * time.Hour
+
+	report, err := jobs.CollectBlobGarbage(r.Context(), h.db, h.storage, grace, dryRun)
+	if err != nil {
+		log.Printf("Blob GC failed: %v", err)
+		http.Error(w, "Failed to collect orphaned blobs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+type ScrubFailureResponse struct {
+	StorageKey string                        `json:"storage_key"`
+	Reason     string                        `json:"reason"`
+	DetectedAt string                        `json:"detected_at"`
+	CheckedAt  string                        `json:"checked_at"`
+	Versions   []ScrubFailureVersionResponse `json:"versions"`
+}
+
+type ScrubFailureVersionResponse struct {
+	ScriptID   int64  `json:"script_id"`
+	ScriptName string `json:"script_name"`
+	Version    int    `json:"version"`
+}
+
+// ListScrubFailures returns the blobs the integrity scrub found damaged and
+// the script versions stored in them
+func (h *AdminHandler) ListScrubFailures(w http.ResponseWriter, r *http.Request) {
+	failures, err := h.db.ListScrubFailures()
+	if err != nil {
+		http.Error(w, "Failed to list scrub failures", http.StatusInternalServerError)
+		return
+	}
+
+	response := []ScrubFailureResponse{}
+	for _, f := range failures {
+		versions := []ScrubFailureVersionResponse{}
+		for _, v := range f.Versions {
+			versions = append(versions, ScrubFailureVersionResponse{
+				ScriptID:   v.ScriptID,
+				ScriptName: v.ScriptName,
+				Version:    v.Version,
+			})
+		}
+		response = append(response, ScrubFailureResponse{
+			StorageKey: f.StorageKey,
+			Reason:     f.Reason,
+			DetectedAt: f.DetectedAt.Format("2006-01-02T15:04:05Z"),
+			CheckedAt:  f.CheckedAt.Format("2006-01-02T15:04:05Z"),
+			Versions:   versions,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,36 +1,81 @@
 package api
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"shebang.run/internal/auth"
 	"shebang.run/internal/config"
 	"shebang.run/internal/database"
+	"shebang.run/internal/mailer"
 	"shebang.run/internal/middleware"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/oauth2"
 )
 
 type AuthHandler struct {
-	db     *database.DB
-	cfg    *config.Config
-	github *auth.OAuthProvider
-	google *auth.OAuthProvider
+	db      *database.DB
+	cfg     *config.Config
+	jwtKeys *auth.KeySet
+	// Configured login providers by name, and for OpenID Connect providers
+	// the shebang.run groups each IdP group maps to
+	providers map[string]*auth.OAuthProvider
+	groupMaps map[string]map[string][]int64
+	// nil when the WebAuthn relying party is misconfigured
+	webauthn *auth.WebAuthn
+	mailer   mailer.Mailer
+	// nil unless LDAP sign-in is configured; its group map is in groupMaps
+	// under auth.LDAPProviderName
+	ldap *auth.LDAPDirectory
 }
 
-func NewAuthHandler(db *database.DB, cfg *config.Config) *AuthHandler {
-	var github, google *auth.OAuthProvider
+var oidcProviderName = regexp.MustCompile(`^[a-z0-9-]{1,50}$`)
+
+func NewAuthHandler(db *database.DB, cfg *config.Config, jwtKeys *auth.KeySet, mail mailer.Mailer) *AuthHandler {
+	providers := make(map[string]*auth.OAuthProvider)
+	groupMaps := make(map[string]map[string][]int64)
 	
 	if cfg.GitHubClientID != "" {
-		github = auth.NewGitHubProvider(cfg.GitHubClientID, cfg.GitHubClientSecret, "http://localhost/api/auth/oauth/github/callback")
+		providers["github"] = auth.NewGitHubProvider(cfg.GitHubClientID, cfg.GitHubClientSecret)
 	}
 	if cfg.GoogleClientID != "" {
-		google = auth.NewGoogleProvider(cfg.GoogleClientID, cfg.GoogleClientSecret, "http://localhost/api/auth/oauth/google/callback")
+		providers["google"] = auth.NewGoogleProvider(cfg.GoogleClientID, cfg.GoogleClientSecret)
+	}
+	for _, p := range cfg.OIDCProviders {
+		switch {
+		case !oidcProviderName.MatchString(p.Name), p.Name == "github", p.Name == "google", p.Name == auth.LDAPProviderName, providers[p.Name] != nil:
+			log.Printf("OIDC provider %q skipped: invalid or duplicate name", p.Name)
+			continue
+		case p.Issuer == "" || p.ClientID == "":
+			log.Printf("OIDC provider %q skipped: issuer and client ID are required", p.Name)
+			continue
+		}
+		providers[p.Name] = auth.NewOIDCProvider(p.Name, p.DisplayName, p.Issuer, p.ClientID, p.ClientSecret, p.Scopes, p.GroupsClaim)
+		groupMaps[p.Name] = p.GroupMap
+	}
+	
+	webauthn, err := auth.NewWebAuthn(cfg.WebAuthnRPID, webAuthnRPName, cfg.WebAuthnOrigins)
+	if err != nil {
+		log.Printf("Passkeys disabled: %v", err)
 	}
 	
-	return &AuthHandler{db: db, cfg: cfg, github: github, google: google}
+	ldap, ldapGroupMap := newLDAPDirectory(cfg)
+	if ldap != nil {
+		groupMaps[auth.LDAPProviderName] = ldapGroupMap
+	}
+	
+	return &AuthHandler{db: db, cfg: cfg, jwtKeys: jwtKeys, providers: providers, groupMaps: groupMaps, webauthn: webauthn, mailer: mail, ldap: ldap}
 }
 
 type RegisterRequest struct {
@@ -45,8 +90,92 @@ type LoginRequest struct {
 }
 
 type AuthResponse struct {
-	Token string      `json:"token"`
-	User  interface{} `json:"user"`
+	Token        string      `json:"token"`
+	RefreshToken string      `json:"refresh_token,omitempty"`
+	ExpiresIn    int         `json:"expires_in,omitempty"`
+	// Set when the MFA policy requires enrollment before anything else
+	MFASetupRequired bool        `json:"mfa_setup_required,omitempty"`
+	User             interface{} `json:"user"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func authUser(user *database.User) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       user.ID,
+		"username": user.Username,
+		"email":    user.Email,
+		"is_admin": user.IsAdmin,
+	}
+}
+
+// accessToken issues a short-lived JWT for the user bound to a session,
+// restricted to MFA enrollment while the MFA policy is unmet. Admin rights
+// are withheld from sessions the admin console policy does not accept.
+func (h *AuthHandler) accessToken(user *database.User, session *database.Session) (string, bool, error) {
+	// Get subscription expiry
+	var expiresAt *time.Time
+	h.db.DB.QueryRow("SELECT subscription_expires_at FROM users WHERE id = ?", user.ID).Scan(&expiresAt)
+
+	setupRequired, err := h.db.MFASetupRequired(user)
+	if err != nil {
+		return "", false, err
+	}
+
+	claims := auth.Claims{
+		UserID:             user.ID,
+		Username:           user.Username,
+		IsAdmin:            user.IsAdmin,
+		TierID:             user.TierID,
+		SubscriptionExpiry: expiresAt,
+		SessionID:          session.ID,
+		AuthMethod:         session.AuthMethod,
+		MFASetupRequired:   setupRequired,
+	}
+	if user.IsAdmin && session.AuthMethod != database.AuthMethodPasskey {
+		policy, err := h.db.GetSetting(database.SettingAdminAuthPolicy, database.AdminAuthPolicyAny)
+		if err != nil {
+			return "", false, err
+		}
+		if policy == database.AdminAuthPolicyPasskey {
+			claims.IsAdmin = false
+			claims.AdminPasskeyRequired = true
+		}
+	}
+
+	token, err := auth.GenerateToken(claims, h.jwtKeys)
+	return token, setupRequired, err
+}
+
+// startSession opens a login session for the user, signed in with
+// authMethod, and returns its access and refresh tokens. Only a hash of the
+// refresh token is stored.
+func (h *AuthHandler) startSession(r *http.Request, user *database.User, authMethod string) (*AuthResponse, error) {
+	refreshToken, err := auth.GenerateRandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := h.db.CreateSession(user.ID, authMethod, auth.HashToken(refreshToken), r.UserAgent(), middleware.ClientIP(r), time.Now().Add(auth.RefreshTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+	h.loginSucceeded(user.Username)
+
+	token, setupRequired, err := h.accessToken(user, session)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthResponse{
+		Token:            token,
+		RefreshToken:     refreshToken,
+		ExpiresIn:        int(auth.AccessTokenTTL.Seconds()),
+		MFASetupRequired: setupRequired,
+		User:             authUser(user),
+	}, nil
 }
 
 func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
@@ -67,6 +196,11 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if _, err := h.db.GetOrgByName(req.Username); err == nil {
+		http.Error(w, "Username or email already exists", http.StatusConflict)
+		return
+	}
+
 	hash, err := auth.HashPassword(req.Password)
 	if err != nil {
 		http.Error(w, "Internal error", http.StatusInternalServerError)
@@ -82,23 +216,16 @@ func (h *AuthHandler) Register(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to create user", http.StatusInternalServerError)
 		return
 	}
+	go h.sendEmailVerification(user)
 
-	token, err := auth.GenerateToken(user.ID, user.Username, user.IsAdmin, user.TierID, nil, h.cfg.JWTSecret)
+	response, err := h.startSession(r, user, database.AuthMethodPassword)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(AuthResponse{
-		Token: token,
-		User: map[string]interface{}{
-			"id":       user.ID,
-			"username": user.Username,
-			"email":    user.Email,
-			"is_admin": user.IsAdmin,
-		},
-	})
+	json.NewEncoder(w).Encode(response)
 }
 
 func (h *AuthHandler) CheckUsername(w http.ResponseWriter, r *http.Request) {
@@ -112,10 +239,15 @@ func (h *AuthHandler) CheckUsername(w http.ResponseWriter, r *http.Request) {
 	existingUser, err := h.db.GetUserByUsername(username)
 	available := err != nil // Available if user not found
 	
+	// Organizations share the username namespace
+	if _, err := h.db.GetOrgByName(username); err == nil {
+		available = false
+	}
+	
 	// If authenticated, allow current user's username
 	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
 		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		claims, err := auth.ValidateToken(tokenString, h.cfg.JWTSecret)
+		claims, err := auth.ValidateToken(tokenString, h.jwtKeys)
 		if err == nil && existingUser != nil && existingUser.ID == claims.UserID {
 			available = true
 		}
@@ -133,6 +265,12 @@ func (h *AuthHandler) SetUsername(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	// The new session has every permission, so only a session may be
+	// replaced; API tokens, scoped or from a device, cannot be traded for one
+	if claims.SessionID == 0 || claims.Scopes != nil {
+		http.Error(w, "Setting a username requires signing in", http.StatusForbidden)
+		return
+	}
 	
 	var req struct {
 		Username string `json:"username"`
@@ -153,6 +291,10 @@ func (h *AuthHandler) SetUsername(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Username already taken", http.StatusConflict)
 		return
 	}
+	if _, err := h.db.GetOrgByName(req.Username); err == nil {
+		http.Error(w, "Username already taken", http.StatusConflict)
+		return
+	}
 	
 	// Update username
 	err = h.db.UpdateUsername(claims.UserID, req.Username)
@@ -168,23 +310,16 @@ func (h *AuthHandler) SetUsername(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	// Generate new token with updated username
-	token, err := auth.GenerateToken(user.ID, user.Username, user.IsAdmin, user.TierID, nil, h.cfg.JWTSecret)
+	// Replace the temporary session with a full one under the new username
+	h.db.RevokeSession(claims.SessionID, claims.UserID)
+	response, err := h.startSession(r, user, database.AuthMethodOAuth)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 	
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(AuthResponse{
-		Token: token,
-		User: map[string]interface{}{
-			"id":       user.ID,
-			"username": user.Username,
-			"email":    user.Email,
-			"is_admin": user.IsAdmin,
-		},
-	})
+	json.NewEncoder(w).Encode(response)
 }
 
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
@@ -194,22 +329,99 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if h.loginLocked(w, r, req.Username) {
+		return
+	}
+
 	user, err := h.db.GetUserByUsername(req.Username)
+	if h.ldap != nil && (err != nil || user.OAuthProvider == auth.LDAPProviderName) {
+		// Directory accounts, and unknown usernames that may be new ones
+		var ok bool
+		if user, ok = h.ldapLogin(w, r, req.Username, req.Password); !ok {
+			return
+		}
+	} else {
+		if err != nil {
+			h.loginFailed(r, req.Username, nil)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+
+		if !auth.CheckPassword(req.Password, user.PasswordHash) {
+			h.loginFailed(r, req.Username, &user.ID)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	// With MFA enabled the password only earns a challenge for LoginMFA
+	if enabled, err := h.db.IsMFAEnabled(user.ID); err != nil || enabled {
+		if err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		challenge, err := h.mfaChallenge(user)
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(challenge)
+		return
+	}
+
+	response, err := h.startSession(r, user, database.AuthMethodPassword)
 	if err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
-	if !auth.CheckPassword(req.Password, user.PasswordHash) {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// Refresh exchanges a refresh token for a new access token and rotates the
+// refresh token. Presenting an already-rotated refresh token revokes its
+// session, since only a copied token can be replayed.
+func (h *AuthHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	var req RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	// Get subscription expiry
-	var expiresAt *time.Time
-	h.db.DB.QueryRow("SELECT subscription_expires_at FROM users WHERE id = ?", user.ID).Scan(&expiresAt)
+	hash := auth.HashToken(req.RefreshToken)
+	session, err := h.db.GetSessionByRefreshHash(hash)
+	if err != nil {
+		if revoked, _ := h.db.RevokeSessionByPreviousHash(hash); revoked {
+			log.Printf("Refresh token reuse detected from %s, session revoked", middleware.ClientIP(r))
+		}
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if !session.Active() {
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return
+	}
 
-	token, err := auth.GenerateToken(user.ID, user.Username, user.IsAdmin, user.TierID, expiresAt, h.cfg.JWTSecret)
+	user, err := h.db.GetUserByID(session.UserID)
+	if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	refreshToken, err := auth.GenerateRandomToken(32)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+	err = h.db.RotateSessionRefreshToken(session.ID, hash, auth.HashToken(refreshToken), r.UserAgent(), middleware.ClientIP(r), time.Now().Add(auth.RefreshTokenTTL))
+	if err != nil {
+		http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+
+	token, setupRequired, err := h.accessToken(user, session)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
@@ -217,96 +429,157 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(AuthResponse{
-		Token: token,
-		User: map[string]interface{}{
-			"id":       user.ID,
-			"username": user.Username,
-			"email":    user.Email,
-			"is_admin": user.IsAdmin,
-		},
+		Token:            token,
+		RefreshToken:     refreshToken,
+		ExpiresIn:        int(auth.AccessTokenTTL.Seconds()),
+		MFASetupRequired: setupRequired,
+		User:             authUser(user),
 	})
 }
 
-func (h *AuthHandler) OAuthLogin(w http.ResponseWriter, r *http.Request, provider string) {
-	var p *auth.OAuthProvider
-	var callbackPath string
-	
-	switch provider {
-	case "github":
-		callbackPath = "/api/auth/oauth/github/callback"
-		if h.github != nil {
-			// Update redirect URL based on request
-			redirectURL := buildRedirectURL(r, callbackPath)
-			fmt.Printf("GitHub OAuth redirect URL: %s\n", redirectURL)
-			p = auth.NewGitHubProvider(h.cfg.GitHubClientID, h.cfg.GitHubClientSecret, redirectURL)
-		}
-	case "google":
-		callbackPath = "/api/auth/oauth/google/callback"
-		if h.google != nil {
-			redirectURL := buildRedirectURL(r, callbackPath)
-			fmt.Printf("Google OAuth redirect URL: %s\n", redirectURL)
-			p = auth.NewGoogleProvider(h.cfg.GoogleClientID, h.cfg.GoogleClientSecret, redirectURL)
-		}
-	default:
-		http.Error(w, "Unknown provider", http.StatusBadRequest)
+// Logout revokes the caller's session
+func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	if claims.SessionID != 0 {
+		h.db.RevokeSession(claims.SessionID, claims.UserID)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type OAuthProviderResponse struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+// ListOAuthProviders lists the configured login providers for the login page
+func (h *AuthHandler) ListOAuthProviders(w http.ResponseWriter, r *http.Request) {
+	response := []OAuthProviderResponse{}
+	for _, p := range h.providers {
+		response = append(response, OAuthProviderResponse{Name: p.Name, DisplayName: p.DisplayName})
+	}
+	sort.Slice(response, func(i, j int) bool { return response[i].DisplayName < response[j].DisplayName })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+const (
+	oauthStateCookie = "oauth_state"
+	oauthStateTTL    = 10 * time.Minute
+)
+
+func oauthCallbackPath(provider string) string {
+	return "/api/auth/oauth/" + provider + "/callback"
+}
+
+// OAuthLogin redirects to the provider. The state is also set in a cookie,
+// so the callback only completes in the browser that started the login.
+func (h *AuthHandler) OAuthLogin(w http.ResponseWriter, r *http.Request) {
+	provider := chi.URLParam(r, "provider")
+	p := h.providers[provider]
 	if p == nil {
-		http.Error(w, "Provider not configured", http.StatusServiceUnavailable)
+		http.Error(w, "Provider not configured", http.StatusNotFound)
+		return
+	}
+
+	state, err := auth.GenerateRandomToken(32)
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := auth.GenerateRandomToken(32)
+	if err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	url, err := p.AuthCodeURL(r.Context(), buildRedirectURL(r, oauthCallbackPath(provider)), state, nonce, verifier)
+	if err != nil {
+		log.Printf("OAuth provider %s unavailable: %v", provider, err)
+		http.Error(w, "Provider unavailable", http.StatusBadGateway)
+		return
+	}
+	if err := h.db.CreateOAuthState(auth.HashToken(state), provider, nonce, verifier, time.Now().Add(oauthStateTTL)); err != nil {
+		http.Error(w, "Failed to start login", http.StatusInternalServerError)
 		return
 	}
 
-	state, _ := auth.GenerateRandomToken(32)
-	url := p.GetAuthURL(state)
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    state,
+		Path:     "/api/auth/oauth/",
+		MaxAge:   int(oauthStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(buildRedirectURL(r, ""), "https:"),
+		SameSite: http.SameSiteLaxMode,
+	})
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
-func (h *AuthHandler) OAuthCallback(w http.ResponseWriter, r *http.Request, provider string) {
-	var p *auth.OAuthProvider
-	var callbackPath string
-	
-	switch provider {
-	case "github":
-		callbackPath = "/api/auth/oauth/github/callback"
-		if h.github != nil {
-			redirectURL := buildRedirectURL(r, callbackPath)
-			p = auth.NewGitHubProvider(h.cfg.GitHubClientID, h.cfg.GitHubClientSecret, redirectURL)
-		}
-	case "google":
-		callbackPath = "/api/auth/oauth/google/callback"
-		if h.google != nil {
-			redirectURL := buildRedirectURL(r, callbackPath)
-			p = auth.NewGoogleProvider(h.cfg.GoogleClientID, h.cfg.GoogleClientSecret, redirectURL)
-		}
-	default:
-		http.Error(w, "Unknown provider", http.StatusBadRequest)
+func (h *AuthHandler) OAuthCallback(w http.ResponseWriter, r *http.Request) {
+	provider := chi.URLParam(r, "provider")
+	p := h.providers[provider]
+	if p == nil {
+		http.Error(w, "Provider not configured", http.StatusNotFound)
 		return
 	}
 
+	if errMsg := r.URL.Query().Get("error"); errMsg != "" {
+		http.Error(w, "Login was not completed: "+errMsg, http.StatusUnauthorized)
+		return
+	}
 	code := r.URL.Query().Get("code")
 	if code == "" {
 		http.Error(w, "No code provided", http.StatusBadRequest)
 		return
 	}
 
-	token, err := p.Exchange(r.Context(), code)
+	// The state must match this browser's cookie and a pending login
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(oauthStateCookie)
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/api/auth/oauth/", MaxAge: -1})
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	pending, err := h.db.ConsumeOAuthState(auth.HashToken(state), provider)
+	if err != nil {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	token, err := p.Exchange(r.Context(), buildRedirectURL(r, oauthCallbackPath(provider)), code, pending.CodeVerifier)
 	if err != nil {
 		http.Error(w, "Failed to exchange token", http.StatusInternalServerError)
 		return
 	}
 
-	oauthUser, err := p.GetUserInfo(r.Context(), token)
+	oauthUser, err := p.GetUserInfo(r.Context(), token, pending.Nonce)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get user info: %v", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Failed to get user info: %v", err), http.StatusUnauthorized)
+		return
+	}
+	if oauthUser.ID == "" {
+		http.Error(w, "Provider did not identify the user", http.StatusUnauthorized)
 		return
 	}
 
 	isNewUser := false
 	user, err := h.db.GetUserByOAuth(provider, oauthUser.ID)
 	if err != nil {
-		// Check if user exists with this email
+		// Check if user exists with this email. OpenID Connect issuers
+		// may let users enter any address, so only verified ones count.
 		existingUser, emailErr := h.db.GetUserByEmail(oauthUser.Email)
+		if oauthUser.Email == "" || (p.IsOIDC() && !oauthUser.EmailVerified) {
+			emailErr = errors.New("email not usable for linking")
+		}
 		if emailErr == nil {
 			// User exists with this email, log them in
 			// This allows linking OAuth to existing password accounts
@@ -319,13 +592,30 @@ func (h *AuthHandler) OAuthCallback(w http.ResponseWriter, r *http.Request, prov
 			if username == "" {
 				username = strings.Split(oauthUser.Email, "@")[0]
 			}
+			if p.IsOIDC() {
+				// Issuers let users choose their preferred_username freely
+				if username, err = h.oidcUsername(oauthUser); err != nil {
+					http.Error(w, "Failed to create user", http.StatusInternalServerError)
+					return
+				}
+			}
 			
+			// Organizations share the username namespace
+			if _, err := h.db.GetOrgByName(username); err == nil {
+				http.Error(w, "Username or email already exists", http.StatusConflict)
+				return
+			}
+
 			// Try to create user, handle duplicate username
 			user, err = h.db.CreateUser(username, oauthUser.Email, "", provider, oauthUser.ID, isFirst)
 			if err != nil {
 				// If username exists, try with provider suffix
 				if strings.Contains(err.Error(), "Duplicate") && strings.Contains(err.Error(), "username") {
 					username = username + "_" + provider
+					if _, orgErr := h.db.GetOrgByName(username); orgErr == nil {
+						http.Error(w, "Username or email already exists", http.StatusConflict)
+						return
+					}
 					user, err = h.db.CreateUser(username, oauthUser.Email, "", provider, oauthUser.ID, isFirst)
 				}
 				if err != nil {
@@ -333,18 +623,50 @@ func (h *AuthHandler) OAuthCallback(w http.ResponseWriter, r *http.Request, prov
 					return
 				}
 			}
+			if oauthUser.EmailVerified {
+				h.db.SetEmailVerified(user.ID, user.Email)
+			} else if user.Email != "" {
+				go h.sendEmailVerification(user)
+			}
 		}
 	}
 
-	// Get subscription expiry
-	var expiresAt *time.Time
-	h.db.DB.QueryRow("SELECT subscription_expires_at FROM users WHERE id = ?", user.ID).Scan(&expiresAt)
+	if groupMap := h.groupMaps[provider]; len(groupMap) > 0 {
+		if err := h.syncMappedGroups(user.ID, groupMap, oauthUser.Groups); err != nil {
+			log.Printf("Failed to sync %s groups for user %d: %v", provider, user.ID, err)
+		}
+	}
 
-	jwtToken, err := auth.GenerateToken(user.ID, user.Username, user.IsAdmin, user.TierID, expiresAt, h.cfg.JWTSecret)
+	// The provider only stands in for the password; MFA still applies
+	if enabled, _ := h.db.IsMFAEnabled(user.ID); enabled && !isNewUser {
+		challenge, err := h.mfaChallenge(user)
+		if err != nil {
+			http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><title>Two-factor authentication</title></head>
+<body>
+<script>
+sessionStorage.setItem('mfa_token', '%s');
+sessionStorage.setItem('mfa_methods', '%s');
+window.location.href = '/login?mfa=1';
+</script>
+<p>Continuing to two-factor authentication...</p>
+</body>
+</html>
+`, challenge.MFAToken, strings.Join(challenge.Methods, ","))
+		return
+	}
+
+	session, err := h.startSession(r, user, database.AuthMethodOAuth)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
+	jwtToken := session.Token
 
 	// Check if username needs to be set (new OAuth user)
 	redirectPath := "/dashboard"
@@ -369,12 +691,13 @@ window.location.href = '%s';
 	func() string {
 		if !isNewUser {
 			return fmt.Sprintf(`localStorage.setItem('token', '%s');
+localStorage.setItem('refresh_token', '%s');
 localStorage.setItem('user', JSON.stringify({
 	id: %d,
 	username: '%s',
 	email: '%s',
 	is_admin: %t
-}));`, jwtToken, user.ID, user.Username, user.Email, user.IsAdmin)
+}));`, jwtToken, session.RefreshToken, user.ID, user.Username, user.Email, user.IsAdmin)
 		}
 		return ""
 	}(),
@@ -385,6 +708,82 @@ localStorage.setItem('user', JSON.stringify({
 }
 
 
+// syncMappedGroups applies the provider's group mapping on each login, so
+// removing a user from an IdP group also removes them from its groups here
+func (h *AuthHandler) syncMappedGroups(userID int64, groupMap map[string][]int64, idpGroups []string) error {
+	mapped, member := mappedGroups(groupMap, idpGroups)
+	return h.db.SetMappedGroupMemberships(userID, mapped, member)
+}
+
+// mappedGroups returns every group the map manages and those of them the
+// user's IdP groups grant
+func mappedGroups(groupMap map[string][]int64, idpGroups []string) (mapped, member []int64) {
+	for _, groupIDs := range groupMap {
+		mapped = append(mapped, groupIDs...)
+	}
+	for _, idpGroup := range idpGroups {
+		member = append(member, groupMap[idpGroup]...)
+	}
+	return mapped, member
+}
+
+// Usernames are lowercase letters, digits, "-" and "_", starting with a
+// letter or digit
+var usernamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{2,38}$`)
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// normalizeUsername turns a username from an identity provider into a
+// local one: lowercased, only the local part of an email address, and
+// other characters replaced by "-". ok is false when that is not a valid
+// username.
+func normalizeUsername(name string) (string, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.Trim(usernameInvalidChars.ReplaceAllString(name, "-"), "-_")
+	return name, usernamePattern.MatchString(name)
+}
+
+// oidcUsername picks the username of a new OpenID Connect user: their
+// preferred_username or email's local part when valid and free, else a
+// generated one. The user chooses their own next.
+func (h *AuthHandler) oidcUsername(oauthUser *auth.OAuthUser) (string, error) {
+	for _, candidate := range []string{oauthUser.Username, oauthUser.Email} {
+		if name, ok := normalizeUsername(candidate); ok && h.usernameFree(name) {
+			return name, nil
+		}
+	}
+	for i := 0; i < 5; i++ {
+		suffix := make([]byte, 4)
+		if _, err := rand.Read(suffix); err != nil {
+			return "", err
+		}
+		if name := "user-" + hex.EncodeToString(suffix); h.usernameFree(name) {
+			return name, nil
+		}
+	}
+	return "", errors.New("no free username")
+}
+
+// usernameFree reports whether no user or organization has the name
+func (h *AuthHandler) usernameFree(name string) bool {
+	if _, err := h.db.GetUserByUsername(name); err == nil {
+		return false
+	}
+	_, err := h.db.GetOrgByName(name)
+	return err != nil
+}
+
+// JWKS publishes the token verification keys so other services can verify
+// shebang.run tokens without a shared secret
+func (h *AuthHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": h.jwtKeys.JWKS()})
+}
+
 func buildRedirectURL(r *http.Request, path string) string {
 	scheme := "https"
 	if r.TLS == nil {
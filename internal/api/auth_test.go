@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"shebang.run/internal/auth"
+	"shebang.run/internal/middleware"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"ada", "ada", true},
+		{"Ada.Lovelace", "ada-lovelace", true},
+		{"ada@example.org", "ada", true},
+		{"  Grace Hopper ", "grace-hopper", true},
+		{"_admin_", "admin", true},
+		{"ümlaut", "mlaut", true},
+		{"ab", "ab", false},
+		{"../../etc", "etc", true},
+		{"***", "", false},
+		{"a-very-long-preferred-username-from-the-issuer", "a-very-long-preferred-username-from-the-issuer", false},
+	}
+	for _, tt := range tests {
+		got, ok := normalizeUsername(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("normalizeUsername(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMappedGroups(t *testing.T) {
+	groupMap := map[string][]int64{
+		"devops": {1, 2},
+		"admins": {3},
+	}
+	mapped, member := mappedGroups(groupMap, []string{"admins", "unmapped"})
+	sort.Slice(mapped, func(i, j int) bool { return mapped[i] < mapped[j] })
+	if want := []int64{1, 2, 3}; !reflect.DeepEqual(mapped, want) {
+		t.Errorf("mapped = %v, want %v", mapped, want)
+	}
+	if want := []int64{3}; !reflect.DeepEqual(member, want) {
+		t.Errorf("member = %v, want %v", member, want)
+	}
+
+	// Users in no mapped IdP group leave every mapped group
+	if _, member := mappedGroups(groupMap, nil); len(member) != 0 {
+		t.Errorf("member without IdP groups = %v, want none", member)
+	}
+}
+
+func TestOAuthCallbackChecksState(t *testing.T) {
+	h := &AuthHandler{providers: map[string]*auth.OAuthProvider{
+		"corp": auth.NewOIDCProvider("corp", "Corp", "http://issuer.invalid", "shebang", "secret", nil, ""),
+	}}
+	r := chi.NewRouter()
+	r.Get("/api/auth/oauth/{provider}/callback", h.OAuthCallback)
+
+	tests := []struct {
+		name   string
+		state  string
+		cookie string
+	}{
+		{"no cookie", "state", ""},
+		{"other login's cookie", "state", "other"},
+		{"no state", "", "state"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/auth/oauth/corp/callback?code=c&state="+tt.state, nil)
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: oauthStateCookie, Value: tt.cookie})
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestSetUsernameRequiresSession(t *testing.T) {
+	h := &AuthHandler{}
+	for _, claims := range []*auth.Claims{
+		{UserID: 1, TokenID: 2, Scopes: []string{"scripts:read"}},
+		{UserID: 1, TokenID: 2, Scopes: []string{}},
+		{UserID: 1},
+	} {
+		req := httptest.NewRequest("POST", "/api/auth/set-username", strings.NewReader(`{"username":"ada"}`))
+		req = req.WithContext(context.WithValue(req.Context(), middleware.UserContextKey, claims))
+		rec := httptest.NewRecorder()
+		h.SetUsername(rec, req)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("SetUsername with %+v: status %d, want %d", claims, rec.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -27,10 +27,11 @@ type CommunityScriptResponse struct {
 func (h *CommunityHandler) ListPublicScripts(w http.ResponseWriter, r *http.Request) {
 	// Get all public scripts from all users
 	rows, err := h.db.Query(`
-		SELECT s.id, s.name, s.description, s.updated_at, u.username,
+		SELECT s.id, s.name, s.description, s.updated_at, COALESCE(u.username, o.name),
 		       COALESCE((SELECT MAX(version) FROM script_versions WHERE script_id = s.id), 0) as version
 		FROM scripts s
-		JOIN users u ON s.user_id = u.id
+		LEFT JOIN users u ON s.user_id = u.id
+		LEFT JOIN organizations o ON s.org_id = o.id
 		WHERE s.visibility = 'public'
 		ORDER BY s.updated_at DESC
 		LIMIT 100
@@ -0,0 +1,299 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"shebang.run/internal/auth"
+	"shebang.run/internal/database"
+	"shebang.run/internal/middleware"
+)
+
+// OAuth 2.0 device authorization grant (RFC 8628): a CLI on a machine
+// without a browser shows a code, the user approves it on the web, and the
+// CLI receives a scoped API token
+
+const (
+	deviceCodeGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+	deviceCodeTTL       = 10 * time.Minute
+	devicePollInterval  = 5 * time.Second
+)
+
+// Scopes a device gets when it does not ask for any, matching the account
+// page's defaults for new API tokens
+var defaultDeviceScopes = []string{"scripts:write", "keys:write", "secrets:write"}
+
+type DeviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DeviceTokenResponse is the standard token response, with the API token's
+// credentials also given separately: access_token is the value for a Basic
+// Authorization header
+type DeviceTokenResponse struct {
+	AccessToken  string   `json:"access_token"`
+	TokenType    string   `json:"token_type"`
+	ExpiresIn    int      `json:"expires_in,omitempty"`
+	Scope        string   `json:"scope"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes"`
+	Username     string   `json:"username"`
+}
+
+type DeviceAuthorizationResponse struct {
+	UserCode   string   `json:"user_code"`
+	ClientName string   `json:"client_name"`
+	Scopes     []string `json:"scopes"`
+	RequestIP  string   `json:"request_ip"`
+	CreatedAt  string   `json:"created_at"`
+	ExpiresAt  string   `json:"expires_at"`
+}
+
+type DeviceDecisionRequest struct {
+	UserCode string `json:"user_code"`
+}
+
+// deviceError answers with an OAuth error object, which device clients
+// expect instead of plain text
+func deviceError(w http.ResponseWriter, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// DeviceCode starts a device login. Parameters are form encoded as in the
+// RFC: client_id names the client for the approval page and scope is a
+// space-separated list of API token scopes.
+func (h *AuthHandler) DeviceCode(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		deviceError(w, "invalid_request", "Invalid form body")
+		return
+	}
+
+	clientName := strings.TrimSpace(r.PostForm.Get("client_id"))
+	if clientName == "" || len(clientName) > 100 {
+		deviceError(w, "invalid_client", "client_id is required (up to 100 characters)")
+		return
+	}
+	scopes := strings.Fields(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		scopes = defaultDeviceScopes
+	}
+	for _, scope := range scopes {
+		if !auth.ValidScope(scope) {
+			deviceError(w, "invalid_scope", "Unknown scope: "+scope)
+			return
+		}
+	}
+
+	deviceCode, err := auth.GenerateRandomToken(32)
+	if err != nil {
+		http.Error(w, "Failed to start device login", http.StatusInternalServerError)
+		return
+	}
+	// Retry on the unlikely collision with a pending user code
+	var userCode string
+	for attempt := 0; attempt < 3; attempt++ {
+		if userCode, err = auth.GenerateUserCode(); err != nil {
+			break
+		}
+		err = h.db.CreateDeviceAuthorization(auth.HashToken(deviceCode), userCode, clientName, scopes, middleware.ClientIP(r), time.Now().Add(deviceCodeTTL))
+		if err == nil || !strings.Contains(err.Error(), "Duplicate") {
+			break
+		}
+	}
+	if err != nil {
+		log.Printf("DeviceCode error: %v", err)
+		http.Error(w, "Failed to start device login", http.StatusInternalServerError)
+		return
+	}
+
+	verificationURI := buildRedirectURL(r, "/device")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(DeviceCodeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?user_code=" + userCode,
+		ExpiresIn:               int(deviceCodeTTL.Seconds()),
+		Interval:                int(devicePollInterval.Seconds()),
+	})
+}
+
+// DeviceToken is polled by the device until the user decides. Once approved
+// the API token is created and returned exactly once.
+func (h *AuthHandler) DeviceToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		deviceError(w, "invalid_request", "Invalid form body")
+		return
+	}
+	if r.PostForm.Get("grant_type") != deviceCodeGrantType {
+		deviceError(w, "unsupported_grant_type", "grant_type must be "+deviceCodeGrantType)
+		return
+	}
+
+	device, err := h.db.GetDeviceAuthorizationByDeviceCode(auth.HashToken(r.PostForm.Get("device_code")))
+	if err != nil {
+		deviceError(w, "invalid_grant", "Unknown device code")
+		return
+	}
+	if device.Expired() {
+		h.db.DeleteDeviceAuthorization(device.ID)
+		deviceError(w, "expired_token", "The device code has expired")
+		return
+	}
+
+	switch device.Status {
+	case database.DeviceAuthPending:
+		now := time.Now()
+		tooFast := device.LastPolledAt != nil && now.Sub(*device.LastPolledAt) < devicePollInterval
+		h.db.UpdateDeviceAuthorizationPoll(device.ID, now)
+		if tooFast {
+			deviceError(w, "slow_down", "Polling too frequently")
+			return
+		}
+		deviceError(w, "authorization_pending", "Waiting for the user to approve the code")
+		return
+	case database.DeviceAuthDenied:
+		h.db.DeleteDeviceAuthorization(device.ID)
+		deviceError(w, "access_denied", "The user denied the request")
+		return
+	}
+
+	// Approved: whoever deletes the row issues the token, so concurrent
+	// polls cannot both receive one
+	if err := h.db.DeleteDeviceAuthorization(device.ID); err != nil || device.UserID == nil {
+		deviceError(w, "invalid_grant", "Unknown device code")
+		return
+	}
+
+	user, err := h.db.GetUserByID(*device.UserID)
+	if err != nil {
+		deviceError(w, "invalid_grant", "Unknown device code")
+		return
+	}
+
+	var expiresAt *time.Time
+	if h.cfg.DeviceTokenTTLDays > 0 {
+		t := time.Now().AddDate(0, 0, h.cfg.DeviceTokenTTLDays)
+		expiresAt = &t
+	}
+	clientID, _ := auth.GenerateRandomToken(32)
+	clientSecret, _ := auth.GenerateRandomToken(48)
+	name := device.ClientName + " (device " + device.UserCode + ")"
+	token, err := h.db.CreateAPIToken(*device.UserID, name, clientID, auth.HashToken(clientSecret), device.Scopes, nil, expiresAt)
+	if err != nil {
+		log.Printf("DeviceToken error for user %d: %v", *device.UserID, err)
+		http.Error(w, "Failed to create token", http.StatusInternalServerError)
+		return
+	}
+
+	response := DeviceTokenResponse{
+		AccessToken:  base64.StdEncoding.EncodeToString([]byte(clientID + ":" + clientSecret)),
+		TokenType:    "Basic",
+		Scope:        strings.Join(token.Scopes, " "),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Scopes:       token.Scopes,
+		Username:     user.Username,
+	}
+	if token.ExpiresAt != nil {
+		response.ExpiresIn = int(time.Until(*token.ExpiresAt).Seconds())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(response)
+}
+
+// pendingDevice loads a device login the signed-in user may decide on
+func (h *AuthHandler) pendingDevice(w http.ResponseWriter, claims *auth.Claims, userCode string) (*database.DeviceAuthorization, bool) {
+	// API tokens cannot approve devices, only a signed-in user can
+	if claims.SessionID == 0 {
+		http.Error(w, "Approving a device requires signing in", http.StatusForbidden)
+		return nil, false
+	}
+	device, err := h.db.GetDeviceAuthorizationByUserCode(auth.NormalizeUserCode(userCode))
+	if err != nil || device.Status != database.DeviceAuthPending || device.Expired() {
+		http.Error(w, "Unknown or expired code", http.StatusNotFound)
+		return nil, false
+	}
+	return device, true
+}
+
+// GetDeviceAuthorization shows what a device asked for, before approval
+func (h *AuthHandler) GetDeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	device, ok := h.pendingDevice(w, claims, r.URL.Query().Get("user_code"))
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeviceAuthorizationResponse{
+		UserCode:   device.UserCode,
+		ClientName: device.ClientName,
+		Scopes:     device.Scopes,
+		RequestIP:  device.RequestIP,
+		CreatedAt:  device.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		ExpiresAt:  device.ExpiresAt.Format("2006-01-02T15:04:05Z"),
+	})
+}
+
+func (h *AuthHandler) ApproveDevice(w http.ResponseWriter, r *http.Request) {
+	h.decideDevice(w, r, database.DeviceAuthApproved)
+}
+
+func (h *AuthHandler) DenyDevice(w http.ResponseWriter, r *http.Request) {
+	h.decideDevice(w, r, database.DeviceAuthDenied)
+}
+
+func (h *AuthHandler) decideDevice(w http.ResponseWriter, r *http.Request, status string) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req DeviceDecisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	device, ok := h.pendingDevice(w, claims, req.UserCode)
+	if !ok {
+		return
+	}
+	// The device gets the same scopes the user could grant a token by hand
+	if status == database.DeviceAuthApproved {
+		if msg, code := checkGrantableScopes(claims, device.Scopes); msg != "" {
+			http.Error(w, msg, code)
+			return
+		}
+	}
+
+	if err := h.db.DecideDeviceAuthorization(device.ID, claims.UserID, status); err != nil {
+		http.Error(w, "Unknown or expired code", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": status})
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"shebang.run/internal/auth"
+	"shebang.run/internal/database"
+	"shebang.run/internal/mailer"
+	"shebang.run/internal/middleware"
+)
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type EmailStatusResponse struct {
+	Email    string `json:"email"`
+	Verified bool   `json:"verified"`
+}
+
+// sendEmailLink mails the user a single-use link to path carrying a signed
+// token. It runs in the background, so callers answer at the same speed
+// whether or not an account exists.
+func (h *AuthHandler) sendEmailLink(user *database.User, purpose string, ttl time.Duration, path, subject, body string) {
+	token, id, err := auth.GenerateEmailToken(purpose, user.ID, user.Email, ttl, h.jwtKeys)
+	if err != nil {
+		log.Printf("Failed to create %s token for user %d: %v", purpose, user.ID, err)
+		return
+	}
+	if err := h.db.CreateEmailToken(id, user.ID, purpose, time.Now().Add(ttl)); err != nil {
+		log.Printf("Failed to store %s token for user %d: %v", purpose, user.ID, err)
+		return
+	}
+
+	link := h.cfg.PublicURL + path + "?token=" + url.QueryEscape(token)
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: subject,
+		Body:    fmt.Sprintf(body, user.Username, link),
+	}
+	if err := h.mailer.Send(context.Background(), msg); err != nil {
+		log.Printf("Failed to send %s email to user %d: %v", purpose, user.ID, err)
+	}
+}
+
+func (h *AuthHandler) sendPasswordReset(user *database.User) {
+	h.sendEmailLink(user, auth.EmailTokenPasswordReset, auth.PasswordResetTTL, "/reset-password",
+		"Reset your shebang.run password",
+		`Hi %s,
+
+Someone asked to reset the password for your shebang.run account. To choose
+a new password, open this link within the next hour:
+
+%s
+
+If you did not ask for this, ignore this email; your password stays the same.
+`)
+}
+
+func (h *AuthHandler) sendEmailVerification(user *database.User) {
+	h.sendEmailLink(user, auth.EmailTokenVerifyEmail, auth.EmailVerificationTTL, "/verify-email",
+		"Verify your shebang.run email address",
+		`Hi %s,
+
+Please confirm this is your email address by opening this link within the
+next two days:
+
+%s
+
+If you did not create a shebang.run account, ignore this email.
+`)
+}
+
+// ForgotPassword mails a reset link if an account has the address. The
+// answer is the same either way, so it cannot be used to find accounts.
+func (h *AuthHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Email) == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	// Directory accounts change their password in the directory
+	if user, err := h.db.GetUserByEmail(strings.TrimSpace(req.Email)); err == nil && user.OAuthProvider != auth.LDAPProviderName {
+		go h.sendPasswordReset(user)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "sent"})
+}
+
+// ResetPassword sets a new password from a reset link. Every session and
+// every other reset link of the account is revoked; two-factor
+// authentication still applies at the next sign-in.
+func (h *AuthHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if req.NewPassword == "" {
+		http.Error(w, "New password is required", http.StatusBadRequest)
+		return
+	}
+
+	userID, claims, err := auth.ValidateEmailToken(auth.EmailTokenPasswordReset, req.Token, h.jwtKeys)
+	if err != nil {
+		http.Error(w, "This reset link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	user, err := h.db.GetUserByID(userID)
+	if err != nil || !strings.EqualFold(user.Email, claims.Email) || user.OAuthProvider == auth.LDAPProviderName {
+		http.Error(w, "This reset link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	if err := h.db.ConsumeEmailToken(claims.ID, userID, auth.EmailTokenPasswordReset); err != nil {
+		http.Error(w, "This reset link has already been used", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := auth.HashPassword(req.NewPassword)
+	if err != nil {
+		http.Error(w, "Failed to hash password", http.StatusInternalServerError)
+		return
+	}
+	if _, err := h.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, userID); err != nil {
+		http.Error(w, "Failed to update password", http.StatusInternalServerError)
+		return
+	}
+
+	h.db.DeleteEmailTokens(userID, auth.EmailTokenPasswordReset)
+	if _, err := h.db.RevokeUserSessions(userID, 0); err != nil {
+		log.Printf("Failed to revoke sessions for user %d: %v", userID, err)
+	}
+	h.loginSucceeded(user.Username)
+	// Following the link proved the address works
+	h.db.SetEmailVerified(userID, user.Email)
+	log.Printf("User %d reset their password by email", userID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// VerifyEmail marks the address a verification link was sent to as
+// verified, as long as the account still uses it
+func (h *AuthHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID, claims, err := auth.ValidateEmailToken(auth.EmailTokenVerifyEmail, req.Token, h.jwtKeys)
+	if err != nil {
+		http.Error(w, "This verification link is invalid or has expired", http.StatusBadRequest)
+		return
+	}
+	if err := h.db.ConsumeEmailToken(claims.ID, userID, auth.EmailTokenVerifyEmail); err != nil {
+		http.Error(w, "This verification link has already been used", http.StatusBadRequest)
+		return
+	}
+	if err := h.db.SetEmailVerified(userID, claims.Email); err != nil {
+		http.Error(w, "This verification link is for an address no longer on the account", http.StatusBadRequest)
+		return
+	}
+	h.db.DeleteEmailTokens(userID, auth.EmailTokenVerifyEmail)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "verified"})
+}
+
+// GetEmailStatus returns the account's address and whether it is verified
+func (h *AuthHandler) GetEmailStatus(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.db.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	verified, err := h.db.IsEmailVerified(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to get email status", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EmailStatusResponse{Email: user.Email, Verified: verified})
+}
+
+// ResendEmailVerification mails a new verification link
+func (h *AuthHandler) ResendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.db.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	if verified, err := h.db.IsEmailVerified(user.ID); err != nil || verified {
+		if err != nil {
+			http.Error(w, "Failed to get email status", http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "Email address is already verified", http.StatusConflict)
+		return
+	}
+
+	go h.sendEmailVerification(user)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "sent"})
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"shebang.run/internal/database"
+)
+
+// fakeDB answers the queries of a test from canned replies, chosen by the
+// first rule whose fragment the query contains, and records every query.
+// Queries matching no rule fail.
+type fakeDB struct {
+	mu      sync.Mutex
+	rules   []fakeRule
+	queries []string
+	args    [][]driver.Value
+}
+
+type fakeRule struct {
+	fragment string
+	columns  []string
+	rows     [][]driver.Value
+	err      error
+}
+
+func newFakeDB(t *testing.T) (*database.DB, *fakeDB) {
+	t.Helper()
+	f := &fakeDB{}
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+	return &database.DB{DB: db}, f
+}
+
+// on answers queries containing fragment with rows of columns, or with
+// err; statements affect one row and insert ID 1
+func (f *fakeDB) on(fragment string, columns []string, rows [][]driver.Value, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, fakeRule{fragment: fragment, columns: columns, rows: rows, err: err})
+}
+
+// argsOf returns the arguments of every query containing fragment
+func (f *fakeDB) argsOf(fragment string) [][]driver.Value {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var args [][]driver.Value
+	for i, query := range f.queries {
+		if strings.Contains(query, fragment) {
+			args = append(args, f.args[i])
+		}
+	}
+	return args
+}
+
+// ran reports whether a query containing fragment was run
+func (f *fakeDB) ran(fragment string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, query := range f.queries {
+		if strings.Contains(query, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeDB) answer(query string, args []driver.Value) (fakeRule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, query)
+	f.args = append(f.args, args)
+	for _, rule := range f.rules {
+		if strings.Contains(query, rule.fragment) {
+			return rule, rule.err
+		}
+	}
+	return fakeRule{}, errors.New("fakedb: unexpected query: " + query)
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if _, err := s.db.answer(s.query, args); err != nil {
+		return nil, err
+	}
+	return fakeResult{}, nil
+}
+
+type fakeResult struct{}
+
+func (fakeResult) LastInsertId() (int64, error) { return 1, nil }
+func (fakeResult) RowsAffected() (int64, error) { return 1, nil }
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rule, err := s.db.answer(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRows{columns: rule.columns, rows: rule.rows}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
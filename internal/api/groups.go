@@ -0,0 +1,321 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"shebang.run/internal/database"
+	"shebang.run/internal/middleware"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type GroupHandler struct {
+	db *database.DB
+}
+
+func NewGroupHandler(db *database.DB) *GroupHandler {
+	return &GroupHandler{db: db}
+}
+
+type GroupRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+type GroupMembersRequest struct {
+	Usernames []string `json:"usernames"`
+}
+
+type GroupResponse struct {
+	ID          int64                 `json:"id"`
+	Name        string                `json:"name"`
+	Description string                `json:"description"`
+	OwnerID     int64                 `json:"owner_id"`
+	IsOwner     bool                  `json:"is_owner"`
+	Members     []GroupMemberResponse `json:"members,omitempty"`
+	CreatedAt   string                `json:"created_at"`
+	UpdatedAt   string                `json:"updated_at"`
+}
+
+type GroupMemberResponse struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	AddedAt  string `json:"added_at"`
+}
+
+func newGroupResponse(g *database.UserGroup, userID int64) GroupResponse {
+	return GroupResponse{
+		ID:          g.ID,
+		Name:        g.Name,
+		Description: g.Description,
+		OwnerID:     g.OwnerID,
+		IsOwner:     g.OwnerID == userID,
+		CreatedAt:   g.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		UpdatedAt:   g.UpdatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+}
+
+// loadGroup resolves the {id} URL parameter to a group the caller belongs to
+func (h *GroupHandler) loadGroup(w http.ResponseWriter, r *http.Request, userID int64) (*database.UserGroup, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid group ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	group, err := h.db.GetGroupByID(id)
+	if err != nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	isMember, err := h.db.IsGroupMember(group.ID, userID)
+	if err != nil || (!isMember && group.OwnerID != userID) {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return nil, false
+	}
+
+	return group, true
+}
+
+func (h *GroupHandler) List(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	groups, err := h.db.GetGroupsForUser(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to fetch groups", http.StatusInternalServerError)
+		return
+	}
+
+	var response []GroupResponse
+	for _, g := range groups {
+		response = append(response, newGroupResponse(g, claims.UserID))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *GroupHandler) Create(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req GroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	group, err := h.db.CreateGroup(claims.UserID, req.Name, req.Description)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate") {
+			http.Error(w, "You already have a group with this name", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to create group", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newGroupResponse(group, claims.UserID))
+}
+
+func (h *GroupHandler) Get(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	group, ok := h.loadGroup(w, r, claims.UserID)
+	if !ok {
+		return
+	}
+
+	members, err := h.db.GetGroupMembers(group.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return
+	}
+
+	response := newGroupResponse(group, claims.UserID)
+	for _, m := range members {
+		response.Members = append(response.Members, GroupMemberResponse{
+			UserID:   m.UserID,
+			Username: m.Username,
+			AddedAt:  m.AddedAt.Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *GroupHandler) Update(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	group, ok := h.loadGroup(w, r, claims.UserID)
+	if !ok {
+		return
+	}
+	if group.OwnerID != claims.UserID {
+		http.Error(w, "Only the group owner can modify it", http.StatusForbidden)
+		return
+	}
+
+	var req GroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = group.Name
+	}
+	description := group.Description
+	if req.Description != "" {
+		description = req.Description
+	}
+
+	if err := h.db.UpdateGroup(group.ID, name, description); err != nil {
+		if strings.Contains(err.Error(), "Duplicate") {
+			http.Error(w, "You already have a group with this name", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to update group", http.StatusInternalServerError)
+		return
+	}
+
+	group, err := h.db.GetGroupByID(group.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch group", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newGroupResponse(group, claims.UserID))
+}
+
+func (h *GroupHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid group ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.DeleteGroup(id, claims.UserID); err != nil {
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *GroupHandler) AddMembers(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	group, ok := h.loadGroup(w, r, claims.UserID)
+	if !ok {
+		return
+	}
+	if group.OwnerID != claims.UserID {
+		http.Error(w, "Only the group owner can add members", http.StatusForbidden)
+		return
+	}
+
+	var req GroupMembersRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	added := []string{}
+	notFound := []string{}
+	for _, username := range req.Usernames {
+		user, err := h.db.GetUserByUsername(username)
+		if err != nil {
+			notFound = append(notFound, username)
+			continue
+		}
+		if err := h.db.AddGroupMember(group.ID, user.ID, claims.UserID); err != nil {
+			http.Error(w, "Failed to add member", http.StatusInternalServerError)
+			return
+		}
+		added = append(added, user.Username)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"added":     added,
+		"not_found": notFound,
+	})
+}
+
+// RemoveMember removes a member; the owner can remove anyone but themselves,
+// and any member can remove themselves to leave the group
+func (h *GroupHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	group, ok := h.loadGroup(w, r, claims.UserID)
+	if !ok {
+		return
+	}
+
+	user, err := h.db.GetUserByUsername(chi.URLParam(r, "username"))
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	if user.ID == group.OwnerID {
+		http.Error(w, "The group owner cannot be removed", http.StatusBadRequest)
+		return
+	}
+	if group.OwnerID != claims.UserID && user.ID != claims.UserID {
+		http.Error(w, "Only the group owner can remove other members", http.StatusForbidden)
+		return
+	}
+
+	if err := h.db.RemoveGroupMember(group.ID, user.ID); err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
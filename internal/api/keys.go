@@ -50,7 +50,18 @@ func (h *KeyHandler) List(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	keypairs, err := h.db.GetKeyPairsByUserID(claims.UserID)
+	org, _, ok := orgFromRequest(h.db, w, r, claims.UserID, "member")
+	if !ok {
+		return
+	}
+
+	var keypairs []*database.KeyPair
+	var err error
+	if org != nil {
+		keypairs, err = h.db.GetKeyPairsByOrgID(org.ID)
+	} else {
+		keypairs, err = h.db.GetKeyPairsByUserID(claims.UserID)
+	}
 	if err != nil {
 		http.Error(w, "Failed to fetch keypairs", http.StatusInternalServerError)
 		return
@@ -77,6 +88,11 @@ func (h *KeyHandler) Generate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	org, _, ok := orgFromRequest(h.db, w, r, claims.UserID, "admin")
+	if !ok {
+		return
+	}
+
 	var req GenerateKeyRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
@@ -100,7 +116,7 @@ func (h *KeyHandler) Generate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	kp, err := h.db.CreateKeyPair(claims.UserID, req.Name, publicKeyPEM)
+	kp, err := h.createKeyPair(org, claims.UserID, req.Name, publicKeyPEM)
 	if err != nil {
 		http.Error(w, "Failed to save keypair", http.StatusInternalServerError)
 		return
@@ -124,6 +140,11 @@ func (h *KeyHandler) Import(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	org, _, ok := orgFromRequest(h.db, w, r, claims.UserID, "admin")
+	if !ok {
+		return
+	}
+
 	var req ImportKeyRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
@@ -140,7 +161,7 @@ func (h *KeyHandler) Import(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	kp, err := h.db.CreateKeyPair(claims.UserID, req.Name, req.PublicKey)
+	kp, err := h.createKeyPair(org, claims.UserID, req.Name, req.PublicKey)
 	if err != nil {
 		http.Error(w, "Failed to save keypair", http.StatusInternalServerError)
 		return
@@ -169,10 +190,29 @@ func (h *KeyHandler) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.db.DeleteKeyPair(id, claims.UserID); err != nil {
+	org, _, ok := orgFromRequest(h.db, w, r, claims.UserID, "admin")
+	if !ok {
+		return
+	}
+
+	if org != nil {
+		err = h.db.DeleteOrgKeyPair(id, org.ID)
+	} else {
+		err = h.db.DeleteKeyPair(id, claims.UserID)
+	}
+	if err != nil {
 		http.Error(w, "Failed to delete keypair", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// createKeyPair stores a public key for the organization when routed under
+// /api/orgs/{org}/keys, otherwise for the calling user
+func (h *KeyHandler) createKeyPair(org *database.Organization, userID int64, name, publicKey string) (*database.KeyPair, error) {
+	if org != nil {
+		return h.db.CreateOrgKeyPair(org.ID, name, publicKey)
+	}
+	return h.db.CreateKeyPair(userID, name, publicKey)
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"shebang.run/internal/auth"
+	"shebang.run/internal/config"
+	"shebang.run/internal/database"
+)
+
+// newLDAPDirectory sets up LDAP sign-in when LDAP_URL is set, returning the
+// group map keyed by normalized group DN. A misconfigured directory is
+// logged and left off rather than stopping the server.
+func newLDAPDirectory(cfg *config.Config) (*auth.LDAPDirectory, map[string][]int64) {
+	if cfg.LDAPURL == "" {
+		return nil, nil
+	}
+
+	directory, err := auth.NewLDAPDirectory(auth.LDAPConfig{
+		URL:                cfg.LDAPURL,
+		StartTLS:           cfg.LDAPStartTLS,
+		InsecureSkipVerify: cfg.LDAPInsecureSkipVerify,
+		CACertFile:         cfg.LDAPCACertFile,
+		BindDN:             cfg.LDAPBindDN,
+		BindPassword:       cfg.LDAPBindPassword,
+		BaseDN:             cfg.LDAPBaseDN,
+		UserFilter:         cfg.LDAPUserFilter,
+		UsernameAttribute:  cfg.LDAPUsernameAttribute,
+		EmailAttribute:     cfg.LDAPEmailAttribute,
+		IDAttribute:        cfg.LDAPIDAttribute,
+		GroupAttribute:     cfg.LDAPGroupAttribute,
+		GroupBaseDN:        cfg.LDAPGroupBaseDN,
+		GroupFilter:        cfg.LDAPGroupFilter,
+	})
+	if err != nil {
+		log.Printf("LDAP sign-in disabled: %v", err)
+		return nil, nil
+	}
+	if !directory.Encrypted() {
+		log.Printf("Warning: LDAP passwords are sent unencrypted; use ldaps:// or LDAP_STARTTLS=true")
+	}
+
+	groupMap := make(map[string][]int64)
+	for groupDN, groupIDs := range cfg.LDAPGroupMap {
+		key := auth.NormalizeDN(groupDN)
+		groupMap[key] = append(groupMap[key], groupIDs...)
+	}
+	return directory, groupMap
+}
+
+// ldapLogin checks the password against the directory and returns the
+// matching account, provisioning it on first sign-in. Mapped group
+// memberships are synced from the directory on every sign-in. On failure
+// the response has been written.
+func (h *AuthHandler) ldapLogin(w http.ResponseWriter, r *http.Request, username, password string) (*database.User, bool) {
+	ldapUser, err := h.ldap.Authenticate(username, password)
+	if err != nil {
+		if errors.Is(err, auth.ErrLDAPInvalidCredentials) {
+			var userID *int64
+			if user, err := h.db.GetUserByUsername(username); err == nil {
+				userID = &user.ID
+			}
+			h.loginFailed(r, username, userID)
+			http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+			return nil, false
+		}
+		log.Printf("LDAP sign-in for %q failed: %v", username, err)
+		http.Error(w, "Directory unavailable, try again later", http.StatusServiceUnavailable)
+		return nil, false
+	}
+
+	user, err := h.db.GetUserByOAuth(auth.LDAPProviderName, ldapUser.ID)
+	if err != nil {
+		var ok bool
+		if user, ok = h.provisionLDAPUser(w, ldapUser); !ok {
+			return nil, false
+		}
+	}
+	return user, h.syncLDAPGroups(w, user, ldapUser)
+}
+
+// provisionLDAPUser creates the account of a directory user signing in for
+// the first time. Existing local accounts with the same username or email
+// are never taken over.
+func (h *AuthHandler) provisionLDAPUser(w http.ResponseWriter, ldapUser *auth.LDAPUser) (*database.User, bool) {
+	if ldapUser.Email == "" {
+		http.Error(w, "Your directory entry has no email address; ask an administrator to add one", http.StatusForbidden)
+		return nil, false
+	}
+	if _, err := h.db.GetOrgByName(ldapUser.Username); err == nil {
+		http.Error(w, "Username or email already exists", http.StatusConflict)
+		return nil, false
+	}
+
+	isFirst, err := h.db.IsFirstUser()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return nil, false
+	}
+	user, err := h.db.CreateUser(ldapUser.Username, ldapUser.Email, "", auth.LDAPProviderName, ldapUser.ID, isFirst)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate") {
+			log.Printf("LDAP user %s conflicts with an existing account", ldapUser.DN)
+			http.Error(w, "Username or email already exists", http.StatusConflict)
+			return nil, false
+		}
+		http.Error(w, "Failed to create user", http.StatusInternalServerError)
+		return nil, false
+	}
+	// The directory vouches for the address
+	h.db.SetEmailVerified(user.ID, user.Email)
+	log.Printf("Provisioned user %d from LDAP entry %s", user.ID, ldapUser.DN)
+	return user, true
+}
+
+// syncLDAPGroups applies the group map. Failing closed keeps a user from
+// signing in with memberships the directory has revoked.
+func (h *AuthHandler) syncLDAPGroups(w http.ResponseWriter, user *database.User, ldapUser *auth.LDAPUser) bool {
+	groupMap := h.groupMaps[auth.LDAPProviderName]
+	if len(groupMap) == 0 {
+		return true
+	}
+	if err := h.syncMappedGroups(user.ID, groupMap, ldapUser.Groups); err != nil {
+		log.Printf("Failed to sync LDAP groups for user %d: %v", user.ID, err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package api
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"shebang.run/internal/auth"
+	"shebang.run/internal/auth/ldaptest"
+	"shebang.run/internal/config"
+)
+
+const (
+	devsGroupDN = "cn=devs,ou=groups,dc=example,dc=org"
+	opsGroupDN  = "cn=ops,ou=groups,dc=example,dc=org"
+)
+
+var (
+	userColumns = []string{"id", "username", "email", "password_hash", "oauth_provider", "oauth_id", "is_admin", "rate_limit", "created_at"}
+	orgColumns  = []string{"id", "name", "display_name", "tier_id", "created_by", "created_at", "updated_at"}
+)
+
+func adaRow() []driver.Value {
+	return []driver.Value{int64(1), "ada", "ada@example.org", "", auth.LDAPProviderName, "ada-uuid", false, nil, time.Now()}
+}
+
+// newLDAPTestHandler returns a handler signing in against an in-process
+// directory with ada, who has an email address and is in devs, and bob, who
+// has none. Groups devs and ops map to groups 7 and 8.
+func newLDAPTestHandler(t *testing.T) (*AuthHandler, *fakeDB, *ldaptest.Server) {
+	t.Helper()
+	server := ldaptest.NewServer()
+	t.Cleanup(server.Close)
+	server.AddEntry(ldaptest.Entry{DN: "uid=ada,ou=people,dc=example,dc=org", Attributes: map[string][]string{
+		"uid":       {"ada"},
+		"mail":      {"ada@example.org"},
+		"entryUUID": {"ada-uuid"},
+		"memberOf":  {devsGroupDN},
+	}}, "ada-password")
+	server.AddEntry(ldaptest.Entry{DN: "uid=bob,ou=people,dc=example,dc=org", Attributes: map[string][]string{
+		"uid":       {"bob"},
+		"entryUUID": {"bob-uuid"},
+	}}, "bob-password")
+
+	directory, err := auth.NewLDAPDirectory(auth.LDAPConfig{
+		URL:               server.URL,
+		BaseDN:            "ou=people,dc=example,dc=org",
+		UserFilter:        "(uid={username})",
+		UsernameAttribute: "uid",
+		EmailAttribute:    "mail",
+		IDAttribute:       "entryUUID",
+		GroupAttribute:    "memberOf",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, fake := newFakeDB(t)
+	h := &AuthHandler{
+		db:   db,
+		cfg:  &config.Config{},
+		ldap: directory,
+		groupMaps: map[string]map[string][]int64{
+			auth.LDAPProviderName: {devsGroupDN: {7}, opsGroupDN: {8}},
+		},
+	}
+	return h, fake, server
+}
+
+func ldapLogin(h *AuthHandler, username, password string) (*httptest.ResponseRecorder, bool) {
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/auth/login", nil)
+	_, ok := h.ldapLogin(rec, r, username, password)
+	return rec, ok
+}
+
+func TestLDAPLoginProvisionsUser(t *testing.T) {
+	h, fake, _ := newLDAPTestHandler(t)
+	fake.on("WHERE oauth_provider = ?", userColumns, nil, nil)
+	fake.on("FROM organizations WHERE name = ?", orgColumns, nil, nil)
+	fake.on("SELECT COUNT(*) FROM users", []string{"count"}, [][]driver.Value{{int64(2)}}, nil)
+	fake.on("INSERT INTO users", nil, nil, nil)
+	fake.on("FROM users WHERE id = ?", userColumns, [][]driver.Value{adaRow()}, nil)
+	fake.on("SET email_verified_at", nil, nil, nil)
+	fake.on("INSERT IGNORE INTO group_members", nil, nil, nil)
+	fake.on("DELETE gm FROM group_members", nil, nil, nil)
+
+	rec, ok := ldapLogin(h, "ada", "ada-password")
+	if !ok {
+		t.Fatalf("sign-in failed: %d %s", rec.Code, rec.Body)
+	}
+	for _, query := range []string{"INSERT INTO users", "SET email_verified_at", "INSERT IGNORE INTO group_members", "DELETE gm FROM group_members"} {
+		if !fake.ran(query) {
+			t.Errorf("no %q query", query)
+		}
+	}
+}
+
+func TestLDAPLoginRefusesConflicts(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		setup    func(*fakeDB)
+		status   int
+	}{
+		{
+			name:     "organization name",
+			username: "ada", password: "ada-password",
+			setup: func(fake *fakeDB) {
+				fake.on("FROM organizations WHERE name = ?", orgColumns, [][]driver.Value{{int64(3), "ada", "Ada Inc", int64(1), nil, time.Now(), time.Now()}}, nil)
+			},
+			status: http.StatusConflict,
+		},
+		{
+			name:     "existing username or email",
+			username: "ada", password: "ada-password",
+			setup: func(fake *fakeDB) {
+				fake.on("FROM organizations WHERE name = ?", orgColumns, nil, nil)
+				fake.on("SELECT COUNT(*) FROM users", []string{"count"}, [][]driver.Value{{int64(2)}}, nil)
+				fake.on("INSERT INTO users", nil, nil, errors.New("Error 1062 (23000): Duplicate entry 'ada@example.org' for key 'email'"))
+			},
+			status: http.StatusConflict,
+		},
+		{
+			name:     "no email address",
+			username: "bob", password: "bob-password",
+			setup:  func(*fakeDB) {},
+			status: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		h, fake, _ := newLDAPTestHandler(t)
+		fake.on("WHERE oauth_provider = ?", userColumns, nil, nil)
+		tt.setup(fake)
+
+		rec, ok := ldapLogin(h, tt.username, tt.password)
+		if ok || rec.Code != tt.status {
+			t.Errorf("%s: sign-in = %v with %d, want refused with %d", tt.name, ok, rec.Code, tt.status)
+		}
+		if fake.ran("SET email_verified_at") || fake.ran("group_members") {
+			t.Errorf("%s: the refused account was set up", tt.name)
+		}
+	}
+}
+
+func TestLDAPLoginGroupSyncFailsClosed(t *testing.T) {
+	h, fake, _ := newLDAPTestHandler(t)
+	fake.on("WHERE oauth_provider = ?", userColumns, [][]driver.Value{adaRow()}, nil)
+	fake.on("INSERT IGNORE INTO group_members", nil, nil, errors.New("connection lost"))
+
+	rec, ok := ldapLogin(h, "ada", "ada-password")
+	if ok || rec.Code != http.StatusInternalServerError {
+		t.Errorf("sign-in = %v with %d, want refused with 500 when groups cannot be synced", ok, rec.Code)
+	}
+}
+
+func TestLDAPLoginDirectoryErrors(t *testing.T) {
+	h, fake, server := newLDAPTestHandler(t)
+	// Failures are counted toward lockouts; the fake fails those queries,
+	// which only get logged
+	rec, ok := ldapLogin(h, "ada", "wrong")
+	if ok || rec.Code != http.StatusUnauthorized {
+		t.Errorf("sign-in with a wrong password = %v with %d, want 401", ok, rec.Code)
+	}
+	if fake.ran("INSERT INTO users") {
+		t.Error("provisioned a user whose password the directory rejected")
+	}
+
+	server.Close()
+	rec, ok = ldapLogin(h, "ada", "ada-password")
+	if ok || rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("sign-in without a directory = %v with %d, want 503", ok, rec.Code)
+	}
+}
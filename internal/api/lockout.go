@@ -0,0 +1,114 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"shebang.run/internal/database"
+	"shebang.run/internal/middleware"
+)
+
+// Failure counters start over after a day without failures
+const loginFailureWindow = 24 * time.Hour
+
+// loginIP is the address sign-in failures are charged to: the connection's,
+// or behind a trusted proxy the client's, see middleware.ClientIP. Clients
+// cannot dodge the per-IP lockout by sending their own X-Real-IP.
+func loginIP(r *http.Request) string {
+	return middleware.ClientIP(r)
+}
+
+// Accounts are counted by the username tried, whether or not it exists, so
+// lockouts do not reveal which accounts exist
+func loginAccountKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// lockoutDuration is the lock earned by a number of consecutive failures:
+// none below the threshold, then doubling from the base up to the maximum
+func (h *AuthHandler) lockoutDuration(failures, threshold int) time.Duration {
+	if threshold <= 0 || failures < threshold {
+		return 0
+	}
+	base := time.Duration(h.cfg.LoginLockoutSeconds) * time.Second
+	max := time.Duration(h.cfg.LoginLockoutMaxSeconds) * time.Second
+	shift := failures - threshold
+	if shift > 30 || base<<shift > max {
+		return max
+	}
+	return base << shift
+}
+
+// loginLocked answers 429 with Retry-After when the account or the client's
+// IP is locked. It runs before the password is checked, so a locked account
+// cannot be guessed at even with the right password.
+func (h *AuthHandler) loginLocked(w http.ResponseWriter, r *http.Request, username string) bool {
+	var until time.Time
+	for _, key := range [][2]string{
+		{database.LoginKindAccount, loginAccountKey(username)},
+		{database.LoginKindIP, loginIP(r)},
+	} {
+		f, err := h.db.GetLoginFailure(key[0], key[1])
+		if err == nil && f.LockedUntil != nil && f.LockedUntil.After(until) {
+			until = *f.LockedUntil
+		}
+	}
+
+	wait := time.Until(until)
+	if wait <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+	http.Error(w, "Too many failed sign-in attempts. Try again later.", http.StatusTooManyRequests)
+	return true
+}
+
+// loginFailed counts a failed password or second-factor attempt against the
+// account and the client's IP, locking either once it reaches its threshold
+func (h *AuthHandler) loginFailed(r *http.Request, username string, userID *int64) {
+	ip := loginIP(r)
+	now := time.Now()
+
+	for _, c := range []struct {
+		kind, key, event string
+		threshold        int
+	}{
+		{database.LoginKindAccount, loginAccountKey(username), database.AuditAccountLocked, h.cfg.LoginLockoutThreshold},
+		{database.LoginKindIP, ip, database.AuditIPLocked, h.cfg.LoginIPLockoutThreshold},
+	} {
+		failures, err := h.db.RecordLoginFailure(c.kind, c.key, now, loginFailureWindow)
+		if err != nil {
+			log.Printf("Failed to record login failure for %s %s: %v", c.kind, c.key, err)
+			continue
+		}
+		lock := h.lockoutDuration(failures, c.threshold)
+		if lock == 0 {
+			continue
+		}
+		if err := h.db.LockLogin(c.kind, c.key, now.Add(lock)); err != nil {
+			log.Printf("Failed to lock %s %s: %v", c.kind, c.key, err)
+			continue
+		}
+
+		// Only the account lock belongs to a user; an IP lock may cover many
+		var auditUserID *int64
+		if c.kind == database.LoginKindAccount {
+			auditUserID = userID
+		}
+		detail := fmt.Sprintf("%d failed attempts, locked for %s", failures, lock)
+		if err := h.db.CreateAuthAuditEntry(c.event, auditUserID, c.key, ip, detail); err != nil {
+			log.Printf("Failed to audit lockout of %s %s: %v", c.kind, c.key, err)
+		}
+		log.Printf("Sign-in locked for %s %s from %s: %s", c.kind, c.key, ip, detail)
+	}
+}
+
+// loginSucceeded resets the account's counter. The IP's is left to expire,
+// or one valid account would let an attacker clear their IP's failures.
+func (h *AuthHandler) loginSucceeded(username string) {
+	h.db.ClearLoginFailures(database.LoginKindAccount, loginAccountKey(username))
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"shebang.run/internal/config"
+	"shebang.run/internal/database"
+	"shebang.run/internal/middleware"
+)
+
+// ipFailureKeys returns the keys per-IP sign-in failures were charged to
+func ipFailureKeys(fake *fakeDB) []string {
+	var keys []string
+	for _, args := range fake.argsOf("INSERT INTO login_failures") {
+		if args[0] == database.LoginKindIP {
+			keys = append(keys, args[1].(string))
+		}
+	}
+	return keys
+}
+
+func TestLoginFailuresIgnoreSpoofedClientIP(t *testing.T) {
+	if err := middleware.SetTrustedProxies([]string{"10.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer middleware.SetTrustedProxies(nil)
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       func(i int) string
+	}{
+		{"direct client", "203.0.113.5:40000", func(int) string { return "203.0.113.5" }},
+		{"trusted proxy", "10.0.0.1:40000", func(i int) string { return fmt.Sprintf("198.51.100.%d", i) }},
+	}
+	for _, tt := range tests {
+		db, fake := newFakeDB(t)
+		fake.on("INSERT INTO login_failures", nil, nil, nil)
+		fake.on("SELECT failures FROM login_failures", []string{"failures"}, [][]driver.Value{{int64(1)}}, nil)
+		h := &AuthHandler{db: db, cfg: &config.Config{LoginLockoutThreshold: 5, LoginIPLockoutThreshold: 5}}
+
+		for i := 0; i < 5; i++ {
+			r := httptest.NewRequest("POST", "/api/auth/login", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header.Set("X-Real-IP", fmt.Sprintf("198.51.100.%d", i))
+			h.loginFailed(r, "ada", nil)
+		}
+
+		keys := ipFailureKeys(fake)
+		if len(keys) != 5 {
+			t.Fatalf("%s: %d per-IP failures recorded, want 5", tt.name, len(keys))
+		}
+		for i, key := range keys {
+			if key != tt.want(i) {
+				t.Errorf("%s: failure %d charged to %s, want %s", tt.name, i+1, key, tt.want(i))
+			}
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"shebang.run/internal/auth"
+	"shebang.run/internal/database"
+	"shebang.run/internal/middleware"
+)
+
+const (
+	totpIssuer        = "shebang.run"
+	recoveryCodeCount = 10
+)
+
+type MFAStatusResponse struct {
+	// Enabled is set when the account has any second factor
+	Enabled                bool `json:"enabled"`
+	TOTPEnabled            bool `json:"totp_enabled"`
+	Pending                bool `json:"pending"`
+	Passkeys               int  `json:"passkeys"`
+	Required               bool `json:"required"`
+	RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+}
+
+type MFAEnrollmentResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type MFACodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	// Second factors the user can answer with: totp, webauthn, recovery_code
+	Methods []string `json:"methods"`
+}
+
+type LoginMFARequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// checkSecondFactor accepts either a TOTP code or an unused recovery code,
+// consuming whichever was used
+func checkSecondFactor(db *database.DB, userID int64, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		return db.UseRecoveryCode(userID, auth.HashToken(auth.NormalizeRecoveryCode(recoveryCode)))
+	}
+
+	mfa, err := db.GetUserMFA(userID)
+	if err != nil || mfa.EnabledAt == nil {
+		return false, nil
+	}
+	step, ok := auth.ValidateTOTP(mfa.TOTPSecret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	return db.UseTOTPStep(userID, step)
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := auth.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashToken(code)
+	}
+	return codes, hashes, nil
+}
+
+// mfaSession returns the caller's claims if they come from a login session;
+// API tokens cannot change the account's second factor
+func mfaSession(w http.ResponseWriter, r *http.Request) (*auth.Claims, bool) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	if claims.Scopes != nil {
+		http.Error(w, "Two-factor authentication can only be managed from a login session", http.StatusForbidden)
+		return nil, false
+	}
+	return claims, true
+}
+
+func (h *AccountHandler) GetMFAStatus(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.db.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	var response MFAStatusResponse
+	if mfa, err := h.db.GetUserMFA(user.ID); err == nil {
+		response.TOTPEnabled = mfa.EnabledAt != nil
+		response.Pending = mfa.EnabledAt == nil
+	}
+	if response.Passkeys, err = h.db.CountWebAuthnCredentials(user.ID); err != nil {
+		http.Error(w, "Failed to fetch MFA status", http.StatusInternalServerError)
+		return
+	}
+	response.Enabled = response.TOTPEnabled || response.Passkeys > 0
+	if response.Required, err = h.db.MFARequired(user); err != nil {
+		http.Error(w, "Failed to fetch MFA status", http.StatusInternalServerError)
+		return
+	}
+	if response.Enabled {
+		response.RecoveryCodesRemaining, _ = h.db.CountRecoveryCodes(user.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// StartMFAEnrollment generates a TOTP secret for the caller. It only takes
+// effect once a code from it is confirmed with VerifyMFAEnrollment.
+func (h *AccountHandler) StartMFAEnrollment(w http.ResponseWriter, r *http.Request) {
+	claims, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		http.Error(w, "Failed to generate secret", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.StartMFAEnrollment(claims.UserID, secret); err != nil {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MFAEnrollmentResponse{
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPProvisioningURI(totpIssuer, claims.Username, secret),
+	})
+}
+
+// VerifyMFAEnrollment enables MFA once the caller proves their authenticator
+// produces valid codes, and returns the recovery codes (shown only once)
+func (h *AccountHandler) VerifyMFAEnrollment(w http.ResponseWriter, r *http.Request) {
+	claims, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	mfa, err := h.db.GetUserMFA(claims.UserID)
+	if err != nil || mfa.EnabledAt != nil {
+		http.Error(w, "No pending enrollment", http.StatusBadRequest)
+		return
+	}
+
+	step, valid := auth.ValidateTOTP(mfa.TOTPSecret, req.Code, time.Now())
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusBadRequest)
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	if err := h.db.EnableMFA(claims.UserID, step, hashes); err != nil {
+		http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes after a valid TOTP
+// code. Accounts secured only by passkeys need a session signed in with one.
+func (h *AccountHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	claims, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if totp, err := h.db.GetUserMFA(claims.UserID); err != nil || totp.EnabledAt == nil {
+		passkeys, err := h.db.CountWebAuthnCredentials(claims.UserID)
+		if err != nil {
+			http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+			return
+		}
+		if passkeys == 0 {
+			http.Error(w, "Two-factor authentication is not enabled", http.StatusNotFound)
+			return
+		}
+		if claims.AuthMethod != database.AuthMethodPasskey {
+			http.Error(w, "Sign in with a passkey to regenerate recovery codes", http.StatusForbidden)
+			return
+		}
+	} else {
+		valid, err := checkSecondFactor(h.db, claims.UserID, req.Code, "")
+		if err != nil {
+			http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+			return
+		}
+		if !valid {
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		http.Error(w, "Failed to generate recovery codes", http.StatusInternalServerError)
+		return
+	}
+	if err := h.db.ReplaceRecoveryCodes(claims.UserID, hashes); err != nil {
+		http.Error(w, "Failed to store recovery codes", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// DisableMFA turns TOTP off after a valid TOTP or recovery code, unless the
+// MFA policy requires a second factor and no passkey remains
+func (h *AccountHandler) DisableMFA(w http.ResponseWriter, r *http.Request) {
+	claims, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+
+	var req MFACodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.db.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	passkeys, err := h.db.CountWebAuthnCredentials(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch MFA status", http.StatusInternalServerError)
+		return
+	}
+	if required, err := h.db.MFARequired(user); err != nil || (required && passkeys == 0) {
+		http.Error(w, "Two-factor authentication is required for your account", http.StatusForbidden)
+		return
+	}
+
+	valid, err := checkSecondFactor(h.db, claims.UserID, req.Code, req.RecoveryCode)
+	if err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.db.DisableMFA(claims.UserID); err != nil {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// mfaChallenge answers a successful first factor for a user with MFA enabled:
+// no session yet, only a short-lived token for LoginMFA or BeginMFAPasskey
+func (h *AuthHandler) mfaChallenge(user *database.User) (*MFAChallengeResponse, error) {
+	token, err := auth.GenerateMFAToken(user.ID, h.jwtKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := []string{}
+	if totp, err := h.db.GetUserMFA(user.ID); err == nil && totp.EnabledAt != nil {
+		methods = append(methods, "totp")
+	}
+	if passkeys, err := h.db.CountWebAuthnCredentials(user.ID); err == nil && passkeys > 0 && h.webauthn != nil {
+		methods = append(methods, "webauthn")
+	}
+	methods = append(methods, "recovery_code")
+
+	return &MFAChallengeResponse{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int(auth.MFATokenTTL.Seconds()),
+		Methods:     methods,
+	}, nil
+}
+
+// LoginMFA completes a login with a TOTP or recovery code and opens the session
+func (h *AuthHandler) LoginMFA(w http.ResponseWriter, r *http.Request) {
+	var req LoginMFARequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := auth.ValidateMFAToken(req.MFAToken, h.jwtKeys)
+	if err != nil {
+		http.Error(w, "Login expired, sign in again", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	// Codes are guessed at like passwords, so they share the lockout
+	if h.loginLocked(w, r, user.Username) {
+		return
+	}
+
+	valid, err := checkSecondFactor(h.db, userID, req.Code, req.RecoveryCode)
+	if err != nil {
+		http.Error(w, "Failed to verify code", http.StatusInternalServerError)
+		return
+	}
+	if !valid {
+		h.loginFailed(r, user.Username, &user.ID)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+	if req.RecoveryCode != "" {
+		log.Printf("User %d signed in with a recovery code", userID)
+	}
+
+	response, err := h.startSession(r, user, database.AuthMethodTOTP)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
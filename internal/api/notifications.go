@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"shebang.run/internal/database"
+	"shebang.run/internal/middleware"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type NotificationHandler struct {
+	db *database.DB
+}
+
+func NewNotificationHandler(db *database.DB) *NotificationHandler {
+	return &NotificationHandler{db: db}
+}
+
+type NotificationResponse struct {
+	ID        int64  `json:"id"`
+	Type      string `json:"type"`
+	Message   string `json:"message"`
+	Link      string `json:"link,omitempty"`
+	Read      bool   `json:"read"`
+	CreatedAt string `json:"created_at"`
+}
+
+// List returns the 50 most recent notifications; ?unread=true limits the
+// list to unread ones
+func (h *NotificationHandler) List(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+	notifications, err := h.db.GetNotifications(claims.UserID, unreadOnly, 50)
+	if err != nil {
+		http.Error(w, "Failed to fetch notifications", http.StatusInternalServerError)
+		return
+	}
+
+	unread, err := h.db.CountUnreadNotifications(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to fetch notifications", http.StatusInternalServerError)
+		return
+	}
+
+	items := []NotificationResponse{}
+	for _, n := range notifications {
+		items = append(items, NotificationResponse{
+			ID:        n.ID,
+			Type:      n.Type,
+			Message:   n.Message,
+			Link:      n.Link,
+			Read:      n.ReadAt != nil,
+			CreatedAt: n.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"notifications": items,
+		"unread":        unread,
+	})
+}
+
+func (h *NotificationHandler) MarkRead(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid notification ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.MarkNotificationRead(id, claims.UserID); err != nil {
+		http.Error(w, "Failed to update notification", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *NotificationHandler) MarkAllRead(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.db.MarkAllNotificationsRead(claims.UserID); err != nil {
+		http.Error(w, "Failed to update notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
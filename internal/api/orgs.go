@@ -0,0 +1,440 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"shebang.run/internal/database"
+	"shebang.run/internal/middleware"
+
+	"github.com/go-chi/chi/v5"
+)
+
+var orgNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{2,49}$`)
+
+type OrgHandler struct {
+	db *database.DB
+}
+
+func NewOrgHandler(db *database.DB) *OrgHandler {
+	return &OrgHandler{db: db}
+}
+
+type CreateOrgRequest struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+type OrgMemberRequest struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type OrgResponse struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	TierID      int64  `json:"tier_id"`
+	Role        string `json:"role,omitempty"`
+	CreatedAt   string `json:"created_at"`
+}
+
+type OrgMemberResponse struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+	AddedAt  string `json:"added_at"`
+}
+
+func newOrgResponse(org *database.Organization, role string) OrgResponse {
+	return OrgResponse{
+		ID:          org.ID,
+		Name:        org.Name,
+		DisplayName: org.DisplayName,
+		TierID:      org.TierID,
+		Role:        role,
+		CreatedAt:   org.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+}
+
+// orgFromRequest resolves the {org} URL parameter and checks that the caller
+// holds at least minRole in it. Returns nil, "", true when the route has no
+// {org} parameter, so handlers shared with personal routes can fall through.
+func orgFromRequest(db *database.DB, w http.ResponseWriter, r *http.Request, userID int64, minRole string) (*database.Organization, string, bool) {
+	name := chi.URLParam(r, "org")
+	if name == "" {
+		return nil, "", true
+	}
+
+	org, err := db.GetOrgByName(name)
+	if err != nil {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return nil, "", false
+	}
+
+	role, err := db.GetOrgMemberRole(org.ID, userID)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return nil, "", false
+	}
+	if role == "" {
+		http.Error(w, "Organization not found", http.StatusNotFound)
+		return nil, "", false
+	}
+	if !database.OrgRoleAtLeast(role, minRole) {
+		http.Error(w, "Your organization role does not allow this", http.StatusForbidden)
+		return nil, "", false
+	}
+
+	return org, role, true
+}
+
+func (h *OrgHandler) List(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	orgs, err := h.db.GetOrgsForUser(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to fetch organizations", http.StatusInternalServerError)
+		return
+	}
+
+	var response []OrgResponse
+	for _, o := range orgs {
+		response = append(response, newOrgResponse(&o.Organization, o.Role))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *OrgHandler) Create(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req CreateOrgRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if !orgNamePattern.MatchString(req.Name) {
+		http.Error(w, "Name must be 3-50 characters of letters, digits, '-' or '_'", http.StatusBadRequest)
+		return
+	}
+	if req.DisplayName == "" {
+		req.DisplayName = req.Name
+	}
+
+	taken, err := h.db.IsNamespaceTaken(req.Name)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "Name is already taken by a user or organization", http.StatusConflict)
+		return
+	}
+
+	org, err := h.db.CreateOrg(req.Name, req.DisplayName, claims.UserID)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate") {
+			http.Error(w, "Name is already taken by a user or organization", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to create organization", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newOrgResponse(org, "owner"))
+}
+
+func (h *OrgHandler) Get(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	org, role, ok := orgFromRequest(h.db, w, r, claims.UserID, "member")
+	if !ok {
+		return
+	}
+
+	tier, err := h.db.GetOrgTier(org.ID)
+	if err != nil {
+		http.Error(w, "Failed to get tier", http.StatusInternalServerError)
+		return
+	}
+	scriptCount, _ := h.db.GetOrgScriptCount(org.ID)
+	storageUsed, _, _ := h.db.GetStorageUsage(0, &org.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"organization": newOrgResponse(org, role),
+		"tier":         tier,
+		"script_count": scriptCount,
+		"storage_used": storageUsed,
+	})
+}
+
+func (h *OrgHandler) Update(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	org, role, ok := orgFromRequest(h.db, w, r, claims.UserID, "admin")
+	if !ok {
+		return
+	}
+
+	var req CreateOrgRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.DisplayName != "" {
+		if err := h.db.UpdateOrg(org.ID, req.DisplayName); err != nil {
+			http.Error(w, "Failed to update organization", http.StatusInternalServerError)
+			return
+		}
+		org.DisplayName = req.DisplayName
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newOrgResponse(org, role))
+}
+
+func (h *OrgHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	org, _, ok := orgFromRequest(h.db, w, r, claims.UserID, "owner")
+	if !ok {
+		return
+	}
+
+	if err := h.db.DeleteOrg(org.ID); err != nil {
+		http.Error(w, "Failed to delete organization", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *OrgHandler) ListMembers(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	org, _, ok := orgFromRequest(h.db, w, r, claims.UserID, "member")
+	if !ok {
+		return
+	}
+
+	members, err := h.db.GetOrgMembers(org.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch members", http.StatusInternalServerError)
+		return
+	}
+
+	var response []OrgMemberResponse
+	for _, m := range members {
+		response = append(response, OrgMemberResponse{
+			UserID:   m.UserID,
+			Username: m.Username,
+			Role:     m.Role,
+			AddedAt:  m.AddedAt.Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// SetMember adds a member or changes a member's role. Admins manage members
+// and admins; only owners can grant or revoke the owner role.
+func (h *OrgHandler) SetMember(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	org, role, ok := orgFromRequest(h.db, w, r, claims.UserID, "admin")
+	if !ok {
+		return
+	}
+
+	var req OrgMemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if username := chi.URLParam(r, "username"); username != "" {
+		req.Username = username
+	}
+	if req.Role == "" {
+		req.Role = "member"
+	}
+	if !database.ValidOrgRole(req.Role) {
+		http.Error(w, "Role must be one of owner, admin, member", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.db.GetUserByUsername(req.Username)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	currentRole, err := h.db.GetOrgMemberRole(org.ID, user.ID)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if (req.Role == "owner" || currentRole == "owner") && role != "owner" {
+		http.Error(w, "Only owners can grant or revoke the owner role", http.StatusForbidden)
+		return
+	}
+	if currentRole == "owner" && req.Role != "owner" {
+		owners, err := h.db.CountOrgOwners(org.ID)
+		if err != nil || owners <= 1 {
+			http.Error(w, "An organization must keep at least one owner", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.db.SetOrgMember(org.ID, user.ID, req.Role, claims.UserID); err != nil {
+		http.Error(w, "Failed to set member", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(OrgMemberResponse{
+		UserID:   user.ID,
+		Username: user.Username,
+		Role:     req.Role,
+	})
+}
+
+// RemoveMember removes a member; any member may remove themselves to leave
+func (h *OrgHandler) RemoveMember(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	org, role, ok := orgFromRequest(h.db, w, r, claims.UserID, "member")
+	if !ok {
+		return
+	}
+
+	user, err := h.db.GetUserByUsername(chi.URLParam(r, "username"))
+	if err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	targetRole, err := h.db.GetOrgMemberRole(org.ID, user.ID)
+	if err != nil || targetRole == "" {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	if user.ID != claims.UserID {
+		if !database.OrgRoleAtLeast(role, "admin") {
+			http.Error(w, "Only admins can remove other members", http.StatusForbidden)
+			return
+		}
+		if targetRole == "owner" && role != "owner" {
+			http.Error(w, "Only owners can remove an owner", http.StatusForbidden)
+			return
+		}
+	}
+	if targetRole == "owner" {
+		owners, err := h.db.CountOrgOwners(org.ID)
+		if err != nil || owners <= 1 {
+			http.Error(w, "An organization must keep at least one owner", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.db.RemoveOrgMember(org.ID, user.ID); err != nil {
+		http.Error(w, "Member not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AdminListOrgs lists all organizations (admin only)
+func (h *OrgHandler) AdminListOrgs(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	offset := 0
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil {
+		limit = l
+	}
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil {
+		offset = o
+	}
+
+	orgs, err := h.db.ListOrgs(limit, offset)
+	if err != nil {
+		http.Error(w, "Failed to fetch organizations", http.StatusInternalServerError)
+		return
+	}
+
+	var response []OrgResponse
+	for _, o := range orgs {
+		response = append(response, newOrgResponse(o, ""))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// AdminSetTier changes an organization's tier (admin only)
+func (h *OrgHandler) AdminSetTier(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid organization ID", http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		TierID int64 `json:"tier_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.UpdateOrgTier(id, req.TierID); err != nil {
+		http.Error(w, "Failed to set tier", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"ok"}`))
+}
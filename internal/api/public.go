@@ -2,16 +2,22 @@ package api
 
 import (
 	"encoding/hex"
+	"errors"
 	"encoding/json"
+	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"shebang.run/internal/auth"
 	"shebang.run/internal/config"
 	"shebang.run/internal/crypto"
 	"shebang.run/internal/database"
+	"shebang.run/internal/middleware"
 	"shebang.run/internal/storage"
 
 	"github.com/go-chi/chi/v5"
@@ -21,10 +27,11 @@ type PublicHandler struct {
 	db      *database.DB
 	storage storage.Storage
 	cfg     *config.Config
+	jwtKeys *auth.KeySet
 }
 
-func NewPublicHandler(db *database.DB, storage storage.Storage, cfg *config.Config) *PublicHandler {
-	return &PublicHandler{db: db, storage: storage, cfg: cfg}
+func NewPublicHandler(db *database.DB, storage storage.Storage, cfg *config.Config, jwtKeys *auth.KeySet) *PublicHandler {
+	return &PublicHandler{db: db, storage: storage, cfg: cfg, jwtKeys: jwtKeys}
 }
 
 func (h *PublicHandler) GetScript(w http.ResponseWriter, r *http.Request) {
@@ -40,76 +47,61 @@ func (h *PublicHandler) GetScript(w http.ResponseWriter, r *http.Request) {
 		tag = parts[1]
 	}
 
-	user, err := h.db.GetUserByUsername(username)
+	script, err := findScript(h.db, username, scriptName)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	script, err := h.db.GetScriptByUserAndName(user.ID, scriptName)
-	if err != nil {
-		http.Error(w, "Script not found", http.StatusNotFound)
+	if !h.fetchAllowed(w, r, script) {
 		return
 	}
 
-	// Get current user ID if authenticated
-	var currentUserID *int64
-	if authHeader := r.Header.Get("Authorization"); authHeader != "" {
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		if claims, err := auth.ValidateToken(tokenString, h.cfg.JWTSecret); err == nil {
-			currentUserID = &claims.UserID
-		}
+	token := r.URL.Query().Get("token")
+	access, err := h.db.EvaluateScriptAccess(script, h.readerID(r, script), token)
+	if err != nil {
+		http.Error(w, "Failed to check access", http.StatusInternalServerError)
+		return
 	}
 
-	// Check ACL for unlisted scripts
-	if script.Visibility == "unlisted" {
-		canAccess, err := h.db.CanAccessScript(script.ID, currentUserID)
-		if err != nil || !canAccess {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	// Without any grant, private scripts still serve encrypted versions: the
+	// content is useless without the owner's private key
+	ciphertextOnly := false
+	if !access.Allowed {
+		if access.ShareToken != nil {
+			h.db.LogShareTokenAccess(access.ShareToken.ID, nil, access.Reason, middleware.ClientIP(r), r.UserAgent())
+		}
+		if token != "" {
+			http.Error(w, "Invalid or revoked token", http.StatusUnauthorized)
+			return
+		}
+		if script.Visibility != "private" {
+			http.Error(w, "Unauthorized. Request access with POST /api/access-requests", http.StatusUnauthorized)
 			return
 		}
+		ciphertextOnly = true
 	}
 
-	if script.Visibility == "private" {
-		token := r.URL.Query().Get("token")
-		if token == "" {
-			// Check if script is encrypted - if so, return encrypted content
-			version, err := h.db.GetLatestScriptVersion(script.ID)
-			if err != nil {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-			
-			content, err := h.db.GetScriptContent(version.ID)
-			if err != nil || content.EncryptionKeyID == nil {
-				// Not encrypted, require token
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-			// Script is encrypted, will return encrypted content below
-		} else {
-			// Validate share token
-			shareToken, err := h.db.GetShareToken(token)
-			if err != nil || shareToken.ScriptID != script.ID || shareToken.Revoked {
-				http.Error(w, "Invalid or revoked token", http.StatusUnauthorized)
+	var version *database.ScriptVersion
+	if access.Via == "token" && access.ShareToken.VersionID != nil {
+		// Pinned links always serve their version; an explicit tag must agree
+		version, err = h.db.GetScriptVersionByID(*access.ShareToken.VersionID)
+		if err == nil && strings.Contains(scriptSpec, "@") {
+			requested, rerr := h.resolveVersion(script.ID, tag)
+			if rerr != nil || requested.ID != version.ID {
+				http.Error(w, fmt.Sprintf("This link is pinned to version %d", version.Version), http.StatusForbidden)
 				return
 			}
 		}
+	} else {
+		version, err = h.resolveVersion(script.ID, tag)
 	}
 
-	var version *database.ScriptVersion
-	if strings.HasPrefix(tag, "v") {
-		versionNum, err := strconv.Atoi(tag[1:])
-		if err != nil {
+	if err != nil {
+		if err == errInvalidVersion {
 			http.Error(w, "Invalid version", http.StatusBadRequest)
 			return
 		}
-		version, err = h.db.GetScriptVersionByNumber(script.ID, versionNum)
-	} else {
-		version, err = h.db.GetVersionByTag(script.ID, tag)
-	}
-
-	if err != nil {
 		http.Error(w, "Version not found", http.StatusNotFound)
 		return
 	}
@@ -120,9 +112,30 @@ func (h *PublicHandler) GetScript(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Blobs stored gzip-compressed go to clients that accept gzip as they are
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if u := h.presignedDownload(r, access, version, content); u != nil {
+		w.Header().Set("X-Script-Version", strconv.Itoa(version.Version))
+		w.Header().Set("X-Script-Checksum", version.Checksum)
+		http.Redirect(w, r, u.String(), http.StatusFound)
+		return
+	}
+
 	var scriptData []byte
+	gzipped := false
 	if content.StoragePath != "" {
-		reader, err := h.storage.Get(r.Context(), content.StoragePath)
+		var reader io.ReadCloser
+		if gz, ok := h.storage.(storage.GzipGetter); ok && acceptsGzip(r) {
+			// Serving the blob compressed is optional, so any failure falls
+			// back to reading it decompressed
+			if reader, gzipped, err = gz.GetGzip(r.Context(), content.StoragePath); err != nil {
+				gzipped = false
+			}
+		}
+		if !gzipped {
+			reader, err = h.storage.Get(r.Context(), content.StoragePath)
+		}
 		if err != nil {
 			http.Error(w, "Failed to retrieve content", http.StatusInternalServerError)
 			return
@@ -137,6 +150,25 @@ func (h *PublicHandler) GetScript(w http.ResponseWriter, r *http.Request) {
 		scriptData = content.Content
 	}
 
+	if ciphertextOnly && content.EncryptionKeyID == nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if access.Via == "token" {
+		ok, err := h.db.ConsumeShareToken(access.ShareToken.ID)
+		if err != nil {
+			http.Error(w, "Failed to check access", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			h.db.LogShareTokenAccess(access.ShareToken.ID, &version.ID, "exhausted", middleware.ClientIP(r), r.UserAgent())
+			http.Error(w, "Invalid or revoked token", http.StatusUnauthorized)
+			return
+		}
+		h.db.LogShareTokenAccess(access.ShareToken.ID, &version.ID, "ok", middleware.ClientIP(r), r.UserAgent())
+	}
+
 	if content.EncryptionKeyID != nil {
 		// Return encrypted content with metadata
 		w.Header().Set("Content-Type", "application/octet-stream")
@@ -151,6 +183,9 @@ func (h *PublicHandler) GetScript(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("X-Wrapped-Key", wrappedKeyB64)
 		}
 		
+		if gzipped {
+			w.Header().Set("Content-Encoding", "gzip")
+		}
 		w.Write(scriptData)
 		return
 	}
@@ -158,26 +193,139 @@ func (h *PublicHandler) GetScript(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	w.Header().Set("X-Script-Version", strconv.Itoa(version.Version))
 	w.Header().Set("X-Script-Checksum", version.Checksum)
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+	}
 	w.Write(scriptData)
 }
 
+// presignedDownload returns a presigned URL to redirect the download to,
+// when enabled and the version is large and readable by anyone. Any failure
+// falls back to serving the script directly.
+func (h *PublicHandler) presignedDownload(r *http.Request, access *database.AccessDecision, version *database.ScriptVersion, content *database.ScriptContent) *url.URL {
+	if h.cfg.S3PresignThreshold <= 0 || version.Size < h.cfg.S3PresignThreshold {
+		return nil
+	}
+	if access.Via != "public" || content.EncryptionKeyID != nil || content.StoragePath == "" {
+		return nil
+	}
+	presigner, ok := h.storage.(storage.DownloadPresigner)
+	if !ok {
+		return nil
+	}
+
+	expiry := time.Duration(h.cfg.S3PresignExpirySeconds) * time.Second
+	u, ok, err := presigner.PresignDownload(r.Context(), content.StoragePath, expiry, "text/plain", acceptsGzip(r))
+	if err != nil {
+		log.Printf("Failed to presign %s: %v", content.StoragePath, err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	return u
+}
+
+var errInvalidVersion = errors.New("invalid version")
+
+// acceptsGzip reports whether the request's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		return q > 0
+	}
+	return false
+}
+
+// resolveVersion resolves a tag name or a "v<number>" version spec
+func (h *PublicHandler) resolveVersion(scriptID int64, tag string) (*database.ScriptVersion, error) {
+	if strings.HasPrefix(tag, "v") {
+		versionNum, err := strconv.Atoi(tag[1:])
+		if err != nil {
+			return nil, errInvalidVersion
+		}
+		return h.db.GetScriptVersionByNumber(scriptID, versionNum)
+	}
+	return h.db.GetVersionByTag(scriptID, tag)
+}
+
+// readerID returns the authenticated caller's user ID for access checks on
+// the script, or nil for anonymous requests. The public routes do not require
+// authentication; API tokens only count when they hold scripts:read and are
+// not restricted to other scripts, and no caller counts while the MFA policy
+// requires them to enroll.
+func (h *PublicHandler) readerID(r *http.Request, script *database.Script) *int64 {
+	if r.Header.Get("Authorization") == "" {
+		return nil
+	}
+	claims, err := middleware.Authenticate(r, h.jwtKeys, h.db)
+	if err != nil || claims.MFASetupRequired || !claims.HasScope("scripts:read") || !claims.CanUseScript(script.ID) {
+		return nil
+	}
+	return &claims.UserID
+}
+
+// fetchAllowed applies the script's per-client fetch limit, the owner's
+// setting or else the rate limit of the owner's tier, and the server's
+// per-script limit
+func (h *PublicHandler) fetchAllowed(w http.ResponseWriter, r *http.Request, script *database.Script) bool {
+	limit, tierLimit, err := h.db.GetScriptFetchRateLimit(script.ID)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return false
+	}
+	if limit == nil {
+		limit = &tierLimit
+	}
+	return middleware.AllowScriptFetch(w, r, script.ID, *limit, h.cfg.ScriptFetchRateLimit)
+}
+
+// findScript resolves a /{namespace}/{script} path; the namespace is either a
+// username or an organization name
+func findScript(db *database.DB, namespace, scriptName string) (*database.Script, error) {
+	if user, err := db.GetUserByUsername(namespace); err == nil {
+		script, err := db.GetScriptByUserAndName(user.ID, scriptName)
+		if err != nil {
+			return nil, errors.New("Script not found")
+		}
+		return script, nil
+	}
+
+	org, err := db.GetOrgByName(namespace)
+	if err != nil {
+		return nil, errors.New("User not found")
+	}
+	script, err := db.GetScriptByOrgAndName(org.ID, scriptName)
+	if err != nil {
+		return nil, errors.New("Script not found")
+	}
+	return script, nil
+}
+
 func (h *PublicHandler) GetMetadata(w http.ResponseWriter, r *http.Request) {
 	username := chi.URLParam(r, "username")
 	scriptName := chi.URLParam(r, "script")
 
-	user, err := h.db.GetUserByUsername(username)
+	script, err := findScript(h.db, username, scriptName)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	script, err := h.db.GetScriptByUserAndName(user.ID, scriptName)
-	if err != nil {
-		http.Error(w, "Script not found", http.StatusNotFound)
+	if !h.fetchAllowed(w, r, script) {
 		return
 	}
 
-	if script.Visibility != "public" {
+	access, err := h.db.EvaluateScriptAccess(script, h.readerID(r, script), r.URL.Query().Get("token"))
+	if err != nil || !access.Allowed {
 		http.Error(w, "Not available", http.StatusForbidden)
 		return
 	}
@@ -207,15 +355,19 @@ func (h *PublicHandler) VerifySignature(w http.ResponseWriter, r *http.Request)
 	username := chi.URLParam(r, "username")
 	scriptName := chi.URLParam(r, "script")
 
-	user, err := h.db.GetUserByUsername(username)
+	script, err := findScript(h.db, username, scriptName)
 	if err != nil {
-		http.Error(w, "User not found", http.StatusNotFound)
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 
-	script, err := h.db.GetScriptByUserAndName(user.ID, scriptName)
-	if err != nil {
-		http.Error(w, "Script not found", http.StatusNotFound)
+	if !h.fetchAllowed(w, r, script) {
+		return
+	}
+
+	access, err := h.db.EvaluateScriptAccess(script, h.readerID(r, script), r.URL.Query().Get("token"))
+	if err != nil || !access.Allowed {
+		http.Error(w, "Not available", http.StatusForbidden)
 		return
 	}
 
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"shebang.run/internal/database"
+	"shebang.run/internal/middleware"
+)
+
+type ScriptRateLimitResponse struct {
+	FetchRateLimit *int `json:"fetch_rate_limit"`
+	Default        int  `json:"default"`
+}
+
+type SetScriptRateLimitRequest struct {
+	FetchRateLimit *int `json:"fetch_rate_limit"`
+}
+
+// GetFetchRateLimit returns the script's per-client fetch limit a minute,
+// null when the owner's tier default applies
+func (h *ScriptHandler) GetFetchRateLimit(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	script, _, ok := h.loadScript(w, r, claims, database.ScriptPermManage)
+	if !ok {
+		return
+	}
+
+	limit, tierLimit, err := h.db.GetScriptFetchRateLimit(script.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch rate limit", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ScriptRateLimitResponse{FetchRateLimit: limit, Default: tierLimit})
+}
+
+// SetFetchRateLimit overrides the script's fetch limit, or resets it to the
+// tier default with null. Only admins may go above the tier's limit.
+func (h *ScriptHandler) SetFetchRateLimit(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	script, _, ok := h.loadScript(w, r, claims, database.ScriptPermManage)
+	if !ok {
+		return
+	}
+
+	var req SetScriptRateLimitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	_, tierLimit, err := h.db.GetScriptFetchRateLimit(script.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch rate limit", http.StatusInternalServerError)
+		return
+	}
+	if req.FetchRateLimit != nil {
+		if *req.FetchRateLimit < 1 {
+			http.Error(w, "Rate limit must be at least 1", http.StatusBadRequest)
+			return
+		}
+		if *req.FetchRateLimit > tierLimit && !claims.IsAdmin {
+			http.Error(w, "Rate limit exceeds your tier's limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.db.SetScriptFetchRateLimit(script.ID, req.FetchRateLimit); err != nil {
+		http.Error(w, "Failed to update rate limit", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ScriptRateLimitResponse{FetchRateLimit: req.FetchRateLimit, Default: tierLimit})
+}
@@ -11,6 +11,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"time"
 
 	"shebang.run/internal/config"
 	"shebang.run/internal/crypto"
@@ -46,6 +47,8 @@ type UpdateScriptRequest struct {
 	Content     string      `json:"content"`
 	KeyPairID   interface{} `json:"keypair_id"` // Can be null, int, or string
 	Tag         string      `json:"tag"`
+	// Answer 409 instead of succeeding when nothing would change
+	RejectUnchanged bool `json:"reject_unchanged"`
 }
 
 type ScriptResponse struct {
@@ -67,7 +70,18 @@ func (h *ScriptHandler) List(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	scripts, err := h.db.GetScriptsByUserID(claims.UserID)
+	org, _, ok := orgFromRequest(h.db, w, r, claims.UserID, "member")
+	if !ok {
+		return
+	}
+
+	var scripts []*database.Script
+	var err error
+	if org != nil {
+		scripts, err = h.db.GetScriptsByOrgID(org.ID)
+	} else {
+		scripts, err = h.db.GetScriptsByUserID(claims.UserID)
+	}
 	if err != nil {
 		http.Error(w, "Failed to fetch scripts", http.StatusInternalServerError)
 		return
@@ -75,6 +89,9 @@ func (h *ScriptHandler) List(w http.ResponseWriter, r *http.Request) {
 
 	var response []ScriptResponse
 	for _, s := range scripts {
+		if !claims.CanUseScript(s.ID) {
+			continue
+		}
 		version, _ := h.db.GetLatestScriptVersion(s.ID)
 		versionNum := 0
 		var encrypted bool
@@ -121,7 +138,7 @@ func (h *ScriptHandler) Get(w http.ResponseWriter, r *http.Request) {
 	}
 
 	script, err := h.db.GetScriptByID(id)
-	if err != nil || script.UserID != claims.UserID {
+	if err != nil || !h.hasPermission(script, claims, database.ScriptPermRead) {
 		http.Error(w, "Script not found", http.StatusNotFound)
 		return
 	}
@@ -176,37 +193,77 @@ func (h *ScriptHandler) Create(w http.ResponseWriter, r *http.Request) {
 		req.Visibility = "private"
 	}
 
-	// Check tier permissions (admins bypass)
-	if !claims.IsAdmin {
-		if !middleware.CheckFeature(r.Context(), req.Visibility) {
-			http.Error(w, fmt.Sprintf("Your tier does not support %s scripts", req.Visibility), http.StatusForbidden)
-			return
-		}
+	if len(claims.ScriptIDs) > 0 {
+		http.Error(w, "This token is restricted to specific scripts", http.StatusForbidden)
+		return
 	}
 
-	count, err := h.db.GetScriptCount(claims.UserID)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+	if !h.checkCanPublish(w, claims, req.Visibility) {
 		return
 	}
 
-	maxScripts, maxSize, err := h.db.GetUserLimits(claims.UserID, h.cfg.DefaultMaxScripts, h.cfg.DefaultMaxScriptSize)
-	if err != nil {
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+	org, _, ok := orgFromRequest(h.db, w, r, claims.UserID, "member")
+	if !ok {
 		return
 	}
 
+	var count, maxScripts int
+	var orgID *int64
+	var err error
+	if org != nil {
+		// Organization scripts are limited by the organization's tier
+		tier, err := h.db.GetOrgTier(org.ID)
+		if err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		if !claims.IsAdmin && !tier.Features[req.Visibility] {
+			http.Error(w, fmt.Sprintf("The organization's tier does not support %s scripts", req.Visibility), http.StatusForbidden)
+			return
+		}
+		count, err = h.db.GetOrgScriptCount(org.ID)
+		if err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		maxScripts, orgID = tier.MaxScripts, &org.ID
+	} else {
+		// Check tier permissions (admins bypass)
+		if !claims.IsAdmin {
+			if !middleware.CheckFeature(r.Context(), req.Visibility) {
+				http.Error(w, fmt.Sprintf("Your tier does not support %s scripts", req.Visibility), http.StatusForbidden)
+				return
+			}
+		}
+
+		count, err = h.db.GetScriptCount(claims.UserID)
+		if err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+
+		maxScripts, _, err = h.db.GetUserLimits(claims.UserID, h.cfg.DefaultMaxScripts, h.cfg.DefaultMaxScriptSize)
+		if err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	if count >= maxScripts {
 		http.Error(w, fmt.Sprintf("Script limit reached (%d)", maxScripts), http.StatusForbidden)
 		return
 	}
 
-	if int64(len(req.Content)) > maxSize {
-		http.Error(w, fmt.Sprintf("Script too large (max %d bytes)", maxSize), http.StatusRequestEntityTooLarge)
+	if !h.checkStorage(w, claims.UserID, orgID, int64(len(req.Content))) {
 		return
 	}
 
-	script, err := h.db.CreateScript(claims.UserID, req.Name, req.Description, req.Visibility)
+	var script *database.Script
+	if org != nil {
+		script, err = h.db.CreateOrgScript(org.ID, claims.UserID, req.Name, req.Description, req.Visibility)
+	} else {
+		script, err = h.db.CreateScript(claims.UserID, req.Name, req.Description, req.Visibility)
+	}
 	if err != nil {
 		http.Error(w, "Failed to create script", http.StatusInternalServerError)
 		return
@@ -251,6 +308,64 @@ func (h *ScriptHandler) Create(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// checkStorage enforces the size limit of a single script and the storage
+// quota of the account a new version of size bytes counts against: the
+// organization's with orgID, otherwise the user's. The size limit is the
+// user's override, or else DEFAULT_MAX_SCRIPT_SIZE; the quota is the
+// account tier's storage. On failure the response has been written.
+func (h *ScriptHandler) checkStorage(w http.ResponseWriter, userID int64, orgID *int64, size int64) bool {
+	maxSize := h.cfg.DefaultMaxScriptSize
+	if orgID == nil {
+		var err error
+		if _, maxSize, err = h.db.GetUserLimits(userID, h.cfg.DefaultMaxScripts, h.cfg.DefaultMaxScriptSize); err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return false
+		}
+	}
+	if size > maxSize {
+		http.Error(w, fmt.Sprintf("Script too large (max %d bytes)", maxSize), http.StatusRequestEntityTooLarge)
+		return false
+	}
+
+	used, quota, err := h.db.GetStorageUsage(userID, orgID)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return false
+	}
+	if used+size > quota {
+		http.Error(w, fmt.Sprintf("Storage quota exceeded: %d of %d bytes used and this version needs %d; delete old scripts or upgrade your plan", used, quota, size), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+// permission returns the caller's permission on the script, treating lookup
+// failures and scripts outside an API token's restriction as no access
+func (h *ScriptHandler) permission(script *database.Script, claims *auth.Claims) database.ScriptPermission {
+	if !claims.CanUseScript(script.ID) {
+		return database.ScriptPermNone
+	}
+	perm, err := h.db.GetScriptPermission(script, claims.UserID)
+	if err != nil {
+		return database.ScriptPermNone
+	}
+	return perm
+}
+
+// hasPermission reports whether the caller holds at least min on the script
+func (h *ScriptHandler) hasPermission(script *database.Script, claims *auth.Claims, min database.ScriptPermission) bool {
+	return h.permission(script, claims) >= min
+}
+
+// keyPairBelongsTo reports whether a keypair may encrypt the script: personal
+// scripts use their owner's keys and organization scripts the organization's
+func keyPairBelongsTo(kp *database.KeyPair, script *database.Script) bool {
+	if script.OrgID != nil {
+		return kp.OrgID != nil && *kp.OrgID == *script.OrgID
+	}
+	return kp.OrgID == nil && kp.UserID == script.UserID
+}
+
 func (h *ScriptHandler) createVersion(script *database.Script, content []byte, keyPairID *int64, userID int64) error {
 	latestVersion, _ := h.db.GetLatestScriptVersion(script.ID)
 	newVersion := 1
@@ -269,7 +384,7 @@ func (h *ScriptHandler) createVersion(script *database.Script, content []byte, k
 
 	if script.Visibility == "private" && keyPairID != nil {
 		kp, err := h.db.GetKeyPairByID(*keyPairID)
-		if err != nil || kp.UserID != userID {
+		if err != nil || !keyPairBelongsTo(kp, script) {
 			return fmt.Errorf("invalid keypair")
 		}
 
@@ -305,20 +420,24 @@ func (h *ScriptHandler) createVersion(script *database.Script, content []byte, k
 		storedContent = content
 	}
 
-	version, err := h.db.CreateScriptVersion(script.ID, newVersion, contentHash, signature, checksum, int64(len(content)))
+	version, err := h.db.CreateScriptVersion(script.ID, newVersion, contentHash, signature, checksum, int64(len(content)), userID)
 	if err != nil {
 		return err
 	}
 
-	storagePath := fmt.Sprintf("%d/%d/%d", userID, script.ID, version.ID)
-	ctx := context.Background()
-	if err := h.storage.Put(ctx, storagePath, bytes.NewReader(storedContent), int64(len(storedContent))); err != nil {
+	storagePath, err := h.storeBlob(context.Background(), storedContent)
+	if err != nil {
 		return err
 	}
 
 	if err := h.db.SaveScriptContent(version.ID, nil, storagePath, encKeyID, wrappedKey); err != nil {
+		h.releaseBlob(storagePath)
 		return err
 	}
+	// Only versions whose content was saved count against the quota
+	if err := h.db.AddStorageUsed(script, int64(len(content))); err != nil {
+		log.Printf("Failed to record storage used by script %d: %v", script.ID, err)
+	}
 
 	if err := h.db.CreateTag(script.ID, "latest", version.ID); err != nil {
 		return err
@@ -327,6 +446,36 @@ func (h *ScriptHandler) createVersion(script *database.Script, content []byte, k
 	return nil
 }
 
+// storeBlob stores content under its SHA-256, so identical content, within
+// a script's history or across scripts, is stored once. The blob is
+// referenced before it is checked for, which keeps the GC from removing it
+// in between, and released again when it cannot be stored.
+func (h *ScriptHandler) storeBlob(ctx context.Context, content []byte) (string, error) {
+	hash := sha256.Sum256(content)
+	key := database.BlobKey(hex.EncodeToString(hash[:]))
+
+	if err := h.db.AddBlobRef(key, int64(len(content))); err != nil {
+		return "", err
+	}
+	exists, err := h.storage.Exists(ctx, key)
+	if err == nil && !exists {
+		err = h.storage.Put(ctx, key, bytes.NewReader(content), int64(len(content)))
+	}
+	if err != nil {
+		h.releaseBlob(key)
+		return "", err
+	}
+	return key, nil
+}
+
+// releaseBlob drops a reference taken by storeBlob. A failure only leaves
+// the blob to the reconcile job.
+func (h *ScriptHandler) releaseBlob(key string) {
+	if err := h.db.ReleaseBlobRef(key); err != nil {
+		log.Printf("Failed to release blob %s: %v", key, err)
+	}
+}
+
 func (h *ScriptHandler) Update(w http.ResponseWriter, r *http.Request) {
 	claims, ok := middleware.GetUserFromContext(r.Context())
 	if !ok {
@@ -342,7 +491,12 @@ func (h *ScriptHandler) Update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	script, err := h.db.GetScriptByID(id)
-	if err != nil || script.UserID != claims.UserID {
+	if err != nil {
+		http.Error(w, "Script not found", http.StatusNotFound)
+		return
+	}
+	perm := h.permission(script, claims)
+	if perm < database.ScriptPermWrite {
 		http.Error(w, "Script not found", http.StatusNotFound)
 		return
 	}
@@ -364,9 +518,51 @@ func (h *ScriptHandler) Update(w http.ResponseWriter, r *http.Request) {
 		needsMetadataUpdate = true
 	}
 	if req.Visibility != "" && req.Visibility != script.Visibility {
+		if perm < database.ScriptPermManage {
+			http.Error(w, "Only maintainers can change visibility", http.StatusForbidden)
+			return
+		}
+		if !h.checkCanPublish(w, claims, req.Visibility) {
+			return
+		}
 		vis = req.Visibility
 		needsMetadataUpdate = true
 	}
+	if req.Tag != "" && !h.canMoveTag(script, req.Tag, perm) {
+		http.Error(w, "Tag is protected", http.StatusForbidden)
+		return
+	}
+
+	// Convert keypair_id from interface{} to *int64
+	var keyPairID *int64
+	if req.KeyPairID != nil {
+		switch v := req.KeyPairID.(type) {
+		case float64:
+			id := int64(v)
+			keyPairID = &id
+		case string:
+			if v != "" && v != "null" {
+				if id, err := strconv.ParseInt(v, 10, 64); err == nil {
+					keyPairID = &id
+				}
+			}
+		case int:
+			id := int64(v)
+			keyPairID = &id
+		case int64:
+			keyPairID = &v
+		}
+	}
+
+	// Pushing the latest version's content again does not create a version
+	unchanged := req.Content != "" && h.unchangedContent(script, vis, []byte(req.Content), keyPairID)
+	if unchanged && req.RejectUnchanged && !needsMetadataUpdate {
+		http.Error(w, "No changes", http.StatusConflict)
+		return
+	}
+	if req.Content != "" && !unchanged && !h.checkStorage(w, script.UserID, script.OrgID, int64(len(req.Content))) {
+		return
+	}
 	
 	if needsMetadataUpdate {
 		if err := h.db.UpdateScript(id, desc, vis); err != nil {
@@ -378,33 +574,14 @@ func (h *ScriptHandler) Update(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if req.Content != "" {
-		// Convert keypair_id from interface{} to *int64
-		var keyPairID *int64
-		if req.KeyPairID != nil {
-			switch v := req.KeyPairID.(type) {
-			case float64:
-				id := int64(v)
-				keyPairID = &id
-			case string:
-				if v != "" && v != "null" {
-					if id, err := strconv.ParseInt(v, 10, 64); err == nil {
-						keyPairID = &id
-					}
-				}
-			case int:
-				id := int64(v)
-				keyPairID = &id
-			case int64:
-				keyPairID = &v
-			}
-		}
-		
-		if err := h.createVersion(script, []byte(req.Content), keyPairID, claims.UserID); err != nil {
+		if unchanged {
+			w.Header().Set("X-Script-Unchanged", "true")
+		} else if err := h.createVersion(script, []byte(req.Content), keyPairID, claims.UserID); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if req.Tag != "" && (req.Tag == "dev" || req.Tag == "beta") {
+		if req.Tag != "" && req.Tag != "latest" && tagNamePattern.MatchString(req.Tag) {
 			latestVersion, _ := h.db.GetLatestScriptVersion(script.ID)
 			if latestVersion != nil {
 				h.db.CreateTag(script.ID, req.Tag, latestVersion.ID)
@@ -415,6 +592,29 @@ func (h *ScriptHandler) Update(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// unchangedContent reports whether content is what the latest version
+// already holds, stored the same way: encrypted with the same keypair, or
+// in the clear when it would be stored in the clear
+func (h *ScriptHandler) unchangedContent(script *database.Script, visibility string, content []byte, keyPairID *int64) bool {
+	latest, err := h.db.GetLatestScriptVersion(script.ID)
+	if err != nil {
+		return false
+	}
+	hash := sha256.Sum256(content)
+	if hex.EncodeToString(hash[:]) != latest.ContentHash {
+		return false
+	}
+	stored, err := h.db.GetScriptContent(latest.ID)
+	if err != nil {
+		return false
+	}
+
+	if visibility != "private" || keyPairID == nil {
+		return stored.EncryptionKeyID == nil
+	}
+	return stored.EncryptionKeyID != nil && *stored.EncryptionKeyID == *keyPairID
+}
+
 func (h *ScriptHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	claims, ok := middleware.GetUserFromContext(r.Context())
 	if !ok {
@@ -429,7 +629,13 @@ func (h *ScriptHandler) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.db.DeleteScript(id, claims.UserID); err != nil {
+	script, err := h.db.GetScriptByID(id)
+	if err != nil || !h.hasPermission(script, claims, database.ScriptPermOwner) {
+		http.Error(w, "Script not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.db.DeleteScriptByID(script.ID); err != nil {
 		http.Error(w, "Failed to delete script", http.StatusInternalServerError)
 		return
 	}
@@ -452,7 +658,7 @@ func (h *ScriptHandler) GetEncryptedContent(w http.ResponseWriter, r *http.Reque
 	}
 
 	script, err := h.db.GetScriptByID(id)
-	if err != nil || script.UserID != claims.UserID {
+	if err != nil || !h.hasPermission(script, claims, database.ScriptPermRead) {
 		http.Error(w, "Script not found", http.StatusNotFound)
 		return
 	}
@@ -515,24 +721,168 @@ func (h *ScriptHandler) GenerateShareToken(w http.ResponseWriter, r *http.Reques
 	}
 
 	script, err := h.db.GetScriptByID(id)
-	if err != nil || script.UserID != claims.UserID {
+	if err != nil || !h.hasPermission(script, claims, database.ScriptPermManage) {
 		http.Error(w, "Script not found", http.StatusNotFound)
 		return
 	}
 
+	// The body is optional; an empty request creates an unrestricted link
+	var req ShareTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "expires_at must be in the future", http.StatusBadRequest)
+		return
+	}
+	if req.MaxDownloads != nil && *req.MaxDownloads < 1 {
+		http.Error(w, "max_downloads must be at least 1", http.StatusBadRequest)
+		return
+	}
+
+	var versionID *int64
+	if req.Version != nil {
+		version, err := h.db.GetScriptVersionByNumber(script.ID, *req.Version)
+		if err != nil {
+			http.Error(w, "Version not found", http.StatusNotFound)
+			return
+		}
+		versionID = &version.ID
+	}
+
 	token, err := auth.GenerateRandomToken(32)
 	if err != nil {
 		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
 		return
 	}
 
-	if err := h.db.CreateShareToken(id, token); err != nil {
+	st, err := h.db.CreateShareToken(script.ID, claims.UserID, token, req.Name, versionID, req.ExpiresAt, req.MaxDownloads)
+	if err != nil {
 		http.Error(w, "Failed to create share token", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"token": token})
+	json.NewEncoder(w).Encode(h.newShareTokenResponse(st))
+}
+
+type ShareTokenRequest struct {
+	Name         string     `json:"name"`
+	Version      *int       `json:"version"` // pin the link to this version
+	ExpiresAt    *time.Time `json:"expires_at"`
+	MaxDownloads *int       `json:"max_downloads"`
+}
+
+type ShareTokenResponse struct {
+	Token         string  `json:"token"`
+	Name          string  `json:"name,omitempty"`
+	Version       *int    `json:"version,omitempty"`
+	ExpiresAt     *string `json:"expires_at"`
+	MaxDownloads  *int    `json:"max_downloads"`
+	DownloadCount int     `json:"download_count"`
+	Status        string  `json:"status"`
+	LastUsedAt    *string `json:"last_used_at"`
+	CreatedAt     string  `json:"created_at"`
+}
+
+func (h *ScriptHandler) newShareTokenResponse(st *database.ShareToken) ShareTokenResponse {
+	resp := ShareTokenResponse{
+		Token:         st.Token,
+		Name:          st.Name,
+		MaxDownloads:  st.MaxDownloads,
+		DownloadCount: st.DownloadCount,
+		Status:        st.Status(),
+		CreatedAt:     st.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+	if st.VersionID != nil {
+		if v, err := h.db.GetScriptVersionByID(*st.VersionID); err == nil {
+			resp.Version = &v.Version
+		}
+	}
+	if st.ExpiresAt != nil {
+		t := st.ExpiresAt.Format("2006-01-02T15:04:05Z")
+		resp.ExpiresAt = &t
+	}
+	if st.LastUsedAt != nil {
+		t := st.LastUsedAt.Format("2006-01-02T15:04:05Z")
+		resp.LastUsedAt = &t
+	}
+	return resp
+}
+
+// ListShareTokens lists a script's share links with their usage
+func (h *ScriptHandler) ListShareTokens(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	script, _, ok := h.loadScript(w, r, claims, database.ScriptPermManage)
+	if !ok {
+		return
+	}
+
+	tokens, err := h.db.GetShareTokensForScript(script.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch share tokens", http.StatusInternalServerError)
+		return
+	}
+
+	response := []ShareTokenResponse{}
+	for _, st := range tokens {
+		response = append(response, h.newShareTokenResponse(st))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// GetShareTokenLog returns the most recent uses of a share link
+func (h *ScriptHandler) GetShareTokenLog(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	script, _, ok := h.loadScript(w, r, claims, database.ScriptPermManage)
+	if !ok {
+		return
+	}
+
+	st, err := h.db.GetShareToken(chi.URLParam(r, "token"))
+	if err != nil || st.ScriptID != script.ID {
+		http.Error(w, "Share token not found", http.StatusNotFound)
+		return
+	}
+
+	entries, err := h.db.GetShareTokenAccessLog(st.ID, 100)
+	if err != nil {
+		http.Error(w, "Failed to fetch access log", http.StatusInternalServerError)
+		return
+	}
+
+	var logs []map[string]interface{}
+	for _, e := range entries {
+		entry := map[string]interface{}{
+			"outcome":     e.Outcome,
+			"ip_address":  e.IPAddress,
+			"user_agent":  e.UserAgent,
+			"accessed_at": e.AccessedAt,
+		}
+		if e.VersionID != nil {
+			if v, err := h.db.GetScriptVersionByID(*e.VersionID); err == nil {
+				entry["version"] = v.Version
+			}
+		}
+		logs = append(logs, entry)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logs)
 }
 
 func (h *ScriptHandler) RevokeShareToken(w http.ResponseWriter, r *http.Request) {
@@ -542,11 +892,49 @@ func (h *ScriptHandler) RevokeShareToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid script ID", http.StatusBadRequest)
+		return
+	}
+
+	script, err := h.db.GetScriptByID(id)
+	if err != nil || !h.hasPermission(script, claims, database.ScriptPermManage) {
+		http.Error(w, "Script not found", http.StatusNotFound)
+		return
+	}
+
 	token := chi.URLParam(r, "token")
-	if err := h.db.RevokeShareToken(token, claims.UserID); err != nil {
+	if err := h.db.RevokeShareToken(token, script.ID); err != nil {
 		http.Error(w, "Failed to revoke token", http.StatusInternalServerError)
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// checkCanPublish enforces the admin setting that only users with a
+// verified email address may make scripts public (admins are exempt)
+func (h *ScriptHandler) checkCanPublish(w http.ResponseWriter, claims *auth.Claims, visibility string) bool {
+	if visibility != "public" || claims.IsAdmin {
+		return true
+	}
+	required, err := h.db.GetSetting(database.SettingPublicRequiresVerifiedEmail, "false")
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return false
+	}
+	if required != "true" {
+		return true
+	}
+	verified, err := h.db.IsEmailVerified(claims.UserID)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return false
+	}
+	if !verified {
+		http.Error(w, "Verify your email address before publishing public scripts", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -10,15 +10,16 @@ import (
 	
 	"github.com/go-chi/chi/v5"
 	"shebang.run/internal/crypto"
+	"shebang.run/internal/database"
 	"shebang.run/internal/middleware"
 )
 
 type SecretsHandler struct {
-	db          *sql.DB
+	db          *database.DB
 	udekManager *crypto.UDEKManager
 }
 
-func NewSecretsHandler(db *sql.DB, udekManager *crypto.UDEKManager) *SecretsHandler {
+func NewSecretsHandler(db *database.DB, udekManager *crypto.UDEKManager) *SecretsHandler {
 	return &SecretsHandler{
 		db:          db,
 		udekManager: udekManager,
@@ -48,10 +49,15 @@ func (h *SecretsHandler) List(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	rows, err := h.db.Query(`
+	scope, ok := h.scope(w, r, claims.UserID, "member")
+	if !ok {
+		return
+	}
+	
+	rows, err := h.db.Query(fmt.Sprintf(`
 		SELECT id, key_name, version, created_at, updated_at, last_accessed, expires_at
-		FROM secrets WHERE user_id = ? ORDER BY key_name
-	`, claims.UserID)
+		FROM secrets WHERE %s = ? ORDER BY key_name
+	`, scope.column), scope.ownerID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -65,6 +71,10 @@ func (h *SecretsHandler) List(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		// Tokens scoped to individual secrets only see those secrets
+		if !claims.HasScope("secrets:read:" + s.KeyName) {
+			continue
+		}
 		secrets = append(secrets, s)
 	}
 	
@@ -79,6 +89,11 @@ func (h *SecretsHandler) Create(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	scope, ok := h.scope(w, r, claims.UserID, "admin")
+	if !ok {
+		return
+	}
+	
 	var req CreateSecretRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -88,10 +103,14 @@ func (h *SecretsHandler) Create(w http.ResponseWriter, r *http.Request) {
 	// Check tier limits (admins bypass)
 	if !claims.IsAdmin {
 		tier, ok := middleware.GetTierFromContext(r.Context())
+		if scope.org != nil {
+			orgTier, err := h.db.GetOrgTier(scope.org.ID)
+			tier, ok = orgTier, err == nil
+		}
 		if ok {
 			// Check secret count
 			var count int
-			h.db.QueryRow("SELECT COUNT(*) FROM secrets WHERE user_id = ?", claims.UserID).Scan(&count)
+			h.db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM secrets WHERE %s = ?", scope.column), scope.ownerID).Scan(&count)
 			if count >= tier.MaxSecrets {
 				http.Error(w, fmt.Sprintf("Secret limit reached (%d). Upgrade your tier.", tier.MaxSecrets), http.StatusForbidden)
 				return
@@ -100,9 +119,9 @@ func (h *SecretsHandler) Create(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Get UDEK
-	udek, err := h.udekManager.GetOrCreateUDEK(claims.UserID)
+	udek, err := h.encryptionKey(scope)
 	if err != nil {
-		log.Printf("Error getting UDEK for user %d: %v", claims.UserID, err)
+		log.Printf("Error getting encryption key for %s %d: %v", scope.column, scope.ownerID, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -116,15 +135,16 @@ func (h *SecretsHandler) Create(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Store
+	userID, orgID := scope.owner()
 	result, err := h.db.Exec(`
-		INSERT INTO secrets (user_id, key_name, encrypted_value, expires_at)
-		VALUES (?, ?, ?, ?)
+		INSERT INTO secrets (user_id, org_id, key_name, encrypted_value, expires_at)
+		VALUES (?, ?, ?, ?, ?)
 		ON DUPLICATE KEY UPDATE 
 			encrypted_value = VALUES(encrypted_value),
 			version = version + 1,
 			updated_at = CURRENT_TIMESTAMP,
 			expires_at = VALUES(expires_at)
-	`, claims.UserID, req.KeyName, encrypted, req.ExpiresAt)
+	`, userID, orgID, req.KeyName, encrypted, req.ExpiresAt)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -149,15 +169,24 @@ func (h *SecretsHandler) GetValue(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	scope, ok := h.scope(w, r, claims.UserID, "member")
+	if !ok {
+		return
+	}
+	
 	keyName := chi.URLParam(r, "name")
+	if !claims.HasScope("secrets:read:" + keyName) {
+		http.Error(w, "Token lacks required scope: secrets:read:"+keyName, http.StatusForbidden)
+		return
+	}
 	
 	var id int64
 	var encrypted []byte
-	err := h.db.QueryRow(`
+	err := h.db.QueryRow(fmt.Sprintf(`
 		SELECT id, encrypted_value FROM secrets 
-		WHERE user_id = ? AND key_name = ?
+		WHERE %s = ? AND key_name = ?
 		AND (expires_at IS NULL OR expires_at > NOW())
-	`, claims.UserID, keyName).Scan(&id, &encrypted)
+	`, scope.column), scope.ownerID, keyName).Scan(&id, &encrypted)
 	if err == sql.ErrNoRows {
 		http.Error(w, "Secret not found", http.StatusNotFound)
 		return
@@ -167,7 +196,7 @@ func (h *SecretsHandler) GetValue(w http.ResponseWriter, r *http.Request) {
 	}
 	
 	// Get UDEK
-	udek, err := h.udekManager.GetOrCreateUDEK(claims.UserID)
+	udek, err := h.encryptionKey(scope)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -197,10 +226,15 @@ func (h *SecretsHandler) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	scope, ok := h.scope(w, r, claims.UserID, "admin")
+	if !ok {
+		return
+	}
+	
 	keyName := chi.URLParam(r, "name")
 	
 	var id int64
-	err := h.db.QueryRow("SELECT id FROM secrets WHERE user_id = ? AND key_name = ?", claims.UserID, keyName).Scan(&id)
+	err := h.db.QueryRow(fmt.Sprintf("SELECT id FROM secrets WHERE %s = ? AND key_name = ?", scope.column), scope.ownerID, keyName).Scan(&id)
 	if err == sql.ErrNoRows {
 		http.Error(w, "Secret not found", http.StatusNotFound)
 		return
@@ -225,10 +259,19 @@ func (h *SecretsHandler) GetAuditLog(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	scope, ok := h.scope(w, r, claims.UserID, "admin")
+	if !ok {
+		return
+	}
+	
 	keyName := chi.URLParam(r, "name")
+	if !claims.HasScope("secrets:read:" + keyName) {
+		http.Error(w, "Token lacks required scope: secrets:read:"+keyName, http.StatusForbidden)
+		return
+	}
 	
 	var secretID int64
-	err := h.db.QueryRow("SELECT id FROM secrets WHERE user_id = ? AND key_name = ?", claims.UserID, keyName).Scan(&secretID)
+	err := h.db.QueryRow(fmt.Sprintf("SELECT id FROM secrets WHERE %s = ? AND key_name = ?", scope.column), scope.ownerID, keyName).Scan(&secretID)
 	if err != nil {
 		http.Error(w, "Secret not found", http.StatusNotFound)
 		return
@@ -264,14 +307,43 @@ func (h *SecretsHandler) GetAuditLog(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(logs)
 }
 
-func (h *SecretsHandler) logAccess(secretID, userID int64, action string, r *http.Request) {
-	ip := r.RemoteAddr
-	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-		ip = forwarded
+// secretScope identifies whose secrets a request works with: the caller's
+// own, or an organization's when routed under /api/orgs/{org}/secrets
+type secretScope struct {
+	column  string // "user_id" or "org_id"
+	ownerID int64
+	org     *database.Organization
+}
+
+// owner returns the user_id and org_id column values for a new secret
+func (s *secretScope) owner() (interface{}, interface{}) {
+	if s.org != nil {
+		return nil, s.org.ID
 	}
-	
+	return s.ownerID, nil
+}
+
+func (h *SecretsHandler) scope(w http.ResponseWriter, r *http.Request, userID int64, minRole string) (*secretScope, bool) {
+	org, _, ok := orgFromRequest(h.db, w, r, userID, minRole)
+	if !ok {
+		return nil, false
+	}
+	if org != nil {
+		return &secretScope{column: "org_id", ownerID: org.ID, org: org}, true
+	}
+	return &secretScope{column: "user_id", ownerID: userID}, true
+}
+
+func (h *SecretsHandler) encryptionKey(s *secretScope) ([]byte, error) {
+	if s.org != nil {
+		return h.udekManager.GetOrCreateOrgDEK(s.org.ID)
+	}
+	return h.udekManager.GetOrCreateUDEK(s.ownerID)
+}
+
+func (h *SecretsHandler) logAccess(secretID, userID int64, action string, r *http.Request) {
 	h.db.Exec(`
 		INSERT INTO secrets_audit (secret_id, user_id, action, ip_address, user_agent)
 		VALUES (?, ?, ?, ?, ?)
-	`, secretID, userID, action, ip, r.UserAgent())
+	`, secretID, userID, action, middleware.ClientIP(r), r.UserAgent())
 }
@@ -0,0 +1,147 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"shebang.run/internal/middleware"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type SessionResponse struct {
+	ID         int64  `json:"id"`
+	Device     string `json:"device"`
+	AuthMethod string `json:"auth_method"`
+	UserAgent  string `json:"user_agent"`
+	IPAddress  string `json:"ip_address"`
+	CreatedAt  string `json:"created_at"`
+	LastSeenAt string `json:"last_seen_at"`
+	ExpiresAt  string `json:"expires_at"`
+	Current    bool   `json:"current"`
+}
+
+// describeDevice turns a user agent into a short "Browser on OS" label
+func describeDevice(userAgent string) string {
+	if userAgent == "" {
+		return "Unknown device"
+	}
+
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		{"shebang", "shebang CLI"},
+		{"curl/", "curl"},
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"python-requests", "Python"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	platform := ""
+	for _, o := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.token) {
+			platform = o.name
+			break
+		}
+	}
+
+	if platform == "" {
+		return browser
+	}
+	return browser + " on " + platform
+}
+
+// ListSessions returns the caller's active login sessions
+func (h *AccountHandler) ListSessions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	sessions, err := h.db.GetActiveSessions(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to fetch sessions", http.StatusInternalServerError)
+		return
+	}
+
+	response := []SessionResponse{}
+	for _, s := range sessions {
+		response = append(response, SessionResponse{
+			ID:         s.ID,
+			Device:     describeDevice(s.UserAgent),
+			AuthMethod: s.AuthMethod,
+			UserAgent:  s.UserAgent,
+			IPAddress:  s.IPAddress,
+			CreatedAt:  s.CreatedAt.Format("2006-01-02T15:04:05Z"),
+			LastSeenAt: s.LastSeenAt.Format("2006-01-02T15:04:05Z"),
+			ExpiresAt:  s.ExpiresAt.Format("2006-01-02T15:04:05Z"),
+			Current:    s.ID == claims.SessionID,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *AccountHandler) RevokeSession(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.db.RevokeSession(id, claims.UserID); err != nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeAllSessions signs out every other session; with ?include_current=true
+// the caller's own session is revoked as well
+func (h *AccountHandler) RevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	keep := claims.SessionID
+	if r.URL.Query().Get("include_current") == "true" {
+		keep = 0
+	}
+
+	revoked, err := h.db.RevokeUserSessions(claims.UserID, keep)
+	if err != nil {
+		http.Error(w, "Failed to revoke sessions", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"revoked": revoked})
+}
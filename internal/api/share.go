@@ -1,26 +1,30 @@
 package api
 
 import (
-	"database/sql"
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"time"
 	
 	"github.com/go-chi/chi/v5"
+	"shebang.run/internal/auth"
+	"shebang.run/internal/database"
 	"shebang.run/internal/middleware"
 )
 
 type ShareHandler struct {
-	db *sql.DB
+	db *database.DB
 }
 
-func NewShareHandler(db *sql.DB) *ShareHandler {
+func NewShareHandler(db *database.DB) *ShareHandler {
 	return &ShareHandler{db: db}
 }
 
 type ShareRequest struct {
-	AccessType string   `json:"access_type"` // 'link' or 'user'
+	AccessType string   `json:"access_type"` // 'link', 'user' or 'group'
 	Usernames  []string `json:"usernames"`   // For 'user' type
+	GroupIDs   []int64  `json:"group_ids"`   // For 'group' type
+	Role       string   `json:"role"`        // 'viewer' (default), 'editor' or 'maintainer'
 	ExpiresAt  *time.Time `json:"expires_at"`
 }
 
@@ -28,6 +32,9 @@ type ShareResponse struct {
 	ID         int64      `json:"id"`
 	AccessType string     `json:"access_type"`
 	Username   string     `json:"username,omitempty"`
+	GroupID    *int64     `json:"group_id,omitempty"`
+	GroupName  string     `json:"group_name,omitempty"`
+	Role       string     `json:"role"`
 	GrantedAt  time.Time  `json:"granted_at"`
 	ExpiresAt  *time.Time `json:"expires_at"`
 }
@@ -41,19 +48,18 @@ func (h *ShareHandler) GetAccess(w http.ResponseWriter, r *http.Request) {
 	
 	scriptID := chi.URLParam(r, "id")
 	
-	// Verify ownership
-	var ownerID int64
-	err := h.db.QueryRow("SELECT user_id FROM scripts WHERE id = ?", scriptID).Scan(&ownerID)
-	if err != nil || ownerID != claims.UserID {
+	// Verify the caller may manage sharing
+	if !h.canManage(scriptID, claims) {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
 	
 	// Get access list
 	rows, err := h.db.Query(`
-		SELECT sa.id, sa.access_type, COALESCE(u.username, ''), sa.granted_at, sa.expires_at
+		SELECT sa.id, sa.access_type, COALESCE(u.username, ''), sa.group_id, COALESCE(g.name, ''), sa.role, sa.granted_at, sa.expires_at
 		FROM script_access sa
 		LEFT JOIN users u ON sa.user_id = u.id
+		LEFT JOIN user_groups g ON sa.group_id = g.id
 		WHERE sa.script_id = ?
 		ORDER BY sa.granted_at DESC
 	`, scriptID)
@@ -66,7 +72,7 @@ func (h *ShareHandler) GetAccess(w http.ResponseWriter, r *http.Request) {
 	var shares []ShareResponse
 	for rows.Next() {
 		var s ShareResponse
-		if err := rows.Scan(&s.ID, &s.AccessType, &s.Username, &s.GrantedAt, &s.ExpiresAt); err != nil {
+		if err := rows.Scan(&s.ID, &s.AccessType, &s.Username, &s.GroupID, &s.GroupName, &s.Role, &s.GrantedAt, &s.ExpiresAt); err != nil {
 			continue
 		}
 		shares = append(shares, s)
@@ -85,10 +91,8 @@ func (h *ShareHandler) AddAccess(w http.ResponseWriter, r *http.Request) {
 	
 	scriptID := chi.URLParam(r, "id")
 	
-	// Verify ownership
-	var ownerID int64
-	err := h.db.QueryRow("SELECT user_id FROM scripts WHERE id = ?", scriptID).Scan(&ownerID)
-	if err != nil || ownerID != claims.UserID {
+	// Verify the caller may manage sharing
+	if !h.canManage(scriptID, claims) {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
@@ -99,7 +103,20 @@ func (h *ShareHandler) AddAccess(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
+	if req.Role == "" {
+		req.Role = "viewer"
+	}
+	if !database.ValidCollaboratorRole(req.Role) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+	
 	if req.AccessType == "link" {
+		if req.Role != "viewer" {
+			http.Error(w, "Link access can only grant the viewer role", http.StatusBadRequest)
+			return
+		}
+
 		// Add "anyone with link" access
 		_, err := h.db.Exec(`
 			INSERT INTO script_access (script_id, access_type, granted_by, expires_at)
@@ -119,11 +136,43 @@ func (h *ShareHandler) AddAccess(w http.ResponseWriter, r *http.Request) {
 				continue // Skip invalid usernames
 			}
 			
+			// Re-sharing with an existing collaborator updates their role
+			h.db.Exec(`
+				UPDATE script_access SET role = ?, expires_at = ?
+				WHERE script_id = ? AND access_type = 'user' AND user_id = ?
+			`, req.Role, req.ExpiresAt, scriptID, userID)
 			h.db.Exec(`
-				INSERT IGNORE INTO script_access (script_id, access_type, user_id, granted_by, expires_at)
-				VALUES (?, 'user', ?, ?, ?)
-			`, scriptID, userID, claims.UserID, req.ExpiresAt)
+				INSERT INTO script_access (script_id, access_type, user_id, role, granted_by, expires_at)
+				SELECT ?, 'user', ?, ?, ?, ?
+				WHERE NOT EXISTS (
+					SELECT 1 FROM script_access WHERE script_id = ? AND access_type = 'user' AND user_id = ?
+				)
+			`, scriptID, userID, req.Role, claims.UserID, req.ExpiresAt, scriptID, userID)
 		}
+	} else if req.AccessType == "group" {
+		// Add groups the sharer belongs to
+		for _, groupID := range req.GroupIDs {
+			var isMember int
+			err := h.db.QueryRow("SELECT COUNT(*) FROM group_members WHERE group_id = ? AND user_id = ?", groupID, claims.UserID).Scan(&isMember)
+			if err != nil || isMember == 0 {
+				continue // Skip groups the sharer is not part of
+			}
+			
+			h.db.Exec(`
+				UPDATE script_access SET role = ?, expires_at = ?
+				WHERE script_id = ? AND access_type = 'group' AND group_id = ?
+			`, req.Role, req.ExpiresAt, scriptID, groupID)
+			h.db.Exec(`
+				INSERT INTO script_access (script_id, access_type, group_id, role, granted_by, expires_at)
+				SELECT ?, 'group', ?, ?, ?, ?
+				WHERE NOT EXISTS (
+					SELECT 1 FROM script_access WHERE script_id = ? AND access_type = 'group' AND group_id = ?
+				)
+			`, scriptID, groupID, req.Role, claims.UserID, req.ExpiresAt, scriptID, groupID)
+		}
+	} else {
+		http.Error(w, "Invalid access type", http.StatusBadRequest)
+		return
 	}
 	
 	w.WriteHeader(http.StatusCreated)
@@ -140,15 +189,13 @@ func (h *ShareHandler) RemoveAccess(w http.ResponseWriter, r *http.Request) {
 	scriptID := chi.URLParam(r, "id")
 	accessID := chi.URLParam(r, "access_id")
 	
-	// Verify ownership
-	var ownerID int64
-	err := h.db.QueryRow("SELECT user_id FROM scripts WHERE id = ?", scriptID).Scan(&ownerID)
-	if err != nil || ownerID != claims.UserID {
+	// Verify the caller may manage sharing
+	if !h.canManage(scriptID, claims) {
 		http.Error(w, "Not found", http.StatusNotFound)
 		return
 	}
 	
-	_, err = h.db.Exec("DELETE FROM script_access WHERE id = ? AND script_id = ?", accessID, scriptID)
+	_, err := h.db.Exec("DELETE FROM script_access WHERE id = ? AND script_id = ?", accessID, scriptID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -157,6 +204,20 @@ func (h *ShareHandler) RemoveAccess(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// canManage reports whether the user may manage sharing on the script
+func (h *ShareHandler) canManage(scriptID string, claims *auth.Claims) bool {
+	id, err := strconv.ParseInt(scriptID, 10, 64)
+	if err != nil || !claims.CanUseScript(id) {
+		return false
+	}
+	script, err := h.db.GetScriptByID(id)
+	if err != nil {
+		return false
+	}
+	perm, err := h.db.GetScriptPermission(script, claims.UserID)
+	return err == nil && perm >= database.ScriptPermManage
+}
+
 func (h *ShareHandler) SearchUsers(w http.ResponseWriter, r *http.Request) {
 	query := r.URL.Query().Get("q")
 	if query == "" || len(query) < 2 {
@@ -197,20 +258,23 @@ func (h *ShareHandler) ListSharedScripts(w http.ResponseWriter, r *http.Request)
 	
 	// Get scripts shared with this user
 	rows, err := h.db.Query(`
-		SELECT DISTINCT s.id, s.user_id, s.name, s.description, s.visibility, s.created_at, s.updated_at,
-		       u.username as owner_username,
+		SELECT DISTINCT s.id, COALESCE(s.user_id, 0), s.name, s.description, s.visibility, s.created_at, s.updated_at,
+		       COALESCE(u.username, o.name) as owner_username,
 		       (SELECT version FROM script_versions WHERE script_id = s.id ORDER BY version DESC LIMIT 1) as version
 		FROM scripts s
-		JOIN users u ON s.user_id = u.id
+		LEFT JOIN users u ON s.user_id = u.id
+		LEFT JOIN organizations o ON s.org_id = o.id
 		JOIN script_access sa ON s.id = sa.script_id
-		WHERE s.visibility = 'unlisted'
-		  AND s.user_id != ?
+		WHERE (s.user_id IS NULL OR s.user_id != ?)
+		  AND (sa.expires_at IS NULL OR sa.expires_at > NOW())
 		  AND (
-		      (sa.access_type = 'link' AND (sa.expires_at IS NULL OR sa.expires_at > NOW()))
-		      OR (sa.access_type = 'user' AND sa.user_id = ? AND (sa.expires_at IS NULL OR sa.expires_at > NOW()))
+		      (sa.access_type = 'link' AND s.visibility = 'unlisted')
+		      OR (sa.access_type = 'user' AND sa.user_id = ?)
+		      OR (sa.access_type = 'group'
+		          AND EXISTS (SELECT 1 FROM group_members gm WHERE gm.group_id = sa.group_id AND gm.user_id = ?))
 		  )
 		ORDER BY s.updated_at DESC
-	`, claims.UserID, claims.UserID)
+	`, claims.UserID, claims.UserID, claims.UserID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -226,6 +290,9 @@ func (h *ShareHandler) ListSharedScripts(w http.ResponseWriter, r *http.Request)
 		if err := rows.Scan(&id, &userID, &name, &description, &visibility, &createdAt, &updatedAt, &ownerUsername, &version); err != nil {
 			continue
 		}
+		if !claims.CanUseScript(id) {
+			continue
+		}
 		
 		scripts = append(scripts, map[string]interface{}{
 			"id":          id,
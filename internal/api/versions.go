@@ -0,0 +1,226 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"shebang.run/internal/auth"
+	"shebang.run/internal/database"
+	"shebang.run/internal/middleware"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// tagNamePattern matches the names accepted for user-managed tags
+var tagNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,49}$`)
+
+type VersionResponse struct {
+	Version   int    `json:"version"`
+	Checksum  string `json:"checksum"`
+	Size      int64  `json:"size"`
+	Author    string `json:"author,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+type TagResponse struct {
+	Name      string `json:"name"`
+	Version   int    `json:"version"`
+	Protected bool   `json:"protected"`
+}
+
+type SetTagRequest struct {
+	Version   int   `json:"version"`
+	Protected *bool `json:"protected"`
+}
+
+// canMoveTag reports whether a user with perm may point tagName at another
+// version: "latest" is managed automatically, protected tags need a maintainer
+// and anything else only needs write access
+func (h *ScriptHandler) canMoveTag(script *database.Script, tagName string, perm database.ScriptPermission) bool {
+	if tagName == "latest" || perm < database.ScriptPermWrite {
+		return false
+	}
+	if perm >= database.ScriptPermManage {
+		return true
+	}
+	tag, err := h.db.GetTag(script.ID, tagName)
+	return err != nil || !tag.Protected
+}
+
+// loadScript resolves the {id} URL parameter and returns the script together
+// with the caller's permission, responding 404 below min
+func (h *ScriptHandler) loadScript(w http.ResponseWriter, r *http.Request, claims *auth.Claims, min database.ScriptPermission) (*database.Script, database.ScriptPermission, bool) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid script ID", http.StatusBadRequest)
+		return nil, database.ScriptPermNone, false
+	}
+
+	script, err := h.db.GetScriptByID(id)
+	if err != nil {
+		http.Error(w, "Script not found", http.StatusNotFound)
+		return nil, database.ScriptPermNone, false
+	}
+
+	perm := h.permission(script, claims)
+	if perm < min {
+		http.Error(w, "Script not found", http.StatusNotFound)
+		return nil, database.ScriptPermNone, false
+	}
+	return script, perm, true
+}
+
+// ListVersions returns the version history with the author of each version
+func (h *ScriptHandler) ListVersions(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	script, _, ok := h.loadScript(w, r, claims, database.ScriptPermRead)
+	if !ok {
+		return
+	}
+
+	versions, err := h.db.GetScriptVersions(script.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch versions", http.StatusInternalServerError)
+		return
+	}
+
+	response := []VersionResponse{}
+	for _, v := range versions {
+		response = append(response, VersionResponse{
+			Version:   v.Version,
+			Checksum:  v.Checksum,
+			Size:      v.Size,
+			Author:    v.AuthorUsername,
+			CreatedAt: v.CreatedAt.Format("2006-01-02T15:04:05Z"),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *ScriptHandler) ListTags(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	script, _, ok := h.loadScript(w, r, claims, database.ScriptPermRead)
+	if !ok {
+		return
+	}
+
+	tags, err := h.db.GetTags(script.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch tags", http.StatusInternalServerError)
+		return
+	}
+
+	response := []TagResponse{}
+	for _, t := range tags {
+		response = append(response, TagResponse{Name: t.TagName, Version: t.Version, Protected: t.Protected})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// SetTag points a tag at a version and optionally changes its protection;
+// editors may move unprotected tags, only maintainers may touch protection
+func (h *ScriptHandler) SetTag(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	script, perm, ok := h.loadScript(w, r, claims, database.ScriptPermWrite)
+	if !ok {
+		return
+	}
+
+	tagName := chi.URLParam(r, "tag")
+	if tagName == "latest" {
+		http.Error(w, "The latest tag is managed automatically", http.StatusBadRequest)
+		return
+	}
+	if !tagNamePattern.MatchString(tagName) {
+		http.Error(w, "Invalid tag name", http.StatusBadRequest)
+		return
+	}
+
+	var req SetTagRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	if req.Protected != nil && perm < database.ScriptPermManage {
+		http.Error(w, "Only maintainers can change tag protection", http.StatusForbidden)
+		return
+	}
+	if !h.canMoveTag(script, tagName, perm) {
+		http.Error(w, "Tag is protected", http.StatusForbidden)
+		return
+	}
+
+	version, err := h.db.GetScriptVersionByNumber(script.ID, req.Version)
+	if err != nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.db.CreateTag(script.ID, tagName, version.ID); err != nil {
+		http.Error(w, "Failed to set tag", http.StatusInternalServerError)
+		return
+	}
+	if req.Protected != nil {
+		if err := h.db.SetTagProtected(script.ID, tagName, *req.Protected); err != nil {
+			http.Error(w, "Failed to set tag protection", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	tag, err := h.db.GetTag(script.ID, tagName)
+	if err != nil {
+		http.Error(w, "Failed to fetch tag", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TagResponse{Name: tag.TagName, Version: tag.Version, Protected: tag.Protected})
+}
+
+func (h *ScriptHandler) DeleteTag(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	script, perm, ok := h.loadScript(w, r, claims, database.ScriptPermWrite)
+	if !ok {
+		return
+	}
+
+	tagName := chi.URLParam(r, "tag")
+	if !h.canMoveTag(script, tagName, perm) {
+		http.Error(w, "Tag cannot be deleted", http.StatusForbidden)
+		return
+	}
+
+	if err := h.db.DeleteTag(script.ID, tagName); err != nil {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
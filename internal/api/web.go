@@ -16,7 +16,7 @@ func NewWebHandler() *WebHandler {
 	}
 	
 	layout := filepath.Join("web", "templates", "layout.html")
-	pages := []string{"index", "login", "register", "dashboard", "keys", "account", "script-editor", "privacy", "gdpr", "setup", "docs", "admin", "terms", "community", "api-reference", "secrets", "select-username"}
+	pages := []string{"index", "login", "register", "dashboard", "keys", "account", "script-editor", "privacy", "gdpr", "setup", "docs", "admin", "terms", "community", "api-reference", "secrets", "select-username", "device", "reset-password", "verify-email"}
 	
 	for _, page := range pages {
 		pagePath := filepath.Join("web", "templates", page+".html")
@@ -62,6 +62,24 @@ func (h *WebHandler) Account(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (h *WebHandler) Device(w http.ResponseWriter, r *http.Request) {
+	h.render(w, "device", map[string]interface{}{
+		"Title": "Connect a Device",
+	})
+}
+
+func (h *WebHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	h.render(w, "reset-password", map[string]interface{}{
+		"Title": "Reset Password",
+	})
+}
+
+func (h *WebHandler) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	h.render(w, "verify-email", map[string]interface{}{
+		"Title": "Verify Email",
+	})
+}
+
 func (h *WebHandler) ScriptEditor(w http.ResponseWriter, r *http.Request) {
 	h.render(w, "script-editor", map[string]interface{}{
 		"Title": "Script Editor",
@@ -0,0 +1,409 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"shebang.run/internal/auth"
+	"shebang.run/internal/database"
+	"shebang.run/internal/middleware"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const webAuthnRPName = "shebang.run"
+
+type PasskeyBeginRequest struct {
+	Name string `json:"name"`
+}
+
+// PasskeyCeremonyResponse carries the options for navigator.credentials and
+// the ID to send back with the browser's answer
+type PasskeyCeremonyResponse struct {
+	SessionID string      `json:"session_id"`
+	Options   interface{} `json:"options"`
+}
+
+type PasskeyResponse struct {
+	ID         int64   `json:"id"`
+	Name       string  `json:"name"`
+	CreatedAt  string  `json:"created_at"`
+	LastUsedAt *string `json:"last_used_at"`
+}
+
+type PasskeyRegisteredResponse struct {
+	Passkey PasskeyResponse `json:"passkey"`
+	// Only set when the passkey is the account's first second factor
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+}
+
+type MFAPasskeyBeginRequest struct {
+	MFAToken string `json:"mfa_token"`
+}
+
+func passkeyResponse(c *database.WebAuthnCredential) PasskeyResponse {
+	response := PasskeyResponse{
+		ID:        c.ID,
+		Name:      c.Name,
+		CreatedAt: c.CreatedAt.Format("2006-01-02T15:04:05Z"),
+	}
+	if c.LastUsedAt != nil {
+		lastUsed := c.LastUsedAt.Format("2006-01-02T15:04:05Z")
+		response.LastUsedAt = &lastUsed
+	}
+	return response
+}
+
+// webAuthnUser loads the user's passkeys for a ceremony
+func webAuthnUser(db *database.DB, user *database.User) (*auth.WebAuthnUser, error) {
+	credentials, err := db.GetWebAuthnCredentials(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	data := make([][]byte, len(credentials))
+	for i, c := range credentials {
+		data[i] = c.Credential
+	}
+	return auth.NewWebAuthnUser(user.ID, user.Username, data)
+}
+
+// passkeysEnabled answers 503 when no relying party could be configured
+func (h *AuthHandler) passkeysEnabled(w http.ResponseWriter) bool {
+	if h.webauthn == nil {
+		http.Error(w, "Passkeys are not configured", http.StatusServiceUnavailable)
+		return false
+	}
+	return true
+}
+
+// beginCeremony stores the ceremony state and writes the options to the client
+func (h *AuthHandler) beginCeremony(w http.ResponseWriter, userID *int64, purpose, name string, options interface{}, state []byte) {
+	id, err := auth.GenerateRandomToken(32)
+	if err != nil {
+		http.Error(w, "Failed to start passkey ceremony", http.StatusInternalServerError)
+		return
+	}
+	if err := h.db.CreateWebAuthnCeremony(id, userID, purpose, name, state, time.Now().Add(auth.WebAuthnCeremonyTTL)); err != nil {
+		http.Error(w, "Failed to start passkey ceremony", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(PasskeyCeremonyResponse{SessionID: id, Options: options})
+}
+
+// BeginPasskeyRegistration starts adding a passkey to the caller's account.
+// Once the account has passkeys, only a session signed in with one may add
+// more, so a stolen password and TOTP code cannot be turned into a passkey.
+func (h *AuthHandler) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	claims, ok := mfaSession(w, r)
+	if !ok || !h.passkeysEnabled(w) {
+		return
+	}
+
+	var req PasskeyBeginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		req.Name = "Passkey"
+	}
+	if len(req.Name) > 100 {
+		http.Error(w, "Name must be at most 100 characters", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.db.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	waUser, err := webAuthnUser(h.db, user)
+	if err != nil {
+		http.Error(w, "Failed to load passkeys", http.StatusInternalServerError)
+		return
+	}
+	if len(waUser.WebAuthnCredentials()) > 0 && claims.AuthMethod != database.AuthMethodPasskey {
+		http.Error(w, "Sign in with one of your passkeys to add another", http.StatusForbidden)
+		return
+	}
+
+	creation, state, err := h.webauthn.BeginRegistration(waUser)
+	if err != nil {
+		http.Error(w, "Failed to start passkey registration", http.StatusInternalServerError)
+		return
+	}
+	h.beginCeremony(w, &user.ID, database.CeremonyRegister, req.Name, creation, state)
+}
+
+// FinishPasskeyRegistration verifies the browser's attestation and stores
+// the passkey. The first second factor on an account comes with recovery
+// codes, shown only once.
+func (h *AuthHandler) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	claims, ok := mfaSession(w, r)
+	if !ok || !h.passkeysEnabled(w) {
+		return
+	}
+
+	ceremony, err := h.db.ConsumeWebAuthnCeremony(r.URL.Query().Get("session_id"), database.CeremonyRegister)
+	if err != nil || ceremony.UserID == nil || *ceremony.UserID != claims.UserID {
+		http.Error(w, "Passkey registration expired, try again", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.db.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	waUser, err := webAuthnUser(h.db, user)
+	if err != nil {
+		http.Error(w, "Failed to load passkeys", http.StatusInternalServerError)
+		return
+	}
+	hadMFA, err := h.db.IsMFAEnabled(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to register passkey", http.StatusInternalServerError)
+		return
+	}
+
+	credential, err := h.webauthn.FinishRegistration(waUser, ceremony.State, r)
+	if err != nil {
+		log.Printf("Passkey registration failed for user %d: %v", user.ID, err)
+		http.Error(w, "Passkey verification failed", http.StatusBadRequest)
+		return
+	}
+
+	stored, err := h.db.CreateWebAuthnCredential(user.ID, ceremony.Name, credential.ID, credential.Data)
+	if err != nil {
+		if strings.Contains(err.Error(), "Duplicate") {
+			http.Error(w, "This passkey is already registered", http.StatusConflict)
+			return
+		}
+		http.Error(w, "Failed to store passkey", http.StatusInternalServerError)
+		return
+	}
+
+	response := PasskeyRegisteredResponse{Passkey: passkeyResponse(stored)}
+	if !hadMFA {
+		codes, hashes, err := newRecoveryCodes()
+		if err == nil {
+			err = h.db.ReplaceRecoveryCodes(user.ID, hashes)
+		}
+		if err != nil {
+			http.Error(w, "Failed to store recovery codes", http.StatusInternalServerError)
+			return
+		}
+		response.RecoveryCodes = codes
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+// BeginPasskeyLogin starts a passwordless login with any discoverable passkey
+func (h *AuthHandler) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if !h.passkeysEnabled(w) {
+		return
+	}
+
+	assertion, state, err := h.webauthn.BeginLogin(nil)
+	if err != nil {
+		http.Error(w, "Failed to start passkey login", http.StatusInternalServerError)
+		return
+	}
+	h.beginCeremony(w, nil, database.CeremonyLogin, "", assertion, state)
+}
+
+// FinishPasskeyLogin verifies the assertion and opens a session for the
+// passkey's owner. A user-verified passkey is both factors at once, so no
+// MFA challenge follows.
+func (h *AuthHandler) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if !h.passkeysEnabled(w) {
+		return
+	}
+
+	ceremony, err := h.db.ConsumeWebAuthnCeremony(r.URL.Query().Get("session_id"), database.CeremonyLogin)
+	if err != nil {
+		http.Error(w, "Passkey login expired, try again", http.StatusBadRequest)
+		return
+	}
+
+	var user *database.User
+	waUser, credential, err := h.webauthn.FinishLogin(nil, func(userID int64) (*auth.WebAuthnUser, error) {
+		if user, err = h.db.GetUserByID(userID); err != nil {
+			return nil, err
+		}
+		return webAuthnUser(h.db, user)
+	}, ceremony.State, r)
+	if err != nil {
+		log.Printf("Passkey login failed from %s: %v", middleware.ClientIP(r), err)
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	h.finishPasskeyLogin(w, r, user, waUser, credential)
+}
+
+// BeginMFAPasskey starts a passkey assertion as the second login step
+func (h *AuthHandler) BeginMFAPasskey(w http.ResponseWriter, r *http.Request) {
+	if !h.passkeysEnabled(w) {
+		return
+	}
+
+	var req MFAPasskeyBeginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := auth.ValidateMFAToken(req.MFAToken, h.jwtKeys)
+	if err != nil {
+		http.Error(w, "Login expired, sign in again", http.StatusUnauthorized)
+		return
+	}
+	user, err := h.db.GetUserByID(userID)
+	if err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	waUser, err := webAuthnUser(h.db, user)
+	if err != nil {
+		http.Error(w, "Failed to load passkeys", http.StatusInternalServerError)
+		return
+	}
+	if len(waUser.WebAuthnCredentials()) == 0 {
+		http.Error(w, "No passkeys registered", http.StatusBadRequest)
+		return
+	}
+
+	assertion, state, err := h.webauthn.BeginLogin(waUser)
+	if err != nil {
+		http.Error(w, "Failed to start passkey login", http.StatusInternalServerError)
+		return
+	}
+	h.beginCeremony(w, &user.ID, database.CeremonyMFA, "", assertion, state)
+}
+
+// FinishMFAPasskey completes a login whose second factor is a passkey
+func (h *AuthHandler) FinishMFAPasskey(w http.ResponseWriter, r *http.Request) {
+	if !h.passkeysEnabled(w) {
+		return
+	}
+
+	ceremony, err := h.db.ConsumeWebAuthnCeremony(r.URL.Query().Get("session_id"), database.CeremonyMFA)
+	if err != nil || ceremony.UserID == nil {
+		http.Error(w, "Login expired, sign in again", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.db.GetUserByID(*ceremony.UserID)
+	if err != nil {
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	waUser, err := webAuthnUser(h.db, user)
+	if err != nil {
+		http.Error(w, "Failed to load passkeys", http.StatusInternalServerError)
+		return
+	}
+
+	waUser, credential, err := h.webauthn.FinishLogin(waUser, nil, ceremony.State, r)
+	if err != nil {
+		log.Printf("Passkey second factor failed for user %d: %v", user.ID, err)
+		http.Error(w, "Invalid passkey", http.StatusUnauthorized)
+		return
+	}
+
+	h.finishPasskeyLogin(w, r, user, waUser, credential)
+}
+
+func (h *AuthHandler) finishPasskeyLogin(w http.ResponseWriter, r *http.Request, user *database.User, waUser *auth.WebAuthnUser, credential *auth.WebAuthnCredential) {
+	if err := h.db.RecordWebAuthnCredentialUse(waUser.ID, credential.ID, credential.Data); err != nil {
+		http.Error(w, "Failed to record passkey use", http.StatusInternalServerError)
+		return
+	}
+
+	response, err := h.startSession(r, user, database.AuthMethodPasskey)
+	if err != nil {
+		http.Error(w, "Failed to generate token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *AccountHandler) ListPasskeys(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetUserFromContext(r.Context())
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	credentials, err := h.db.GetWebAuthnCredentials(claims.UserID)
+	if err != nil {
+		http.Error(w, "Failed to fetch passkeys", http.StatusInternalServerError)
+		return
+	}
+
+	response := []PasskeyResponse{}
+	for _, c := range credentials {
+		response = append(response, passkeyResponse(c))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeletePasskey removes one of the caller's passkeys, unless it is the last
+// second factor the MFA policy requires or the last passkey an admin needs
+// for the admin console
+func (h *AccountHandler) DeletePasskey(w http.ResponseWriter, r *http.Request) {
+	claims, ok := mfaSession(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid passkey ID", http.StatusBadRequest)
+		return
+	}
+
+	user, err := h.db.GetUserByID(claims.UserID)
+	if err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	count, err := h.db.CountWebAuthnCredentials(user.ID)
+	if err != nil {
+		http.Error(w, "Failed to fetch passkeys", http.StatusInternalServerError)
+		return
+	}
+	if count == 1 {
+		totp, _ := h.db.GetUserMFA(user.ID)
+		if required, err := h.db.MFARequired(user); err != nil || (required && (totp == nil || totp.EnabledAt == nil)) {
+			http.Error(w, "Two-factor authentication is required for your account; add another factor first", http.StatusForbidden)
+			return
+		}
+		if policy, _ := h.db.GetSetting(database.SettingAdminAuthPolicy, database.AdminAuthPolicyAny); user.IsAdmin && policy == database.AdminAuthPolicyPasskey {
+			http.Error(w, "The admin console requires a passkey; add another one first", http.StatusForbidden)
+			return
+		}
+	}
+
+	if err := h.db.DeleteWebAuthnCredential(id, user.ID); err != nil {
+		http.Error(w, "Passkey not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -9,12 +9,31 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Access tokens are short-lived; a session's refresh token renews them and
+// can be revoked server-side
+const (
+	AccessTokenTTL  = 15 * time.Minute
+	RefreshTokenTTL = 30 * 24 * time.Hour
+)
+
 type Claims struct {
 	UserID             int64      `json:"user_id"`
 	Username           string     `json:"username"`
 	IsAdmin            bool       `json:"is_admin"`
 	TierID             int64      `json:"tier_id"`
 	SubscriptionExpiry *time.Time `json:"subscription_expiry,omitempty"`
+	SessionID          int64      `json:"sid,omitempty"`
+	// How the session signed in; see the database.AuthMethod constants
+	AuthMethod string `json:"auth_method,omitempty"`
+	// Set while an MFA policy applies to the user and they have not enrolled
+	MFASetupRequired bool `json:"mfa_setup,omitempty"`
+	// Set for admins whose session does not meet the admin console policy;
+	// IsAdmin is false until they sign in with a passkey
+	AdminPasskeyRequired bool `json:"admin_passkey,omitempty"`
+	// Set only for API token requests; see HasScope and CanUseScript
+	Scopes    []string `json:"-"`
+	ScriptIDs []int64  `json:"-"`
+	TokenID   int64    `json:"-"`
 	jwt.RegisteredClaims
 }
 
@@ -27,30 +46,21 @@ func CheckPassword(password, hash string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
 }
 
-func GenerateToken(userID int64, username string, isAdmin bool, tierID int64, subscriptionExpiry *time.Time, secret string) (string, error) {
-	claims := Claims{
-		UserID:             userID,
-		Username:           username,
-		IsAdmin:            isAdmin,
-		TierID:             tierID,
-		SubscriptionExpiry: subscriptionExpiry,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+// GenerateToken signs an access token for the claims, valid for AccessTokenTTL
+func GenerateToken(claims Claims, keys *KeySet) (string, error) {
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(AccessTokenTTL)),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	return keys.Sign(claims)
 }
 
-func ValidateToken(tokenString, secret string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+func ValidateToken(tokenString string, keys *KeySet) (*Claims, error) {
+	token, err := keys.Parse(tokenString, &Claims{})
 	if err != nil {
 		return nil, err
 	}
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && len(claims.Audience) == 0 {
 		return claims, nil
 	}
 	return nil, jwt.ErrSignatureInvalid
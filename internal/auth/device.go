@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"crypto/rand"
+	"math/big"
+	"strings"
+)
+
+// User codes are typed by hand, so they avoid vowels (no accidental words)
+// and characters that are easily confused
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// GenerateUserCode returns a device flow user code such as "WDJB-MJHT"
+func GenerateUserCode() (string, error) {
+	code := make([]byte, 8)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeAlphabet[n.Int64()]
+	}
+	return string(code[:4]) + "-" + string(code[4:]), nil
+}
+
+// NormalizeUserCode accepts a user code as typed, in any case and with or
+// without separators, and returns it in GenerateUserCode's form
+func NormalizeUserCode(input string) string {
+	var code []byte
+	for _, c := range []byte(strings.ToUpper(input)) {
+		if strings.IndexByte(userCodeAlphabet, c) >= 0 {
+			code = append(code, c)
+		}
+	}
+	if len(code) != 8 {
+		return ""
+	}
+	return string(code[:4]) + "-" + string(code[4:])
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Purposes of tokens sent by email. Each purpose is its own audience, so a
+// verification link cannot be used to reset a password.
+const (
+	EmailTokenPasswordReset = "password_reset"
+	EmailTokenVerifyEmail   = "verify_email"
+
+	PasswordResetTTL     = time.Hour
+	EmailVerificationTTL = 48 * time.Hour
+)
+
+// EmailTokenClaims bind a token to the address it was sent to. The ID is
+// recorded when the token is used, so each token works once.
+type EmailTokenClaims struct {
+	Email string `json:"email"`
+	jwt.RegisteredClaims
+}
+
+func emailTokenAudience(purpose string) string {
+	return "shebang-" + purpose
+}
+
+// GenerateEmailToken signs a token for a link sent to email and returns it
+// with its ID
+func GenerateEmailToken(purpose string, userID int64, email string, ttl time.Duration, keys *KeySet) (string, string, error) {
+	id, err := GenerateRandomToken(16)
+	if err != nil {
+		return "", "", err
+	}
+	claims := EmailTokenClaims{
+		Email: email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        id,
+			Subject:   strconv.FormatInt(userID, 10),
+			Audience:  jwt.ClaimStrings{emailTokenAudience(purpose)},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	token, err := keys.Sign(claims)
+	return token, id, err
+}
+
+// ValidateEmailToken checks a token's signature, expiry and purpose and
+// returns the user ID and claims. Whether it was already used is up to the
+// caller.
+func ValidateEmailToken(purpose, tokenString string, keys *KeySet) (int64, *EmailTokenClaims, error) {
+	claims := &EmailTokenClaims{}
+	token, err := keys.Parse(tokenString, claims, jwt.WithAudience(emailTokenAudience(purpose)))
+	if err != nil || !token.Valid || claims.ID == "" {
+		return 0, nil, errors.New("invalid or expired link")
+	}
+	userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return 0, nil, errors.New("invalid or expired link")
+	}
+	return userID, claims, nil
+}
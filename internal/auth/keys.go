@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// verificationKey is a public key tokens may be signed with, identified by
+// its RFC 7638 thumbprint
+type verificationKey struct {
+	id     string
+	method jwt.SigningMethod
+	public crypto.PublicKey
+}
+
+// KeySet signs and verifies session JWTs. With a signing key it issues
+// EdDSA or RS256 tokens carrying a kid header and accepts any of its
+// verification keys, so keys can be rotated by keeping the previous key for
+// verification until its tokens have expired. Without one it falls back to
+// HS256 with the shared secret.
+type KeySet struct {
+	signingID     string
+	signingMethod jwt.SigningMethod
+	signingKey    crypto.Signer
+	verify        map[string]*verificationKey
+	secret        []byte
+}
+
+// NewHMACKeySet signs and verifies with a shared HS256 secret
+func NewHMACKeySet(secret string) *KeySet {
+	return &KeySet{secret: []byte(secret)}
+}
+
+// LoadKeySet reads a PEM private key (Ed25519 or RSA, PKCS#8 or PKCS#1) to
+// sign with, plus PEM public or private keys that remain valid for
+// verification, typically the previous signing key during a rotation
+func LoadKeySet(signingKeyFile string, verificationKeyFiles []string) (*KeySet, error) {
+	ks := &KeySet{verify: map[string]*verificationKey{}}
+
+	key, err := readPEMKey(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: signing key must be a private key", signingKeyFile)
+	}
+	vk, err := newVerificationKey(signer.Public())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", signingKeyFile, err)
+	}
+	ks.signingID = vk.id
+	ks.signingMethod = vk.method
+	ks.signingKey = signer
+	ks.verify[vk.id] = vk
+
+	for _, file := range verificationKeyFiles {
+		key, err := readPEMKey(file)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			key = signer.Public()
+		}
+		vk, err := newVerificationKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		ks.verify[vk.id] = vk
+	}
+
+	return ks, nil
+}
+
+func readPEMKey(file string) (interface{}, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", file)
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("%s: unsupported PEM block %q", file, block.Type)
+}
+
+func newVerificationKey(public crypto.PublicKey) (*verificationKey, error) {
+	switch pub := public.(type) {
+	case ed25519.PublicKey:
+		return &verificationKey{id: thumbprint(pub), method: jwt.SigningMethodEdDSA, public: pub}, nil
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return &verificationKey{id: thumbprint(pub), method: jwt.SigningMethodRS256, public: pub}, nil
+	}
+	return nil, errors.New("only Ed25519 and RSA keys are supported")
+}
+
+// Asymmetric reports whether tokens are signed with a private key, as opposed
+// to the shared HS256 secret
+func (ks *KeySet) Asymmetric() bool {
+	return ks.signingKey != nil
+}
+
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	if !ks.Asymmetric() {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(ks.secret)
+	}
+	token := jwt.NewWithClaims(ks.signingMethod, claims)
+	token.Header["kid"] = ks.signingID
+	return token.SignedString(ks.signingKey)
+}
+
+// Parse verifies a token against the key named by its kid header. HS256
+// tokens are only accepted when no signing key is configured.
+func (ks *KeySet) Parse(tokenString string, claims jwt.Claims, opts ...jwt.ParserOption) (*jwt.Token, error) {
+	if !ks.Asymmetric() {
+		opts = append(opts, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+		return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+			return ks.secret, nil
+		}, opts...)
+	}
+
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := ks.verify[kid]
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, errors.New("signing method does not match key")
+		}
+		return key.public, nil
+	}, append(opts, jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg(), jwt.SigningMethodRS256.Alg()}))...)
+}
+
+// JWK is a public key in JSON Web Key form
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+// JWKS returns the verification keys for publishing at
+// /.well-known/jwks.json; it is empty in HS256 mode
+func (ks *KeySet) JWKS() []JWK {
+	keys := []JWK{}
+	for _, vk := range ks.verify {
+		jwk := toJWK(vk.public)
+		jwk.Kid = vk.id
+		jwk.Use = "sig"
+		jwk.Alg = vk.method.Alg()
+		keys = append(keys, jwk)
+	}
+	return keys
+}
+
+func toJWK(public crypto.PublicKey) JWK {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := public.(type) {
+	case ed25519.PublicKey:
+		return JWK{Kty: "OKP", Crv: "Ed25519", X: b64(pub)}
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", N: b64(pub.N.Bytes()), E: b64(big.NewInt(int64(pub.E)).Bytes())}
+	}
+	return JWK{}
+}
+
+// thumbprint computes the RFC 7638 JWK thumbprint, hashing the required
+// members in lexicographic order
+func thumbprint(public crypto.PublicKey) string {
+	jwk := toJWK(public)
+	var canonical []byte
+	switch jwk.Kty {
+	case "OKP":
+		canonical, _ = json.Marshal(struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X})
+	case "RSA":
+		canonical, _ = json.Marshal(struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N})
+	}
+	sum := sha256.Sum256(canonical)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
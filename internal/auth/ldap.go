@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPProviderName is stored as the oauth_provider of accounts provisioned
+// from the directory; their passwords are checked by the directory only
+const LDAPProviderName = "ldap"
+
+// ErrLDAPInvalidCredentials means the directory has no single user matching
+// the username or rejected the password
+var ErrLDAPInvalidCredentials = errors.New("invalid credentials")
+
+// LDAPConfig configures the directory users sign in against. The user is
+// looked up under BaseDN with UserFilter, where {username} is replaced by the
+// escaped login name, and bound as with their password to verify it. Groups come
+// from GroupAttribute on the user entry (memberOf), or when GroupBaseDN is
+// set from a search with GroupFilter, where {dn} and {username} are
+// replaced.
+type LDAPConfig struct {
+	URL                string // ldap:// or ldaps://
+	StartTLS           bool
+	InsecureSkipVerify bool
+	CACertFile         string
+	BindDN             string // service account for searches; empty binds anonymously
+	BindPassword       string
+	BaseDN             string
+	UserFilter         string
+	UsernameAttribute  string
+	EmailAttribute     string
+	IDAttribute        string // stable ID, e.g. entryUUID or objectGUID; the DN when empty
+	GroupAttribute     string
+	GroupBaseDN        string
+	GroupFilter        string
+	Timeout            time.Duration
+}
+
+// LDAPUser is a directory user whose password was verified. Groups are
+// normalized DNs, see NormalizeDN.
+type LDAPUser struct {
+	DN       string
+	ID       string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+type LDAPDirectory struct {
+	config    LDAPConfig
+	tlsConfig *tls.Config
+}
+
+func NewLDAPDirectory(config LDAPConfig) (*LDAPDirectory, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, errors.New("LDAP URL must be ldap://host[:port] or ldaps://host[:port]")
+	}
+	if config.BaseDN == "" {
+		return nil, errors.New("LDAP search base is required")
+	}
+	if !strings.Contains(config.UserFilter, "{username}") {
+		return nil, errors.New("LDAP user filter must contain {username}")
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if config.CACertFile != "" {
+		pem, err := os.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading LDAP CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in LDAP CA certificate file")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &LDAPDirectory{config: config, tlsConfig: tlsConfig}, nil
+}
+
+// Encrypted reports whether passwords travel to the directory over TLS
+func (d *LDAPDirectory) Encrypted() bool {
+	return strings.HasPrefix(d.config.URL, "ldaps://") || d.config.StartTLS
+}
+
+func (d *LDAPDirectory) dial() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(d.config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: d.config.Timeout}),
+		ldap.DialWithTLSConfig(d.tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(d.config.Timeout)
+	if d.config.StartTLS && !strings.HasPrefix(d.config.URL, "ldaps://") {
+		if err := conn.StartTLS(d.tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// bindService binds as the service account, or stays anonymous without one
+func (d *LDAPDirectory) bindService(conn *ldap.Conn) error {
+	if d.config.BindDN == "" {
+		return nil
+	}
+	return conn.Bind(d.config.BindDN, d.config.BindPassword)
+}
+
+// Authenticate finds the user and verifies the password by binding as them.
+// It returns ErrLDAPInvalidCredentials for unknown users and wrong
+// passwords, and other errors when the directory cannot be used.
+func (d *LDAPDirectory) Authenticate(username, password string) (*LDAPUser, error) {
+	// An empty password would be an unauthenticated bind, which directories
+	// accept for any DN
+	if username == "" || password == "" {
+		return nil, ErrLDAPInvalidCredentials
+	}
+
+	conn, err := d.dial()
+	if err != nil {
+		return nil, fmt.Errorf("connecting to LDAP: %w", err)
+	}
+	defer conn.Close()
+
+	if err := d.bindService(conn); err != nil {
+		return nil, fmt.Errorf("LDAP service bind: %w", err)
+	}
+
+	var attributes []string
+	for _, attr := range []string{d.config.UsernameAttribute, d.config.EmailAttribute, d.config.IDAttribute, d.config.GroupAttribute} {
+		if attr != "" {
+			attributes = append(attributes, attr)
+		}
+	}
+	if len(attributes) == 0 {
+		// "1.1" asks for no attributes, only the DN
+		attributes = []string{"1.1"}
+	}
+	filter := strings.ReplaceAll(d.config.UserFilter, "{username}", ldap.EscapeFilter(username))
+	result, err := conn.Search(ldap.NewSearchRequest(
+		d.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(d.config.Timeout/time.Second), false,
+		filter, attributes, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("LDAP user search: %w", err)
+	}
+	if result == nil || len(result.Entries) != 1 {
+		return nil, ErrLDAPInvalidCredentials
+	}
+	entry := result.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrLDAPInvalidCredentials
+		}
+		return nil, fmt.Errorf("LDAP user bind: %w", err)
+	}
+
+	user := &LDAPUser{
+		DN:       entry.DN,
+		ID:       entry.DN,
+		Username: username,
+		Email:    entry.GetEqualFoldAttributeValue(d.config.EmailAttribute),
+	}
+	if d.config.UsernameAttribute != "" {
+		if name := entry.GetEqualFoldAttributeValue(d.config.UsernameAttribute); name != "" {
+			user.Username = name
+		}
+	}
+	if d.config.IDAttribute != "" {
+		if raw := entry.GetEqualFoldRawAttributeValue(d.config.IDAttribute); len(raw) > 0 {
+			// Binary IDs such as Active Directory's objectGUID are hex encoded
+			if utf8.Valid(raw) {
+				user.ID = string(raw)
+			} else {
+				user.ID = hex.EncodeToString(raw)
+			}
+		}
+	}
+
+	if d.config.GroupBaseDN == "" {
+		for _, group := range entry.GetEqualFoldAttributeValues(d.config.GroupAttribute) {
+			user.Groups = append(user.Groups, NormalizeDN(group))
+		}
+		return user, nil
+	}
+
+	// The user may not be allowed to read groups
+	if err := d.bindService(conn); err != nil {
+		return nil, fmt.Errorf("LDAP service bind: %w", err)
+	}
+	filter = strings.NewReplacer(
+		"{dn}", ldap.EscapeFilter(entry.DN),
+		"{username}", ldap.EscapeFilter(user.Username),
+	).Replace(d.config.GroupFilter)
+	groups, err := conn.Search(ldap.NewSearchRequest(
+		d.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, int(d.config.Timeout/time.Second), false,
+		filter, []string{"1.1"}, nil,
+	))
+	if err != nil {
+		return nil, fmt.Errorf("LDAP group search: %w", err)
+	}
+	for _, group := range groups.Entries {
+		user.Groups = append(user.Groups, NormalizeDN(group.DN))
+	}
+	return user, nil
+}
+
+var dnValueEscaper = strings.NewReplacer(`\`, `\\`, `,`, `\,`, `+`, `\+`, `=`, `\=`)
+
+// NormalizeDN renders a DN in one canonical form, lowercase and without
+// optional spaces or escapes, so group DNs from the directory and from
+// configuration compare equal. Unparseable DNs are only lowercased.
+func NormalizeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(dn))
+	}
+	rdns := make([]string, len(parsed.RDNs))
+	for i, rdn := range parsed.RDNs {
+		attrs := make([]string, len(rdn.Attributes))
+		for j, attr := range rdn.Attributes {
+			attrs[j] = strings.ToLower(attr.Type) + "=" + dnValueEscaper.Replace(strings.ToLower(attr.Value))
+		}
+		rdns[i] = strings.Join(attrs, "+")
+	}
+	return strings.Join(rdns, ",")
+}
@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"shebang.run/internal/auth/ldaptest"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	serviceDN = "cn=shebang,ou=services,dc=example,dc=org"
+	adaDN     = "uid=ada,ou=people,dc=example,dc=org"
+)
+
+func newTestDirectory(t *testing.T, configure func(*LDAPConfig)) (*LDAPDirectory, *ldaptest.Server) {
+	t.Helper()
+	server := ldaptest.NewServer()
+	t.Cleanup(server.Close)
+	server.AddEntry(ldaptest.Entry{DN: serviceDN}, "service-secret")
+	server.AddEntry(ldaptest.Entry{DN: adaDN, Attributes: map[string][]string{
+		"objectClass": {"person"},
+		"uid":         {"ada"},
+		"mail":        {"ada@example.org"},
+		"entryUUID":   {"5d4c6bb4-2a33-4d55-9b1f-9c1b4b0f0c1e"},
+		"memberOf":    {"CN=Devs, OU=Groups,DC=example,DC=org"},
+	}}, "ada-password")
+	server.AddEntry(ldaptest.Entry{DN: "uid=bob,ou=people,dc=example,dc=org", Attributes: map[string][]string{
+		"objectClass": {"person"},
+		"uid":         {"bob"},
+	}}, "bob-password")
+	server.AddEntry(ldaptest.Entry{DN: "cn=devs,ou=groups,dc=example,dc=org", Attributes: map[string][]string{
+		"member": {adaDN},
+	}}, "")
+	server.AddEntry(ldaptest.Entry{DN: "cn=ops,ou=groups,dc=example,dc=org", Attributes: map[string][]string{
+		"member": {"uid=bob,ou=people,dc=example,dc=org"},
+	}}, "")
+
+	config := LDAPConfig{
+		URL:               server.URL,
+		BindDN:            serviceDN,
+		BindPassword:      "service-secret",
+		BaseDN:            "ou=people,dc=example,dc=org",
+		UserFilter:        "(&(objectClass=person)(uid={username}))",
+		UsernameAttribute: "uid",
+		EmailAttribute:    "mail",
+		IDAttribute:       "entryUUID",
+		GroupAttribute:    "memberOf",
+	}
+	if configure != nil {
+		configure(&config)
+	}
+	directory, err := NewLDAPDirectory(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return directory, server
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	directory, server := newTestDirectory(t, nil)
+
+	user, err := directory.Authenticate("ada", "ada-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &LDAPUser{
+		DN:       adaDN,
+		ID:       "5d4c6bb4-2a33-4d55-9b1f-9c1b4b0f0c1e",
+		Username: "ada",
+		Email:    "ada@example.org",
+		Groups:   []string{"cn=devs,ou=groups,dc=example,dc=org"},
+	}
+	if !reflect.DeepEqual(user, want) {
+		t.Errorf("user = %+v, want %+v", user, want)
+	}
+	if binds := server.Binds(); !reflect.DeepEqual(binds, []string{serviceDN, adaDN}) {
+		t.Errorf("binds = %v, want the service account then the user", binds)
+	}
+}
+
+func TestLDAPAuthenticateRejects(t *testing.T) {
+	directory, server := newTestDirectory(t, nil)
+
+	tests := []struct{ name, username, password string }{
+		{"wrong password", "ada", "bob-password"},
+		{"unknown user", "carol", "ada-password"},
+		{"empty password", "ada", ""},
+	}
+	for _, tt := range tests {
+		if _, err := directory.Authenticate(tt.username, tt.password); !errors.Is(err, ErrLDAPInvalidCredentials) {
+			t.Errorf("%s: err = %v, want ErrLDAPInvalidCredentials", tt.name, err)
+		}
+	}
+	for _, dn := range server.Binds() {
+		if dn == "" {
+			t.Error("bound anonymously with an empty password")
+		}
+	}
+}
+
+func TestLDAPAuthenticateEscapesFilter(t *testing.T) {
+	directory, server := newTestDirectory(t, nil)
+
+	// Unescaped, these would match every user or any user's entry
+	for _, username := range []string{"*", "ada)(uid=*", `ada\`} {
+		if _, err := directory.Authenticate(username, "ada-password"); !errors.Is(err, ErrLDAPInvalidCredentials) {
+			t.Errorf("Authenticate(%q) = %v, want ErrLDAPInvalidCredentials", username, err)
+		}
+	}
+	want := []string{
+		`(&(objectClass=person)(uid=\2a))`,
+		`(&(objectClass=person)(uid=ada\29\28uid=\2a))`,
+		`(&(objectClass=person)(uid=ada\5c))`,
+	}
+	if searches := server.Searches(); !reflect.DeepEqual(searches, want) {
+		t.Errorf("searches = %q, want %q", searches, want)
+	}
+}
+
+func TestLDAPAuthenticateRejectsAmbiguousUser(t *testing.T) {
+	directory, _ := newTestDirectory(t, func(c *LDAPConfig) {
+		c.UserFilter = "(|(uid={username})(objectClass=person))"
+	})
+	if _, err := directory.Authenticate("ada", "ada-password"); !errors.Is(err, ErrLDAPInvalidCredentials) {
+		t.Errorf("err = %v, want ErrLDAPInvalidCredentials when several users match", err)
+	}
+}
+
+func TestLDAPAuthenticateGroupSearch(t *testing.T) {
+	directory, server := newTestDirectory(t, func(c *LDAPConfig) {
+		c.GroupAttribute = ""
+		c.GroupBaseDN = "ou=groups,dc=example,dc=org"
+		c.GroupFilter = "(member={dn})"
+	})
+
+	user, err := directory.Authenticate("ada", "ada-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"cn=devs,ou=groups,dc=example,dc=org"}; !reflect.DeepEqual(user.Groups, want) {
+		t.Errorf("groups = %v, want %v", user.Groups, want)
+	}
+	// Groups are read as the service account, not the user
+	if binds := server.Binds(); !reflect.DeepEqual(binds, []string{serviceDN, adaDN, serviceDN}) {
+		t.Errorf("binds = %v", binds)
+	}
+	searches := server.Searches()
+	if want := `(member=uid=ada,ou=people,dc=example,dc=org)`; len(searches) != 2 || searches[1] != want {
+		t.Errorf("searches = %q, want the group search %q", searches, want)
+	}
+}
+
+func TestLDAPAuthenticateFailsClosed(t *testing.T) {
+	directory, server := newTestDirectory(t, func(c *LDAPConfig) {
+		c.GroupBaseDN = "ou=groups,dc=example,dc=org"
+		c.GroupFilter = "(member={dn})"
+	})
+	server.FailSearches("ou=groups,dc=example,dc=org", ldap.LDAPResultUnavailable)
+
+	// Without its groups the user must not sign in with stale ones
+	user, err := directory.Authenticate("ada", "ada-password")
+	if err == nil || errors.Is(err, ErrLDAPInvalidCredentials) {
+		t.Errorf("Authenticate with failing group search = %+v, %v, want a directory error", user, err)
+	}
+
+	wrongService, _ := newTestDirectory(t, func(c *LDAPConfig) { c.BindPassword = "wrong" })
+	if _, err := wrongService.Authenticate("ada", "ada-password"); err == nil || errors.Is(err, ErrLDAPInvalidCredentials) {
+		t.Errorf("Authenticate with a rejected service account = %v, want a directory error", err)
+	}
+
+	server.Close()
+	if _, err := directory.Authenticate("ada", "ada-password"); err == nil || errors.Is(err, ErrLDAPInvalidCredentials) {
+		t.Errorf("Authenticate without a directory = %v, want a directory error", err)
+	}
+}
+
+func TestNewLDAPDirectoryValidates(t *testing.T) {
+	tests := []LDAPConfig{
+		{URL: "http://ldap.example.org", BaseDN: "dc=example", UserFilter: "(uid={username})"},
+		{URL: "ldap://ldap.example.org", UserFilter: "(uid={username})"},
+		{URL: "ldap://ldap.example.org", BaseDN: "dc=example", UserFilter: "(uid=ada)"},
+	}
+	for _, config := range tests {
+		if _, err := NewLDAPDirectory(config); err == nil {
+			t.Errorf("NewLDAPDirectory(%+v) accepted an invalid configuration", config)
+		}
+	}
+}
+
+func TestNormalizeDN(t *testing.T) {
+	tests := map[string]string{
+		"CN=Devs, OU=Groups,DC=example,DC=org": "cn=devs,ou=groups,dc=example,dc=org",
+		`cn=Smith\, John,dc=example`:           `cn=smith\, john,dc=example`,
+		"cn=a+uid=b,dc=example":                "cn=a+uid=b,dc=example",
+		" Not A DN ":                           "not a dn",
+	}
+	for in, want := range tests {
+		if got := NormalizeDN(in); got != want {
+			t.Errorf("NormalizeDN(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if NormalizeDN("cn=devs,dc=example") != NormalizeDN(strings.ToUpper("cn=devs, dc=example")) {
+		t.Error("DNs differing in case and spacing normalize differently")
+	}
+}
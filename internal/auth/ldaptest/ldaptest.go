@@ -0,0 +1,269 @@
+// Package ldaptest provides an in-process LDAP server for tests, answering
+// simple binds and searches from a fixed set of entries
+package ldaptest
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Entry is a directory entry. Attribute names and values compare
+// case-insensitively, as with most directory schemas.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Server is an LDAP server listening on a loopback port. Searches support
+// and, or, not, equality and presence filters.
+type Server struct {
+	URL string
+	ln  net.Listener
+
+	mu        sync.Mutex
+	entries   []Entry
+	passwords map[string]string // by lowercase DN
+	failures  map[string]uint16 // result codes of searches, by lowercase base DN
+	binds     []string
+	searches  []string
+}
+
+// NewServer starts a server; Close stops it
+func NewServer() *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("ldaptest: " + err.Error())
+	}
+	s := &Server{
+		URL:       "ldap://" + ln.Addr().String(),
+		ln:        ln,
+		passwords: make(map[string]string),
+		failures:  make(map[string]uint16),
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *Server) Close() {
+	s.ln.Close()
+}
+
+// AddEntry adds an entry, which accepts binds with password unless it is
+// empty
+func (s *Server) AddEntry(entry Entry, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries = append(s.entries, entry)
+	if password != "" {
+		s.passwords[strings.ToLower(entry.DN)] = password
+	}
+}
+
+// FailSearches makes searches under baseDN fail with the result code
+func (s *Server) FailSearches(baseDN string, code uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[strings.ToLower(baseDN)] = code
+}
+
+// Binds returns the DNs of the binds received, in order
+func (s *Server) Binds() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.binds...)
+}
+
+// Searches returns the filters of the searches received, in order
+func (s *Server) Searches() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.searches...)
+}
+
+const (
+	appBindRequest    = 0
+	appBindResponse   = 1
+	appUnbindRequest  = 2
+	appSearchRequest  = 3
+	appSearchEntry    = 4
+	appSearchDone     = 5
+	contextSimpleAuth = 0
+)
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		var replies []*ber.Packet
+		switch op.Tag {
+		case appBindRequest:
+			replies = []*ber.Packet{s.bind(op)}
+		case appSearchRequest:
+			replies = s.search(op)
+		case appUnbindRequest:
+			return
+		default:
+			return
+		}
+		for _, reply := range replies {
+			message := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			message.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "Message ID"))
+			message.AppendChild(reply)
+			if _, err := conn.Write(message.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func result(app ber.Tag, code uint16) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, app, nil, "Result")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), "Result Code"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+	return p
+}
+
+func (s *Server) bind(op *ber.Packet) *ber.Packet {
+	if len(op.Children) < 3 || op.Children[2].Tag != contextSimpleAuth {
+		return result(appBindResponse, ldap.LDAPResultAuthMethodNotSupported)
+	}
+	dn := octets(op.Children[1])
+	password := octets(op.Children[2])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.binds = append(s.binds, dn)
+	if want, ok := s.passwords[strings.ToLower(dn)]; !ok || want != password {
+		return result(appBindResponse, ldap.LDAPResultInvalidCredentials)
+	}
+	return result(appBindResponse, ldap.LDAPResultSuccess)
+}
+
+func (s *Server) search(op *ber.Packet) []*ber.Packet {
+	if len(op.Children) < 8 {
+		return []*ber.Packet{result(appSearchDone, ldap.LDAPResultProtocolError)}
+	}
+	baseDN := strings.ToLower(octets(op.Children[0]))
+	sizeLimit, _ := op.Children[3].Value.(int64)
+	filter := op.Children[6]
+	var attributes []string
+	for _, attr := range op.Children[7].Children {
+		attributes = append(attributes, octets(attr))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	decompiled, err := ldap.DecompileFilter(filter)
+	if err != nil {
+		return []*ber.Packet{result(appSearchDone, ldap.LDAPResultProtocolError)}
+	}
+	s.searches = append(s.searches, decompiled)
+	if code, ok := s.failures[baseDN]; ok {
+		return []*ber.Packet{result(appSearchDone, code)}
+	}
+
+	var replies []*ber.Packet
+	for _, entry := range s.entries {
+		dn := strings.ToLower(entry.DN)
+		if dn != baseDN && !strings.HasSuffix(dn, ","+baseDN) || !matches(entry, filter) {
+			continue
+		}
+		if sizeLimit > 0 && int64(len(replies)) == sizeLimit {
+			return append(replies, result(appSearchDone, ldap.LDAPResultSizeLimitExceeded))
+		}
+		replies = append(replies, encodeEntry(entry, attributes))
+	}
+	return append(replies, result(appSearchDone, ldap.LDAPResultSuccess))
+}
+
+func encodeEntry(entry Entry, attributes []string) *ber.Packet {
+	p := ber.Encode(ber.ClassApplication, ber.TypeConstructed, appSearchEntry, nil, "Search Result Entry")
+	p.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, entry.DN, "DN"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for _, name := range attributes {
+		values := attribute(entry, name)
+		if values == nil {
+			continue
+		}
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+		attr.AppendChild(set)
+		attrs.AppendChild(attr)
+	}
+	p.AppendChild(attrs)
+	return p
+}
+
+func attribute(entry Entry, name string) []string {
+	for attr, values := range entry.Attributes {
+		if strings.EqualFold(attr, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+func matches(entry Entry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matches(entry, child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if matches(entry, child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(filter.Children) == 1 && !matches(entry, filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		want := octets(filter.Children[1])
+		for _, value := range attribute(entry, octets(filter.Children[0])) {
+			if strings.EqualFold(value, want) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return attribute(entry, octets(filter)) != nil
+	}
+	return false
+}
+
+func octets(p *ber.Packet) string {
+	if p.Data == nil {
+		return ""
+	}
+	return p.Data.String()
+}
@@ -3,26 +3,42 @@ package auth
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
+	"sync"
 
+	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
 	"golang.org/x/oauth2/google"
 )
 
+// OAuthProvider is a login provider: GitHub or Google with their user-info
+// APIs, or any OpenID Connect issuer, whose signed ID token identifies the
+// user instead
 type OAuthProvider struct {
+	Name        string
+	DisplayName string
 	config *oauth2.Config
 	userInfoURL string
+
+	// OpenID Connect only: the issuer is discovered on first use
+	issuer      string
+	groupsClaim string
+	mu          sync.Mutex
+	verifier    *oidc.IDTokenVerifier
 }
 
-func NewGitHubProvider(clientID, clientSecret, redirectURL string) *OAuthProvider {
+func NewGitHubProvider(clientID, clientSecret string) *OAuthProvider {
 	return &OAuthProvider{
+		Name:        "github",
+		DisplayName: "GitHub",
 		config: &oauth2.Config{
 			ClientID:     clientID,
 			ClientSecret: clientSecret,
-			RedirectURL:  redirectURL,
 			Scopes:       []string{"user:email"},
 			Endpoint:     github.Endpoint,
 		},
@@ -30,12 +46,13 @@ func NewGitHubProvider(clientID, clientSecret, redirectURL string) *OAuthProvide
 	}
 }
 
-func NewGoogleProvider(clientID, clientSecret, redirectURL string) *OAuthProvider {
+func NewGoogleProvider(clientID, clientSecret string) *OAuthProvider {
 	return &OAuthProvider{
+		Name:        "google",
+		DisplayName: "Google",
 		config: &oauth2.Config{
 			ClientID:     clientID,
 			ClientSecret: clientSecret,
-			RedirectURL:  redirectURL,
 			Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email", "https://www.googleapis.com/auth/userinfo.profile"},
 			Endpoint:     google.Endpoint,
 		},
@@ -43,12 +60,73 @@ func NewGoogleProvider(clientID, clientSecret, redirectURL string) *OAuthProvide
 	}
 }
 
-func (p *OAuthProvider) GetAuthURL(state string) string {
-	return p.config.AuthCodeURL(state)
+// NewOIDCProvider configures an OpenID Connect provider by issuer URL. The
+// user's IdP groups are read from groupsClaim, which may be a dotted path
+// such as realm_access.roles.
+func NewOIDCProvider(name, displayName, issuer, clientID, clientSecret string, scopes []string, groupsClaim string) *OAuthProvider {
+	return &OAuthProvider{
+		Name:        name,
+		DisplayName: displayName,
+		config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			Scopes:       scopes,
+		},
+		issuer:      issuer,
+		groupsClaim: groupsClaim,
+	}
 }
 
-func (p *OAuthProvider) Exchange(ctx context.Context, code string) (*oauth2.Token, error) {
-	return p.config.Exchange(ctx, code)
+func (p *OAuthProvider) IsOIDC() bool {
+	return p.issuer != ""
+}
+
+// discover fetches the issuer's discovery document and keys once; a failed
+// attempt is retried on the next login
+func (p *OAuthProvider) discover(ctx context.Context) error {
+	if !p.IsOIDC() {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.verifier != nil {
+		return nil
+	}
+
+	provider, err := oidc.NewProvider(ctx, p.issuer)
+	if err != nil {
+		return fmt.Errorf("discovering %s: %w", p.issuer, err)
+	}
+	p.config.Endpoint = provider.Endpoint()
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.config.ClientID})
+	return nil
+}
+
+func (p *OAuthProvider) withRedirect(redirectURL string) *oauth2.Config {
+	config := *p.config
+	config.RedirectURL = redirectURL
+	return &config
+}
+
+// AuthCodeURL returns the provider's login URL. The state is checked on the
+// callback, the PKCE verifier proves the code is redeemed by whoever started
+// the login, and the nonce is bound into the ID token.
+func (p *OAuthProvider) AuthCodeURL(ctx context.Context, redirectURL, state, nonce, verifier string) (string, error) {
+	if err := p.discover(ctx); err != nil {
+		return "", err
+	}
+	opts := []oauth2.AuthCodeOption{oauth2.S256ChallengeOption(verifier)}
+	if p.IsOIDC() {
+		opts = append(opts, oidc.Nonce(nonce))
+	}
+	return p.withRedirect(redirectURL).AuthCodeURL(state, opts...), nil
+}
+
+func (p *OAuthProvider) Exchange(ctx context.Context, redirectURL, code, verifier string) (*oauth2.Token, error) {
+	if err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+	return p.withRedirect(redirectURL).Exchange(ctx, code, oauth2.VerifierOption(verifier))
 }
 
 type OAuthUser struct {
@@ -57,6 +135,9 @@ type OAuthUser struct {
 	Username string `json:"login"` // GitHub uses "login"
 	Name     string `json:"name"`
 	RawID    interface{} `json:"id"` // Can be string or number
+	// Set from OpenID Connect claims only
+	EmailVerified bool     `json:"-"`
+	Groups        []string `json:"-"`
 }
 
 func (u *OAuthUser) UnmarshalJSON(data []byte) error {
@@ -83,7 +164,14 @@ func (u *OAuthUser) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-func (p *OAuthProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*OAuthUser, error) {
+// GetUserInfo identifies the user behind the token. For OpenID Connect the
+// ID token must be signed by the issuer for this client and carry the nonce
+// the login started with.
+func (p *OAuthProvider) GetUserInfo(ctx context.Context, token *oauth2.Token, nonce string) (*OAuthUser, error) {
+	if p.IsOIDC() {
+		return p.verifyIDToken(ctx, token, nonce)
+	}
+
 	client := p.config.Client(ctx, token)
 	resp, err := client.Get(p.userInfoURL)
 	if err != nil {
@@ -126,3 +214,72 @@ func (p *OAuthProvider) GetUserInfo(ctx context.Context, token *oauth2.Token) (*
 	
 	return &user, nil
 }
+
+func (p *OAuthProvider) verifyIDToken(ctx context.Context, token *oauth2.Token, nonce string) (*OAuthUser, error) {
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no id_token in token response")
+	}
+	if err := p.discover(ctx); err != nil {
+		return nil, err
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if nonce == "" || idToken.Nonce != nonce {
+		return nil, errors.New("id_token nonce mismatch")
+	}
+
+	var claims struct {
+		Email             string `json:"email"`
+		EmailVerified     bool   `json:"email_verified"`
+		PreferredUsername string `json:"preferred_username"`
+		Name              string `json:"name"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	var all map[string]interface{}
+	if err := idToken.Claims(&all); err != nil {
+		return nil, err
+	}
+
+	return &OAuthUser{
+		ID:            idToken.Subject,
+		Email:         claims.Email,
+		EmailVerified: claims.EmailVerified,
+		Username:      claims.PreferredUsername,
+		Name:          claims.Name,
+		Groups:        claimStrings(all, p.groupsClaim),
+	}, nil
+}
+
+// claimStrings reads a string or string-list claim at a dotted path
+func claimStrings(claims map[string]interface{}, path string) []string {
+	if path == "" {
+		return nil
+	}
+	var value interface{} = claims
+	for _, key := range strings.Split(path, ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = m[key]
+	}
+
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
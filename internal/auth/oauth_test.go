@@ -0,0 +1,274 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/oauth2"
+)
+
+// mockIssuer is an in-process OpenID Connect issuer serving discovery, keys
+// and a token endpoint that enforces PKCE
+type mockIssuer struct {
+	*httptest.Server
+	key      *rsa.PrivateKey
+	clientID string
+
+	mu sync.Mutex
+	// Pending authorization codes: the PKCE challenge and nonce of the
+	// login that obtained them
+	codes map[string]pendingCode
+	// Claims added to the next ID token; nonce overrides the login's
+	claims map[string]interface{}
+}
+
+type pendingCode struct {
+	challenge string
+	nonce     string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{key: key, clientID: "shebang", codes: map[string]pendingCode{}, claims: map[string]interface{}{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                m.URL,
+			"authorization_endpoint":                m.URL + "/authorize",
+			"token_endpoint":                        m.URL + "/token",
+			"jwks_uri":                              m.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"alg": "RS256",
+				"use": "sig",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+// authorize stands in for the user approving the login at the issuer: it
+// records the login's PKCE challenge and nonce against a new code
+func (m *mockIssuer) authorize(t *testing.T, loginURL string) (code, state string) {
+	t.Helper()
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		t.Fatalf("login URL lacks an S256 PKCE challenge: %s", loginURL)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code = "code-" + q.Get("state")
+	m.codes[code] = pendingCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	return code, q.Get("state")
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	m.mu.Lock()
+	pending, ok := m.codes[r.Form.Get("code")]
+	delete(m.codes, r.Form.Get("code"))
+	extra := m.claims
+	m.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != pending.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	claims := jwt.MapClaims{
+		"iss":   m.URL,
+		"sub":   "user-1",
+		"aud":   m.clientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": pending.nonce,
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(m.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access",
+		"token_type":   "Bearer",
+		"expires_in":   60,
+		"id_token":     idToken,
+	})
+}
+
+func (m *mockIssuer) provider(groupsClaim string) *OAuthProvider {
+	return NewOIDCProvider("corp", "Corp", m.URL, m.clientID, "secret", []string{"openid", "email"}, groupsClaim)
+}
+
+const redirectURL = "http://shebang.test/api/auth/oauth/corp/callback"
+
+func TestOIDCLogin(t *testing.T) {
+	m := newMockIssuer(t)
+	m.claims = map[string]interface{}{
+		"email":              "ada@example.org",
+		"email_verified":     true,
+		"preferred_username": "ada",
+		"realm_access":       map[string]interface{}{"roles": []string{"devops", "admins"}},
+	}
+	p := m.provider("realm_access.roles")
+	ctx := context.Background()
+
+	verifier := oauth2.GenerateVerifier()
+	loginURL, err := p.AuthCodeURL(ctx, redirectURL, "state-1", "nonce-1", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, state := m.authorize(t, loginURL)
+	if state != "state-1" {
+		t.Errorf("login URL state = %q, want state-1", state)
+	}
+
+	token, err := p.Exchange(ctx, redirectURL, code, verifier)
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	user, err := p.GetUserInfo(ctx, token, "nonce-1")
+	if err != nil {
+		t.Fatalf("GetUserInfo: %v", err)
+	}
+
+	want := &OAuthUser{
+		ID:            "user-1",
+		Email:         "ada@example.org",
+		EmailVerified: true,
+		Username:      "ada",
+		Groups:        []string{"devops", "admins"},
+	}
+	if !reflect.DeepEqual(user, want) {
+		t.Errorf("user = %+v, want %+v", user, want)
+	}
+}
+
+func TestOIDCRejectsWrongNonce(t *testing.T) {
+	m := newMockIssuer(t)
+	p := m.provider("")
+	ctx := context.Background()
+
+	verifier := oauth2.GenerateVerifier()
+	loginURL, err := p.AuthCodeURL(ctx, redirectURL, "state", "nonce-of-this-login", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := m.authorize(t, loginURL)
+	token, err := p.Exchange(ctx, redirectURL, code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.GetUserInfo(ctx, token, "nonce-of-another-login"); err == nil {
+		t.Error("GetUserInfo accepted an ID token issued for another login")
+	}
+	if _, err := p.GetUserInfo(ctx, token, ""); err == nil {
+		t.Error("GetUserInfo accepted an ID token without an expected nonce")
+	}
+}
+
+func TestOIDCRejectsWrongVerifier(t *testing.T) {
+	m := newMockIssuer(t)
+	p := m.provider("")
+	ctx := context.Background()
+
+	loginURL, err := p.AuthCodeURL(ctx, redirectURL, "state", "nonce", oauth2.GenerateVerifier())
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := m.authorize(t, loginURL)
+
+	if _, err := p.Exchange(ctx, redirectURL, code, oauth2.GenerateVerifier()); err == nil {
+		t.Error("Exchange redeemed a code without the login's PKCE verifier")
+	}
+}
+
+func TestOIDCRejectsOtherAudience(t *testing.T) {
+	m := newMockIssuer(t)
+	m.claims = map[string]interface{}{"aud": "another-client"}
+	p := m.provider("")
+	ctx := context.Background()
+
+	verifier := oauth2.GenerateVerifier()
+	loginURL, err := p.AuthCodeURL(ctx, redirectURL, "state", "nonce", verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := m.authorize(t, loginURL)
+	token, err := p.Exchange(ctx, redirectURL, code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.GetUserInfo(ctx, token, "nonce"); err == nil {
+		t.Error("GetUserInfo accepted an ID token issued to another client")
+	}
+}
+
+func TestClaimStrings(t *testing.T) {
+	claims := map[string]interface{}{
+		"groups":       []interface{}{"a", "b", 3},
+		"group":        "single",
+		"realm_access": map[string]interface{}{"roles": []interface{}{"r"}},
+	}
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"groups", []string{"a", "b"}},
+		{"group", []string{"single"}},
+		{"realm_access.roles", []string{"r"}},
+		{"realm_access.missing", nil},
+		{"group.nested", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		if got := claimStrings(claims, tt.path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("claimStrings(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
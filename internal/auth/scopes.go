@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+)
+
+// Scopes that can be granted to API tokens. "secrets:read:<name>" narrows
+// secrets:read to a single secret; a write scope implies the matching read
+// scope. "*" is only held by tokens created before scopes existed.
+var KnownScopes = []string{
+	"scripts:read", "scripts:write",
+	"keys:read", "keys:write",
+	"secrets:read", "secrets:write",
+	"groups:read", "groups:write",
+	"orgs:read", "orgs:write",
+	"ai",
+	"account",
+	"admin",
+}
+
+// ValidScope reports whether scope may be granted to a new API token
+func ValidScope(scope string) bool {
+	if name := strings.TrimPrefix(scope, "secrets:read:"); name != scope {
+		return name != ""
+	}
+	for _, s := range KnownScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeCovers reports whether a granted scope satisfies a required one:
+// scopes cover their own narrower forms ("secrets:read" covers
+// "secrets:read:db") and write covers read
+func scopeCovers(granted, required string) bool {
+	if granted == "*" || granted == required || strings.HasPrefix(required, granted+":") {
+		return true
+	}
+	if resource, rest, ok := strings.Cut(required, ":read"); ok && (rest == "" || rest[0] == ':') {
+		return granted == resource+":write"
+	}
+	return false
+}
+
+// HasScope reports whether the credential may perform an action requiring
+// scope. Session (JWT) logins carry no scopes and may do anything.
+func (c *Claims) HasScope(scope string) bool {
+	if c.Scopes == nil {
+		return true
+	}
+	for _, granted := range c.Scopes {
+		if scopeCovers(granted, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasAnyScopeUnder is HasScope that also accepts narrower grants, such as
+// "secrets:read:db" for "secrets:read"; handlers then check the exact scope
+func (c *Claims) HasAnyScopeUnder(scope string) bool {
+	if c.HasScope(scope) {
+		return true
+	}
+	for _, granted := range c.Scopes {
+		if strings.HasPrefix(granted, scope+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// CanUseScript reports whether the credential is allowed to act on the
+// script; API tokens may be restricted to a fixed set of scripts
+func (c *Claims) CanUseScript(scriptID int64) bool {
+	if len(c.ScriptIDs) == 0 {
+		return true
+	}
+	for _, id := range c.ScriptIDs {
+		if id == scriptID {
+			return true
+		}
+	}
+	return false
+}
+
+// HashToken hashes a high-entropy secret such as an API token secret for
+// storage; unlike passwords these do not need a slow hash
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckTokenHash compares a secret against a stored HashToken value in
+// constant time
+func CheckTokenHash(secret, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashToken(secret)), []byte(hash)) == 1
+}
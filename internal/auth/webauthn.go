@@ -0,0 +1,197 @@
+package auth
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// WebAuthnCeremonyTTL bounds how long a registration or login ceremony may
+// take between its begin and finish requests
+const WebAuthnCeremonyTTL = 5 * time.Minute
+
+// WebAuthn runs passkey registration and assertion ceremonies. Ceremony state
+// and credentials are handed to callers as JSON so they can be stored without
+// depending on the WebAuthn library.
+type WebAuthn struct {
+	w *webauthn.WebAuthn
+}
+
+func NewWebAuthn(rpID, rpName string, origins []string) (*WebAuthn, error) {
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: WebAuthnCeremonyTTL, TimeoutUVD: WebAuthnCeremonyTTL}
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: rpName,
+		RPOrigins:     origins,
+		Timeouts:      webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthn{w: w}, nil
+}
+
+// WebAuthnUser adapts an account and its stored credentials to the library.
+// The user handle stored in passkeys is the 8-byte big-endian user ID.
+type WebAuthnUser struct {
+	ID          int64
+	Name        string
+	credentials []webauthn.Credential
+}
+
+// NewWebAuthnUser decodes the user's stored credentials
+func NewWebAuthnUser(id int64, name string, credentials [][]byte) (*WebAuthnUser, error) {
+	u := &WebAuthnUser{ID: id, Name: name}
+	for _, data := range credentials {
+		var c webauthn.Credential
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, err
+		}
+		u.credentials = append(u.credentials, c)
+	}
+	return u, nil
+}
+
+func (u *WebAuthnUser) WebAuthnID() []byte {
+	return webAuthnUserHandle(u.ID)
+}
+
+func (u *WebAuthnUser) WebAuthnName() string {
+	return u.Name
+}
+
+func (u *WebAuthnUser) WebAuthnDisplayName() string {
+	return u.Name
+}
+
+func (u *WebAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *WebAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func webAuthnUserHandle(userID int64) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(userID))
+	return handle
+}
+
+// ParseWebAuthnUserHandle returns the user ID a discoverable passkey names
+func ParseWebAuthnUserHandle(handle []byte) (int64, error) {
+	if len(handle) != 8 {
+		return 0, errors.New("invalid user handle")
+	}
+	return int64(binary.BigEndian.Uint64(handle)), nil
+}
+
+// WebAuthnCredential is a newly registered or just used credential
+type WebAuthnCredential struct {
+	ID []byte
+	// Data is the JSON form to store and pass back to NewWebAuthnUser
+	Data []byte
+}
+
+func newWebAuthnCredential(c *webauthn.Credential) (*WebAuthnCredential, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnCredential{ID: c.ID, Data: data}, nil
+}
+
+// BeginRegistration returns the options for navigator.credentials.create and
+// the ceremony state to keep until FinishRegistration. Passkeys are
+// discoverable so they also work for passwordless login, and the user's
+// existing credentials are excluded so an authenticator is not added twice.
+func (wa *WebAuthn) BeginRegistration(user *WebAuthnUser) (*protocol.CredentialCreation, []byte, error) {
+	exclude := make([]protocol.CredentialDescriptor, len(user.credentials))
+	for i, c := range user.credentials {
+		exclude[i] = c.Descriptor()
+	}
+
+	creation, session, err := wa.w.BeginRegistration(user,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired),
+		webauthn.WithExclusions(exclude),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	state, err := json.Marshal(session)
+	return creation, state, err
+}
+
+// FinishRegistration verifies the attestation in the request body
+func (wa *WebAuthn) FinishRegistration(user *WebAuthnUser, state []byte, r *http.Request) (*WebAuthnCredential, error) {
+	var session webauthn.SessionData
+	if err := json.Unmarshal(state, &session); err != nil {
+		return nil, err
+	}
+	c, err := wa.w.FinishRegistration(user, session, r)
+	if err != nil {
+		return nil, err
+	}
+	return newWebAuthnCredential(c)
+}
+
+// BeginLogin starts an assertion. For a known user (passkey as a second
+// factor) only their credentials are allowed; with a nil user any
+// discoverable passkey may answer, and user verification is required since
+// the passkey is then the only factor.
+func (wa *WebAuthn) BeginLogin(user *WebAuthnUser) (*protocol.CredentialAssertion, []byte, error) {
+	var assertion *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+	var err error
+	if user == nil {
+		assertion, session, err = wa.w.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	} else {
+		assertion, session, err = wa.w.BeginLogin(user)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	state, err := json.Marshal(session)
+	return assertion, state, err
+}
+
+// FinishLogin verifies the assertion in the request body. For a
+// discoverable login the user is looked up by the handle in the passkey.
+// It returns the user and the credential with its updated sign count.
+func (wa *WebAuthn) FinishLogin(user *WebAuthnUser, lookup func(userID int64) (*WebAuthnUser, error), state []byte, r *http.Request) (*WebAuthnUser, *WebAuthnCredential, error) {
+	var session webauthn.SessionData
+	if err := json.Unmarshal(state, &session); err != nil {
+		return nil, nil, err
+	}
+
+	var c *webauthn.Credential
+	var err error
+	if user != nil {
+		c, err = wa.w.FinishLogin(user, session, r)
+	} else {
+		c, err = wa.w.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			userID, err := ParseWebAuthnUserHandle(userHandle)
+			if err != nil {
+				return nil, err
+			}
+			user, err = lookup(userID)
+			return user, err
+		}, session, r)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// A counter that went backwards means the key may have been cloned
+	if c.Authenticator.CloneWarning {
+		return nil, nil, errors.New("authenticator sign count went backwards")
+	}
+
+	stored, err := newWebAuthnCredential(c)
+	return user, stored, err
+}
@@ -3,19 +3,54 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
+// DefaultJWTSecret is the placeholder JWT_SECRET; the server refuses to sign
+// tokens with it outside DEV_MODE
+const DefaultJWTSecret = "change-me-in-production"
+
 type Config struct {
 	ServerPort       string
 	DatabaseURL      string
 	JWTSecret        string
+	JWTSigningKeyFile string
+	JWTVerificationKeyFiles []string
+	DevMode          bool
 	StorageType      string
 	S3Endpoint       string
 	S3AccessKey      string
 	S3SecretKey      string
 	S3Bucket         string
+	S3Region         string
+	S3UseSSL         bool
+	S3CACertFile     string
+	S3PathStyle      bool
+	S3KeyPrefix      string
+	S3SSE            string // AES256 or aws:kms
+	S3SSEKMSKeyID    string
+	// Public downloads of at least this many bytes redirect to a presigned
+	// S3 URL valid for S3PresignExpirySeconds; 0 serves everything directly
+	S3PresignThreshold     int64
+	S3PresignExpirySeconds int
 	LocalStoragePath string
+	StorageCompression string // none, gzip or zstd for new blobs
+	// Second backend written alongside the first while migrating, see
+	// loadMirrorStorage
+	MirrorStorage    *StorageBackendConfig
 	DefaultRateLimit int
+	RateLimitBurst   float64 // token bucket size as a multiple of the per-minute limit
+	PublicFetchRateLimit int // per client IP a minute across public script routes
+	ScriptFetchRateLimit int // per script a minute across all clients
+	RateLimitStore   string // memory or redis
+	RedisURL         string
+	// Reverse proxies, as CIDRs or IPs, whose X-Real-IP header is believed
+	TrustedProxies   []string
+	BlobGCIntervalHours int // 0 disables the orphaned blob collector
+	BlobGCGraceHours    int
+	BlobGCDryRun        bool
+	ScrubIntervalHours  int // 0 disables the integrity scrub
+	ScrubBlobsPerSecond float64
 	DefaultMaxScripts int
 	DefaultMaxScriptSize int64
 	GitHubClientID   string
@@ -23,6 +58,56 @@ type Config struct {
 	GoogleClientID   string
 	GoogleClientSecret string
 	
+	// Generic OpenID Connect providers, see loadOIDCProviders
+	OIDCProviders []OIDCProviderConfig
+	
+	// LDAP / Active Directory sign-in, off while LDAPURL is empty. See
+	// auth.LDAPConfig; LDAPGroupMap maps group DNs to shebang.run group IDs.
+	LDAPURL                string
+	LDAPStartTLS           bool
+	LDAPInsecureSkipVerify bool
+	LDAPCACertFile         string
+	LDAPBindDN             string
+	LDAPBindPassword       string
+	LDAPBaseDN             string
+	LDAPUserFilter         string
+	LDAPUsernameAttribute  string
+	LDAPEmailAttribute     string
+	LDAPIDAttribute        string
+	LDAPGroupAttribute     string
+	LDAPGroupBaseDN        string
+	LDAPGroupFilter        string
+	LDAPGroupMap           map[string][]int64
+	
+	// WebAuthn relying party: passkeys are bound to the RP ID (the site's
+	// domain) and only accepted from the listed origins
+	WebAuthnRPID    string
+	WebAuthnOrigins []string
+	
+	// Lifetime of API tokens issued to devices through the device
+	// authorization flow; 0 means they do not expire
+	DeviceTokenTTLDays int
+	
+	// Sign-in lockout: after the threshold of consecutive failures an
+	// account or IP is locked for the base duration, doubling with each
+	// further failure up to the maximum
+	LoginLockoutThreshold   int
+	LoginIPLockoutThreshold int
+	LoginLockoutSeconds     int
+	LoginLockoutMaxSeconds  int
+	
+	// Outgoing mail for password resets and email verification. PublicURL
+	// is the site's address for links in mail; it is never taken from the
+	// request, whose Host header the client controls.
+	PublicURL    string
+	Mailer       string // smtp or log
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+	MailDir      string // log mailer: write messages here instead of the log
+	
 	// Encryption
 	MasterKeySource string
 	MasterKeyEnv    string
@@ -43,20 +128,76 @@ func Load() *Config {
 	return &Config{
 		ServerPort:       getEnv("SERVER_PORT", "8080"),
 		DatabaseURL:      getEnv("DATABASE_URL", "root:password@tcp(mariadb:3306)/shebang?parseTime=true"),
-		JWTSecret:        getEnv("JWT_SECRET", "change-me-in-production"),
+		JWTSecret:        getEnv("JWT_SECRET", DefaultJWTSecret),
+		JWTSigningKeyFile: getEnv("JWT_SIGNING_KEY_FILE", ""),
+		JWTVerificationKeyFiles: getEnvList("JWT_VERIFICATION_KEY_FILES"),
+		DevMode:          getEnv("DEV_MODE", "") == "true",
 		StorageType:      getEnv("STORAGE_TYPE", "s3"),
 		S3Endpoint:       getEnv("S3_ENDPOINT", "minio:9000"),
 		S3AccessKey:      getEnv("S3_ACCESS_KEY", "minioadmin"),
 		S3SecretKey:      getEnv("S3_SECRET_KEY", "minioadmin"),
 		S3Bucket:         getEnv("S3_BUCKET", "scripts"),
+		S3Region:         getEnv("S3_REGION", ""),
+		S3UseSSL:         getEnv("S3_USE_SSL", "") == "true",
+		S3CACertFile:     getEnv("S3_CA_CERT_FILE", ""),
+		S3PathStyle:      getEnv("S3_PATH_STYLE", "") == "true",
+		S3KeyPrefix:      getEnv("S3_KEY_PREFIX", ""),
+		S3SSE:            getEnv("S3_SSE", ""),
+		S3SSEKMSKeyID:    getEnv("S3_SSE_KMS_KEY_ID", ""),
+		S3PresignThreshold: getEnvInt64("S3_PRESIGN_THRESHOLD_BYTES", 0),
+		S3PresignExpirySeconds: getEnvInt("S3_PRESIGN_EXPIRY_SECONDS", 300),
 		LocalStoragePath: getEnv("LOCAL_STORAGE_PATH", "/data/scripts"),
+		StorageCompression: getEnv("STORAGE_COMPRESSION", "gzip"),
+		MirrorStorage:    loadMirrorStorage(),
 		DefaultRateLimit: getEnvInt("DEFAULT_RATE_LIMIT", 50),
+		RateLimitBurst: getEnvFloat("RATE_LIMIT_BURST", 1),
+		PublicFetchRateLimit: getEnvInt("PUBLIC_FETCH_RATE_LIMIT", 600),
+		ScriptFetchRateLimit: getEnvInt("SCRIPT_FETCH_RATE_LIMIT", 6000),
+		RateLimitStore: getEnv("RATE_LIMIT_STORE", "memory"),
+		RedisURL: getEnv("REDIS_URL", "redis://localhost:6379"),
+		TrustedProxies: getEnvList("TRUSTED_PROXIES"),
+		BlobGCIntervalHours: getEnvInt("BLOB_GC_INTERVAL_HOURS", 24),
+		BlobGCGraceHours: getEnvInt("BLOB_GC_GRACE_HOURS", 24),
+		BlobGCDryRun: getEnv("BLOB_GC_DRY_RUN", "") == "true",
+		ScrubIntervalHours: getEnvInt("SCRUB_INTERVAL_HOURS", 168),
+		ScrubBlobsPerSecond: getEnvFloat("SCRUB_BLOBS_PER_SECOND", 10),
 		DefaultMaxScripts: getEnvInt("DEFAULT_MAX_SCRIPTS", 25),
 		DefaultMaxScriptSize: getEnvInt64("DEFAULT_MAX_SCRIPT_SIZE", 1048576),
 		GitHubClientID:   getEnv("GITHUB_CLIENT_ID", ""),
 		GitHubClientSecret: getEnv("GITHUB_CLIENT_SECRET", ""),
 		GoogleClientID:   getEnv("GOOGLE_CLIENT_ID", ""),
 		GoogleClientSecret: getEnv("GOOGLE_CLIENT_SECRET", ""),
+		OIDCProviders:    loadOIDCProviders(),
+		LDAPURL:          getEnv("LDAP_URL", ""),
+		LDAPStartTLS:     getEnv("LDAP_STARTTLS", "") == "true",
+		LDAPInsecureSkipVerify: getEnv("LDAP_TLS_INSECURE_SKIP_VERIFY", "") == "true",
+		LDAPCACertFile:   getEnv("LDAP_CA_CERT_FILE", ""),
+		LDAPBindDN:       getEnv("LDAP_BIND_DN", ""),
+		LDAPBindPassword: getEnv("LDAP_BIND_PASSWORD", ""),
+		LDAPBaseDN:       getEnv("LDAP_SEARCH_BASE", ""),
+		LDAPUserFilter:   getEnv("LDAP_USER_FILTER", "(&(objectClass=person)(uid={username}))"),
+		LDAPUsernameAttribute: getEnv("LDAP_USERNAME_ATTRIBUTE", "uid"),
+		LDAPEmailAttribute: getEnv("LDAP_EMAIL_ATTRIBUTE", "mail"),
+		LDAPIDAttribute:  getEnv("LDAP_ID_ATTRIBUTE", "entryUUID"),
+		LDAPGroupAttribute: getEnv("LDAP_GROUP_ATTRIBUTE", "memberOf"),
+		LDAPGroupBaseDN:  getEnv("LDAP_GROUP_SEARCH_BASE", ""),
+		LDAPGroupFilter:  getEnv("LDAP_GROUP_FILTER", "(member={dn})"),
+		LDAPGroupMap:     loadLDAPGroupMap(),
+		WebAuthnRPID:     getEnv("WEBAUTHN_RP_ID", "localhost"),
+		WebAuthnOrigins:  getEnvListDefault("WEBAUTHN_ORIGINS", []string{"http://localhost", "http://localhost:8080"}),
+		DeviceTokenTTLDays: getEnvInt("DEVICE_TOKEN_TTL_DAYS", 90),
+		LoginLockoutThreshold: getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 5),
+		LoginIPLockoutThreshold: getEnvInt("LOGIN_IP_LOCKOUT_THRESHOLD", 20),
+		LoginLockoutSeconds: getEnvInt("LOGIN_LOCKOUT_SECONDS", 60),
+		LoginLockoutMaxSeconds: getEnvInt("LOGIN_LOCKOUT_MAX_SECONDS", 3600),
+		PublicURL:        strings.TrimRight(getEnv("PUBLIC_URL", "http://localhost"), "/"),
+		Mailer:           getEnv("MAILER", "log"),
+		SMTPHost:         getEnv("SMTP_HOST", ""),
+		SMTPPort:         getEnvInt("SMTP_PORT", 587),
+		SMTPUsername:     getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:     getEnv("SMTP_PASSWORD", ""),
+		MailFrom:         getEnv("MAIL_FROM", "shebang.run <noreply@localhost>"),
+		MailDir:          getEnv("MAIL_DIR", ""),
 		MasterKeySource:  getEnv("MASTER_KEY_SOURCE", "env"),
 		MasterKeyEnv:     getEnv("MASTER_KEY_ENV", "MASTER_ENCRYPTION_KEY"),
 		SecretsBackend:   getEnv("SECRETS_BACKEND", "database"),
@@ -69,6 +210,133 @@ func Load() *Config {
 	}
 }
 
+// StorageBackendConfig configures one blob storage backend
+type StorageBackendConfig struct {
+	Type        string // s3 or local
+	S3Endpoint  string
+	S3AccessKey string
+	S3SecretKey string
+	S3Bucket    string
+	S3Region    string
+	S3UseSSL    bool
+	S3CACertFile string
+	S3PathStyle bool
+	S3KeyPrefix string
+	S3SSE       string
+	S3SSEKMSKeyID string
+	LocalPath   string
+}
+
+// Storage returns the backend scripts are stored in
+func (c *Config) Storage() StorageBackendConfig {
+	return StorageBackendConfig{
+		Type:        c.StorageType,
+		S3Endpoint:  c.S3Endpoint,
+		S3AccessKey: c.S3AccessKey,
+		S3SecretKey: c.S3SecretKey,
+		S3Bucket:    c.S3Bucket,
+		S3Region:    c.S3Region,
+		S3UseSSL:    c.S3UseSSL,
+		S3CACertFile: c.S3CACertFile,
+		S3PathStyle: c.S3PathStyle,
+		S3KeyPrefix: c.S3KeyPrefix,
+		S3SSE:       c.S3SSE,
+		S3SSEKMSKeyID: c.S3SSEKMSKeyID,
+		LocalPath:   c.LocalStoragePath,
+	}
+}
+
+// loadMirrorStorage reads the mirror backend from MIRROR_STORAGE_TYPE and
+// the MIRROR_-prefixed S3_* variables or MIRROR_LOCAL_STORAGE_PATH, or
+// returns nil when no type is set
+func loadMirrorStorage() *StorageBackendConfig {
+	backendType := getEnv("MIRROR_STORAGE_TYPE", "")
+	if backendType == "" {
+		return nil
+	}
+	return &StorageBackendConfig{
+		Type:        backendType,
+		S3Endpoint:  getEnv("MIRROR_S3_ENDPOINT", ""),
+		S3AccessKey: getEnv("MIRROR_S3_ACCESS_KEY", ""),
+		S3SecretKey: getEnv("MIRROR_S3_SECRET_KEY", ""),
+		S3Bucket:    getEnv("MIRROR_S3_BUCKET", "scripts"),
+		S3Region:    getEnv("MIRROR_S3_REGION", ""),
+		S3UseSSL:    getEnv("MIRROR_S3_USE_SSL", "") == "true",
+		S3CACertFile: getEnv("MIRROR_S3_CA_CERT_FILE", ""),
+		S3PathStyle: getEnv("MIRROR_S3_PATH_STYLE", "") == "true",
+		S3KeyPrefix: getEnv("MIRROR_S3_KEY_PREFIX", ""),
+		S3SSE:       getEnv("MIRROR_S3_SSE", ""),
+		S3SSEKMSKeyID: getEnv("MIRROR_S3_SSE_KMS_KEY_ID", ""),
+		LocalPath:   getEnv("MIRROR_LOCAL_STORAGE_PATH", ""),
+	}
+}
+
+// OIDCProviderConfig configures one OpenID Connect login provider
+type OIDCProviderConfig struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	// Claim listing the user's IdP groups, and the shebang.run group IDs
+	// each IdP group maps to
+	GroupsClaim string
+	GroupMap    map[string][]int64
+}
+
+// loadOIDCProviders reads the providers named in OIDC_PROVIDERS
+// (comma-separated, lowercase) from OIDC_<NAME>_* variables:
+// ISSUER, CLIENT_ID, CLIENT_SECRET, DISPLAY_NAME, SCOPES, GROUPS_CLAIM and
+// GROUP_MAP, the latter as "idp-group=groupID,..."
+func loadOIDCProviders() []OIDCProviderConfig {
+	var providers []OIDCProviderConfig
+	for _, name := range getEnvList("OIDC_PROVIDERS") {
+		name = strings.ToLower(name)
+		prefix := "OIDC_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name)) + "_"
+
+		p := OIDCProviderConfig{
+			Name:         name,
+			DisplayName:  getEnv(prefix+"DISPLAY_NAME", name),
+			Issuer:       getEnv(prefix+"ISSUER", ""),
+			ClientID:     getEnv(prefix+"CLIENT_ID", ""),
+			ClientSecret: getEnv(prefix+"CLIENT_SECRET", ""),
+			Scopes:       getEnvListDefault(prefix+"SCOPES", []string{"openid", "profile", "email"}),
+			GroupsClaim:  getEnv(prefix+"GROUPS_CLAIM", "groups"),
+			GroupMap:     map[string][]int64{},
+		}
+		for _, entry := range getEnvList(prefix + "GROUP_MAP") {
+			parts := strings.SplitN(entry, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			if groupID, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64); err == nil {
+				idpGroup := strings.TrimSpace(parts[0])
+				p.GroupMap[idpGroup] = append(p.GroupMap[idpGroup], groupID)
+			}
+		}
+		providers = append(providers, p)
+	}
+	return providers
+}
+
+// loadLDAPGroupMap reads LDAP_GROUP_MAP, "groupDN=groupID;..." separated by
+// semicolons since DNs contain commas. The ID follows the last "=".
+func loadLDAPGroupMap() map[string][]int64 {
+	groupMap := map[string][]int64{}
+	for _, entry := range strings.Split(os.Getenv("LDAP_GROUP_MAP"), ";") {
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			continue
+		}
+		if groupID, err := strconv.ParseInt(strings.TrimSpace(entry[i+1:]), 10, 64); err == nil {
+			groupDN := strings.TrimSpace(entry[:i])
+			groupMap[groupDN] = append(groupMap[groupDN], groupID)
+		}
+	}
+	return groupMap
+}
+
 func getEnv(key, defaultVal string) string {
 	if val := os.Getenv(key); val != "" {
 		return val
@@ -93,3 +361,29 @@ func getEnvInt64(key string, defaultVal int64) int64 {
 	}
 	return defaultVal
 }
+
+func getEnvFloat(key string, defaultVal float64) float64 {
+	if val := os.Getenv(key); val != "" {
+		if f, err := strconv.ParseFloat(val, 64); err == nil {
+			return f
+		}
+	}
+	return defaultVal
+}
+
+func getEnvList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func getEnvListDefault(key string, defaultVal []string) []string {
+	if list := getEnvList(key); len(list) > 0 {
+		return list
+	}
+	return defaultVal
+}
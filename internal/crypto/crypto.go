@@ -106,6 +106,12 @@ func DecryptData(ciphertext []byte, key []byte) ([]byte, error) {
 	return aead.Open(nil, nonce, ciphertext, nil)
 }
 
+// EncryptedSize is the length of EncryptData's output for plaintextSize
+// bytes: the nonce, the ciphertext and the authentication tag
+func EncryptedSize(plaintextSize int64) int64 {
+	return chacha20poly1305.NonceSizeX + plaintextSize + chacha20poly1305.Overhead
+}
+
 func GenerateEncryptionKey() ([]byte, error) {
 	key := make([]byte, chacha20poly1305.KeySize)
 	if _, err := rand.Read(key); err != nil {
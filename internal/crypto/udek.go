@@ -72,6 +72,41 @@ func (m *UDEKManager) createUDEK(userID int64) ([]byte, error) {
 	return udek, nil
 }
 
+// GetOrCreateOrgDEK retrieves or creates the data encryption key for an
+// organization, used to encrypt organization-owned secrets
+func (m *UDEKManager) GetOrCreateOrgDEK(orgID int64) ([]byte, error) {
+	var encryptedDEK []byte
+	err := m.db.QueryRow(`
+		SELECT encrypted_dek FROM org_encryption_keys 
+		WHERE org_id = ? ORDER BY id DESC LIMIT 1
+	`, orgID).Scan(&encryptedDEK)
+	
+	if err == sql.ErrNoRows {
+		dek := make([]byte, 32)
+		if _, err := rand.Read(dek); err != nil {
+			return nil, err
+		}
+		
+		encryptedDEK, err := m.kms.Encrypt(dek)
+		if err != nil {
+			return nil, err
+		}
+		
+		_, err = m.db.Exec(`
+			INSERT INTO org_encryption_keys (org_id, encrypted_dek, key_version)
+			VALUES (?, ?, 1)
+		`, orgID, encryptedDEK)
+		if err != nil {
+			return nil, err
+		}
+		return dek, nil
+	} else if err != nil {
+		return nil, err
+	}
+	
+	return m.kms.Decrypt(encryptedDEK)
+}
+
 // EncryptWithUDEK encrypts data with a UDEK
 func EncryptWithUDEK(plaintext []byte, udek []byte) ([]byte, error) {
 	if len(udek) != 32 {
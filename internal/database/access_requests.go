@@ -0,0 +1,223 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const accessRequestSelect = `
+	SELECT ar.id, ar.script_id, s.name, COALESCE(su.username, o.name), ar.requester_id, u.username,
+	       ar.role, COALESCE(ar.reason, ''), ar.status, ar.decided_by, COALESCE(ar.decision_note, ''),
+	       ar.access_id, ar.expires_at, ar.created_at, ar.decided_at
+	FROM access_requests ar
+	JOIN scripts s ON s.id = ar.script_id
+	JOIN users u ON u.id = ar.requester_id
+	LEFT JOIN users su ON su.id = s.user_id
+	LEFT JOIN organizations o ON o.id = s.org_id
+`
+
+func scanAccessRequest(row interface{ Scan(...interface{}) error }) (*AccessRequest, error) {
+	ar := &AccessRequest{}
+	err := row.Scan(&ar.ID, &ar.ScriptID, &ar.ScriptName, &ar.Namespace, &ar.RequesterID, &ar.Requester,
+		&ar.Role, &ar.Reason, &ar.Status, &ar.DecidedBy, &ar.DecisionNote,
+		&ar.AccessID, &ar.ExpiresAt, &ar.CreatedAt, &ar.DecidedAt)
+	return ar, err
+}
+
+func (db *DB) queryAccessRequests(query string, args ...interface{}) ([]*AccessRequest, error) {
+	rows, err := db.Query(accessRequestSelect+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []*AccessRequest
+	for rows.Next() {
+		ar, err := scanAccessRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, ar)
+	}
+	return requests, rows.Err()
+}
+
+func (db *DB) CreateAccessRequest(scriptID, requesterID int64, role, reason string) (*AccessRequest, error) {
+	result, err := db.Exec(
+		"INSERT INTO access_requests (script_id, requester_id, role, reason) VALUES (?, ?, ?, ?)",
+		scriptID, requesterID, role, reason,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetAccessRequestByID(id)
+}
+
+func (db *DB) GetAccessRequestByID(id int64) (*AccessRequest, error) {
+	ar, err := scanAccessRequest(db.QueryRow(accessRequestSelect+"WHERE ar.id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("access request not found")
+	}
+	return ar, err
+}
+
+func (db *DB) HasPendingAccessRequest(scriptID, requesterID int64) (bool, error) {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM access_requests WHERE script_id = ? AND requester_id = ? AND status = 'pending'",
+		scriptID, requesterID,
+	).Scan(&count)
+	return count > 0, err
+}
+
+// GetIncomingAccessRequests lists requests for scripts the user can manage:
+// their own scripts, scripts of organizations they administer and scripts
+// they maintain. An empty status returns every status.
+func (db *DB) GetIncomingAccessRequests(userID int64, status string) ([]*AccessRequest, error) {
+	return db.queryAccessRequests(`
+		WHERE (? = '' OR ar.status = ?)
+		  AND (
+		      s.user_id = ?
+		      OR EXISTS (SELECT 1 FROM org_members om WHERE om.org_id = s.org_id AND om.user_id = ? AND om.role IN ('owner', 'admin'))
+		      OR EXISTS (SELECT 1 FROM script_access sa WHERE sa.script_id = s.id AND sa.access_type = 'user'
+		                 AND sa.user_id = ? AND sa.role = 'maintainer' AND (sa.expires_at IS NULL OR sa.expires_at > NOW()))
+		      OR EXISTS (SELECT 1 FROM script_access sa JOIN group_members gm ON gm.group_id = sa.group_id
+		                 WHERE sa.script_id = s.id AND sa.access_type = 'group' AND gm.user_id = ?
+		                 AND sa.role = 'maintainer' AND (sa.expires_at IS NULL OR sa.expires_at > NOW()))
+		  )
+		ORDER BY ar.created_at DESC
+	`, status, status, userID, userID, userID, userID)
+}
+
+// GetOutgoingAccessRequests lists requests the user has made
+func (db *DB) GetOutgoingAccessRequests(userID int64, status string) ([]*AccessRequest, error) {
+	return db.queryAccessRequests(`
+		WHERE ar.requester_id = ? AND (? = '' OR ar.status = ?)
+		ORDER BY ar.created_at DESC
+	`, userID, status, status)
+}
+
+// GetScriptManagerIDs returns the users who decide access requests for a
+// script: the owner or organization owners/admins, plus maintainers
+func (db *DB) GetScriptManagerIDs(scriptID int64) ([]int64, error) {
+	rows, err := db.Query(`
+		SELECT s.user_id FROM scripts s WHERE s.id = ? AND s.user_id IS NOT NULL
+		UNION
+		SELECT om.user_id FROM scripts s
+		JOIN org_members om ON om.org_id = s.org_id
+		WHERE s.id = ? AND om.role IN ('owner', 'admin')
+		UNION
+		SELECT sa.user_id FROM script_access sa
+		WHERE sa.script_id = ? AND sa.access_type = 'user' AND sa.role = 'maintainer'
+		AND (sa.expires_at IS NULL OR sa.expires_at > NOW())
+		UNION
+		SELECT gm.user_id FROM script_access sa
+		JOIN group_members gm ON gm.group_id = sa.group_id
+		WHERE sa.script_id = ? AND sa.access_type = 'group' AND sa.role = 'maintainer'
+		AND (sa.expires_at IS NULL OR sa.expires_at > NOW())
+	`, scriptID, scriptID, scriptID, scriptID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ApproveAccessRequest grants the requester access to the script and marks
+// the request approved in one transaction. An existing direct grant for the
+// requester is updated rather than duplicated.
+func (db *DB) ApproveAccessRequest(id, decidedBy int64, role, note string, expiresAt *time.Time) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var scriptID, requesterID int64
+	var status string
+	err = tx.QueryRow(
+		"SELECT script_id, requester_id, status FROM access_requests WHERE id = ? FOR UPDATE", id,
+	).Scan(&scriptID, &requesterID, &status)
+	if err == sql.ErrNoRows {
+		return errors.New("access request not found")
+	}
+	if err != nil {
+		return err
+	}
+	if status != "pending" {
+		return errors.New("access request already decided")
+	}
+
+	var accessID int64
+	err = tx.QueryRow(
+		"SELECT id FROM script_access WHERE script_id = ? AND access_type = 'user' AND user_id = ? LIMIT 1",
+		scriptID, requesterID,
+	).Scan(&accessID)
+	switch {
+	case err == sql.ErrNoRows:
+		result, err := tx.Exec(
+			"INSERT INTO script_access (script_id, access_type, user_id, role, granted_by, expires_at) VALUES (?, 'user', ?, ?, ?, ?)",
+			scriptID, requesterID, role, decidedBy, expiresAt,
+		)
+		if err != nil {
+			return err
+		}
+		if accessID, err = result.LastInsertId(); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	default:
+		if _, err := tx.Exec(
+			"UPDATE script_access SET role = ?, granted_by = ?, expires_at = ? WHERE id = ?",
+			role, decidedBy, expiresAt, accessID,
+		); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE access_requests
+		SET status = 'approved', role = ?, decided_by = ?, decision_note = ?, access_id = ?, expires_at = ?, decided_at = NOW()
+		WHERE id = ?
+	`, role, decidedBy, note, accessID, expiresAt, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CloseAccessRequest moves a pending request to denied or cancelled
+func (db *DB) CloseAccessRequest(id int64, status string, decidedBy int64, note string) error {
+	result, err := db.Exec(`
+		UPDATE access_requests SET status = ?, decided_by = ?, decision_note = ?, decided_at = NOW()
+		WHERE id = ? AND status = 'pending'
+	`, status, decidedBy, note, id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("access request already decided")
+	}
+	return nil
+}
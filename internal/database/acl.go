@@ -1,60 +1,144 @@
 package database
 
-// CanAccessScript checks if a user can access a script based on ACL
-func (db *DB) CanAccessScript(scriptID int64, userID *int64) (bool, error) {
-	var ownerID int64
-	var visibility string
-	err := db.QueryRow("SELECT user_id, visibility FROM scripts WHERE id = ?", scriptID).
-		Scan(&ownerID, &visibility)
-	if err != nil {
-		return false, err
+// ScriptPermission is what a user may do with a script, in increasing order
+type ScriptPermission int
+
+const (
+	ScriptPermNone ScriptPermission = iota
+	ScriptPermRead   // view the script and its history
+	ScriptPermWrite  // create versions and move non-protected tags
+	ScriptPermManage // manage sharing, share tokens, visibility and protected tags
+	ScriptPermOwner  // delete the script
+)
+
+// collaboratorRolePerm maps script_access roles to the permission they grant
+var collaboratorRolePerm = map[string]ScriptPermission{
+	"viewer":     ScriptPermRead,
+	"editor":     ScriptPermWrite,
+	"maintainer": ScriptPermManage,
+}
+
+// CollaboratorPermission returns the permission a collaborator role grants
+func CollaboratorPermission(role string) ScriptPermission {
+	return collaboratorRolePerm[role]
+}
+
+// ValidCollaboratorRole reports whether role is a known script collaborator role
+func ValidCollaboratorRole(role string) bool {
+	_, ok := collaboratorRolePerm[role]
+	return ok
+}
+
+// GetScriptPermission returns the management permission a user holds on a
+// script. Personal scripts are fully controlled by their owner; for
+// organization scripts, members may write and admins/owners may do anything.
+// Collaborator grants in script_access, direct or through a group, can raise
+// the permission up to maintainer.
+func (db *DB) GetScriptPermission(script *Script, userID int64) (ScriptPermission, error) {
+	perm := ScriptPermNone
+	if script.OrgID == nil {
+		if script.UserID == userID {
+			return ScriptPermOwner, nil
+		}
+	} else {
+		role, err := db.GetOrgMemberRole(*script.OrgID, userID)
+		if err != nil {
+			return ScriptPermNone, err
+		}
+		switch {
+		case OrgRoleAtLeast(role, "admin"):
+			return ScriptPermOwner, nil
+		case OrgRoleAtLeast(role, "member"):
+			perm = ScriptPermWrite
+		}
 	}
 	
-	// Owner always has access
-	if userID != nil && *userID == ownerID {
-		return true, nil
+	rows, err := db.Query(`
+		SELECT role FROM script_access
+		WHERE script_id = ? AND access_type = 'user' AND user_id = ?
+		AND (expires_at IS NULL OR expires_at > NOW())
+		UNION
+		SELECT sa.role FROM script_access sa
+		JOIN group_members gm ON gm.group_id = sa.group_id
+		WHERE sa.script_id = ? AND sa.access_type = 'group' AND gm.user_id = ?
+		AND (sa.expires_at IS NULL OR sa.expires_at > NOW())
+	`, script.ID, userID, script.ID, userID)
+	if err != nil {
+		return ScriptPermNone, err
 	}
+	defer rows.Close()
 	
-	// Public scripts - anyone
-	if visibility == "public" {
-		return true, nil
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return ScriptPermNone, err
+		}
+		if p := collaboratorRolePerm[role]; p > perm {
+			perm = p
+		}
 	}
-	
-	// Private scripts - handled separately (share tokens or encryption)
-	if visibility == "private" {
-		return false, nil
+	return perm, rows.Err()
+}
+
+// AccessDecision is the outcome of evaluating a request to read a script
+type AccessDecision struct {
+	Allowed bool
+	Via     string // "public", "permission", "link" or "token"
+	// ShareToken is the link presented with the request, if any; when it was
+	// rejected Reason holds its status ("invalid", "revoked", "expired", ...)
+	ShareToken *ShareToken
+	Reason     string
+}
+
+// EvaluateScriptAccess decides whether a request may read a script. It is
+// the single place read access is decided, in this order:
+//   - public scripts are readable by anyone
+//   - owners, organization members and user/group grantees of any visibility
+//   - "anyone with link" grants on unlisted scripts
+//   - a share token for the script that is still active
+// userID is nil for anonymous requests and token is "" when none was given.
+// The token is only checked, not consumed; callers serving content must
+// call ConsumeShareToken.
+func (db *DB) EvaluateScriptAccess(script *Script, userID *int64, token string) (*AccessDecision, error) {
+	if script.Visibility == "public" {
+		return &AccessDecision{Allowed: true, Via: "public"}, nil
 	}
 	
-	// Unlisted - check ACL
-	var count int
-	
-	// Check for "anyone with link" access
-	err = db.QueryRow(`
-		SELECT COUNT(*) FROM script_access 
-		WHERE script_id = ? AND access_type = 'link' 
-		AND (expires_at IS NULL OR expires_at > NOW())
-	`, scriptID).Scan(&count)
-	if err != nil {
-		return false, err
-	}
-	if count > 0 {
-		return true, nil
+	if userID != nil {
+		perm, err := db.GetScriptPermission(script, *userID)
+		if err != nil {
+			return nil, err
+		}
+		if perm >= ScriptPermRead {
+			return &AccessDecision{Allowed: true, Via: "permission"}, nil
+		}
 	}
 	
-	// Check for specific user access
-	if userID != nil {
-		err = db.QueryRow(`
+	if script.Visibility == "unlisted" {
+		var count int
+		err := db.QueryRow(`
 			SELECT COUNT(*) FROM script_access 
-			WHERE script_id = ? AND access_type = 'user' AND user_id = ?
+			WHERE script_id = ? AND access_type = 'link' 
 			AND (expires_at IS NULL OR expires_at > NOW())
-		`, scriptID, *userID).Scan(&count)
+		`, script.ID).Scan(&count)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 		if count > 0 {
-			return true, nil
+			return &AccessDecision{Allowed: true, Via: "link"}, nil
 		}
 	}
 	
-	return false, nil
+	if token == "" {
+		return &AccessDecision{}, nil
+	}
+	
+	st, err := db.GetShareToken(token)
+	if err != nil || st.ScriptID != script.ID {
+		return &AccessDecision{Reason: "invalid"}, nil
+	}
+	if status := st.Status(); status != "active" {
+		return &AccessDecision{ShareToken: st, Reason: status}, nil
+	}
+	return &AccessDecision{Allowed: true, Via: "token", ShareToken: st}, nil
 }
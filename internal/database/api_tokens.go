@@ -2,23 +2,66 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"time"
 )
 
 type APIToken struct {
-	ID           int64
-	UserID       int64
-	Name         string
-	ClientID     string
-	ClientSecret string
-	CreatedAt    string
-	LastUsed     sql.NullString
+	ID         int64
+	UserID     int64
+	Name       string
+	ClientID   string
+	SecretHash string   // SHA-256 of the client secret; the secret itself is never stored
+	Scopes     []string // "*" for tokens created before scopes existed
+	ScriptIDs  []int64  // empty means every script the owner can access
+	ExpiresAt  *time.Time
+	CreatedAt  string
+	LastUsed   sql.NullString
 }
 
-func (db *DB) CreateAPIToken(userID int64, name, clientID, clientSecret string) (*APIToken, error) {
+// Expired reports whether the token is past its expiry date
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && !t.ExpiresAt.After(time.Now())
+}
+
+const apiTokenColumns = "id, user_id, name, client_id, COALESCE(secret_hash, ''), COALESCE(scopes, '[\"*\"]'), script_ids, expires_at, created_at, last_used"
+
+func scanAPIToken(row interface{ Scan(...interface{}) error }) (*APIToken, error) {
+	t := &APIToken{}
+	var scopes string
+	var scriptIDs sql.NullString
+	if err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.ClientID, &t.SecretHash, &scopes, &scriptIDs, &t.ExpiresAt, &t.CreatedAt, &t.LastUsed); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(scopes), &t.Scopes); err != nil {
+		return nil, err
+	}
+	if scriptIDs.Valid {
+		if err := json.Unmarshal([]byte(scriptIDs.String), &t.ScriptIDs); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+func (db *DB) CreateAPIToken(userID int64, name, clientID, secretHash string, scopes []string, scriptIDs []int64, expiresAt *time.Time) (*APIToken, error) {
+	scopesJSON, err := json.Marshal(scopes)
+	if err != nil {
+		return nil, err
+	}
+	var scriptIDsJSON interface{}
+	if len(scriptIDs) > 0 {
+		b, err := json.Marshal(scriptIDs)
+		if err != nil {
+			return nil, err
+		}
+		scriptIDsJSON = string(b)
+	}
+
 	result, err := db.Exec(
-		"INSERT INTO api_tokens (user_id, name, client_id, client_secret) VALUES (?, ?, ?, ?)",
-		userID, name, clientID, clientSecret,
+		"INSERT INTO api_tokens (user_id, name, client_id, secret_hash, scopes, script_ids, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userID, name, clientID, secretHash, string(scopesJSON), scriptIDsJSON, expiresAt,
 	)
 	if err != nil {
 		return nil, err
@@ -33,12 +76,7 @@ func (db *DB) CreateAPIToken(userID int64, name, clientID, clientSecret string)
 }
 
 func (db *DB) GetAPITokenByID(id int64) (*APIToken, error) {
-	token := &APIToken{}
-	err := db.QueryRow(
-		"SELECT id, user_id, name, client_id, client_secret, created_at, last_used FROM api_tokens WHERE id = ?",
-		id,
-	).Scan(&token.ID, &token.UserID, &token.Name, &token.ClientID, &token.ClientSecret, &token.CreatedAt, &token.LastUsed)
-	
+	token, err := scanAPIToken(db.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE id = ?", id))
 	if err == sql.ErrNoRows {
 		return nil, errors.New("token not found")
 	}
@@ -46,12 +84,7 @@ func (db *DB) GetAPITokenByID(id int64) (*APIToken, error) {
 }
 
 func (db *DB) GetAPITokenByClientID(clientID string) (*APIToken, error) {
-	token := &APIToken{}
-	err := db.QueryRow(
-		"SELECT id, user_id, name, client_id, client_secret, created_at, last_used FROM api_tokens WHERE client_id = ?",
-		clientID,
-	).Scan(&token.ID, &token.UserID, &token.Name, &token.ClientID, &token.ClientSecret, &token.CreatedAt, &token.LastUsed)
-	
+	token, err := scanAPIToken(db.QueryRow("SELECT "+apiTokenColumns+" FROM api_tokens WHERE client_id = ?", clientID))
 	if err == sql.ErrNoRows {
 		return nil, errors.New("token not found")
 	}
@@ -60,7 +93,7 @@ func (db *DB) GetAPITokenByClientID(clientID string) (*APIToken, error) {
 
 func (db *DB) GetAPITokensByUserID(userID int64) ([]*APIToken, error) {
 	rows, err := db.Query(
-		"SELECT id, user_id, name, client_id, client_secret, created_at, last_used FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC",
+		"SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = ? ORDER BY created_at DESC",
 		userID,
 	)
 	if err != nil {
@@ -70,8 +103,8 @@ func (db *DB) GetAPITokensByUserID(userID int64) ([]*APIToken, error) {
 	
 	var tokens []*APIToken
 	for rows.Next() {
-		t := &APIToken{}
-		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.ClientID, &t.ClientSecret, &t.CreatedAt, &t.LastUsed); err != nil {
+		t, err := scanAPIToken(rows)
+		if err != nil {
 			return nil, err
 		}
 		tokens = append(tokens, t)
@@ -0,0 +1,97 @@
+package database
+
+// Script content is stored once per distinct content under its SHA-256, see
+// BlobKey. The blobs table counts the script versions referring to each
+// blob; blobs no version refers to are left for the blob GC to remove.
+// Content written before blobs were content-addressed keeps its
+// {user}/{script}/{version} key and is not counted.
+
+// BlobKey returns the storage key of the blob with the hex SHA-256 hash
+func BlobKey(hash string) string {
+	return "sha256/" + hash[:2] + "/" + hash
+}
+
+// AddBlobRef counts one more reference to the blob, recording it if new
+func (db *DB) AddBlobRef(key string, size int64) error {
+	_, err := db.Exec(`
+		INSERT INTO blobs (storage_key, size, ref_count) VALUES (?, ?, 1)
+		ON DUPLICATE KEY UPDATE ref_count = ref_count + 1
+	`, key, size)
+	return err
+}
+
+// ReleaseBlobRef drops a reference counted by AddBlobRef, for a version
+// whose content could not be saved after all
+func (db *DB) ReleaseBlobRef(key string) error {
+	_, err := db.Exec("UPDATE blobs SET ref_count = GREATEST(ref_count - 1, 0) WHERE storage_key = ?", key)
+	return err
+}
+
+// releaseScriptBlobs drops the references the script's versions hold, for
+// use before the script is deleted
+func (db *DB) releaseScriptBlobs(scriptID int64) error {
+	_, err := db.Exec(`
+		UPDATE blobs b
+		JOIN (
+			SELECT c.storage_path, COUNT(*) AS refs
+			FROM script_content c
+			JOIN script_versions v ON v.id = c.version_id
+			WHERE v.script_id = ?
+			GROUP BY c.storage_path
+		) r ON r.storage_path = b.storage_key
+		SET b.ref_count = GREATEST(b.ref_count - r.refs, 0)
+	`, scriptID)
+	return err
+}
+
+// ReconcileBlobRefs recounts every blob's references from script_content,
+// correcting drift from failed writes or cascading deletes. It returns how
+// many blobs were corrected.
+func (db *DB) ReconcileBlobRefs() (int64, error) {
+	result, err := db.Exec(`
+		UPDATE blobs b
+		SET ref_count = (
+			SELECT COUNT(*) FROM script_content c WHERE c.storage_path = b.storage_key
+		)
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// StoredBlob is a blob script content is stored in, with the checksum of
+// one version stored there
+type StoredBlob struct {
+	Key       string
+	Checksum  string // SHA-256 of the version's plaintext
+	Size      int64  // of the plaintext
+	Encrypted bool
+}
+
+// ListStoredBlobs returns every blob script_content refers to, once each,
+// in key order
+func (db *DB) ListStoredBlobs() ([]StoredBlob, error) {
+	rows, err := db.Query(`
+		SELECT c.storage_path, MIN(v.checksum), MIN(v.size), MAX(c.encryption_key_id IS NOT NULL)
+		FROM script_content c
+		JOIN script_versions v ON v.id = c.version_id
+		WHERE c.storage_path IS NOT NULL AND c.storage_path != ''
+		GROUP BY c.storage_path
+		ORDER BY c.storage_path
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blobs []StoredBlob
+	for rows.Next() {
+		var b StoredBlob
+		if err := rows.Scan(&b.Key, &b.Checksum, &b.Size, &b.Encrypted); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, b)
+	}
+	return blobs, rows.Err()
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	DeviceAuthPending  = "pending"
+	DeviceAuthApproved = "approved"
+	DeviceAuthDenied   = "denied"
+)
+
+// DeviceAuthorization is a device's pending login under the OAuth device
+// authorization grant
+type DeviceAuthorization struct {
+	ID           int64
+	UserCode     string
+	ClientName   string
+	Scopes       []string
+	Status       string
+	UserID       *int64 // who approved or denied it
+	RequestIP    string
+	LastPolledAt *time.Time
+	ExpiresAt    time.Time
+	CreatedAt    time.Time
+}
+
+// Expired reports whether the device can no longer complete the login
+func (d *DeviceAuthorization) Expired() bool {
+	return !d.ExpiresAt.After(time.Now())
+}
+
+const deviceAuthorizationColumns = "id, user_code, client_name, scopes, status, user_id, request_ip, last_polled_at, expires_at, created_at"
+
+func scanDeviceAuthorization(row interface{ Scan(...interface{}) error }) (*DeviceAuthorization, error) {
+	d := &DeviceAuthorization{}
+	var scopes string
+	if err := row.Scan(&d.ID, &d.UserCode, &d.ClientName, &scopes, &d.Status, &d.UserID, &d.RequestIP, &d.LastPolledAt, &d.ExpiresAt, &d.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(scopes), &d.Scopes); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// CreateDeviceAuthorization starts a device login. Expired ones are cleaned
+// up on the way.
+func (db *DB) CreateDeviceAuthorization(deviceCodeHash, userCode, clientName string, scopes []string, requestIP string, expiresAt time.Time) error {
+	if _, err := db.Exec("DELETE FROM device_authorizations WHERE expires_at < NOW()"); err != nil {
+		return err
+	}
+	scopesJSON, err := json.Marshal(scopes)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		"INSERT INTO device_authorizations (device_code_hash, user_code, client_name, scopes, request_ip, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		deviceCodeHash, userCode, clientName, string(scopesJSON), requestIP, expiresAt,
+	)
+	return err
+}
+
+func (db *DB) getDeviceAuthorization(where string, arg interface{}) (*DeviceAuthorization, error) {
+	d, err := scanDeviceAuthorization(db.QueryRow("SELECT "+deviceAuthorizationColumns+" FROM device_authorizations WHERE "+where, arg))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("device authorization not found")
+	}
+	return d, err
+}
+
+func (db *DB) GetDeviceAuthorizationByUserCode(userCode string) (*DeviceAuthorization, error) {
+	return db.getDeviceAuthorization("user_code = ?", userCode)
+}
+
+func (db *DB) GetDeviceAuthorizationByDeviceCode(deviceCodeHash string) (*DeviceAuthorization, error) {
+	return db.getDeviceAuthorization("device_code_hash = ?", deviceCodeHash)
+}
+
+// DecideDeviceAuthorization approves or denies a pending, unexpired device
+// login on behalf of userID
+func (db *DB) DecideDeviceAuthorization(id, userID int64, status string) error {
+	result, err := db.Exec(
+		"UPDATE device_authorizations SET status = ?, user_id = ? WHERE id = ? AND status = ? AND expires_at > NOW()",
+		status, userID, id, DeviceAuthPending,
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("device authorization not found")
+	}
+	return nil
+}
+
+func (db *DB) UpdateDeviceAuthorizationPoll(id int64, polledAt time.Time) error {
+	_, err := db.Exec("UPDATE device_authorizations SET last_polled_at = ? WHERE id = ?", polledAt, id)
+	return err
+}
+
+// DeleteDeviceAuthorization removes a finished device login. The caller that
+// deletes it is the only one allowed to act on its outcome.
+func (db *DB) DeleteDeviceAuthorization(id int64) error {
+	result, err := db.Exec("DELETE FROM device_authorizations WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("device authorization not found")
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// CreateEmailToken records a link sent by email until it is used or
+// expires. Expired links are cleaned up on the way.
+func (db *DB) CreateEmailToken(id string, userID int64, purpose string, expiresAt time.Time) error {
+	if _, err := db.Exec("DELETE FROM email_tokens WHERE expires_at < NOW()"); err != nil {
+		return err
+	}
+	_, err := db.Exec(
+		"INSERT INTO email_tokens (id, user_id, purpose, expires_at) VALUES (?, ?, ?, ?)",
+		id, userID, purpose, expiresAt,
+	)
+	return err
+}
+
+// ConsumeEmailToken deletes an outstanding link, failing if it was already
+// used or revoked
+func (db *DB) ConsumeEmailToken(id string, userID int64, purpose string) error {
+	result, err := db.Exec(
+		"DELETE FROM email_tokens WHERE id = ? AND user_id = ? AND purpose = ?",
+		id, userID, purpose,
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("email token not found")
+	}
+	return nil
+}
+
+// DeleteEmailTokens revokes a user's outstanding links for a purpose, e.g.
+// every reset link once the password has changed
+func (db *DB) DeleteEmailTokens(userID int64, purpose string) error {
+	_, err := db.Exec("DELETE FROM email_tokens WHERE user_id = ? AND purpose = ?", userID, purpose)
+	return err
+}
+
+func (db *DB) IsEmailVerified(userID int64) (bool, error) {
+	var verifiedAt sql.NullTime
+	err := db.QueryRow("SELECT email_verified_at FROM users WHERE id = ?", userID).Scan(&verifiedAt)
+	if err == sql.ErrNoRows {
+		return false, errors.New("user not found")
+	}
+	return verifiedAt.Valid, err
+}
+
+// SetEmailVerified marks the user's address verified, as long as it is
+// still the address the link was sent to
+func (db *DB) SetEmailVerified(userID int64, email string) error {
+	result, err := db.Exec(
+		"UPDATE users SET email_verified_at = COALESCE(email_verified_at, NOW()) WHERE id = ? AND email = ?",
+		userID, email,
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE id = ? AND email = ?", userID, email).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return errors.New("user not found")
+		}
+	}
+	return nil
+}
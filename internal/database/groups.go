@@ -0,0 +1,198 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// CreateGroup creates a user group and adds the owner as its first member
+func (db *DB) CreateGroup(ownerID int64, name, description string) (*UserGroup, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO user_groups (owner_id, name, description) VALUES (?, ?, ?)",
+		ownerID, name, description,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO group_members (group_id, user_id, added_by) VALUES (?, ?, ?)",
+		id, ownerID, ownerID,
+	); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return db.GetGroupByID(id)
+}
+
+func (db *DB) GetGroupByID(id int64) (*UserGroup, error) {
+	g := &UserGroup{}
+	err := db.QueryRow(
+		"SELECT id, owner_id, name, COALESCE(description, ''), created_at, updated_at FROM user_groups WHERE id = ?",
+		id,
+	).Scan(&g.ID, &g.OwnerID, &g.Name, &g.Description, &g.CreatedAt, &g.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, errors.New("group not found")
+	}
+	return g, err
+}
+
+// GetGroupsForUser returns every group the user owns or belongs to
+func (db *DB) GetGroupsForUser(userID int64) ([]*UserGroup, error) {
+	rows, err := db.Query(`
+		SELECT g.id, g.owner_id, g.name, COALESCE(g.description, ''), g.created_at, g.updated_at
+		FROM user_groups g
+		JOIN group_members gm ON gm.group_id = g.id
+		WHERE gm.user_id = ?
+		ORDER BY g.name
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var groups []*UserGroup
+	for rows.Next() {
+		g := &UserGroup{}
+		if err := rows.Scan(&g.ID, &g.OwnerID, &g.Name, &g.Description, &g.CreatedAt, &g.UpdatedAt); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+func (db *DB) UpdateGroup(id int64, name, description string) error {
+	_, err := db.Exec(
+		"UPDATE user_groups SET name = ?, description = ? WHERE id = ?",
+		name, description, id,
+	)
+	return err
+}
+
+func (db *DB) DeleteGroup(id, ownerID int64) error {
+	result, err := db.Exec("DELETE FROM user_groups WHERE id = ? AND owner_id = ?", id, ownerID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("group not found")
+	}
+	return nil
+}
+
+func (db *DB) AddGroupMember(groupID, userID, addedBy int64) error {
+	_, err := db.Exec(
+		"INSERT IGNORE INTO group_members (group_id, user_id, added_by) VALUES (?, ?, ?)",
+		groupID, userID, addedBy,
+	)
+	return err
+}
+
+func (db *DB) RemoveGroupMember(groupID, userID int64) error {
+	result, err := db.Exec("DELETE FROM group_members WHERE group_id = ? AND user_id = ?", groupID, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("member not found")
+	}
+	return nil
+}
+
+func (db *DB) GetGroupMembers(groupID int64) ([]*GroupMemberInfo, error) {
+	rows, err := db.Query(`
+		SELECT gm.user_id, u.username, gm.added_by, gm.added_at
+		FROM group_members gm
+		JOIN users u ON u.id = gm.user_id
+		WHERE gm.group_id = ?
+		ORDER BY u.username
+	`, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []*GroupMemberInfo
+	for rows.Next() {
+		m := &GroupMemberInfo{}
+		if err := rows.Scan(&m.UserID, &m.Username, &m.AddedBy, &m.AddedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (db *DB) IsGroupMember(groupID, userID int64) (bool, error) {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM group_members WHERE group_id = ? AND user_id = ?",
+		groupID, userID,
+	).Scan(&count)
+	return count > 0, err
+}
+
+// SetMappedGroupMemberships syncs a user's membership of the groups an
+// identity provider manages: the user joins memberGroupIDs and leaves the
+// other mappedGroupIDs. Memberships of unmapped groups are left alone.
+// Members are recorded as added by the group's owner.
+func (db *DB) SetMappedGroupMemberships(userID int64, mappedGroupIDs, memberGroupIDs []int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	member := make(map[int64]bool)
+	for _, groupID := range memberGroupIDs {
+		member[groupID] = true
+		if _, err := tx.Exec(
+			"INSERT IGNORE INTO group_members (group_id, user_id, added_by) SELECT id, ?, owner_id FROM user_groups WHERE id = ?",
+			userID, groupID,
+		); err != nil {
+			return err
+		}
+	}
+
+	for _, groupID := range mappedGroupIDs {
+		if member[groupID] {
+			continue
+		}
+		// The owner always stays a member of their own group
+		if _, err := tx.Exec(
+			"DELETE gm FROM group_members gm JOIN user_groups g ON g.id = gm.group_id WHERE gm.group_id = ? AND gm.user_id = ? AND g.owner_id <> ?",
+			groupID, userID, userID,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
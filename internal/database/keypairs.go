@@ -25,9 +25,9 @@ func (db *DB) CreateKeyPair(userID int64, name, publicKey string) (*KeyPair, err
 func (db *DB) GetKeyPairByID(id int64) (*KeyPair, error) {
 	kp := &KeyPair{}
 	err := db.QueryRow(
-		"SELECT id, user_id, name, public_key, created_at FROM keypairs WHERE id = ?",
+		"SELECT id, COALESCE(user_id, 0), org_id, name, public_key, created_at FROM keypairs WHERE id = ?",
 		id,
-	).Scan(&kp.ID, &kp.UserID, &kp.Name, &kp.PublicKey, &kp.CreatedAt)
+	).Scan(&kp.ID, &kp.UserID, &kp.OrgID, &kp.Name, &kp.PublicKey, &kp.CreatedAt)
 	
 	if err == sql.ErrNoRows {
 		return nil, errors.New("keypair not found")
@@ -37,7 +37,7 @@ func (db *DB) GetKeyPairByID(id int64) (*KeyPair, error) {
 
 func (db *DB) GetKeyPairsByUserID(userID int64) ([]*KeyPair, error) {
 	rows, err := db.Query(
-		"SELECT id, user_id, name, public_key, created_at FROM keypairs WHERE user_id = ? ORDER BY created_at DESC",
+		"SELECT id, COALESCE(user_id, 0), org_id, name, public_key, created_at FROM keypairs WHERE user_id = ? ORDER BY created_at DESC",
 		userID,
 	)
 	if err != nil {
@@ -48,7 +48,7 @@ func (db *DB) GetKeyPairsByUserID(userID int64) ([]*KeyPair, error) {
 	var keypairs []*KeyPair
 	for rows.Next() {
 		kp := &KeyPair{}
-		if err := rows.Scan(&kp.ID, &kp.UserID, &kp.Name, &kp.PublicKey, &kp.CreatedAt); err != nil {
+		if err := rows.Scan(&kp.ID, &kp.UserID, &kp.OrgID, &kp.Name, &kp.PublicKey, &kp.CreatedAt); err != nil {
 			return nil, err
 		}
 		keypairs = append(keypairs, kp)
@@ -71,3 +71,57 @@ func (db *DB) DeleteKeyPair(id, userID int64) error {
 	}
 	return nil
 }
+
+func (db *DB) CreateOrgKeyPair(orgID int64, name, publicKey string) (*KeyPair, error) {
+	result, err := db.Exec(
+		"INSERT INTO keypairs (org_id, name, public_key) VALUES (?, ?, ?)",
+		orgID, name, publicKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	
+	return db.GetKeyPairByID(id)
+}
+
+func (db *DB) GetKeyPairsByOrgID(orgID int64) ([]*KeyPair, error) {
+	rows, err := db.Query(
+		"SELECT id, COALESCE(user_id, 0), org_id, name, public_key, created_at FROM keypairs WHERE org_id = ? ORDER BY created_at DESC",
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var keypairs []*KeyPair
+	for rows.Next() {
+		kp := &KeyPair{}
+		if err := rows.Scan(&kp.ID, &kp.UserID, &kp.OrgID, &kp.Name, &kp.PublicKey, &kp.CreatedAt); err != nil {
+			return nil, err
+		}
+		keypairs = append(keypairs, kp)
+	}
+	return keypairs, rows.Err()
+}
+
+func (db *DB) DeleteOrgKeyPair(id, orgID int64) error {
+	result, err := db.Exec("DELETE FROM keypairs WHERE id = ? AND org_id = ?", id, orgID)
+	if err != nil {
+		return err
+	}
+	
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("keypair not found")
+	}
+	return nil
+}
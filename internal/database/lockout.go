@@ -0,0 +1,139 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Login failure counters are kept per account and per client IP
+const (
+	LoginKindAccount = "account"
+	LoginKindIP      = "ip"
+)
+
+// Events in the auth audit log
+const (
+	AuditAccountLocked   = "account_locked"
+	AuditIPLocked        = "ip_locked"
+	AuditAccountUnlocked = "account_unlocked"
+	AuditIPUnlocked      = "ip_unlocked"
+)
+
+const loginFailureColumns = "kind, login_key, failures, last_failure_at, locked_until"
+
+func scanLoginFailure(row interface{ Scan(...interface{}) error }) (*LoginFailure, error) {
+	f := &LoginFailure{}
+	err := row.Scan(&f.Kind, &f.Key, &f.Failures, &f.LastFailureAt, &f.LockedUntil)
+	return f, err
+}
+
+func (db *DB) GetLoginFailure(kind, key string) (*LoginFailure, error) {
+	f, err := scanLoginFailure(db.QueryRow(
+		"SELECT "+loginFailureColumns+" FROM login_failures WHERE kind = ? AND login_key = ?", kind, key,
+	))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("login failure not found")
+	}
+	return f, err
+}
+
+// RecordLoginFailure counts a failed sign-in and returns the new count. The
+// count starts over when the previous failure is older than window.
+func (db *DB) RecordLoginFailure(kind, key string, now time.Time, window time.Duration) (int, error) {
+	if _, err := db.Exec(`
+		INSERT INTO login_failures (kind, login_key, failures, last_failure_at) VALUES (?, ?, 1, ?)
+		ON DUPLICATE KEY UPDATE
+			failures = IF(last_failure_at < ?, 1, failures + 1),
+			last_failure_at = VALUES(last_failure_at)
+	`, kind, key, now, now.Add(-window)); err != nil {
+		return 0, err
+	}
+
+	var failures int
+	err := db.QueryRow("SELECT failures FROM login_failures WHERE kind = ? AND login_key = ?", kind, key).Scan(&failures)
+	return failures, err
+}
+
+func (db *DB) LockLogin(kind, key string, until time.Time) error {
+	_, err := db.Exec("UPDATE login_failures SET locked_until = ? WHERE kind = ? AND login_key = ?", until, kind, key)
+	return err
+}
+
+// ClearLoginFailures resets a counter and lifts its lock, after a successful
+// sign-in or when an admin unlocks it
+func (db *DB) ClearLoginFailures(kind, key string) error {
+	result, err := db.Exec("DELETE FROM login_failures WHERE kind = ? AND login_key = ?", kind, key)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("login failure not found")
+	}
+	return nil
+}
+
+// ListLoginLockouts returns the accounts and IPs locked at now, longest
+// lock first. Stale counters are cleaned up on the way.
+func (db *DB) ListLoginLockouts(now time.Time, window time.Duration) ([]*LoginFailure, error) {
+	if _, err := db.Exec(
+		"DELETE FROM login_failures WHERE last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)",
+		now.Add(-window), now,
+	); err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(
+		"SELECT "+loginFailureColumns+" FROM login_failures WHERE locked_until > ? ORDER BY locked_until DESC",
+		now,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lockouts []*LoginFailure
+	for rows.Next() {
+		f, err := scanLoginFailure(rows)
+		if err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, f)
+	}
+	return lockouts, rows.Err()
+}
+
+func (db *DB) CreateAuthAuditEntry(event string, userID *int64, subject, ipAddress, detail string) error {
+	_, err := db.Exec(
+		"INSERT INTO auth_audit_log (event, user_id, subject, ip_address, detail) VALUES (?, ?, ?, ?, ?)",
+		event, userID, subject, ipAddress, detail,
+	)
+	return err
+}
+
+// GetAuthAuditLog returns the most recent entries first
+func (db *DB) GetAuthAuditLog(limit int) ([]*AuthAuditEntry, error) {
+	rows, err := db.Query(
+		"SELECT id, event, user_id, subject, ip_address, detail, created_at FROM auth_audit_log ORDER BY id DESC LIMIT ?",
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*AuthAuditEntry
+	for rows.Next() {
+		e := &AuthAuditEntry{}
+		if err := rows.Scan(&e.ID, &e.Event, &e.UserID, &e.Subject, &e.IPAddress, &e.Detail, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
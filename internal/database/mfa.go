@@ -0,0 +1,223 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+)
+
+func (db *DB) GetUserMFA(userID int64) (*UserMFA, error) {
+	m := &UserMFA{}
+	err := db.QueryRow(
+		"SELECT user_id, totp_secret, enabled_at, last_step, created_at FROM user_mfa WHERE user_id = ?",
+		userID,
+	).Scan(&m.UserID, &m.TOTPSecret, &m.EnabledAt, &m.LastStep, &m.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("mfa not configured")
+	}
+	return m, err
+}
+
+// IsMFAEnabled reports whether the user has a second factor: an enabled
+// TOTP authenticator or a passkey
+func (db *DB) IsMFAEnabled(userID int64) (bool, error) {
+	var enabled bool
+	err := db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM user_mfa WHERE user_id = ? AND enabled_at IS NOT NULL)
+		    OR EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = ?)
+	`, userID, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// MFARequired reports whether the MFA policy applies to the user
+func (db *DB) MFARequired(user *User) (bool, error) {
+	policy, err := db.GetSetting(SettingMFAPolicy, MFAPolicyOff)
+	if err != nil {
+		return false, err
+	}
+	return policy == MFAPolicyAll || (policy == MFAPolicyAdmins && user.IsAdmin), nil
+}
+
+// MFASetupRequired reports whether the policy requires MFA for the user and
+// they have not enabled it yet
+func (db *DB) MFASetupRequired(user *User) (bool, error) {
+	required, err := db.MFARequired(user)
+	if err != nil || !required {
+		return false, err
+	}
+	enabled, err := db.IsMFAEnabled(user.ID)
+	return !enabled, err
+}
+
+// StartMFAEnrollment stores a new pending TOTP secret, replacing any earlier
+// unfinished enrollment. It fails if MFA is already enabled.
+func (db *DB) StartMFAEnrollment(userID int64, secret string) error {
+	result, err := db.Exec(`
+		INSERT INTO user_mfa (user_id, totp_secret) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE
+			totp_secret = IF(enabled_at IS NULL, VALUES(totp_secret), totp_secret),
+			last_step = IF(enabled_at IS NULL, NULL, last_step)
+	`, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	// MariaDB reports 0 affected rows when the enabled row was left untouched
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("mfa already enabled")
+	}
+	return nil
+}
+
+// EnableMFA completes enrollment at the verified time step and stores the
+// hashes of a fresh set of recovery codes
+func (db *DB) EnableMFA(userID, step int64, codeHashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE user_mfa SET enabled_at = NOW(), last_step = ? WHERE user_id = ? AND enabled_at IS NULL",
+		step, userID,
+	)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("no pending mfa enrollment")
+	}
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records a successful code so the same or an earlier step cannot
+// be used again; it returns false for a replay
+func (db *DB) UseTOTPStep(userID, step int64) (bool, error) {
+	result, err := db.Exec(
+		"UPDATE user_mfa SET last_step = ? WHERE user_id = ? AND (last_step IS NULL OR last_step < ?)",
+		step, userID, step,
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// UseRecoveryCode marks an unused recovery code as used; it returns false if
+// the code does not exist or was used before
+func (db *DB) UseRecoveryCode(userID int64, codeHash string) (bool, error) {
+	result, err := db.Exec(
+		"UPDATE mfa_recovery_codes SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL LIMIT 1",
+		userID, codeHash,
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+func (db *DB) CountRecoveryCodes(userID int64) (int, error) {
+	var count int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = ? AND used_at IS NULL", userID,
+	).Scan(&count)
+	return count, err
+}
+
+func (db *DB) ReplaceRecoveryCodes(userID int64, codeHashes []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int64, codeHashes []string) error {
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if _, err := tx.Exec(
+			"INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DisableMFA removes the user's TOTP secret, and their recovery codes unless
+// passkeys remain as a second factor
+func (db *DB) DisableMFA(userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM user_mfa WHERE user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("mfa not configured")
+	}
+
+	if _, err := tx.Exec(`
+		DELETE FROM mfa_recovery_codes WHERE user_id = ?
+		AND NOT EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = ?)
+	`, userID, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ResetMFA removes every second factor of the user: TOTP, passkeys and
+// recovery codes
+func (db *DB) ResetMFA(userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var removed int64
+	for _, table := range []string{"user_mfa", "webauthn_credentials", "mfa_recovery_codes"} {
+		result, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", userID)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		removed += rows
+	}
+	if removed == 0 {
+		return errors.New("mfa not configured")
+	}
+	return tx.Commit()
+}
@@ -242,6 +242,303 @@ func InitSchema(db *sql.DB) error {
 			INDEX idx_user_id (user_id)
 		)`,
 		
+		// Group names are unique per owner; group grants cascade with the group
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_owner_name ON user_groups(owner_id, name)`,
+		`CREATE INDEX IF NOT EXISTS idx_group_id ON script_access(group_id)`,
+		`ALTER TABLE script_access ADD FOREIGN KEY IF NOT EXISTS (group_id) REFERENCES user_groups(id) ON DELETE CASCADE`,
+		`INSERT IGNORE INTO group_members (group_id, user_id, added_by) SELECT id, owner_id, owner_id FROM user_groups`,
+		
+		// Organizations
+		`CREATE TABLE IF NOT EXISTS organizations (
+			id BIGINT PRIMARY KEY AUTO_INCREMENT,
+			name VARCHAR(50) UNIQUE NOT NULL,
+			display_name VARCHAR(255) NOT NULL,
+			tier_id BIGINT NOT NULL DEFAULT 1,
+			created_by BIGINT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+			FOREIGN KEY (tier_id) REFERENCES tiers(id),
+			FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+		)`,
+		`ALTER TABLE organizations ADD COLUMN IF NOT EXISTS name_lower VARCHAR(255) GENERATED ALWAYS AS (LOWER(name)) STORED`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_org_name_lower ON organizations(name_lower)`,
+		
+		// Organization members
+		`CREATE TABLE IF NOT EXISTS org_members (
+			org_id BIGINT NOT NULL,
+			user_id BIGINT NOT NULL,
+			role ENUM('owner', 'admin', 'member') NOT NULL DEFAULT 'member',
+			added_by BIGINT NULL,
+			added_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (org_id, user_id),
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (added_by) REFERENCES users(id) ON DELETE SET NULL,
+			INDEX idx_user_id (user_id)
+		)`,
+		
+		// Organization data encryption keys (org equivalent of user_encryption_keys)
+		`CREATE TABLE IF NOT EXISTS org_encryption_keys (
+			id BIGINT PRIMARY KEY AUTO_INCREMENT,
+			org_id BIGINT NOT NULL,
+			encrypted_dek BLOB NOT NULL,
+			key_version INT DEFAULT 1,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (org_id) REFERENCES organizations(id) ON DELETE CASCADE,
+			INDEX idx_org_id (org_id)
+		)`,
+		
+		// Org-owned scripts, secrets and keypairs have org_id set and user_id NULL,
+		// so they survive the deletion of the member who created them
+		`ALTER TABLE scripts MODIFY user_id BIGINT NULL`,
+		`ALTER TABLE scripts ADD COLUMN IF NOT EXISTS org_id BIGINT NULL`,
+		`ALTER TABLE scripts ADD COLUMN IF NOT EXISTS created_by BIGINT NULL`,
+		`ALTER TABLE scripts ADD FOREIGN KEY IF NOT EXISTS (org_id) REFERENCES organizations(id) ON DELETE CASCADE`,
+		`ALTER TABLE scripts ADD FOREIGN KEY IF NOT EXISTS (created_by) REFERENCES users(id) ON DELETE SET NULL`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS unique_org_script ON scripts(org_id, name)`,
+		`ALTER TABLE secrets MODIFY user_id BIGINT NULL`,
+		`ALTER TABLE secrets ADD COLUMN IF NOT EXISTS org_id BIGINT NULL`,
+		`ALTER TABLE secrets ADD FOREIGN KEY IF NOT EXISTS (org_id) REFERENCES organizations(id) ON DELETE CASCADE`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS unique_org_key ON secrets(org_id, key_name)`,
+		`ALTER TABLE keypairs MODIFY user_id BIGINT NULL`,
+		`ALTER TABLE keypairs ADD COLUMN IF NOT EXISTS org_id BIGINT NULL`,
+		`ALTER TABLE keypairs ADD FOREIGN KEY IF NOT EXISTS (org_id) REFERENCES organizations(id) ON DELETE CASCADE`,
+		
+		// Collaborator roles on ACL entries; versions record their author and
+		// tags can be protected from being moved by editors
+		`ALTER TABLE script_access ADD COLUMN IF NOT EXISTS role ENUM('viewer', 'editor', 'maintainer') NOT NULL DEFAULT 'viewer' AFTER group_id`,
+		`ALTER TABLE script_versions ADD COLUMN IF NOT EXISTS author_id BIGINT NULL AFTER size`,
+		`ALTER TABLE script_versions ADD FOREIGN KEY IF NOT EXISTS (author_id) REFERENCES users(id) ON DELETE SET NULL`,
+		`ALTER TABLE tags ADD COLUMN IF NOT EXISTS protected BOOLEAN NOT NULL DEFAULT FALSE`,
+		
+		// Share tokens are first-class links: optional name, expiry, download
+		// cap and version pin, with every use recorded in an access log
+		`ALTER TABLE share_tokens ADD COLUMN IF NOT EXISTS name VARCHAR(255) NULL AFTER token`,
+		`ALTER TABLE share_tokens ADD COLUMN IF NOT EXISTS created_by BIGINT NULL AFTER name`,
+		`ALTER TABLE share_tokens ADD COLUMN IF NOT EXISTS version_id BIGINT NULL AFTER created_by`,
+		`ALTER TABLE share_tokens ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP NULL AFTER version_id`,
+		`ALTER TABLE share_tokens ADD COLUMN IF NOT EXISTS max_downloads INT NULL AFTER expires_at`,
+		`ALTER TABLE share_tokens ADD COLUMN IF NOT EXISTS download_count INT NOT NULL DEFAULT 0 AFTER max_downloads`,
+		`ALTER TABLE share_tokens ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMP NULL AFTER revoked`,
+		`ALTER TABLE share_tokens ADD FOREIGN KEY IF NOT EXISTS (created_by) REFERENCES users(id) ON DELETE SET NULL`,
+		`ALTER TABLE share_tokens ADD FOREIGN KEY IF NOT EXISTS (version_id) REFERENCES script_versions(id) ON DELETE CASCADE`,
+		
+		`CREATE TABLE IF NOT EXISTS share_token_access_log (
+			id BIGINT PRIMARY KEY AUTO_INCREMENT,
+			token_id BIGINT NOT NULL,
+			version_id BIGINT NULL,
+			outcome VARCHAR(20) NOT NULL,
+			ip_address VARCHAR(45),
+			user_agent TEXT,
+			accessed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (token_id) REFERENCES share_tokens(id) ON DELETE CASCADE,
+			FOREIGN KEY (version_id) REFERENCES script_versions(id) ON DELETE SET NULL,
+			INDEX idx_token_accessed (token_id, accessed_at)
+		)`,
+		
+		// Requests for access to scripts, decided by the script's managers
+		`CREATE TABLE IF NOT EXISTS access_requests (
+			id BIGINT PRIMARY KEY AUTO_INCREMENT,
+			script_id BIGINT NOT NULL,
+			requester_id BIGINT NOT NULL,
+			role ENUM('viewer', 'editor', 'maintainer') NOT NULL DEFAULT 'viewer',
+			reason TEXT,
+			status ENUM('pending', 'approved', 'denied', 'cancelled') NOT NULL DEFAULT 'pending',
+			decided_by BIGINT NULL,
+			decision_note TEXT,
+			access_id BIGINT NULL,
+			expires_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			decided_at TIMESTAMP NULL,
+			FOREIGN KEY (script_id) REFERENCES scripts(id) ON DELETE CASCADE,
+			FOREIGN KEY (requester_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (decided_by) REFERENCES users(id) ON DELETE SET NULL,
+			FOREIGN KEY (access_id) REFERENCES script_access(id) ON DELETE SET NULL,
+			INDEX idx_script_status (script_id, status),
+			INDEX idx_requester (requester_id)
+		)`,
+		
+		// In-app notifications
+		`CREATE TABLE IF NOT EXISTS notifications (
+			id BIGINT PRIMARY KEY AUTO_INCREMENT,
+			user_id BIGINT NOT NULL,
+			type VARCHAR(50) NOT NULL,
+			message TEXT NOT NULL,
+			link VARCHAR(255),
+			read_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_user_created (user_id, created_at)
+		)`,
+		
+		// Scoped API tokens: secrets are stored as SHA-256 hashes, existing
+		// plaintext secrets are hashed and cleared, and pre-existing tokens keep
+		// full access through the legacy "*" scope
+		`ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS secret_hash CHAR(64) NULL AFTER client_secret`,
+		`ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS scopes TEXT NULL AFTER secret_hash`,
+		`ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS script_ids TEXT NULL AFTER scopes`,
+		`ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP NULL AFTER script_ids`,
+		`ALTER TABLE api_tokens MODIFY client_secret VARCHAR(255) NULL`,
+		`UPDATE api_tokens SET secret_hash = SHA2(client_secret, 256) WHERE secret_hash IS NULL AND client_secret IS NOT NULL`,
+		`UPDATE api_tokens SET client_secret = NULL WHERE secret_hash IS NOT NULL`,
+		`UPDATE api_tokens SET scopes = '["*"]' WHERE scopes IS NULL`,
+		
+		// Login sessions: each holds the hash of its current refresh token and
+		// of the one it replaced, so a replayed refresh token can be detected
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id BIGINT PRIMARY KEY AUTO_INCREMENT,
+			user_id BIGINT NOT NULL,
+			refresh_hash CHAR(64) NOT NULL UNIQUE,
+			previous_hash CHAR(64) NULL,
+			user_agent VARCHAR(255),
+			ip_address VARCHAR(45),
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_user_id (user_id),
+			INDEX idx_previous_hash (previous_hash)
+		)`,
+		
+		// Server-wide settings changed at runtime by admins
+		`CREATE TABLE IF NOT EXISTS settings (
+			name VARCHAR(100) PRIMARY KEY,
+			value TEXT NOT NULL,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+		)`,
+		
+		// TOTP two-factor authentication: enabled_at stays NULL until the
+		// first code is verified, last_step blocks replaying a used code
+		`CREATE TABLE IF NOT EXISTS user_mfa (
+			user_id BIGINT PRIMARY KEY,
+			totp_secret VARCHAR(64) NOT NULL,
+			enabled_at TIMESTAMP NULL,
+			last_step BIGINT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+			id BIGINT PRIMARY KEY AUTO_INCREMENT,
+			user_id BIGINT NOT NULL,
+			code_hash CHAR(64) NOT NULL,
+			used_at TIMESTAMP NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_user_code (user_id, code_hash)
+		)`,
+		
+		// WebAuthn passkeys. credential holds the library's JSON form,
+		// including the public key and sign count.
+		`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+			id BIGINT PRIMARY KEY AUTO_INCREMENT,
+			user_id BIGINT NOT NULL,
+			name VARCHAR(100) NOT NULL,
+			credential_id VARBINARY(1023) NOT NULL UNIQUE,
+			credential TEXT NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			last_used_at TIMESTAMP NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_user_id (user_id)
+		)`,
+		// State of WebAuthn ceremonies between their begin and finish
+		// requests; each row is consumed once
+		`CREATE TABLE IF NOT EXISTS webauthn_ceremonies (
+			id VARCHAR(64) PRIMARY KEY,
+			user_id BIGINT NULL,
+			purpose VARCHAR(20) NOT NULL,
+			name VARCHAR(100) NULL,
+			state TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_expires_at (expires_at)
+		)`,
+		// How each session signed in, for the admin console passkey policy
+		`ALTER TABLE sessions ADD COLUMN IF NOT EXISTS auth_method VARCHAR(20) NOT NULL DEFAULT 'password' AFTER user_id`,
+		// Pending OAuth/OpenID Connect logins: the state (stored hashed) is
+		// consumed once by the callback, which needs the nonce and PKCE verifier
+		`CREATE TABLE IF NOT EXISTS oauth_states (
+			state_hash CHAR(64) PRIMARY KEY,
+			provider VARCHAR(50) NOT NULL,
+			nonce VARCHAR(64) NOT NULL,
+			code_verifier VARCHAR(128) NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			INDEX idx_expires_at (expires_at)
+		)`,
+		// OAuth device authorization grant: a CLI's pending login until a
+		// user approves or denies its code; only the device code's hash is kept
+		`CREATE TABLE IF NOT EXISTS device_authorizations (
+			id BIGINT PRIMARY KEY AUTO_INCREMENT,
+			device_code_hash CHAR(64) NOT NULL UNIQUE,
+			user_code VARCHAR(9) NOT NULL UNIQUE,
+			client_name VARCHAR(100) NOT NULL,
+			scopes JSON NOT NULL,
+			status VARCHAR(20) NOT NULL DEFAULT 'pending',
+			user_id BIGINT NULL,
+			request_ip VARCHAR(64) NOT NULL,
+			last_polled_at TIMESTAMP NULL,
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_expires_at (expires_at)
+		)`,
+		// Failed sign-in counters per account (username) and per IP, with
+		// the lock they have earned
+		`CREATE TABLE IF NOT EXISTS login_failures (
+			kind VARCHAR(10) NOT NULL,
+			login_key VARCHAR(255) NOT NULL,
+			failures INT NOT NULL DEFAULT 0,
+			last_failure_at TIMESTAMP NOT NULL,
+			locked_until TIMESTAMP NULL,
+			PRIMARY KEY (kind, login_key),
+			INDEX idx_locked_until (locked_until)
+		)`,
+		// Security events such as lockouts and unlocks
+		`CREATE TABLE IF NOT EXISTS auth_audit_log (
+			id BIGINT PRIMARY KEY AUTO_INCREMENT,
+			event VARCHAR(50) NOT NULL,
+			user_id BIGINT NULL,
+			subject VARCHAR(255) NOT NULL,
+			ip_address VARCHAR(64) NOT NULL,
+			detail VARCHAR(255) NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+			INDEX idx_created_at (created_at)
+		)`,
+		// Email ownership, proven by following a verification link
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP NULL`,
+		// Outstanding password reset and verification links; a link works
+		// while its row exists
+		`CREATE TABLE IF NOT EXISTS email_tokens (
+			id VARCHAR(64) PRIMARY KEY,
+			user_id BIGINT NOT NULL,
+			purpose VARCHAR(20) NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+			INDEX idx_user_purpose (user_id, purpose),
+			INDEX idx_expires_at (expires_at)
+		)`,
+		// Owner-set limit on public fetches of a script per client a minute;
+		// NULL uses the owner's tier rate limit
+		`ALTER TABLE scripts ADD COLUMN IF NOT EXISTS fetch_rate_limit INT NULL`,
+		// Bytes of all script versions per account, see ReconcileStorageUsage
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS storage_used BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE organizations ADD COLUMN IF NOT EXISTS storage_used BIGINT NOT NULL DEFAULT 0`,
+		// Content-addressed script content and its references, see BlobKey
+		`CREATE TABLE IF NOT EXISTS blobs (
+			storage_key VARCHAR(255) PRIMARY KEY,
+			size BIGINT NOT NULL,
+			ref_count INT NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		// Blobs the integrity scrub found damaged, see RecordScrubFailure
+		`CREATE TABLE IF NOT EXISTS scrub_failures (
+			storage_key VARCHAR(255) PRIMARY KEY,
+			reason VARCHAR(255) NOT NULL,
+			detected_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			checked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		
 		// AI generations
 		`CREATE TABLE IF NOT EXISTS ai_generations (
 			id BIGINT PRIMARY KEY AUTO_INCREMENT,
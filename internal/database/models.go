@@ -17,7 +17,8 @@ type User struct {
 
 type KeyPair struct {
 	ID        int64
-	UserID    int64
+	UserID    int64  // 0 for organization keypairs
+	OrgID     *int64
 	Name      string
 	PublicKey string
 	CreatedAt time.Time
@@ -25,7 +26,9 @@ type KeyPair struct {
 
 type Script struct {
 	ID          int64
-	UserID      int64
+	UserID      int64  // 0 for organization scripts
+	OrgID       *int64
+	CreatedBy   *int64
 	Name        string
 	Description string
 	Visibility  string
@@ -41,9 +44,16 @@ type ScriptVersion struct {
 	Signature   string
 	Checksum    string
 	Size        int64
+	AuthorID    *int64
 	CreatedAt   time.Time
 }
 
+// ScriptVersionInfo is a version history entry with its author's name
+type ScriptVersionInfo struct {
+	ScriptVersion
+	AuthorUsername string
+}
+
 type ScriptContent struct {
 	VersionID       int64
 	Content         []byte
@@ -54,11 +64,42 @@ type ScriptContent struct {
 }
 
 type ShareToken struct {
-	ID        int64
-	ScriptID  int64
-	Token     string
-	Revoked   bool
-	CreatedAt time.Time
+	ID            int64
+	ScriptID      int64
+	Token         string
+	Name          string
+	CreatedBy     *int64
+	VersionID     *int64 // pinned version, nil follows the requested tag
+	ExpiresAt     *time.Time
+	MaxDownloads  *int
+	DownloadCount int
+	Revoked       bool
+	LastUsedAt    *time.Time
+	CreatedAt     time.Time
+}
+
+// Status reports whether the link can still be used: "active", "revoked",
+// "expired" or "exhausted"
+func (t *ShareToken) Status() string {
+	switch {
+	case t.Revoked:
+		return "revoked"
+	case t.ExpiresAt != nil && !t.ExpiresAt.After(time.Now()):
+		return "expired"
+	case t.MaxDownloads != nil && t.DownloadCount >= *t.MaxDownloads:
+		return "exhausted"
+	}
+	return "active"
+}
+
+type ShareTokenAccess struct {
+	ID         int64
+	TokenID    int64
+	VersionID  *int64
+	Outcome    string
+	IPAddress  string
+	UserAgent  string
+	AccessedAt time.Time
 }
 
 type Tag struct {
@@ -66,6 +107,8 @@ type Tag struct {
 	ScriptID  int64
 	TagName   string
 	VersionID int64
+	Version   int // version number the tag points to
+	Protected bool
 }
 
 type UserLimits struct {
@@ -87,7 +130,8 @@ type UserEncryptionKey struct {
 
 type Secret struct {
 	ID             int64
-	UserID         int64
+	UserID         int64  // 0 for organization secrets
+	OrgID          *int64
 	KeyName        string
 	EncryptedValue []byte
 	Version        int
@@ -113,6 +157,7 @@ type ScriptAccess struct {
 	AccessType string // 'link', 'user', 'group'
 	UserID     *int64
 	GroupID    *int64
+	Role       string // 'viewer', 'editor', 'maintainer'
 	GrantedBy  int64
 	GrantedAt  time.Time
 	ExpiresAt  *time.Time
@@ -134,6 +179,40 @@ type GroupMember struct {
 	AddedAt  time.Time
 }
 
+// GroupMemberInfo is a group member joined with their username
+type GroupMemberInfo struct {
+	UserID   int64
+	Username string
+	AddedBy  int64
+	AddedAt  time.Time
+}
+
+// Organization models
+
+type Organization struct {
+	ID          int64
+	Name        string
+	DisplayName string
+	TierID      int64
+	CreatedBy   *int64
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// UserOrg is an organization as seen by one of its members
+type UserOrg struct {
+	Organization
+	Role string
+}
+
+type OrgMember struct {
+	OrgID    int64
+	UserID   int64
+	Username string
+	Role     string // 'owner', 'admin', 'member'
+	AddedAt  time.Time
+}
+
 // Tier system models
 
 type Tier struct {
@@ -185,3 +264,99 @@ type Subscription struct {
 	StripeSubscriptionID  string
 	StripeCustomerID      string
 }
+
+type AccessRequest struct {
+	ID           int64
+	ScriptID     int64
+	ScriptName   string
+	Namespace    string // owning user or organization name
+	RequesterID  int64
+	Requester    string
+	Role         string
+	Reason       string
+	Status       string // 'pending', 'approved', 'denied', 'cancelled'
+	DecidedBy    *int64
+	DecisionNote string
+	AccessID     *int64
+	ExpiresAt    *time.Time
+	CreatedAt    time.Time
+	DecidedAt    *time.Time
+}
+
+type Notification struct {
+	ID        int64
+	UserID    int64
+	Type      string
+	Message   string
+	Link      string
+	ReadAt    *time.Time
+	CreatedAt time.Time
+}
+
+type Session struct {
+	ID         int64
+	UserID     int64
+	AuthMethod string
+	UserAgent  string
+	IPAddress  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+}
+
+func (s *Session) Active() bool {
+	return s.RevokedAt == nil && time.Now().Before(s.ExpiresAt)
+}
+
+type WebAuthnCredential struct {
+	ID           int64
+	UserID       int64
+	Name         string
+	CredentialID []byte
+	Credential   []byte
+	CreatedAt    time.Time
+	LastUsedAt   *time.Time
+}
+
+type WebAuthnCeremony struct {
+	ID        string
+	UserID    *int64
+	Purpose   string
+	Name      string
+	State     []byte
+	ExpiresAt time.Time
+}
+
+type OAuthState struct {
+	Provider     string
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+type LoginFailure struct {
+	Kind          string
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	LockedUntil   *time.Time
+}
+
+type AuthAuditEntry struct {
+	ID        int64
+	Event     string
+	UserID    *int64
+	Subject   string
+	IPAddress string
+	Detail    string
+	CreatedAt time.Time
+}
+
+type UserMFA struct {
+	UserID     int64
+	TOTPSecret string
+	EnabledAt  *time.Time
+	LastStep   *int64
+	CreatedAt  time.Time
+}
@@ -0,0 +1,52 @@
+package database
+
+func (db *DB) CreateNotification(userID int64, kind, message, link string) error {
+	_, err := db.Exec(
+		"INSERT INTO notifications (user_id, type, message, link) VALUES (?, ?, ?, NULLIF(?, ''))",
+		userID, kind, message, link,
+	)
+	return err
+}
+
+func (db *DB) GetNotifications(userID int64, unreadOnly bool, limit int) ([]*Notification, error) {
+	rows, err := db.Query(`
+		SELECT id, user_id, type, message, COALESCE(link, ''), read_at, created_at
+		FROM notifications
+		WHERE user_id = ? AND (? = FALSE OR read_at IS NULL)
+		ORDER BY created_at DESC, id DESC
+		LIMIT ?
+	`, userID, unreadOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notifications []*Notification
+	for rows.Next() {
+		n := &Notification{}
+		if err := rows.Scan(&n.ID, &n.UserID, &n.Type, &n.Message, &n.Link, &n.ReadAt, &n.CreatedAt); err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func (db *DB) CountUnreadNotifications(userID int64) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = ? AND read_at IS NULL", userID).Scan(&count)
+	return count, err
+}
+
+func (db *DB) MarkNotificationRead(id, userID int64) error {
+	_, err := db.Exec(
+		"UPDATE notifications SET read_at = NOW() WHERE id = ? AND user_id = ? AND read_at IS NULL",
+		id, userID,
+	)
+	return err
+}
+
+func (db *DB) MarkAllNotificationsRead(userID int64) error {
+	_, err := db.Exec("UPDATE notifications SET read_at = NOW() WHERE user_id = ? AND read_at IS NULL", userID)
+	return err
+}
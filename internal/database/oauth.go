@@ -0,0 +1,49 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// CreateOAuthState records a login started with a provider until its
+// callback arrives or it expires. Expired logins are cleaned up on the way.
+func (db *DB) CreateOAuthState(stateHash, provider, nonce, codeVerifier string, expiresAt time.Time) error {
+	if _, err := db.Exec("DELETE FROM oauth_states WHERE expires_at < NOW()"); err != nil {
+		return err
+	}
+	_, err := db.Exec(
+		"INSERT INTO oauth_states (state_hash, provider, nonce, code_verifier, expires_at) VALUES (?, ?, ?, ?, ?)",
+		stateHash, provider, nonce, codeVerifier, expiresAt,
+	)
+	return err
+}
+
+// ConsumeOAuthState returns and deletes a pending login, so each state can
+// only complete one callback
+func (db *DB) ConsumeOAuthState(stateHash, provider string) (*OAuthState, error) {
+	s := &OAuthState{}
+	err := db.QueryRow(
+		"SELECT provider, nonce, code_verifier, expires_at FROM oauth_states WHERE state_hash = ? AND provider = ?",
+		stateHash, provider,
+	).Scan(&s.Provider, &s.Nonce, &s.CodeVerifier, &s.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("oauth state not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := db.Exec("DELETE FROM oauth_states WHERE state_hash = ?", stateHash)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 || time.Now().After(s.ExpiresAt) {
+		return nil, errors.New("oauth state not found")
+	}
+	return s, nil
+}
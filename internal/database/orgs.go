@@ -0,0 +1,279 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+var orgRoleRank = map[string]int{
+	"member": 1,
+	"admin":  2,
+	"owner":  3,
+}
+
+// OrgRoleAtLeast reports whether role grants at least the privileges of min
+func OrgRoleAtLeast(role, min string) bool {
+	return orgRoleRank[role] >= orgRoleRank[min] && orgRoleRank[role] > 0
+}
+
+// ValidOrgRole reports whether role is a known organization role
+func ValidOrgRole(role string) bool {
+	_, ok := orgRoleRank[role]
+	return ok
+}
+
+// CreateOrg creates an organization with the creator as its owner
+func (db *DB) CreateOrg(name, displayName string, createdBy int64) (*Organization, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO organizations (name, display_name, created_by) VALUES (?, ?, ?)",
+		name, displayName, createdBy,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO org_members (org_id, user_id, role, added_by) VALUES (?, ?, 'owner', ?)",
+		id, createdBy, createdBy,
+	); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return db.GetOrgByID(id)
+}
+
+func (db *DB) GetOrgByID(id int64) (*Organization, error) {
+	org := &Organization{}
+	err := db.QueryRow(
+		"SELECT id, name, display_name, tier_id, created_by, created_at, updated_at FROM organizations WHERE id = ?",
+		id,
+	).Scan(&org.ID, &org.Name, &org.DisplayName, &org.TierID, &org.CreatedBy, &org.CreatedAt, &org.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, errors.New("organization not found")
+	}
+	return org, err
+}
+
+func (db *DB) GetOrgByName(name string) (*Organization, error) {
+	org := &Organization{}
+	err := db.QueryRow(
+		"SELECT id, name, display_name, tier_id, created_by, created_at, updated_at FROM organizations WHERE name = ?",
+		name,
+	).Scan(&org.ID, &org.Name, &org.DisplayName, &org.TierID, &org.CreatedBy, &org.CreatedAt, &org.UpdatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, errors.New("organization not found")
+	}
+	return org, err
+}
+
+// ListOrgs lists all organizations (admin)
+func (db *DB) ListOrgs(limit, offset int) ([]*Organization, error) {
+	rows, err := db.Query(
+		"SELECT id, name, display_name, tier_id, created_by, created_at, updated_at FROM organizations ORDER BY name LIMIT ? OFFSET ?",
+		limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []*Organization
+	for rows.Next() {
+		org := &Organization{}
+		if err := rows.Scan(&org.ID, &org.Name, &org.DisplayName, &org.TierID, &org.CreatedBy, &org.CreatedAt, &org.UpdatedAt); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, org)
+	}
+	return orgs, rows.Err()
+}
+
+// GetOrgsForUser returns the organizations a user belongs to along with their role
+func (db *DB) GetOrgsForUser(userID int64) ([]*UserOrg, error) {
+	rows, err := db.Query(`
+		SELECT o.id, o.name, o.display_name, o.tier_id, o.created_by, o.created_at, o.updated_at, om.role
+		FROM organizations o
+		JOIN org_members om ON om.org_id = o.id
+		WHERE om.user_id = ?
+		ORDER BY o.name
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []*UserOrg
+	for rows.Next() {
+		o := &UserOrg{}
+		if err := rows.Scan(&o.ID, &o.Name, &o.DisplayName, &o.TierID, &o.CreatedBy, &o.CreatedAt, &o.UpdatedAt, &o.Role); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+func (db *DB) UpdateOrg(id int64, displayName string) error {
+	_, err := db.Exec("UPDATE organizations SET display_name = ? WHERE id = ?", displayName, id)
+	return err
+}
+
+func (db *DB) UpdateOrgTier(id, tierID int64) error {
+	_, err := db.Exec("UPDATE organizations SET tier_id = ? WHERE id = ?", tierID, id)
+	return err
+}
+
+func (db *DB) DeleteOrg(id int64) error {
+	_, err := db.Exec("DELETE FROM organizations WHERE id = ?", id)
+	return err
+}
+
+// GetOrgMemberRole returns the user's role in the organization, or "" if not a member
+func (db *DB) GetOrgMemberRole(orgID, userID int64) (string, error) {
+	var role string
+	err := db.QueryRow(
+		"SELECT role FROM org_members WHERE org_id = ? AND user_id = ?",
+		orgID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+func (db *DB) GetOrgMembers(orgID int64) ([]*OrgMember, error) {
+	rows, err := db.Query(`
+		SELECT om.org_id, om.user_id, u.username, om.role, om.added_at
+		FROM org_members om
+		JOIN users u ON u.id = om.user_id
+		WHERE om.org_id = ?
+		ORDER BY u.username
+	`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []*OrgMember
+	for rows.Next() {
+		m := &OrgMember{}
+		if err := rows.Scan(&m.OrgID, &m.UserID, &m.Username, &m.Role, &m.AddedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+// SetOrgMember adds a member or changes an existing member's role
+func (db *DB) SetOrgMember(orgID, userID int64, role string, addedBy int64) error {
+	_, err := db.Exec(
+		"INSERT INTO org_members (org_id, user_id, role, added_by) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE role = ?",
+		orgID, userID, role, addedBy, role,
+	)
+	return err
+}
+
+func (db *DB) RemoveOrgMember(orgID, userID int64) error {
+	result, err := db.Exec("DELETE FROM org_members WHERE org_id = ? AND user_id = ?", orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("member not found")
+	}
+	return nil
+}
+
+func (db *DB) CountOrgOwners(orgID int64) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM org_members WHERE org_id = ? AND role = 'owner'", orgID).Scan(&count)
+	return count, err
+}
+
+// GetSolelyOwnedOrgs lists organizations where the user is the only owner;
+// deleting such a user would leave the organization unmanageable
+func (db *DB) GetSolelyOwnedOrgs(userID int64) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT o.name FROM organizations o
+		JOIN org_members om ON om.org_id = o.id
+		WHERE om.user_id = ? AND om.role = 'owner'
+		  AND (SELECT COUNT(*) FROM org_members o2 WHERE o2.org_id = o.id AND o2.role = 'owner') = 1
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// GetOrgTier gets the tier for an organization
+func (db *DB) GetOrgTier(orgID int64) (*Tier, error) {
+	tier := &Tier{}
+	var featuresJSON string
+
+	err := db.QueryRow(`
+		SELECT t.id, t.name, t.display_name, t.price_monthly, t.max_storage_bytes,
+		       t.max_secrets, t.max_scripts, t.max_ai_generations, t.rate_limit,
+		       t.features, t.created_at, t.updated_at
+		FROM tiers t
+		JOIN organizations o ON o.tier_id = t.id
+		WHERE o.id = ?
+	`, orgID).Scan(
+		&tier.ID, &tier.Name, &tier.DisplayName, &tier.PriceMonthly,
+		&tier.MaxStorageBytes, &tier.MaxSecrets, &tier.MaxScripts, &tier.MaxAIGenerations,
+		&tier.RateLimit, &featuresJSON, &tier.CreatedAt, &tier.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tier.Features = make(map[string]bool)
+	json.Unmarshal([]byte(featuresJSON), &tier.Features)
+
+	return tier, nil
+}
+
+// IsNamespaceTaken reports whether a name is already used by a user or an
+// organization; both share the /{namespace}/{script} URL space
+func (db *DB) IsNamespaceTaken(name string) (bool, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT (SELECT COUNT(*) FROM users WHERE username_lower = LOWER(?))
+		     + (SELECT COUNT(*) FROM organizations WHERE name_lower = LOWER(?))
+	`, name, name).Scan(&count)
+	return count > 0, err
+}
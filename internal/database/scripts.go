@@ -7,8 +7,8 @@ import (
 
 func (db *DB) CreateScript(userID int64, name, description, visibility string) (*Script, error) {
 	result, err := db.Exec(
-		"INSERT INTO scripts (user_id, name, description, visibility) VALUES (?, ?, ?, ?)",
-		userID, name, description, visibility,
+		"INSERT INTO scripts (user_id, created_by, name, description, visibility) VALUES (?, ?, ?, ?, ?)",
+		userID, userID, name, description, visibility,
 	)
 	if err != nil {
 		return nil, err
@@ -25,9 +25,9 @@ func (db *DB) CreateScript(userID int64, name, description, visibility string) (
 func (db *DB) GetScriptByID(id int64) (*Script, error) {
 	script := &Script{}
 	err := db.QueryRow(
-		"SELECT id, user_id, name, description, visibility, created_at, updated_at FROM scripts WHERE id = ?",
+		"SELECT id, COALESCE(user_id, 0), org_id, created_by, name, description, visibility, created_at, updated_at FROM scripts WHERE id = ?",
 		id,
-	).Scan(&script.ID, &script.UserID, &script.Name, &script.Description, &script.Visibility, &script.CreatedAt, &script.UpdatedAt)
+	).Scan(&script.ID, &script.UserID, &script.OrgID, &script.CreatedBy, &script.Name, &script.Description, &script.Visibility, &script.CreatedAt, &script.UpdatedAt)
 	
 	if err == sql.ErrNoRows {
 		return nil, errors.New("script not found")
@@ -38,9 +38,9 @@ func (db *DB) GetScriptByID(id int64) (*Script, error) {
 func (db *DB) GetScriptByUserAndName(userID int64, name string) (*Script, error) {
 	script := &Script{}
 	err := db.QueryRow(
-		"SELECT id, user_id, name, description, visibility, created_at, updated_at FROM scripts WHERE user_id = ? AND name = ?",
+		"SELECT id, COALESCE(user_id, 0), org_id, created_by, name, description, visibility, created_at, updated_at FROM scripts WHERE user_id = ? AND name = ?",
 		userID, name,
-	).Scan(&script.ID, &script.UserID, &script.Name, &script.Description, &script.Visibility, &script.CreatedAt, &script.UpdatedAt)
+	).Scan(&script.ID, &script.UserID, &script.OrgID, &script.CreatedBy, &script.Name, &script.Description, &script.Visibility, &script.CreatedAt, &script.UpdatedAt)
 	
 	if err == sql.ErrNoRows {
 		return nil, errors.New("script not found")
@@ -50,7 +50,7 @@ func (db *DB) GetScriptByUserAndName(userID int64, name string) (*Script, error)
 
 func (db *DB) GetScriptsByUserID(userID int64) ([]*Script, error) {
 	rows, err := db.Query(
-		"SELECT id, user_id, name, description, visibility, created_at, updated_at FROM scripts WHERE user_id = ? ORDER BY updated_at DESC",
+		"SELECT id, COALESCE(user_id, 0), org_id, created_by, name, description, visibility, created_at, updated_at FROM scripts WHERE user_id = ? ORDER BY updated_at DESC",
 		userID,
 	)
 	if err != nil {
@@ -61,7 +61,7 @@ func (db *DB) GetScriptsByUserID(userID int64) ([]*Script, error) {
 	var scripts []*Script
 	for rows.Next() {
 		s := &Script{}
-		if err := rows.Scan(&s.ID, &s.UserID, &s.Name, &s.Description, &s.Visibility, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		if err := rows.Scan(&s.ID, &s.UserID, &s.OrgID, &s.CreatedBy, &s.Name, &s.Description, &s.Visibility, &s.CreatedAt, &s.UpdatedAt); err != nil {
 			return nil, err
 		}
 		scripts = append(scripts, s)
@@ -69,6 +69,64 @@ func (db *DB) GetScriptsByUserID(userID int64) ([]*Script, error) {
 	return scripts, rows.Err()
 }
 
+// CreateOrgScript creates a script owned by an organization rather than a user
+func (db *DB) CreateOrgScript(orgID, createdBy int64, name, description, visibility string) (*Script, error) {
+	result, err := db.Exec(
+		"INSERT INTO scripts (org_id, created_by, name, description, visibility) VALUES (?, ?, ?, ?, ?)",
+		orgID, createdBy, name, description, visibility,
+	)
+	if err != nil {
+		return nil, err
+	}
+	
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	
+	return db.GetScriptByID(id)
+}
+
+func (db *DB) GetScriptByOrgAndName(orgID int64, name string) (*Script, error) {
+	script := &Script{}
+	err := db.QueryRow(
+		"SELECT id, COALESCE(user_id, 0), org_id, created_by, name, description, visibility, created_at, updated_at FROM scripts WHERE org_id = ? AND name = ?",
+		orgID, name,
+	).Scan(&script.ID, &script.UserID, &script.OrgID, &script.CreatedBy, &script.Name, &script.Description, &script.Visibility, &script.CreatedAt, &script.UpdatedAt)
+	
+	if err == sql.ErrNoRows {
+		return nil, errors.New("script not found")
+	}
+	return script, err
+}
+
+func (db *DB) GetScriptsByOrgID(orgID int64) ([]*Script, error) {
+	rows, err := db.Query(
+		"SELECT id, COALESCE(user_id, 0), org_id, created_by, name, description, visibility, created_at, updated_at FROM scripts WHERE org_id = ? ORDER BY updated_at DESC",
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var scripts []*Script
+	for rows.Next() {
+		s := &Script{}
+		if err := rows.Scan(&s.ID, &s.UserID, &s.OrgID, &s.CreatedBy, &s.Name, &s.Description, &s.Visibility, &s.CreatedAt, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, s)
+	}
+	return scripts, rows.Err()
+}
+
+func (db *DB) GetOrgScriptCount(orgID int64) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM scripts WHERE org_id = ?", orgID).Scan(&count)
+	return count, err
+}
+
 func (db *DB) UpdateScript(id int64, description, visibility string) error {
 	_, err := db.Exec(
 		"UPDATE scripts SET description = ?, visibility = ? WHERE id = ?",
@@ -77,8 +135,47 @@ func (db *DB) UpdateScript(id int64, description, visibility string) error {
 	return err
 }
 
-func (db *DB) DeleteScript(id, userID int64) error {
-	result, err := db.Exec("DELETE FROM scripts WHERE id = ? AND user_id = ?", id, userID)
+// GetScriptFetchRateLimit returns the owner-set fetch limit of a script, nil
+// when unset, and the rate limit of the owning user's or organization's tier
+// that applies otherwise
+func (db *DB) GetScriptFetchRateLimit(scriptID int64) (*int, int, error) {
+	var limit *int
+	var tierLimit int
+	err := db.QueryRow(`
+		SELECT s.fetch_rate_limit, t.rate_limit
+		FROM scripts s
+		LEFT JOIN organizations o ON o.id = s.org_id
+		LEFT JOIN users u ON u.id = s.user_id
+		JOIN tiers t ON t.id = COALESCE(o.tier_id, u.tier_id)
+		WHERE s.id = ?
+	`, scriptID).Scan(&limit, &tierLimit)
+	if err == sql.ErrNoRows {
+		return nil, 0, errors.New("script not found")
+	}
+	return limit, tierLimit, err
+}
+
+// SetScriptFetchRateLimit sets or, with nil, clears a script's fetch limit
+func (db *DB) SetScriptFetchRateLimit(scriptID int64, limit *int) error {
+	_, err := db.Exec("UPDATE scripts SET fetch_rate_limit = ? WHERE id = ?", limit, scriptID)
+	return err
+}
+
+// DeleteScriptByID deletes a script without an ownership check; callers must
+// have verified the caller's permission on the script first
+func (db *DB) DeleteScriptByID(id int64) error {
+	script, size, err := db.scriptStorage(id)
+	if err != nil {
+		return errors.New("script not found")
+	}
+
+	// Released first, while the versions still say which blobs they use;
+	// ReconcileBlobRefs restores them if the delete fails
+	if err := db.releaseScriptBlobs(id); err != nil {
+		return err
+	}
+
+	result, err := db.Exec("DELETE FROM scripts WHERE id = ?", id)
 	if err != nil {
 		return err
 	}
@@ -90,6 +187,8 @@ func (db *DB) DeleteScript(id, userID int64) error {
 	if rows == 0 {
 		return errors.New("script not found")
 	}
+	// A failure here is corrected by ReconcileStorageUsage
+	db.AddStorageUsed(script, -size)
 	return nil
 }
 
@@ -99,10 +198,10 @@ func (db *DB) GetScriptCount(userID int64) (int, error) {
 	return count, err
 }
 
-func (db *DB) CreateScriptVersion(scriptID int64, version int, contentHash, signature, checksum string, size int64) (*ScriptVersion, error) {
+func (db *DB) CreateScriptVersion(scriptID int64, version int, contentHash, signature, checksum string, size int64, authorID int64) (*ScriptVersion, error) {
 	result, err := db.Exec(
-		"INSERT INTO script_versions (script_id, version, content_hash, signature, checksum, size) VALUES (?, ?, ?, ?, ?, ?)",
-		scriptID, version, contentHash, signature, checksum, size,
+		"INSERT INTO script_versions (script_id, version, content_hash, signature, checksum, size, author_id) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		scriptID, version, contentHash, signature, checksum, size, authorID,
 	)
 	if err != nil {
 		return nil, err
@@ -119,9 +218,9 @@ func (db *DB) CreateScriptVersion(scriptID int64, version int, contentHash, sign
 func (db *DB) GetScriptVersionByID(id int64) (*ScriptVersion, error) {
 	sv := &ScriptVersion{}
 	err := db.QueryRow(
-		"SELECT id, script_id, version, content_hash, signature, checksum, size, created_at FROM script_versions WHERE id = ?",
+		"SELECT id, script_id, version, content_hash, signature, checksum, size, author_id, created_at FROM script_versions WHERE id = ?",
 		id,
-	).Scan(&sv.ID, &sv.ScriptID, &sv.Version, &sv.ContentHash, &sv.Signature, &sv.Checksum, &sv.Size, &sv.CreatedAt)
+	).Scan(&sv.ID, &sv.ScriptID, &sv.Version, &sv.ContentHash, &sv.Signature, &sv.Checksum, &sv.Size, &sv.AuthorID, &sv.CreatedAt)
 	
 	if err == sql.ErrNoRows {
 		return nil, errors.New("version not found")
@@ -132,9 +231,9 @@ func (db *DB) GetScriptVersionByID(id int64) (*ScriptVersion, error) {
 func (db *DB) GetLatestScriptVersion(scriptID int64) (*ScriptVersion, error) {
 	sv := &ScriptVersion{}
 	err := db.QueryRow(
-		"SELECT id, script_id, version, content_hash, signature, checksum, size, created_at FROM script_versions WHERE script_id = ? ORDER BY version DESC LIMIT 1",
+		"SELECT id, script_id, version, content_hash, signature, checksum, size, author_id, created_at FROM script_versions WHERE script_id = ? ORDER BY version DESC LIMIT 1",
 		scriptID,
-	).Scan(&sv.ID, &sv.ScriptID, &sv.Version, &sv.ContentHash, &sv.Signature, &sv.Checksum, &sv.Size, &sv.CreatedAt)
+	).Scan(&sv.ID, &sv.ScriptID, &sv.Version, &sv.ContentHash, &sv.Signature, &sv.Checksum, &sv.Size, &sv.AuthorID, &sv.CreatedAt)
 	
 	if err == sql.ErrNoRows {
 		return nil, errors.New("no versions found")
@@ -145,9 +244,9 @@ func (db *DB) GetLatestScriptVersion(scriptID int64) (*ScriptVersion, error) {
 func (db *DB) GetScriptVersionByNumber(scriptID int64, version int) (*ScriptVersion, error) {
 	sv := &ScriptVersion{}
 	err := db.QueryRow(
-		"SELECT id, script_id, version, content_hash, signature, checksum, size, created_at FROM script_versions WHERE script_id = ? AND version = ?",
+		"SELECT id, script_id, version, content_hash, signature, checksum, size, author_id, created_at FROM script_versions WHERE script_id = ? AND version = ?",
 		scriptID, version,
-	).Scan(&sv.ID, &sv.ScriptID, &sv.Version, &sv.ContentHash, &sv.Signature, &sv.Checksum, &sv.Size, &sv.CreatedAt)
+	).Scan(&sv.ID, &sv.ScriptID, &sv.Version, &sv.ContentHash, &sv.Signature, &sv.Checksum, &sv.Size, &sv.AuthorID, &sv.CreatedAt)
 	
 	if err == sql.ErrNoRows {
 		return nil, errors.New("version not found")
@@ -155,6 +254,32 @@ func (db *DB) GetScriptVersionByNumber(scriptID int64, version int) (*ScriptVers
 	return sv, err
 }
 
+// GetScriptVersions returns the version history of a script, newest first
+func (db *DB) GetScriptVersions(scriptID int64) ([]*ScriptVersionInfo, error) {
+	rows, err := db.Query(`
+		SELECT sv.id, sv.script_id, sv.version, sv.content_hash, sv.signature, sv.checksum, sv.size, sv.author_id, sv.created_at,
+		       COALESCE(u.username, '')
+		FROM script_versions sv
+		LEFT JOIN users u ON u.id = sv.author_id
+		WHERE sv.script_id = ?
+		ORDER BY sv.version DESC
+	`, scriptID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var versions []*ScriptVersionInfo
+	for rows.Next() {
+		sv := &ScriptVersionInfo{}
+		if err := rows.Scan(&sv.ID, &sv.ScriptID, &sv.Version, &sv.ContentHash, &sv.Signature, &sv.Checksum, &sv.Size, &sv.AuthorID, &sv.CreatedAt, &sv.AuthorUsername); err != nil {
+			return nil, err
+		}
+		versions = append(versions, sv)
+	}
+	return versions, rows.Err()
+}
+
 func (db *DB) SaveScriptContent(versionID int64, content []byte, storagePath string, encryptionKeyID *int64, wrappedKey []byte) error {
 	_, err := db.Exec(
 		"INSERT INTO script_content (version_id, content, storage_path, encryption_key_id, wrapped_key) VALUES (?, ?, ?, ?, ?)",
@@ -163,6 +288,30 @@ func (db *DB) SaveScriptContent(versionID int64, content []byte, storagePath str
 	return err
 }
 
+// GetStoragePaths returns the storage key of every script version and every
+// referenced blob, the blobs that must be kept
+func (db *DB) GetStoragePaths() (map[string]bool, error) {
+	rows, err := db.Query(`
+		SELECT storage_path FROM script_content WHERE storage_path IS NOT NULL AND storage_path != ''
+		UNION
+		SELECT storage_key FROM blobs WHERE ref_count > 0
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	paths := make(map[string]bool)
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		paths[path] = true
+	}
+	return paths, rows.Err()
+}
+
 func (db *DB) GetScriptContent(versionID int64) (*ScriptContent, error) {
 	sc := &ScriptContent{VersionID: versionID}
 	var encKeyID sql.NullInt64
@@ -196,12 +345,73 @@ func (db *DB) CreateTag(scriptID int64, tagName string, versionID int64) error {
 func (db *DB) GetVersionByTag(scriptID int64, tagName string) (*ScriptVersion, error) {
 	sv := &ScriptVersion{}
 	err := db.QueryRow(
-		"SELECT sv.id, sv.script_id, sv.version, sv.content_hash, sv.signature, sv.checksum, sv.size, sv.created_at FROM script_versions sv JOIN tags t ON sv.id = t.version_id WHERE t.script_id = ? AND t.tag_name = ?",
+		"SELECT sv.id, sv.script_id, sv.version, sv.content_hash, sv.signature, sv.checksum, sv.size, sv.author_id, sv.created_at FROM script_versions sv JOIN tags t ON sv.id = t.version_id WHERE t.script_id = ? AND t.tag_name = ?",
 		scriptID, tagName,
-	).Scan(&sv.ID, &sv.ScriptID, &sv.Version, &sv.ContentHash, &sv.Signature, &sv.Checksum, &sv.Size, &sv.CreatedAt)
+	).Scan(&sv.ID, &sv.ScriptID, &sv.Version, &sv.ContentHash, &sv.Signature, &sv.Checksum, &sv.Size, &sv.AuthorID, &sv.CreatedAt)
 	
 	if err == sql.ErrNoRows {
 		return nil, errors.New("tag not found")
 	}
 	return sv, err
 }
+
+// GetTags lists a script's tags with the version number each points to
+func (db *DB) GetTags(scriptID int64) ([]*Tag, error) {
+	rows, err := db.Query(`
+		SELECT t.id, t.script_id, t.tag_name, t.version_id, sv.version, t.protected
+		FROM tags t
+		JOIN script_versions sv ON sv.id = t.version_id
+		WHERE t.script_id = ?
+		ORDER BY t.tag_name
+	`, scriptID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var tags []*Tag
+	for rows.Next() {
+		t := &Tag{}
+		if err := rows.Scan(&t.ID, &t.ScriptID, &t.TagName, &t.VersionID, &t.Version, &t.Protected); err != nil {
+			return nil, err
+		}
+		tags = append(tags, t)
+	}
+	return tags, rows.Err()
+}
+
+func (db *DB) GetTag(scriptID int64, tagName string) (*Tag, error) {
+	t := &Tag{}
+	err := db.QueryRow(`
+		SELECT t.id, t.script_id, t.tag_name, t.version_id, sv.version, t.protected
+		FROM tags t
+		JOIN script_versions sv ON sv.id = t.version_id
+		WHERE t.script_id = ? AND t.tag_name = ?
+	`, scriptID, tagName).Scan(&t.ID, &t.ScriptID, &t.TagName, &t.VersionID, &t.Version, &t.Protected)
+	
+	if err == sql.ErrNoRows {
+		return nil, errors.New("tag not found")
+	}
+	return t, err
+}
+
+func (db *DB) SetTagProtected(scriptID int64, tagName string, protected bool) error {
+	_, err := db.Exec("UPDATE tags SET protected = ? WHERE script_id = ? AND tag_name = ?", protected, scriptID, tagName)
+	return err
+}
+
+func (db *DB) DeleteTag(scriptID int64, tagName string) error {
+	result, err := db.Exec("DELETE FROM tags WHERE script_id = ? AND tag_name = ?", scriptID, tagName)
+	if err != nil {
+		return err
+	}
+	
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("tag not found")
+	}
+	return nil
+}
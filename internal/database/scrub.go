@@ -0,0 +1,85 @@
+package database
+
+import "time"
+
+// ScrubFailure is a blob whose content no longer matches what was stored,
+// with the script versions served from it
+type ScrubFailure struct {
+	StorageKey string
+	Reason     string
+	DetectedAt time.Time // first found damaged
+	CheckedAt  time.Time // last found damaged
+	Versions   []ScrubFailureVersion
+}
+
+type ScrubFailureVersion struct {
+	ScriptID   int64
+	ScriptName string
+	Version    int
+}
+
+// RecordScrubFailure records that the blob failed its check, keeping when
+// it was first found damaged
+func (db *DB) RecordScrubFailure(key, reason string) error {
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	_, err := db.Exec(`
+		INSERT INTO scrub_failures (storage_key, reason) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE reason = VALUES(reason), checked_at = CURRENT_TIMESTAMP
+	`, key, reason)
+	return err
+}
+
+// ClearScrubFailure removes the blob's failure once it passes its check,
+// e.g. after being restored from a backup
+func (db *DB) ClearScrubFailure(key string) error {
+	_, err := db.Exec("DELETE FROM scrub_failures WHERE storage_key = ?", key)
+	return err
+}
+
+// DeleteStaleScrubFailures removes failures of blobs no script version is
+// stored in any more
+func (db *DB) DeleteStaleScrubFailures() error {
+	_, err := db.Exec(`
+		DELETE FROM scrub_failures
+		WHERE storage_key NOT IN (
+			SELECT storage_path FROM script_content WHERE storage_path IS NOT NULL
+		)
+	`)
+	return err
+}
+
+// ListScrubFailures returns the damaged blobs, most recently found first
+func (db *DB) ListScrubFailures() ([]*ScrubFailure, error) {
+	rows, err := db.Query(`
+		SELECT f.storage_key, f.reason, f.detected_at, f.checked_at, s.id, s.name, v.version
+		FROM scrub_failures f
+		JOIN script_content c ON c.storage_path = f.storage_key
+		JOIN script_versions v ON v.id = c.version_id
+		JOIN scripts s ON s.id = v.script_id
+		ORDER BY f.checked_at DESC, f.storage_key, s.id, v.version
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var failures []*ScrubFailure
+	byKey := make(map[string]*ScrubFailure)
+	for rows.Next() {
+		f := &ScrubFailure{}
+		var v ScrubFailureVersion
+		if err := rows.Scan(&f.StorageKey, &f.Reason, &f.DetectedAt, &f.CheckedAt, &v.ScriptID, &v.ScriptName, &v.Version); err != nil {
+			return nil, err
+		}
+		if existing, ok := byKey[f.StorageKey]; ok {
+			f = existing
+		} else {
+			byKey[f.StorageKey] = f
+			failures = append(failures, f)
+		}
+		f.Versions = append(f.Versions, v)
+	}
+	return failures, rows.Err()
+}
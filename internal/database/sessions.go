@@ -0,0 +1,180 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// How a session was signed in
+const (
+	AuthMethodPassword = "password"
+	AuthMethodOAuth    = "oauth"
+	AuthMethodTOTP     = "totp"
+	AuthMethodPasskey  = "passkey"
+)
+
+const sessionColumns = `id, user_id, auth_method, COALESCE(user_agent, ''), COALESCE(ip_address, ''),
+	created_at, last_seen_at, expires_at, revoked_at`
+
+func scanSession(row interface{ Scan(...interface{}) error }) (*Session, error) {
+	s := &Session{}
+	err := row.Scan(&s.ID, &s.UserID, &s.AuthMethod, &s.UserAgent, &s.IPAddress,
+		&s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &s.RevokedAt)
+	return s, err
+}
+
+func (db *DB) CreateSession(userID int64, authMethod, refreshHash, userAgent, ipAddress string, expiresAt time.Time) (*Session, error) {
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	result, err := db.Exec(
+		"INSERT INTO sessions (user_id, auth_method, refresh_hash, user_agent, ip_address, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, authMethod, refreshHash, userAgent, ipAddress, expiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetSessionByID(id)
+}
+
+func (db *DB) GetSessionByID(id int64) (*Session, error) {
+	s, err := scanSession(db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("session not found")
+	}
+	return s, err
+}
+
+func (db *DB) GetSessionByRefreshHash(refreshHash string) (*Session, error) {
+	s, err := scanSession(db.QueryRow("SELECT "+sessionColumns+" FROM sessions WHERE refresh_hash = ?", refreshHash))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("session not found")
+	}
+	return s, err
+}
+
+// GetActiveSessions lists the user's sessions that are neither revoked nor
+// expired, most recently used first
+func (db *DB) GetActiveSessions(userID int64) ([]*Session, error) {
+	rows, err := db.Query(`
+		SELECT `+sessionColumns+` FROM sessions
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_seen_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RotateSessionRefreshToken replaces the session's refresh token, keeping the
+// old hash to detect replays. It fails if oldHash is no longer current, so two
+// concurrent refreshes with the same token cannot both succeed.
+func (db *DB) RotateSessionRefreshToken(id int64, oldHash, newHash, userAgent, ipAddress string, expiresAt time.Time) error {
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	result, err := db.Exec(`
+		UPDATE sessions
+		SET previous_hash = refresh_hash, refresh_hash = ?, user_agent = ?, ip_address = ?,
+		    last_seen_at = NOW(), expires_at = ?
+		WHERE id = ? AND refresh_hash = ? AND revoked_at IS NULL AND expires_at > NOW()
+	`, newHash, userAgent, ipAddress, expiresAt, id, oldHash)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("session not found")
+	}
+	return nil
+}
+
+// RevokeSessionByPreviousHash revokes the session whose last rotated-out
+// refresh token is refreshHash. A refresh token is only presented again after
+// rotation if it was copied, so the whole session is treated as compromised.
+func (db *DB) RevokeSessionByPreviousHash(refreshHash string) (bool, error) {
+	result, err := db.Exec(
+		"UPDATE sessions SET revoked_at = NOW() WHERE previous_hash = ? AND revoked_at IS NULL",
+		refreshHash,
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
+}
+
+// TouchSession reports whether the session is active for the user and
+// records activity at most once a minute
+func (db *DB) TouchSession(id, userID int64) (bool, error) {
+	var active bool
+	err := db.QueryRow(
+		"SELECT revoked_at IS NULL AND expires_at > NOW() FROM sessions WHERE id = ? AND user_id = ?",
+		id, userID,
+	).Scan(&active)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil || !active {
+		return false, err
+	}
+
+	_, err = db.Exec(
+		"UPDATE sessions SET last_seen_at = NOW() WHERE id = ? AND last_seen_at < NOW() - INTERVAL 1 MINUTE",
+		id,
+	)
+	return true, err
+}
+
+func (db *DB) RevokeSession(id, userID int64) error {
+	result, err := db.Exec(
+		"UPDATE sessions SET revoked_at = NOW() WHERE id = ? AND user_id = ? AND revoked_at IS NULL",
+		id, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("session not found")
+	}
+	return nil
+}
+
+// RevokeUserSessions revokes every session of the user except exceptID (0 to
+// revoke all) and returns how many were revoked
+func (db *DB) RevokeUserSessions(userID, exceptID int64) (int64, error) {
+	result, err := db.Exec(
+		"UPDATE sessions SET revoked_at = NOW() WHERE user_id = ? AND id <> ? AND revoked_at IS NULL",
+		userID, exceptID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
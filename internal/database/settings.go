@@ -0,0 +1,45 @@
+package database
+
+import "database/sql"
+
+// MFA policies: who must have two-factor authentication enabled
+const (
+	SettingMFAPolicy = "mfa_policy"
+
+	MFAPolicyOff    = "off"
+	MFAPolicyAdmins = "admins"
+	MFAPolicyAll    = "all"
+)
+
+// Admin console policies: whether admin rights need a passkey sign-in
+const (
+	SettingAdminAuthPolicy = "admin_auth_policy"
+
+	AdminAuthPolicyAny     = "any"
+	AdminAuthPolicyPasskey = "passkey"
+)
+
+// Whether publishing public scripts needs a verified email address: "true"
+// or "false"
+const SettingPublicRequiresVerifiedEmail = "public_requires_verified_email"
+
+// GetSetting returns a server setting, or def when it has never been set
+func (db *DB) GetSetting(name, def string) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE name = ?", name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return def, nil
+	}
+	if err != nil {
+		return def, err
+	}
+	return value, nil
+}
+
+func (db *DB) SetSetting(name, value string) error {
+	_, err := db.Exec(
+		"INSERT INTO settings (name, value) VALUES (?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)",
+		name, value,
+	)
+	return err
+}
@@ -0,0 +1,104 @@
+package database
+
+import "database/sql"
+
+// Storage used is the size of every version of the account's scripts:
+// personal scripts count against their owner, organization scripts against
+// the organization. It is kept on users.storage_used and
+// organizations.storage_used as versions are written and deleted, and
+// ReconcileStorageUsage recomputes it from script_versions.
+
+// GetStorageUsage returns the bytes used by the user's personal scripts, or
+// with orgID the organization's, and the quota of their tier
+func (db *DB) GetStorageUsage(userID int64, orgID *int64) (used, quota int64, err error) {
+	if orgID != nil {
+		err = db.QueryRow(`
+			SELECT o.storage_used, t.max_storage_bytes
+			FROM organizations o
+			JOIN tiers t ON t.id = o.tier_id
+			WHERE o.id = ?
+		`, *orgID).Scan(&used, &quota)
+	} else {
+		err = db.QueryRow(`
+			SELECT u.storage_used, t.max_storage_bytes
+			FROM users u
+			JOIN tiers t ON t.id = u.tier_id
+			WHERE u.id = ?
+		`, userID).Scan(&used, &quota)
+	}
+	return used, quota, err
+}
+
+// AddStorageUsed changes the storage used by the script's account by delta
+// bytes, never going below zero
+func (db *DB) AddStorageUsed(script *Script, delta int64) error {
+	if script.OrgID != nil {
+		_, err := db.Exec("UPDATE organizations SET storage_used = GREATEST(storage_used + ?, 0) WHERE id = ?", delta, *script.OrgID)
+		return err
+	}
+	_, err := db.Exec("UPDATE users SET storage_used = GREATEST(storage_used + ?, 0) WHERE id = ?", delta, script.UserID)
+	return err
+}
+
+// scriptStorage returns the script with the total size of its versions, for
+// releasing them from its account's usage once it is deleted
+func (db *DB) scriptStorage(id int64) (*Script, int64, error) {
+	script := &Script{ID: id}
+	var orgID sql.NullInt64
+	var size int64
+	err := db.QueryRow(`
+		SELECT COALESCE(s.user_id, 0), s.org_id, COALESCE(SUM(v.size), 0)
+		FROM scripts s
+		LEFT JOIN script_versions v ON v.script_id = s.id
+		WHERE s.id = ?
+		GROUP BY s.id, s.user_id, s.org_id
+	`, id).Scan(&script.UserID, &orgID, &size)
+	if err != nil {
+		return nil, 0, err
+	}
+	if orgID.Valid {
+		script.OrgID = &orgID.Int64
+	}
+	return script, size, nil
+}
+
+// ReconcileStorageUsage recomputes every account's storage used from
+// script_versions, correcting drift from failed writes or cascading
+// deletes, and records users' usage in the current month's usage_stats. It
+// returns how many accounts were corrected.
+func (db *DB) ReconcileStorageUsage() (int64, error) {
+	result, err := db.Exec(`
+		UPDATE users u
+		SET storage_used = (
+			SELECT COALESCE(SUM(v.size), 0)
+			FROM script_versions v
+			JOIN scripts s ON s.id = v.script_id
+			WHERE s.user_id = u.id AND s.org_id IS NULL
+		)
+	`)
+	if err != nil {
+		return 0, err
+	}
+	users, _ := result.RowsAffected()
+
+	result, err = db.Exec(`
+		UPDATE organizations o
+		SET storage_used = (
+			SELECT COALESCE(SUM(v.size), 0)
+			FROM script_versions v
+			JOIN scripts s ON s.id = v.script_id
+			WHERE s.org_id = o.id
+		)
+	`)
+	if err != nil {
+		return users, err
+	}
+	orgs, _ := result.RowsAffected()
+
+	_, err = db.Exec(`
+		INSERT INTO usage_stats (user_id, month, storage_used)
+		SELECT id, DATE_FORMAT(NOW(), '%Y-%m-01'), storage_used FROM users
+		ON DUPLICATE KEY UPDATE storage_used = VALUES(storage_used)
+	`)
+	return users + orgs, err
+}
@@ -66,6 +66,19 @@ func (db *DB) GetAllTiers() ([]*Tier, error) {
 	return tiers, rows.Err()
 }
 
+// GetUserRateLimit returns the user's API requests a minute: their own
+// override if an admin set one, otherwise their tier's
+func (db *DB) GetUserRateLimit(userID int64) (int, error) {
+	var limit int
+	err := db.QueryRow(`
+		SELECT COALESCE(u.rate_limit, t.rate_limit)
+		FROM users u
+		JOIN tiers t ON t.id = u.tier_id
+		WHERE u.id = ?
+	`, userID).Scan(&limit)
+	return limit, err
+}
+
 // UpdateUserTier changes a user's tier
 func (db *DB) UpdateUserTier(userID, tierID int64) error {
 	_, err := db.Exec("UPDATE users SET tier_id = ? WHERE id = ?", tierID, userID)
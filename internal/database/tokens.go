@@ -3,33 +3,118 @@ package database
 import (
 	"database/sql"
 	"errors"
+	"time"
 )
 
-func (db *DB) CreateShareToken(scriptID int64, token string) error {
+const shareTokenColumns = "id, script_id, token, COALESCE(name, ''), created_by, version_id, expires_at, max_downloads, download_count, revoked, last_used_at, created_at"
+
+func scanShareToken(row interface{ Scan(...interface{}) error }) (*ShareToken, error) {
+	st := &ShareToken{}
+	err := row.Scan(&st.ID, &st.ScriptID, &st.Token, &st.Name, &st.CreatedBy, &st.VersionID,
+		&st.ExpiresAt, &st.MaxDownloads, &st.DownloadCount, &st.Revoked, &st.LastUsedAt, &st.CreatedAt)
+	return st, err
+}
+
+// CreateShareToken creates a share link; expiry, download cap and version pin
+// are optional
+func (db *DB) CreateShareToken(scriptID, createdBy int64, token, name string, versionID *int64, expiresAt *time.Time, maxDownloads *int) (*ShareToken, error) {
 	_, err := db.Exec(
-		"INSERT INTO share_tokens (script_id, token) VALUES (?, ?)",
-		scriptID, token,
+		"INSERT INTO share_tokens (script_id, token, name, created_by, version_id, expires_at, max_downloads) VALUES (?, ?, NULLIF(?, ''), ?, ?, ?, ?)",
+		scriptID, token, name, createdBy, versionID, expiresAt, maxDownloads,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	return db.GetShareToken(token)
 }
 
 func (db *DB) GetShareToken(token string) (*ShareToken, error) {
-	st := &ShareToken{}
-	err := db.QueryRow(
-		"SELECT id, script_id, token, revoked, created_at FROM share_tokens WHERE token = ?",
+	st, err := scanShareToken(db.QueryRow(
+		"SELECT "+shareTokenColumns+" FROM share_tokens WHERE token = ?",
 		token,
-	).Scan(&st.ID, &st.ScriptID, &st.Token, &st.Revoked, &st.CreatedAt)
-	
+	))
 	if err == sql.ErrNoRows {
 		return nil, errors.New("token not found")
 	}
 	return st, err
 }
 
-func (db *DB) RevokeShareToken(token string, userID int64) error {
+func (db *DB) GetShareTokensForScript(scriptID int64) ([]*ShareToken, error) {
+	rows, err := db.Query(
+		"SELECT "+shareTokenColumns+" FROM share_tokens WHERE script_id = ? ORDER BY created_at DESC",
+		scriptID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var tokens []*ShareToken
+	for rows.Next() {
+		st, err := scanShareToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, st)
+	}
+	return tokens, rows.Err()
+}
+
+// ConsumeShareToken counts one download against a link. It returns false
+// when the link was revoked, expired or used up in the meantime, so
+// concurrent downloads can never exceed max_downloads.
+func (db *DB) ConsumeShareToken(id int64) (bool, error) {
+	result, err := db.Exec(`
+		UPDATE share_tokens SET download_count = download_count + 1, last_used_at = NOW()
+		WHERE id = ? AND revoked = FALSE
+		AND (expires_at IS NULL OR expires_at > NOW())
+		AND (max_downloads IS NULL OR download_count < max_downloads)
+	`, id)
+	if err != nil {
+		return false, err
+	}
+	
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+func (db *DB) LogShareTokenAccess(tokenID int64, versionID *int64, outcome, ipAddress, userAgent string) error {
+	_, err := db.Exec(
+		"INSERT INTO share_token_access_log (token_id, version_id, outcome, ip_address, user_agent) VALUES (?, ?, ?, ?, ?)",
+		tokenID, versionID, outcome, ipAddress, userAgent,
+	)
+	return err
+}
+
+func (db *DB) GetShareTokenAccessLog(tokenID int64, limit int) ([]*ShareTokenAccess, error) {
+	rows, err := db.Query(`
+		SELECT id, token_id, version_id, outcome, COALESCE(ip_address, ''), COALESCE(user_agent, ''), accessed_at
+		FROM share_token_access_log WHERE token_id = ?
+		ORDER BY accessed_at DESC LIMIT ?
+	`, tokenID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	
+	var entries []*ShareTokenAccess
+	for rows.Next() {
+		e := &ShareTokenAccess{}
+		if err := rows.Scan(&e.ID, &e.TokenID, &e.VersionID, &e.Outcome, &e.IPAddress, &e.UserAgent, &e.AccessedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (db *DB) RevokeShareToken(token string, scriptID int64) error {
 	result, err := db.Exec(
-		"UPDATE share_tokens st JOIN scripts s ON st.script_id = s.id SET st.revoked = TRUE WHERE st.token = ? AND s.user_id = ?",
-		token, userID,
+		"UPDATE share_tokens SET revoked = TRUE WHERE token = ? AND script_id = ?",
+		token, scriptID,
 	)
 	if err != nil {
 		return err
@@ -45,6 +130,10 @@ func (db *DB) RevokeShareToken(token string, userID int64) error {
 	return nil
 }
 
+// GetUserLimits returns the user's script count limit, from their tier, and
+// size limit of a single script, the default; user_limits overrides either.
+// The tier's storage is the quota of all scripts together, not of one, see
+// GetStorageUsage.
 func (db *DB) GetUserLimits(userID int64, defaultMaxScripts int, defaultMaxScriptSize int64) (int, int64, error) {
 	// Get tier limits first
 	tier, err := db.GetUserTier(userID)
@@ -53,7 +142,6 @@ func (db *DB) GetUserLimits(userID int64, defaultMaxScripts int, defaultMaxScrip
 	
 	if err == nil {
 		maxScripts = tier.MaxScripts
-		maxScriptSize = tier.MaxStorageBytes
 	}
 	
 	// Check for user-specific overrides
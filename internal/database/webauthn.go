@@ -0,0 +1,156 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// WebAuthn ceremony purposes
+const (
+	CeremonyRegister = "register"
+	CeremonyLogin    = "login"
+	CeremonyMFA      = "mfa"
+)
+
+const webAuthnCredentialColumns = "id, user_id, name, credential_id, credential, created_at, last_used_at"
+
+func scanWebAuthnCredential(row interface{ Scan(...interface{}) error }) (*WebAuthnCredential, error) {
+	c := &WebAuthnCredential{}
+	err := row.Scan(&c.ID, &c.UserID, &c.Name, &c.CredentialID, &c.Credential, &c.CreatedAt, &c.LastUsedAt)
+	return c, err
+}
+
+func (db *DB) CreateWebAuthnCredential(userID int64, name string, credentialID, credential []byte) (*WebAuthnCredential, error) {
+	result, err := db.Exec(
+		"INSERT INTO webauthn_credentials (user_id, name, credential_id, credential) VALUES (?, ?, ?, ?)",
+		userID, name, credentialID, credential,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	c, err := scanWebAuthnCredential(db.QueryRow(
+		"SELECT "+webAuthnCredentialColumns+" FROM webauthn_credentials WHERE id = ?", id,
+	))
+	if err == sql.ErrNoRows {
+		return nil, errors.New("passkey not found")
+	}
+	return c, err
+}
+
+func (db *DB) GetWebAuthnCredentials(userID int64) ([]*WebAuthnCredential, error) {
+	rows, err := db.Query(
+		"SELECT "+webAuthnCredentialColumns+" FROM webauthn_credentials WHERE user_id = ? ORDER BY created_at",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []*WebAuthnCredential
+	for rows.Next() {
+		c, err := scanWebAuthnCredential(rows)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, c)
+	}
+	return credentials, rows.Err()
+}
+
+func (db *DB) CountWebAuthnCredentials(userID int64) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = ?", userID).Scan(&count)
+	return count, err
+}
+
+// RecordWebAuthnCredentialUse stores the credential as returned by a
+// successful assertion, which carries the new sign count
+func (db *DB) RecordWebAuthnCredentialUse(userID int64, credentialID, credential []byte) error {
+	_, err := db.Exec(
+		"UPDATE webauthn_credentials SET credential = ?, last_used_at = NOW() WHERE user_id = ? AND credential_id = ?",
+		credential, userID, credentialID,
+	)
+	return err
+}
+
+// DeleteWebAuthnCredential removes one of the user's passkeys. Recovery codes
+// go with the last second factor.
+func (db *DB) DeleteWebAuthnCredential(id, userID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM webauthn_credentials WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return errors.New("passkey not found")
+	}
+
+	if _, err := tx.Exec(`
+		DELETE FROM mfa_recovery_codes WHERE user_id = ?
+		AND NOT EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = ?)
+		AND NOT EXISTS (SELECT 1 FROM user_mfa WHERE user_id = ? AND enabled_at IS NOT NULL)
+	`, userID, userID, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CreateWebAuthnCeremony stores the state of a ceremony until it is finished
+// or expires. Expired ceremonies are cleaned up on the way.
+func (db *DB) CreateWebAuthnCeremony(id string, userID *int64, purpose, name string, state []byte, expiresAt time.Time) error {
+	if _, err := db.Exec("DELETE FROM webauthn_ceremonies WHERE expires_at < NOW()"); err != nil {
+		return err
+	}
+	_, err := db.Exec(
+		"INSERT INTO webauthn_ceremonies (id, user_id, purpose, name, state, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		id, userID, purpose, name, state, expiresAt,
+	)
+	return err
+}
+
+// ConsumeWebAuthnCeremony returns and deletes a pending ceremony, so each
+// challenge can only be answered once
+func (db *DB) ConsumeWebAuthnCeremony(id, purpose string) (*WebAuthnCeremony, error) {
+	c := &WebAuthnCeremony{}
+	var name sql.NullString
+	err := db.QueryRow(
+		"SELECT id, user_id, purpose, name, state, expires_at FROM webauthn_ceremonies WHERE id = ? AND purpose = ?",
+		id, purpose,
+	).Scan(&c.ID, &c.UserID, &c.Purpose, &name, &c.State, &c.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("ceremony not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.Name = name.String
+
+	result, err := db.Exec("DELETE FROM webauthn_ceremonies WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if rows == 0 || time.Now().After(c.ExpiresAt) {
+		return nil, errors.New("ceremony not found")
+	}
+	return c, nil
+}
@@ -0,0 +1,106 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"shebang.run/internal/database"
+	"shebang.run/internal/storage"
+)
+
+// maxReportedBlobs bounds the keys listed in a GC report
+const maxReportedBlobs = 1000
+
+// BlobGCReport summarizes a garbage collection run
+type BlobGCReport struct {
+	DryRun        bool     `json:"dry_run"`
+	Scanned       int      `json:"scanned"`
+	Orphaned      int      `json:"orphaned"`
+	OrphanedBytes int64    `json:"orphaned_bytes"`
+	Deleted       int      `json:"deleted"`
+	InGracePeriod int      `json:"in_grace_period"`
+	Failed        int      `json:"failed"`
+	OrphanedKeys  []string `json:"orphaned_keys"`
+}
+
+// CollectBlobGarbage deletes stored blobs that no script version refers to
+// any more, such as those of deleted scripts and accounts. Blobs younger
+// than grace are kept, since a version's blob is written before its row. A
+// dry run only reports what would be deleted.
+func CollectBlobGarbage(ctx context.Context, db *database.DB, store storage.Storage, grace time.Duration, dryRun bool) (*BlobGCReport, error) {
+	report := &BlobGCReport{DryRun: dryRun, OrphanedKeys: []string{}}
+	cutoff := time.Now().Add(-grace)
+
+	// Listed after the references are read, a blob written and referenced in
+	// between is still within the grace period
+	referenced, err := db.GetStoragePaths()
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	err = store.List(ctx, "", func(obj storage.ObjectInfo) error {
+		report.Scanned++
+		if referenced[obj.Key] {
+			return nil
+		}
+		if obj.LastModified.After(cutoff) {
+			report.InGracePeriod++
+			return nil
+		}
+		report.Orphaned++
+		report.OrphanedBytes += obj.Size
+		if len(report.OrphanedKeys) < maxReportedBlobs {
+			report.OrphanedKeys = append(report.OrphanedKeys, obj.Key)
+		}
+		orphans = append(orphans, obj.Key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if dryRun {
+		return report, nil
+	}
+	for _, key := range orphans {
+		if err := store.Delete(ctx, key); err != nil {
+			log.Printf("Failed to delete orphaned blob %s: %v", key, err)
+			report.Failed++
+			continue
+		}
+		report.Deleted++
+	}
+	return report, nil
+}
+
+// StartBlobGC collects orphaned blobs every interval; with dryRun it only
+// logs what it would delete
+func StartBlobGC(db *database.DB, store storage.Storage, interval, grace time.Duration, dryRun bool) {
+	run := func() {
+		report, err := CollectBlobGarbage(context.Background(), db, store, grace, dryRun)
+		if err != nil {
+			log.Printf("Error collecting orphaned blobs: %v", err)
+			return
+		}
+		if dryRun {
+			log.Printf("Blob GC dry run: %d of %d blobs orphaned (%d bytes), %d within the grace period", report.Orphaned, report.Scanned, report.OrphanedBytes, report.InGracePeriod)
+			for _, key := range report.OrphanedKeys {
+				log.Printf("Blob GC dry run: would delete %s", key)
+			}
+		} else if report.Orphaned > 0 {
+			log.Printf("Blob GC deleted %d of %d orphaned blobs (%d bytes)", report.Deleted, report.Orphaned, report.OrphanedBytes)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		run()
+		for range ticker.C {
+			run()
+		}
+	}()
+
+	log.Printf("Blob GC started (runs every %s, grace period %s)", interval, grace)
+}
@@ -0,0 +1,125 @@
+package jobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"shebang.run/internal/crypto"
+	"shebang.run/internal/database"
+	"shebang.run/internal/storage"
+)
+
+// ScrubReport summarizes an integrity scrub
+type ScrubReport struct {
+	Checked int
+	Failed  int
+}
+
+// ScrubBlobs reads every blob script content is stored in, at most
+// perSecond a second so the scrub does not compete with serving scripts,
+// and checks it against what was stored. Blobs failing their check are
+// recorded for admins and cleared once they pass again.
+func ScrubBlobs(ctx context.Context, db *database.DB, store storage.Storage, perSecond float64) (*ScrubReport, error) {
+	if err := db.DeleteStaleScrubFailures(); err != nil {
+		return nil, err
+	}
+	blobs, err := db.ListStoredBlobs()
+	if err != nil {
+		return nil, err
+	}
+
+	if perSecond <= 0 {
+		perSecond = 1
+	}
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / perSecond))
+	defer ticker.Stop()
+
+	report := &ScrubReport{}
+	for _, blob := range blobs {
+		select {
+		case <-ctx.Done():
+			return report, ctx.Err()
+		case <-ticker.C:
+		}
+
+		report.Checked++
+		if problem := checkBlob(ctx, store, blob); problem != "" {
+			report.Failed++
+			log.Printf("Integrity scrub: %s: %s", blob.Key, problem)
+			if err := db.RecordScrubFailure(blob.Key, problem); err != nil {
+				log.Printf("Failed to record scrub failure of %s: %v", blob.Key, err)
+			}
+			continue
+		}
+		if err := db.ClearScrubFailure(blob.Key); err != nil {
+			log.Printf("Failed to clear scrub failure of %s: %v", blob.Key, err)
+		}
+	}
+	return report, nil
+}
+
+// checkBlob describes what is wrong with the blob, or returns "" if nothing
+// is. Plaintext must hash to its version's checksum. Encrypted content can
+// only be authenticated with the owner's private key, which the server
+// never holds, so it is checked for the length encryption produces and,
+// when content-addressed, against the hash in its key. Compressed blobs are
+// also checked by their codec's own checksum as they are decompressed.
+func checkBlob(ctx context.Context, store storage.Storage, blob database.StoredBlob) string {
+	reader, err := store.Get(ctx, blob.Key)
+	if err != nil {
+		return fmt.Sprintf("unreadable: %v", err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return fmt.Sprintf("unreadable: %v", err)
+	}
+
+	hash := sha256.Sum256(data)
+	sum := hex.EncodeToString(hash[:])
+	if !blob.Encrypted {
+		if sum != blob.Checksum {
+			return fmt.Sprintf("checksum mismatch: content %s, version %s", sum, blob.Checksum)
+		}
+		return ""
+	}
+
+	if want := crypto.EncryptedSize(blob.Size); int64(len(data)) != want {
+		return fmt.Sprintf("ciphertext is %d bytes, expected %d", len(data), want)
+	}
+	if strings.HasPrefix(blob.Key, "sha256/") && sum != path.Base(blob.Key) {
+		return fmt.Sprintf("ciphertext hash %s does not match its key", sum)
+	}
+	return ""
+}
+
+// StartScrubber scrubs all blobs every interval
+func StartScrubber(db *database.DB, store storage.Storage, interval time.Duration, perSecond float64) {
+	run := func() {
+		report, err := ScrubBlobs(context.Background(), db, store, perSecond)
+		if err != nil {
+			log.Printf("Error scrubbing blobs: %v", err)
+			return
+		}
+		if report.Failed > 0 {
+			log.Printf("Integrity scrub: %d of %d blobs failed their check", report.Failed, report.Checked)
+		}
+	}
+
+	// Not on startup: a scrub reads everything, and restarts are frequent
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			run()
+		}
+	}()
+
+	log.Printf("Integrity scrubber started (runs every %s, %g blobs a second)", interval, perSecond)
+}
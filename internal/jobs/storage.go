@@ -0,0 +1,48 @@
+package jobs
+
+import (
+	"log"
+	"time"
+
+	"shebang.run/internal/database"
+)
+
+// ReconcileStorageUsage recomputes every account's storage used from the
+// script versions it holds, and every blob's references
+func ReconcileStorageUsage(db *database.DB) {
+	log.Println("Reconciling storage usage...")
+
+	corrected, err := db.ReconcileStorageUsage()
+	if err != nil {
+		log.Printf("Error reconciling storage usage: %v", err)
+		return
+	}
+
+	if corrected > 0 {
+		log.Printf("Corrected storage usage of %d accounts", corrected)
+	}
+
+	fixed, err := db.ReconcileBlobRefs()
+	if err != nil {
+		log.Printf("Error reconciling blob references: %v", err)
+		return
+	}
+	if fixed > 0 {
+		log.Printf("Corrected reference counts of %d blobs", fixed)
+	}
+}
+
+// StartStorageReconciler runs the reconciliation daily
+func StartStorageReconciler(db *database.DB) {
+	ticker := time.NewTicker(24 * time.Hour)
+	go func() {
+		// Run immediately on startup, which also fills in usage after upgrading
+		ReconcileStorageUsage(db)
+
+		for range ticker.C {
+			ReconcileStorageUsage(db)
+		}
+	}()
+
+	log.Println("Storage reconciler started (runs daily)")
+}
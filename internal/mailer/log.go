@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LogMailer does not deliver mail. Messages are written as .eml files to
+// dir, or to the server log when dir is empty, so links in them can be
+// followed during local testing.
+type LogMailer struct {
+	dir  string
+	from string
+}
+
+func NewLogMailer(dir, from string) (*LogMailer, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &LogMailer{dir: dir, from: from}, nil
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	data, to, err := build(m.from, msg)
+	if err != nil {
+		return err
+	}
+
+	if m.dir == "" {
+		log.Printf("Mail to %s (not sent):\n%s", to, data)
+		return nil
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102T150405.000000000"), to)
+	return os.WriteFile(filepath.Join(m.dir, filepath.Base(name)), data, 0600)
+}
@@ -0,0 +1,53 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email: SMTPMailer for real delivery, LogMailer to write
+// messages to the log or a directory during development
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// build renders msg as an RFC 5322 message. Addresses are parsed and the
+// subject encoded, so user input cannot inject headers.
+func build(from string, msg Message) ([]byte, string, error) {
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid from address: %w", err)
+	}
+	toAddr, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid recipient: %w", err)
+	}
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return nil, "", errors.New("invalid subject")
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", fromAddr.String())
+	fmt.Fprintf(&b, "To: %s\r\n", toAddr.String())
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes(), toAddr.Address, nil
+}
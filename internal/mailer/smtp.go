@@ -0,0 +1,101 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// SMTPMailer delivers through an SMTP server. Port 465 uses implicit TLS;
+// other ports upgrade with STARTTLS, which is required before credentials
+// are sent.
+type SMTPMailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+}
+
+func NewSMTPMailer(host string, port int, username, password, from string) (*SMTPMailer, error) {
+	if host == "" {
+		return nil, errors.New("SMTP host is required")
+	}
+	if _, err := mail.ParseAddress(from); err != nil {
+		return nil, errors.New("invalid from address")
+	}
+	return &SMTPMailer{host: host, port: port, username: username, password: password, from: from}, nil
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	data, to, err := build(m.from, msg)
+	if err != nil {
+		return err
+	}
+	from, _ := mail.ParseAddress(m.from)
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+	}
+
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	tlsConfig := &tls.Config{ServerName: m.host}
+	var conn net.Conn
+	if m.port == 465 {
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if m.port != 465 {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if m.username != "" {
+		// PlainAuth refuses to send credentials without TLS
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
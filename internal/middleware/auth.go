@@ -3,6 +3,7 @@ package middleware
 import (
 	"context"
 	"encoding/base64"
+	"errors"
 	"net/http"
 	"strings"
 
@@ -14,77 +15,129 @@ type contextKey string
 
 const UserContextKey contextKey = "user"
 
-func AuthMiddleware(jwtSecret string, db *database.DB) func(http.Handler) http.Handler {
+// Authenticate resolves the request's credentials: a Bearer JWT whose login
+// session is still active, or Basic auth with an API token's client ID and secret. API token
+// claims carry the token's scopes and script restrictions, and only keep
+// admin rights if the token has the admin scope.
+func Authenticate(r *http.Request, jwtKeys *auth.KeySet, db *database.DB) (*auth.Claims, error) {
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return nil, errors.New("Unauthorized")
+	}
+
+	// Check if it's Basic Auth (API tokens)
+	if strings.HasPrefix(authHeader, "Basic ") {
+		encoded := strings.TrimPrefix(authHeader, "Basic ")
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.New("Invalid authorization")
+		}
+		
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("Invalid authorization")
+		}
+		
+		clientID := parts[0]
+		clientSecret := parts[1]
+		
+		// Validate API token
+		token, err := db.GetAPITokenByClientID(clientID)
+		if err != nil || !auth.CheckTokenHash(clientSecret, token.SecretHash) {
+			return nil, errors.New("Invalid credentials")
+		}
+		if token.Expired() {
+			return nil, errors.New("Token expired")
+		}
+		
+		// Update last used
+		db.UpdateAPITokenLastUsed(clientID)
+		
+		// Get user
+		user, err := db.GetUserByID(token.UserID)
+		if err != nil {
+			return nil, errors.New("User not found")
+		}
+		
+		// Create claims
+		claims := &auth.Claims{
+			UserID:    user.ID,
+			Username:  user.Username,
+			Scopes:    token.Scopes,
+			ScriptIDs: token.ScriptIDs,
+			TokenID:   token.ID,
+		}
+		claims.IsAdmin = user.IsAdmin && claims.HasScope("admin")
+		if claims.MFASetupRequired, err = db.MFASetupRequired(user); err != nil {
+			return nil, errors.New("Internal error")
+		}
+		return claims, nil
+	}
+
+	// Bearer token (JWT)
+	parts := strings.Split(authHeader, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return nil, errors.New("Invalid authorization header")
+	}
+
+	claims, err := auth.ValidateToken(parts[1], jwtKeys)
+	if err != nil {
+		return nil, errors.New("Invalid token")
+	}
+
+	// Access tokens are only good while their session is
+	active, err := db.TouchSession(claims.SessionID, claims.UserID)
+	if err != nil || !active {
+		return nil, errors.New("Session expired")
+	}
+	return claims, nil
+}
+
+func AuthMiddleware(jwtKeys *auth.KeySet, db *database.DB) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			authHeader := r.Header.Get("Authorization")
-			if authHeader == "" {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			claims, err := Authenticate(r, jwtKeys, db)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnauthorized)
 				return
 			}
-
-			// Check if it's Basic Auth (API tokens)
-			if strings.HasPrefix(authHeader, "Basic ") {
-				encoded := strings.TrimPrefix(authHeader, "Basic ")
-				decoded, err := base64.StdEncoding.DecodeString(encoded)
-				if err != nil {
-					http.Error(w, "Invalid authorization", http.StatusUnauthorized)
-					return
-				}
-				
-				parts := strings.SplitN(string(decoded), ":", 2)
-				if len(parts) != 2 {
-					http.Error(w, "Invalid authorization", http.StatusUnauthorized)
-					return
-				}
-				
-				clientID := parts[0]
-				clientSecret := parts[1]
-				
-				// Validate API token
-				token, err := db.GetAPITokenByClientID(clientID)
-				if err != nil || token.ClientSecret != clientSecret {
-					http.Error(w, "Invalid credentials", http.StatusUnauthorized)
-					return
-				}
-				
-				// Update last used
-				db.UpdateAPITokenLastUsed(clientID)
-				
-				// Get user
-				user, err := db.GetUserByID(token.UserID)
-				if err != nil {
-					http.Error(w, "User not found", http.StatusUnauthorized)
-					return
-				}
-				
-				// Create claims
-				claims := &auth.Claims{
-					UserID:   user.ID,
-					Username: user.Username,
-					IsAdmin:  user.IsAdmin,
-				}
-				
-				ctx := context.WithValue(r.Context(), UserContextKey, claims)
-				next.ServeHTTP(w, r.WithContext(ctx))
+			if claims.MFASetupRequired && !mfaSetupAllowed(r.URL.Path) {
+				http.Error(w, "Two-factor authentication is required; enroll at /api/account/mfa", http.StatusForbidden)
 				return
 			}
 
-			// Bearer token (JWT)
-			parts := strings.Split(authHeader, " ")
-			if len(parts) != 2 || parts[0] != "Bearer" {
-				http.Error(w, "Invalid authorization header", http.StatusUnauthorized)
+			ctx := context.WithValue(r.Context(), UserContextKey, claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// mfaSetupAllowed lists what a user who must enroll in MFA can still reach
+func mfaSetupAllowed(path string) bool {
+	return strings.HasPrefix(path, "/api/account/mfa") || path == "/api/auth/logout"
+}
+
+// RequireScope rejects API token requests lacking the scope for the route:
+// read for GET and HEAD, write for everything else. Narrower grants such as
+// "secrets:read:<name>" pass here and are checked by the handler.
+func RequireScope(read, write string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := GetUserFromContext(r.Context())
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
 
-			claims, err := auth.ValidateToken(parts[1], jwtSecret)
-			if err != nil {
-				http.Error(w, "Invalid token", http.StatusUnauthorized)
+			scope := write
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				scope = read
+			}
+			if !claims.HasAnyScopeUnder(scope) {
+				http.Error(w, "Token lacks required scope: "+scope, http.StatusForbidden)
 				return
 			}
-
-			ctx := context.WithValue(r.Context(), UserContextKey, claims)
-			next.ServeHTTP(w, r.WithContext(ctx))
+			next.ServeHTTP(w, r)
 		})
 	}
 }
@@ -101,6 +154,10 @@ func APITokenMiddleware(db *database.DB) func(http.Handler) http.Handler {
 func AdminMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		claims, ok := r.Context().Value(UserContextKey).(*auth.Claims)
+		if ok && claims.AdminPasskeyRequired {
+			http.Error(w, "The admin console requires signing in with a passkey", http.StatusForbidden)
+			return
+		}
 		if !ok || !claims.IsAdmin {
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
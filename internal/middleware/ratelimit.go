@@ -1,117 +1,389 @@
 package middleware
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
-	
+
 	"shebang.run/internal/database"
 )
 
-type rateLimiter struct {
-	requests map[string][]time.Time
-	mu       sync.RWMutex
-	window   time.Duration
+// Limits are requests a minute. Each key has a token bucket that holds up
+// to its capacity and refills at the limit, so a client can burst up to the
+// capacity and then continue at the limit.
+const rateLimitWindow = time.Minute
+
+// RateLimitStore keeps the token buckets. Take refills key's bucket at rate
+// tokens a second up to capacity, removes cost tokens if it holds that many
+// and returns the tokens left; a new bucket starts full. Implementations
+// shared by several instances must apply Take atomically.
+type RateLimitStore interface {
+	Take(key string, rate, capacity, cost float64) (tokens float64, allowed bool, err error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // when the bucket will have refilled completely
 }
 
-func newRateLimiter(window time.Duration) *rateLimiter {
-	rl := &rateLimiter{
-		requests: make(map[string][]time.Time),
-		window:   window,
+// MemoryRateLimitStore keeps buckets in process, so each instance of the
+// server limits on its own
+type MemoryRateLimitStore struct {
+	buckets map[string]*bucket
+	mu      sync.Mutex
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	s := &MemoryRateLimitStore{
+		buckets: make(map[string]*bucket),
 	}
-	
-	go rl.cleanup()
-	
-	return rl
+
+	go s.cleanup()
+
+	return s
 }
 
-func (rl *rateLimiter) cleanup() {
+// cleanup drops buckets that have refilled, which behave as new ones
+func (s *MemoryRateLimitStore) cleanup() {
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
-	
+
 	for range ticker.C {
-		rl.mu.Lock()
+		s.mu.Lock()
 		now := time.Now()
-		for key, times := range rl.requests {
-			var valid []time.Time
-			for _, t := range times {
-				if now.Sub(t) < rl.window {
-					valid = append(valid, t)
-				}
-			}
-			if len(valid) == 0 {
-				delete(rl.requests, key)
-			} else {
-				rl.requests[key] = valid
+		for key, b := range s.buckets {
+			if now.After(b.full) {
+				delete(s.buckets, key)
 			}
 		}
-		rl.mu.Unlock()
+		s.mu.Unlock()
 	}
 }
 
-func (rl *rateLimiter) allow(key string, limit int) bool {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-	
+func (s *MemoryRateLimitStore) Take(key string, rate, capacity, cost float64) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	now := time.Now()
-	times := rl.requests[key]
-	
-	var valid []time.Time
-	for _, t := range times {
-		if now.Sub(t) < rl.window {
-			valid = append(valid, t)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		s.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+
+	allowed := b.tokens >= cost
+	if allowed {
+		b.tokens -= cost
+	}
+	b.full = now.Add(secondsDuration((capacity - b.tokens) / rate))
+	return b.tokens, allowed, nil
+}
+
+var rateLimitStore RateLimitStore = NewMemoryRateLimitStore()
+
+// UseRateLimitStore replaces the in-memory buckets, e.g. with Redis so that
+// all instances share limits. Call it before serving requests.
+func UseRateLimitStore(store RateLimitStore) {
+	rateLimitStore = store
+}
+
+// rateLimitResult describes a bucket after a take
+type rateLimitResult struct {
+	allowed    bool
+	limit      int
+	remaining  int
+	reset      time.Duration // until the bucket is full again
+	retryAfter time.Duration // until the request would be allowed, when it was not
+}
+
+// take removes cost tokens from key's bucket, which refills at limit tokens
+// a window. A cost above the capacity is charged as the whole bucket so it
+// stays possible. When the store fails the request is let through, so an
+// outage of a shared store does not take the API down with it.
+func take(key string, limit int, capacity, cost float64) rateLimitResult {
+	if limit < 1 {
+		return rateLimitResult{limit: limit, reset: rateLimitWindow, retryAfter: rateLimitWindow}
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+	if cost > capacity {
+		cost = capacity
+	}
+	rate := float64(limit) / rateLimitWindow.Seconds()
+
+	tokens, allowed, err := rateLimitStore.Take(key, rate, capacity, cost)
+	if err != nil {
+		log.Printf("Rate limit store failed, allowing request: %v", err)
+		return rateLimitResult{allowed: true, limit: limit, remaining: int(capacity)}
+	}
+
+	result := rateLimitResult{allowed: allowed, limit: limit, remaining: int(math.Floor(tokens))}
+	if !allowed {
+		result.retryAfter = secondsDuration((cost - tokens) / rate)
+	}
+	result.reset = secondsDuration((capacity - tokens) / rate)
+	return result
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// wholeSeconds rounds up, so waiting that long is always enough
+func wholeSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
+
+// setHeaders reports the bucket in X-RateLimit-Limit (requests a minute),
+// X-RateLimit-Remaining and X-RateLimit-Reset (seconds until it is full)
+func (res rateLimitResult) setHeaders(w http.ResponseWriter) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(res.limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(res.remaining))
+	w.Header().Set("X-RateLimit-Reset", wholeSeconds(res.reset))
+}
+
+// tooManyRequests answers 429 with a Retry-After in whole seconds
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+}
+
+// trustedProxies are the reverse proxies whose X-Real-IP header is
+// believed, see SetTrustedProxies
+var trustedProxies []*net.IPNet
+
+// SetTrustedProxies sets the addresses of the reverse proxies in front of
+// the server, as CIDRs or single IPs. Call it before serving requests.
+func SetTrustedProxies(proxies []string) error {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		cidr := proxy
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
 		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid proxy address %q", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+// ClientIP returns the client address for rate limits and access logs: the
+// connection's address, or for connections from a trusted proxy the
+// X-Real-IP it sets. Anyone else could send any X-Real-IP, for instance a
+// new one with every request to get fresh rate limit buckets.
+func ClientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		peer = host
+	}
+	if !trustedProxy(peer) {
+		return peer
 	}
-	
-	if len(valid) >= limit {
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return peer
+}
+
+func trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
 		return false
 	}
-	
-	valid = append(valid, now)
-	rl.requests[key] = valid
-	
-	return true
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
-var globalRateLimiter *rateLimiter
+// rateLimitKey identifies who a request counts against: the API token, so
+// each token has its own budget, the signed-in user, or the client IP
+func rateLimitKey(r *http.Request) string {
+	if claims, ok := GetUserFromContext(r.Context()); ok {
+		if claims.TokenID != 0 {
+			return "api:token:" + strconv.FormatInt(claims.TokenID, 10)
+		}
+		return "api:user:" + strconv.FormatInt(claims.UserID, 10)
+	}
+	return "api:ip:" + ClientIP(r)
+}
+
+// User limits change rarely, so they are cached briefly instead of being
+// read on every request
+const userLimitTTL = time.Minute
+
+type cachedLimit struct {
+	limit   int
+	expires time.Time
+}
+
+var (
+	userLimits   = make(map[int64]cachedLimit)
+	userLimitsMu sync.Mutex
+)
+
+// userRateLimit returns the user's override or tier limit, or defaultLimit
+// if it cannot be read
+func userRateLimit(db *database.DB, userID int64, defaultLimit int) int {
+	userLimitsMu.Lock()
+	cached, ok := userLimits[userID]
+	userLimitsMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.limit
+	}
 
-func RateLimitMiddleware(defaultLimit int, db *database.DB) func(http.Handler) http.Handler {
-	if globalRateLimiter == nil {
-		globalRateLimiter = newRateLimiter(time.Minute)
+	limit, err := db.GetUserRateLimit(userID)
+	if err != nil {
+		return defaultLimit
+	}
+
+	userLimitsMu.Lock()
+	now := time.Now()
+	for id, c := range userLimits {
+		if now.After(c.expires) {
+			delete(userLimits, id)
+		}
 	}
-	
+	userLimits[userID] = cachedLimit{limit: limit, expires: now.Add(userLimitTTL)}
+	userLimitsMu.Unlock()
+	return limit
+}
+
+// InvalidateRateLimit drops the user's cached limit after their override or
+// tier changed
+func InvalidateRateLimit(userID int64) {
+	userLimitsMu.Lock()
+	delete(userLimits, userID)
+	userLimitsMu.Unlock()
+}
+
+const rateLimitContextKey contextKey = "rate_limit"
+
+// rateLimitState is what RateLimitCost needs to charge the same bucket
+type rateLimitState struct {
+	key      string
+	limit    int
+	capacity float64
+}
+
+// RateLimitMiddleware charges each request one token from the caller's
+// bucket; RateLimitCost charges more for expensive routes. It goes after
+// AuthMiddleware so authenticated requests count against the user or API
+// token with their tier's limit or override, and anonymous ones against
+// the client IP with defaultLimit. burst sizes the bucket as a multiple of
+// the limit. Admins are not limited.
+func RateLimitMiddleware(defaultLimit int, burst float64, db *database.DB) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Check if user is admin (bypass rate limiting)
-			if claims, ok := GetUserFromContext(r.Context()); ok && claims.IsAdmin {
+			claims, ok := GetUserFromContext(r.Context())
+			if ok && claims.IsAdmin {
 				next.ServeHTTP(w, r)
 				return
 			}
-			
-			// Get user's tier limit (or override)
+
 			limit := defaultLimit
-			if claims, ok := GetUserFromContext(r.Context()); ok {
-				// Check for user-specific override first
-				var userRateLimit *int
-				db.DB.QueryRow("SELECT rate_limit FROM users WHERE id = ?", claims.UserID).Scan(&userRateLimit)
-				
-				if userRateLimit != nil {
-					// User has override set
-					limit = *userRateLimit
-				} else if tier, err := db.GetUserTier(claims.UserID); err == nil {
-					// Use tier limit
-					limit = tier.RateLimit
-				}
+			if ok {
+				limit = userRateLimit(db, claims.UserID, defaultLimit)
+			}
+			state := &rateLimitState{
+				key:      rateLimitKey(r),
+				limit:    limit,
+				capacity: math.Ceil(float64(limit) * burst),
 			}
-			
-			ip := r.RemoteAddr
-			
-			if !globalRateLimiter.allow(ip, limit) {
-				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+
+			res := take(state.key, state.limit, state.capacity, 1)
+			res.setHeaders(w)
+			if !res.allowed {
+				tooManyRequests(w, res.retryAfter)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), rateLimitContextKey, state)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RateLimitCost makes a route cost tokens in total instead of one, for use
+// with r.With below a RateLimitMiddleware
+func RateLimitCost(tokens int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			state, ok := r.Context().Value(rateLimitContextKey).(*rateLimitState)
+			if !ok || tokens <= 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The middleware already took one
+			res := take(state.key, state.limit, state.capacity, float64(tokens-1))
+			res.setHeaders(w)
+			if !res.allowed {
+				tooManyRequests(w, res.retryAfter)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Public script fetches are limited per client IP across all scripts, per
+// client IP and script with the script's own limit, and per script across
+// all clients, so many clients together cannot hammer one script either
+
+// PublicFetchRateLimitMiddleware limits each client IP to limit fetches a
+// minute across the public script routes
+func PublicFetchRateLimitMiddleware(limit int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res := take("fetch:ip:"+ClientIP(r), limit, float64(limit), 1)
+			if !res.allowed {
+				tooManyRequests(w, res.retryAfter)
 				return
 			}
-			
 			next.ServeHTTP(w, r)
 		})
 	}
 }
+
+// AllowScriptFetch counts a fetch of the script by the client against the
+// script's per-client limit a minute and its total limit a minute,
+// answering 429 when either is used up. The client's bucket is taken from
+// first, so a client over its own limit does not use up the total.
+func AllowScriptFetch(w http.ResponseWriter, r *http.Request, scriptID int64, limit, totalLimit int) bool {
+	key := "fetch:script:" + strconv.FormatInt(scriptID, 10)
+	res := take(key+":"+ClientIP(r), limit, float64(limit), 1)
+	if res.allowed {
+		res = take(key, totalLimit, float64(totalLimit), 1)
+	}
+	if !res.allowed {
+		tooManyRequests(w, res.retryAfter)
+		return false
+	}
+	return true
+}
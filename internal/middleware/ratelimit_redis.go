@@ -0,0 +1,291 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// takeScript is the token bucket of MemoryRateLimitStore.Take run inside
+// Redis, so concurrent requests from all instances apply atomically. The
+// clock is Redis's, which keeps instances with drifting clocks consistent;
+// calling TIME before writing needs Redis 5 or later. The bucket expires
+// once it has refilled.
+const takeScript = `
+local rate = tonumber(ARGV[1])
+local capacity = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens = tonumber(bucket[1]) or capacity
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - updated) * rate)
+
+local allowed = 0
+if tokens >= cost then
+	tokens = tokens - cost
+	allowed = 1
+end
+
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`
+
+var takeScriptSHA = func() string {
+	sum := sha1.Sum([]byte(takeScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// redisKeyPrefix namespaces the buckets in a Redis shared with other data
+const redisKeyPrefix = "shebang:ratelimit:"
+
+// RedisRateLimitStore keeps buckets in Redis, so every instance of the
+// server draws from the same ones
+type RedisRateLimitStore struct {
+	addr      string
+	username  string
+	password  string
+	db        int
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+// maxIdleRedisConns bounds the connections kept open between requests
+const maxIdleRedisConns = 16
+
+// NewRedisRateLimitStore connects to the Redis at rawURL, in the form
+// redis://[[user]:password@]host[:port][/db], or rediss:// for TLS, and
+// checks that it answers
+func NewRedisRateLimitStore(rawURL string) (*RedisRateLimitStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return nil, errors.New("Redis URL must be redis://[[user]:password@]host[:port][/db] or rediss://...")
+	}
+
+	s := &RedisRateLimitStore{
+		addr:    u.Host,
+		timeout: 2 * time.Second,
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.username = u.User.Username()
+		s.password, _ = u.User.Password()
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if s.db, err = strconv.Atoi(path); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", path)
+		}
+	}
+	if u.Scheme == "rediss" {
+		s.tlsConfig = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	}
+
+	conn, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.do("PING"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Redis ping: %w", err)
+	}
+	s.put(conn)
+	return s, nil
+}
+
+func (s *RedisRateLimitStore) Take(key string, rate, capacity, cost float64) (float64, bool, error) {
+	conn, err := s.get()
+	if err != nil {
+		return 0, false, err
+	}
+
+	args := []string{
+		"1", redisKeyPrefix + key,
+		strconv.FormatFloat(rate, 'g', -1, 64),
+		strconv.FormatFloat(capacity, 'g', -1, 64),
+		strconv.FormatFloat(cost, 'g', -1, 64),
+	}
+	reply, err := conn.do(append([]string{"EVALSHA", takeScriptSHA}, args...)...)
+	var redisErr redisError
+	if errors.As(err, &redisErr) && strings.HasPrefix(string(redisErr), "NOSCRIPT") {
+		// First use since Redis started; EVAL caches the script for EVALSHA
+		reply, err = conn.do(append([]string{"EVAL", takeScript}, args...)...)
+	}
+	if err != nil && !errors.As(err, &redisErr) {
+		// The connection may be out of step with the protocol
+		conn.Close()
+		return 0, false, err
+	}
+	s.put(conn)
+	if err != nil {
+		return 0, false, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, false, fmt.Errorf("unexpected Redis reply %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	tokensStr, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(tokensStr, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("unexpected Redis reply %v", reply)
+	}
+	return tokens, allowed == 1, nil
+}
+
+// get returns an idle connection or dials, authenticates and selects the
+// database on a new one
+func (s *RedisRateLimitStore) get() (*redisConn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		conn := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return conn, nil
+	}
+	s.mu.Unlock()
+
+	dialer := &net.Dialer{Timeout: s.timeout}
+	var netConn net.Conn
+	var err error
+	if s.tlsConfig != nil {
+		netConn, err = tls.DialWithDialer(dialer, "tcp", s.addr, s.tlsConfig)
+	} else {
+		netConn, err = dialer.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to Redis: %w", err)
+	}
+	conn := &redisConn{Conn: netConn, reader: bufio.NewReader(netConn), timeout: s.timeout}
+
+	if s.password != "" {
+		args := []string{"AUTH", s.password}
+		if s.username != "" {
+			args = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := conn.do(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Redis AUTH: %w", err)
+		}
+	}
+	if s.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Redis SELECT: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (s *RedisRateLimitStore) put(conn *redisConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.idle) >= maxIdleRedisConns {
+		conn.Close()
+		return
+	}
+	s.idle = append(s.idle, conn)
+}
+
+// redisError is an error reply; the connection stays usable after one
+type redisError string
+
+func (e redisError) Error() string { return string(e) }
+
+// redisConn speaks just enough RESP for the store: commands go out as
+// arrays of bulk strings and replies come back as string, int64, nil,
+// []interface{} or redisError
+type redisConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+}
+
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	c.SetDeadline(time.Now().Add(c.timeout))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.Conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	reply, err := c.readReply()
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(redisError); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed Redis reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return redisError(body), nil
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unknown Redis reply type %q", kind)
+}
@@ -0,0 +1,392 @@
+package middleware
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process stand-in for Redis that speaks RESP and runs
+// the token bucket script as a Go port of it, on a clock the test controls.
+// Real Lua runs in TestRedisStoreAgainstRedis.
+type fakeRedis struct {
+	ln       net.Listener
+	username string
+	password string
+
+	mu       sync.Mutex
+	now      time.Time
+	scripts  map[string]bool // SHA1s of scripts loaded with EVAL
+	buckets  map[string]fakeBucket
+	commands []string // command names received, in order
+	accepted int
+	// failNext makes the next n scripts reply with an error; dropNext
+	// closes the connection instead of replying
+	failNext int
+	dropNext int
+}
+
+type fakeBucket struct {
+	tokens, updated float64
+	ttl             int64 // milliseconds, as set by PEXPIRE
+}
+
+// newFakeRedis starts a fake Redis that requires AUTH when password is set
+func newFakeRedis(t *testing.T, username, password string) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{
+		ln:       ln,
+		username: username,
+		password: password,
+		now:      time.Unix(1700000000, 0),
+		scripts:  map[string]bool{},
+		buckets:  map[string]fakeBucket{},
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.accepted++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) url(userinfo, db string) string {
+	return "redis://" + userinfo + f.ln.Addr().String() + db
+}
+
+func (f *fakeRedis) advance(d time.Duration) {
+	f.mu.Lock()
+	f.now = f.now.Add(d)
+	f.mu.Unlock()
+}
+
+func (f *fakeRedis) history() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.commands...)
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	authed := f.password == ""
+	db := 0
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(args[0])
+		f.mu.Lock()
+		f.commands = append(f.commands, name)
+		f.mu.Unlock()
+
+		var reply string
+		switch {
+		case name == "AUTH":
+			user, pass := "default", args[len(args)-1]
+			if len(args) == 3 {
+				user = args[1]
+			}
+			if pass != f.password || (f.username != "" && user != f.username) {
+				reply = "-WRONGPASS invalid username-password pair\r\n"
+			} else {
+				authed = true
+				reply = "+OK\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case name == "PING":
+			reply = "+PONG\r\n"
+		case name == "SELECT":
+			db, _ = strconv.Atoi(args[1])
+			reply = "+OK\r\n"
+		case name == "EVAL" || name == "EVALSHA":
+			var ok bool
+			if reply, ok = f.eval(name, args[1:], db); !ok {
+				return
+			}
+		default:
+			reply = "-ERR unknown command '" + args[0] + "'\r\n"
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// eval runs the token bucket for EVAL or EVALSHA, with args from the script
+// or its SHA1 on. ok is false when the connection is to be dropped.
+func (f *fakeRedis) eval(name string, args []string, db int) (reply string, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	sha := args[0]
+	if name == "EVAL" {
+		sum := sha1.Sum([]byte(args[0]))
+		sha = hex.EncodeToString(sum[:])
+		if args[0] != takeScript {
+			return "-ERR unknown script\r\n", true
+		}
+		f.scripts[sha] = true
+	}
+	if !f.scripts[sha] {
+		return "-NOSCRIPT No matching script. Please use EVAL.\r\n", true
+	}
+	if f.dropNext > 0 {
+		f.dropNext--
+		return "", false
+	}
+	if f.failNext > 0 {
+		f.failNext--
+		return "-ERR injected failure\r\n", true
+	}
+
+	key := strconv.Itoa(db) + ":" + args[2]
+	rate, _ := strconv.ParseFloat(args[3], 64)
+	capacity, _ := strconv.ParseFloat(args[4], 64)
+	cost, _ := strconv.ParseFloat(args[5], 64)
+	now := float64(f.now.UnixMicro()) / 1e6
+
+	b, exists := f.buckets[key]
+	if !exists {
+		b = fakeBucket{tokens: capacity, updated: now}
+	}
+	b.tokens = math.Min(capacity, b.tokens+math.Max(0, now-b.updated)*rate)
+	allowed := 0
+	if b.tokens >= cost {
+		b.tokens -= cost
+		allowed = 1
+	}
+	b.updated = now
+	b.ttl = int64(math.Ceil((capacity-b.tokens)/rate*1000)) + 1000
+	f.buckets[key] = b
+
+	tokens := strconv.FormatFloat(b.tokens, 'g', 14, 64)
+	return fmt.Sprintf("*2\r\n:%d\r\n$%d\r\n%s\r\n", allowed, len(tokens), tokens), true
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("bad command %q", line)
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("bad argument %q", line)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func mustTake(t *testing.T, store RateLimitStore, key string, rate, capacity, cost float64, wantAllowed bool, wantTokens float64) {
+	t.Helper()
+	tokens, allowed, err := store.Take(key, rate, capacity, cost)
+	if err != nil {
+		t.Fatalf("Take(%q): %v", key, err)
+	}
+	if allowed != wantAllowed || math.Abs(tokens-wantTokens) > 0.01 {
+		t.Fatalf("Take(%q) = %v, %v, want %v, %v", key, tokens, allowed, wantTokens, wantAllowed)
+	}
+}
+
+// checkDrain takes a fresh bucket down to empty and checks that costs it
+// cannot cover are refused without being charged
+func checkDrain(t *testing.T, store RateLimitStore, key string) {
+	t.Helper()
+	const slow = 1e-6 // refills too slowly to matter within a test
+	mustTake(t, store, key, slow, 3, 1, true, 2)
+	mustTake(t, store, key, slow, 3, 1, true, 1)
+	mustTake(t, store, key, slow, 3, 2, false, 1)
+	mustTake(t, store, key, slow, 3, 1, true, 0)
+	mustTake(t, store, key, slow, 3, 1, false, 0)
+	// Buckets are independent
+	mustTake(t, store, key+":other", slow, 3, 1, true, 2)
+}
+
+func TestMemoryStoreTake(t *testing.T) {
+	store := &MemoryRateLimitStore{buckets: make(map[string]*bucket)}
+	checkDrain(t, store, "drain")
+
+	mustTake(t, store, "refill", 1, 2, 2, true, 0)
+	// Pretend 1.5 seconds passed
+	store.buckets["refill"].updated = store.buckets["refill"].updated.Add(-1500 * time.Millisecond)
+	mustTake(t, store, "refill", 1, 2, 1, true, 0.5)
+	// Refilling stops at the capacity
+	store.buckets["refill"].updated = store.buckets["refill"].updated.Add(-time.Hour)
+	mustTake(t, store, "refill", 1, 2, 0, true, 2)
+
+	if full := store.buckets["drain"].full; full.Before(time.Now().Add(time.Hour)) {
+		t.Errorf("an empty slowly refilling bucket is full again at %v", full)
+	}
+}
+
+func TestRedisStoreLoadsScriptOnNoScript(t *testing.T) {
+	f := newFakeRedis(t, "", "")
+	store, err := NewRedisRateLimitStore(f.url("", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustTake(t, store, "k", 1, 3, 1, true, 2)
+	mustTake(t, store, "k", 1, 3, 1, true, 1)
+
+	got := strings.Join(f.history(), " ")
+	if want := "PING EVALSHA EVAL EVALSHA"; got != want {
+		t.Errorf("commands = %s, want %s", got, want)
+	}
+}
+
+func TestRedisStoreTokenBucket(t *testing.T) {
+	f := newFakeRedis(t, "", "")
+	store, err := NewRedisRateLimitStore(f.url("", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDrain(t, store, "drain")
+
+	mustTake(t, store, "refill", 1, 2, 2, true, 0)
+	f.advance(1500 * time.Millisecond)
+	mustTake(t, store, "refill", 1, 2, 1, true, 0.5)
+	f.advance(time.Hour)
+	mustTake(t, store, "refill", 1, 2, 0, true, 2)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	b, ok := f.buckets["0:"+redisKeyPrefix+"refill"]
+	if !ok {
+		t.Fatalf("no bucket under %q in %v", redisKeyPrefix+"refill", f.buckets)
+	}
+	if b.ttl != 1000 {
+		t.Errorf("full bucket expires in %dms, want 1000", b.ttl)
+	}
+}
+
+func TestRedisStoreAuthAndSelect(t *testing.T) {
+	f := newFakeRedis(t, "app", "s3cret")
+
+	if _, err := NewRedisRateLimitStore(f.url("app:wrong@", "")); err == nil {
+		t.Error("connected with a wrong password")
+	}
+
+	store, err := NewRedisRateLimitStore(f.url("app:s3cret@", "/3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustTake(t, store, "k", 1, 3, 1, true, 2)
+
+	f.mu.Lock()
+	_, ok := f.buckets["3:"+redisKeyPrefix+"k"]
+	f.mu.Unlock()
+	if !ok {
+		t.Error("bucket not in the selected database")
+	}
+	got := strings.Join(f.history(), " ")
+	if want := "AUTH AUTH SELECT PING EVALSHA EVAL"; got != want {
+		t.Errorf("commands = %s, want %s", got, want)
+	}
+}
+
+func TestRedisStoreReusesConnAfterErrorReply(t *testing.T) {
+	f := newFakeRedis(t, "", "")
+	store, err := NewRedisRateLimitStore(f.url("", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustTake(t, store, "k", 1, 3, 1, true, 2)
+
+	f.mu.Lock()
+	f.failNext = 1
+	f.mu.Unlock()
+	if _, _, err := store.Take("k", 1, 3, 1); err == nil || !strings.Contains(err.Error(), "injected") {
+		t.Fatalf("Take with an error reply = %v", err)
+	}
+	mustTake(t, store, "k", 1, 3, 1, true, 1)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.accepted != 1 {
+		t.Errorf("%d connections, want the first one reused", f.accepted)
+	}
+}
+
+func TestRedisStoreRedialsAfterBrokenConn(t *testing.T) {
+	f := newFakeRedis(t, "", "")
+	store, err := NewRedisRateLimitStore(f.url("", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustTake(t, store, "k", 1, 3, 1, true, 2)
+
+	f.mu.Lock()
+	f.dropNext = 1
+	f.mu.Unlock()
+	if _, _, err := store.Take("k", 1, 3, 1); err == nil {
+		t.Fatal("Take on a dropped connection succeeded")
+	}
+	mustTake(t, store, "k", 1, 3, 1, true, 1)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.accepted != 2 {
+		t.Errorf("%d connections, want the broken one replaced", f.accepted)
+	}
+}
+
+// TestRedisStoreAgainstRedis runs the Lua script itself, given a Redis that
+// may be written to in SHEBANG_TEST_REDIS_URL
+func TestRedisStoreAgainstRedis(t *testing.T) {
+	rawURL := os.Getenv("SHEBANG_TEST_REDIS_URL")
+	if rawURL == "" {
+		t.Skip("SHEBANG_TEST_REDIS_URL not set")
+	}
+	store, err := NewRedisRateLimitStore(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDrain(t, store, "test:"+strconv.FormatInt(time.Now().UnixNano(), 36))
+
+	key := "test:refill:" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	mustTake(t, store, key, 10, 2, 2, true, 0)
+	time.Sleep(150 * time.Millisecond)
+	tokens, allowed, err := store.Take(key, 10, 2, 1)
+	if err != nil || !allowed || tokens < 0.4 || tokens > 1 {
+		t.Errorf("Take after refilling = %v, %v, %v", tokens, allowed, err)
+	}
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowScriptFetch(t *testing.T) {
+	UseRateLimitStore(NewMemoryRateLimitStore())
+	defer UseRateLimitStore(NewMemoryRateLimitStore())
+
+	fetch := func(ip string) int {
+		r := httptest.NewRequest("GET", "/ada/deploy.sh", nil)
+		r.RemoteAddr = ip + ":40000"
+		w := httptest.NewRecorder()
+		if AllowScriptFetch(w, r, 42, 2, 3) {
+			return http.StatusOK
+		}
+		return w.Code
+	}
+
+	steps := []struct {
+		ip   string
+		want int
+	}{
+		{"192.0.2.1", http.StatusOK},
+		{"192.0.2.1", http.StatusOK},
+		// Over the client's limit, which leaves the total alone
+		{"192.0.2.1", http.StatusTooManyRequests},
+		{"192.0.2.2", http.StatusOK},
+		// Over the script's total across clients
+		{"192.0.2.2", http.StatusTooManyRequests},
+		{"192.0.2.3", http.StatusTooManyRequests},
+	}
+	for i, step := range steps {
+		if got := fetch(step.ip); got != step.want {
+			t.Errorf("fetch %d from %s: %d, want %d", i+1, step.ip, got, step.want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	if err := SetTrustedProxies([]string{"10.0.0.0/8", "2001:db8::1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTrustedProxies(nil)
+
+	tests := []struct {
+		remoteAddr, realIP, want string
+	}{
+		{"203.0.113.5:40000", "", "203.0.113.5"},
+		// Only trusted proxies may name the client
+		{"203.0.113.5:40000", "198.51.100.7", "203.0.113.5"},
+		{"10.1.2.3:40000", "198.51.100.7", "198.51.100.7"},
+		{"[2001:db8::1]:40000", "198.51.100.7", "198.51.100.7"},
+		{"[2001:db8::2]:40000", "198.51.100.7", "2001:db8::2"},
+		{"10.1.2.3:40000", "not an address", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := ClientIP(r); got != tt.want {
+			t.Errorf("ClientIP from %s with X-Real-IP %q = %s, want %s", tt.remoteAddr, tt.realIP, got, tt.want)
+		}
+	}
+
+	if err := SetTrustedProxies([]string{"proxy.internal"}); err == nil {
+		t.Error("SetTrustedProxies accepted a host name")
+	}
+}
+
+func TestPublicFetchLimitIgnoresSpoofedHeaders(t *testing.T) {
+	UseRateLimitStore(NewMemoryRateLimitStore())
+	defer UseRateLimitStore(NewMemoryRateLimitStore())
+
+	handler := PublicFetchRateLimitMiddleware(3)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	var limited int
+	for i := 0; i < 6; i++ {
+		r := httptest.NewRequest("GET", "/ada/deploy.sh", nil)
+		r.RemoteAddr = "203.0.113.5:40000"
+		// A new client address every time, which a direct client can claim
+		r.Header.Set("X-Real-IP", fmt.Sprintf("198.51.100.%d", i))
+		r.Header.Set("X-Forwarded-For", fmt.Sprintf("192.0.2.%d", i))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code == http.StatusTooManyRequests {
+			limited++
+		}
+	}
+	if limited != 3 {
+		t.Errorf("%d of 6 fetches limited, want 3 beyond the single client's limit", limited)
+	}
+}
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Gzip blobs are plain gzip streams marked with an extra field, so S3 can
+// serve them as they are. Other compressed blobs, and blobs that could be
+// mistaken for either, start with a header naming their codec. Anything
+// else is stored as it is, as were blobs written before compression.
+const (
+	codecMagic  = "\x00SBC"
+	codecHeader = len(codecMagic) + 1
+
+	codecNone = 'n' // stored uncompressed
+	codecGzip = 'g'
+	codecZstd = 'z'
+)
+
+// gzipMarker is the gzip extra subfield, ID "SB" with no data, that marks
+// gzip blobs written by CompressedStorage
+var gzipMarker = []byte{'S', 'B', 0, 0}
+
+// markedGzipHeader is how many bytes of a blob tell whether it is a marked
+// gzip stream: the fixed gzip header, the extra field length and the marker
+const markedGzipHeader = 10 + 2 + 4
+
+func isMarkedGzip(b []byte) bool {
+	const flagExtra = 1 << 2
+	return len(b) >= markedGzipHeader && b[0] == 0x1f && b[1] == 0x8b && b[2] == 8 &&
+		b[3]&flagExtra != 0 && bytes.Equal(b[12:16], gzipMarker)
+}
+
+// GzipGetter is implemented by storages that can return a blob still
+// gzip-compressed, to be served with Content-Encoding: gzip as it is. ok is
+// false when the blob is not stored gzip-compressed.
+type GzipGetter interface {
+	GetGzip(ctx context.Context, key string) (data io.ReadCloser, ok bool, err error)
+}
+
+// DownloadPresigner is implemented by storages that can redirect downloads
+// of blobs to the backend, see CompressedStorage.PresignDownload
+type DownloadPresigner interface {
+	PresignDownload(ctx context.Context, key string, expiry time.Duration, contentType string, acceptsGzip bool) (u *url.URL, ok bool, err error)
+}
+
+// CompressedStorage compresses blobs before they reach the underlying
+// storage and decompresses them on the way back
+type CompressedStorage struct {
+	Storage
+	codec byte
+}
+
+// NewCompressedStorage wraps store so new blobs are compressed with codec,
+// "gzip" or "zstd", or stored as they are with "none"; blobs already stored
+// are read whatever their codec. Only gzip blobs can be served compressed
+// to clients.
+func NewCompressedStorage(store Storage, codec string) (*CompressedStorage, error) {
+	switch codec {
+	case "none":
+		return &CompressedStorage{Storage: store, codec: codecNone}, nil
+	case "gzip":
+		return &CompressedStorage{Storage: store, codec: codecGzip}, nil
+	case "zstd":
+		return &CompressedStorage{Storage: store, codec: codecZstd}, nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", codec)
+}
+
+func (c *CompressedStorage) Put(ctx context.Context, key string, data io.Reader, size int64) error {
+	raw, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if c.codec == codecZstd {
+		buf.WriteString(codecMagic)
+		buf.WriteByte(codecZstd)
+	}
+	if c.codec != codecNone {
+		if err := c.compress(&buf, raw); err != nil {
+			return err
+		}
+	}
+
+	// Encrypted content does not compress
+	if c.codec == codecNone || buf.Len() >= len(raw) {
+		buf.Reset()
+		if ambiguous(raw) {
+			buf.WriteString(codecMagic)
+			buf.WriteByte(codecNone)
+		}
+		buf.Write(raw)
+	}
+
+	return c.Storage.Put(ctx, key, &buf, int64(buf.Len()))
+}
+
+// ambiguous reports whether raw content could be read back as compressed
+func ambiguous(raw []byte) bool {
+	return bytes.HasPrefix(raw, []byte(codecMagic)) || bytes.HasPrefix(raw, []byte{0x1f, 0x8b})
+}
+
+func (c *CompressedStorage) compress(w io.Writer, raw []byte) error {
+	var enc io.WriteCloser
+	if c.codec == codecZstd {
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+		if err != nil {
+			return err
+		}
+		enc = zw
+	} else {
+		zw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+		if err != nil {
+			return err
+		}
+		zw.Extra = gzipMarker
+		enc = zw
+	}
+	if _, err := enc.Write(raw); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+func (c *CompressedStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	blob, codec, _, err := c.open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch codec {
+	case codecGzip:
+		zr, err := gzip.NewReader(blob)
+		if err != nil {
+			blob.Close()
+			return nil, err
+		}
+		return &decodedReader{Reader: zr, decoder: zr, blob: blob}, nil
+	case codecZstd:
+		zr, err := zstd.NewReader(blob, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			blob.Close()
+			return nil, err
+		}
+		return &decodedReader{Reader: zr, decoder: zstdCloser{zr}, blob: blob}, nil
+	}
+	return blob, nil
+}
+
+func (c *CompressedStorage) GetGzip(ctx context.Context, key string) (io.ReadCloser, bool, error) {
+	blob, codec, _, err := c.open(ctx, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if codec != codecGzip {
+		blob.Close()
+		return nil, false, nil
+	}
+	return blob, true, nil
+}
+
+// PresignDownload returns a short-lived URL to download the blob from the
+// underlying storage, served with contentType. ok is false when the storage
+// cannot presign, or the blob cannot be served as it is: gzip blobs can to
+// clients that accept gzip, with Content-Encoding: gzip, and uncompressed
+// blobs without a codec header can to all.
+func (c *CompressedStorage) PresignDownload(ctx context.Context, key string, expiry time.Duration, contentType string, acceptsGzip bool) (*url.URL, bool, error) {
+	p, ok := c.Storage.(Presigner)
+	if !ok {
+		return nil, false, nil
+	}
+
+	// Only the header is needed to tell how the blob is stored
+	head, err := getRange(ctx, c.Storage, key, 0, markedGzipHeader)
+	if err != nil {
+		return nil, false, err
+	}
+	header, err := io.ReadAll(head)
+	head.Close()
+	if err != nil {
+		return nil, false, err
+	}
+	codec, framed, err := classify(key, header)
+	if err != nil {
+		return nil, false, err
+	}
+
+	params := url.Values{"response-content-type": {contentType}}
+	switch {
+	case framed:
+		return nil, false, nil
+	case codec == codecGzip:
+		if !acceptsGzip {
+			return nil, false, nil
+		}
+		params.Set("response-content-encoding", "gzip")
+	}
+
+	u, err := p.PresignGet(ctx, key, expiry, params)
+	if errors.Is(err, ErrPresignUnsupported) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return u, true, nil
+}
+
+// open returns the blob positioned at its content, its codec, 0 for blobs
+// stored as they are, and whether it starts with a codec header
+func (c *CompressedStorage) open(ctx context.Context, key string) (io.ReadCloser, byte, bool, error) {
+	rc, err := c.Storage.Get(ctx, key)
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	br := bufio.NewReader(rc)
+	blob := &bufferedReader{Reader: br, Closer: rc}
+	header, err := br.Peek(markedGzipHeader)
+	if err != nil && err != io.EOF {
+		rc.Close()
+		return nil, 0, false, err
+	}
+	codec, framed, err := classify(key, header)
+	if err != nil {
+		rc.Close()
+		return nil, 0, false, err
+	}
+	if framed {
+		br.Discard(codecHeader)
+	}
+	return blob, codec, framed, nil
+}
+
+// classify tells from the first markedGzipHeader bytes of a blob, or all of
+// a shorter one, its codec and whether it starts with a codec header
+func classify(key string, header []byte) (byte, bool, error) {
+	if isMarkedGzip(header) {
+		return codecGzip, false, nil
+	}
+	if len(header) < codecHeader || string(header[:len(codecMagic)]) != codecMagic {
+		return 0, false, nil
+	}
+
+	codec := header[len(codecMagic)]
+	switch codec {
+	case codecNone, codecGzip, codecZstd:
+	default:
+		return 0, false, fmt.Errorf("blob %s has unknown codec %q", key, codec)
+	}
+	return codec, true, nil
+}
+
+type bufferedReader struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// decodedReader closes the decoder and the blob under it
+type decodedReader struct {
+	io.Reader
+	decoder io.Closer
+	blob    io.Closer
+}
+
+func (d *decodedReader) Close() error {
+	d.decoder.Close()
+	return d.blob.Close()
+}
+
+type zstdCloser struct{ *zstd.Decoder }
+
+func (z zstdCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
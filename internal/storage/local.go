@@ -3,8 +3,10 @@ package storage
 import (
 	"context"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type LocalStorage struct {
@@ -50,3 +52,30 @@ func (l *LocalStorage) Exists(ctx context.Context, key string) (bool, error) {
 	}
 	return true, nil
 }
+
+func (l *LocalStorage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	return filepath.WalkDir(l.basePath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(l.basePath, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+	})
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+)
+
+// MirrorStorage writes and deletes on two backends and reads from the
+// primary, keeping the secondary current while blobs are migrated to it.
+// A write fails unless both backends took it, so the secondary never misses
+// a blob the primary has.
+type MirrorStorage struct {
+	primary   Storage
+	secondary Storage
+}
+
+func NewMirrorStorage(primary, secondary Storage) *MirrorStorage {
+	return &MirrorStorage{primary: primary, secondary: secondary}
+}
+
+func (m *MirrorStorage) Put(ctx context.Context, key string, data io.Reader, size int64) error {
+	// Each backend reads the data in full
+	raw, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+	if err := m.primary.Put(ctx, key, bytes.NewReader(raw), int64(len(raw))); err != nil {
+		return err
+	}
+	if err := m.secondary.Put(ctx, key, bytes.NewReader(raw), int64(len(raw))); err != nil {
+		return fmt.Errorf("mirror: %w", err)
+	}
+	return nil
+}
+
+func (m *MirrorStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return m.primary.Get(ctx, key)
+}
+
+// Delete removes the blob from both backends. The secondary may not have
+// blobs that have not been migrated yet, so it is only asked when it does.
+func (m *MirrorStorage) Delete(ctx context.Context, key string) error {
+	if err := m.primary.Delete(ctx, key); err != nil {
+		return err
+	}
+	exists, err := m.secondary.Exists(ctx, key)
+	if err != nil {
+		return fmt.Errorf("mirror: %w", err)
+	}
+	if exists {
+		if err := m.secondary.Delete(ctx, key); err != nil {
+			return fmt.Errorf("mirror: %w", err)
+		}
+	}
+	return nil
+}
+
+// Exists reports whether both backends have the blob, so a blob that is
+// reused instead of written again is written to the secondary if missing
+func (m *MirrorStorage) Exists(ctx context.Context, key string) (bool, error) {
+	exists, err := m.primary.Exists(ctx, key)
+	if err != nil || !exists {
+		return false, err
+	}
+	exists, err = m.secondary.Exists(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("mirror: %w", err)
+	}
+	return exists, nil
+}
+
+func (m *MirrorStorage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	return m.primary.List(ctx, prefix, fn)
+}
+
+// GetRange reads from the primary, as Get does
+func (m *MirrorStorage) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	return getRange(ctx, m.primary, key, offset, length)
+}
+
+// PresignGet presigns on the primary, which reads are served from
+func (m *MirrorStorage) PresignGet(ctx context.Context, key string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	p, ok := m.primary.(Presigner)
+	if !ok {
+		return nil, ErrPresignUnsupported
+	}
+	return p.PresignGet(ctx, key, expiry, params)
+}
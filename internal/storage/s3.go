@@ -2,55 +2,136 @@ package storage
 
 import (
 	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 )
 
+// S3Config configures an S3 or S3-compatible bucket. Blobs are stored under
+// KeyPrefix, so several deployments can share a bucket. With SSE set, every
+// object is written with server-side encryption: "AES256" for S3-managed
+// keys or "aws:kms" for KMS, with SSEKMSKeyID or else the account's default
+// key.
+type S3Config struct {
+	Endpoint    string // host[:port]
+	AccessKey   string
+	SecretKey   string
+	Bucket      string
+	Region      string // empty discovers the bucket's region
+	UseSSL      bool
+	CACertFile  string // verifies the endpoint's certificate instead of the system roots
+	PathStyle   bool   // address buckets as endpoint/bucket instead of bucket.endpoint
+	KeyPrefix   string
+	SSE         string
+	SSEKMSKeyID string
+}
+
 type S3Storage struct {
 	client *minio.Client
 	bucket string
+	prefix string
+	sse    encrypt.ServerSide
 }
 
-func NewS3Storage(endpoint, accessKey, secretKey, bucket string, useSSL bool) (*S3Storage, error) {
-	client, err := minio.New(endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
-		Secure: useSSL,
-	})
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	opts := &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	}
+	if cfg.PathStyle {
+		opts.BucketLookup = minio.BucketLookupPath
+	}
+	if cfg.CACertFile != "" {
+		if !cfg.UseSSL {
+			return nil, errors.New("S3 CA certificate needs TLS")
+		}
+		pem, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading S3 CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in S3 CA certificate file")
+		}
+		transport, err := minio.DefaultTransport(true)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig.RootCAs = pool
+		opts.Transport = transport
+	}
+
+	s := &S3Storage{bucket: cfg.Bucket}
+	if prefix := strings.Trim(cfg.KeyPrefix, "/"); prefix != "" {
+		s.prefix = prefix + "/"
+	}
+	switch cfg.SSE {
+	case "":
+	case "AES256":
+		s.sse = encrypt.NewSSE()
+	case "aws:kms":
+		sse, err := encrypt.NewSSEKMS(cfg.SSEKMSKeyID, nil)
+		if err != nil {
+			return nil, err
+		}
+		s.sse = sse
+	default:
+		return nil, fmt.Errorf("unknown S3 server-side encryption %q, expected AES256 or aws:kms", cfg.SSE)
+	}
+
+	client, err := minio.New(cfg.Endpoint, opts)
 	if err != nil {
 		return nil, err
 	}
+	s.client = client
 
 	ctx := context.Background()
-	exists, err := client.BucketExists(ctx, bucket)
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
 	if err != nil {
 		return nil, err
 	}
 	if !exists {
-		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+		if err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region}); err != nil {
 			return nil, err
 		}
 	}
 
-	return &S3Storage{client: client, bucket: bucket}, nil
+	return s, nil
 }
 
 func (s *S3Storage) Put(ctx context.Context, key string, data io.Reader, size int64) error {
-	_, err := s.client.PutObject(ctx, s.bucket, key, data, size, minio.PutObjectOptions{})
+	_, err := s.client.PutObject(ctx, s.bucket, s.prefix+key, data, size, minio.PutObjectOptions{ServerSideEncryption: s.sse})
 	return err
 }
 
 func (s *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
-	return s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	return s.client.GetObject(ctx, s.bucket, s.prefix+key, minio.GetObjectOptions{})
+}
+
+func (s *S3Storage) GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error) {
+	var opts minio.GetObjectOptions
+	if err := opts.SetRange(offset, offset+length-1); err != nil {
+		return nil, err
+	}
+	return s.client.GetObject(ctx, s.bucket, s.prefix+key, opts)
 }
 
 func (s *S3Storage) Delete(ctx context.Context, key string) error {
-	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+	return s.client.RemoveObject(ctx, s.bucket, s.prefix+key, minio.RemoveObjectOptions{})
 }
 
 func (s *S3Storage) Exists(ctx context.Context, key string) (bool, error) {
-	_, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	_, err := s.client.StatObject(ctx, s.bucket, s.prefix+key, minio.StatObjectOptions{})
 	if err != nil {
 		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
 			return false, nil
@@ -59,3 +140,25 @@ func (s *S3Storage) Exists(ctx context.Context, key string) (bool, error) {
 	}
 	return true, nil
 }
+
+func (s *S3Storage) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix + prefix, Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		key := strings.TrimPrefix(obj.Key, s.prefix)
+		if err := fn(ObjectInfo{Key: key, Size: obj.Size, LastModified: obj.LastModified}); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// PresignGet returns a URL anyone can download the blob from until expiry,
+// with params such as response-content-type overriding the response headers
+func (s *S3Storage) PresignGet(ctx context.Context, key string, expiry time.Duration, params url.Values) (*url.URL, error) {
+	return s.client.PresignedGetObject(ctx, s.bucket, s.prefix+key, expiry, params)
+}
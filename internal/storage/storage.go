@@ -2,7 +2,13 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net/url"
+	"time"
+
+	"shebang.run/internal/config"
 )
 
 type Storage interface {
@@ -10,4 +16,72 @@ type Storage interface {
 	Get(ctx context.Context, key string) (io.ReadCloser, error)
 	Delete(ctx context.Context, key string) error
 	Exists(ctx context.Context, key string) (bool, error)
+	// List calls fn for every object whose key starts with prefix, stopping
+	// at the first error fn returns
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// Presigner is implemented by storages that can hand out short-lived URLs
+// to download a blob from directly
+type Presigner interface {
+	PresignGet(ctx context.Context, key string, expiry time.Duration, params url.Values) (*url.URL, error)
+}
+
+// RangeGetter is implemented by storages that can read part of a blob
+// without fetching all of it. The range may run past the end of the blob.
+type RangeGetter interface {
+	GetRange(ctx context.Context, key string, offset, length int64) (io.ReadCloser, error)
+}
+
+// getRange reads length bytes of the blob from offset, with a ranged read
+// when the storage supports one
+func getRange(ctx context.Context, s Storage, key string, offset, length int64) (io.ReadCloser, error) {
+	if rg, ok := s.(RangeGetter); ok {
+		return rg.GetRange(ctx, key, offset, length)
+	}
+	rc, err := s.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, rc, offset); err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, length), rc}, nil
+}
+
+// ErrPresignUnsupported is returned by wrappers whose storage cannot presign
+var ErrPresignUnsupported = errors.New("storage cannot presign downloads")
+
+// Open connects to the configured backend: S3, or else a local directory
+func Open(cfg config.StorageBackendConfig) (Storage, error) {
+	if cfg.Type == "s3" {
+		return NewS3Storage(S3Config{
+			Endpoint:    cfg.S3Endpoint,
+			AccessKey:   cfg.S3AccessKey,
+			SecretKey:   cfg.S3SecretKey,
+			Bucket:      cfg.S3Bucket,
+			Region:      cfg.S3Region,
+			UseSSL:      cfg.S3UseSSL,
+			CACertFile:  cfg.S3CACertFile,
+			PathStyle:   cfg.S3PathStyle,
+			KeyPrefix:   cfg.S3KeyPrefix,
+			SSE:         cfg.S3SSE,
+			SSEKMSKeyID: cfg.S3SSEKMSKeyID,
+		})
+	}
+	if cfg.LocalPath == "" {
+		return nil, fmt.Errorf("local storage needs a path")
+	}
+	return NewLocalStorage(cfg.LocalPath)
 }
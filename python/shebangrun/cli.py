@@ -64,13 +64,54 @@ def save_config(config):
             f.write(f'{key}="{value}"\n')
     CONFIG_FILE.chmod(0o600)
 
+def cmd_device_login(args):
+    """Login by approving a code in a browser on another machine"""
+    url = args.url or input("Server URL [https://shebang.run]: ").strip() or "https://shebang.run"
+    client = ShebangClient(url=url.replace('https://', '').replace('http://', ''))
+    
+    import socket
+    try:
+        device = client.start_device_login(f"shebang CLI on {socket.gethostname()}"[:100])
+    except Exception as e:
+        print(f"Error: Could not start device login - {e}", file=sys.stderr)
+        sys.exit(1)
+    
+    print(f"To sign in, open {device['verification_uri']} in a browser")
+    print(f"and enter the code: {device['user_code']}")
+    print()
+    print(f"Or open: {device['verification_uri_complete']}")
+    print("Waiting for approval...")
+    
+    try:
+        api_token = client.wait_for_device_login(device['device_code'], device['interval'], device['expires_in'])
+    except Exception as e:
+        print(f"Error: Login failed - {e}", file=sys.stderr)
+        sys.exit(1)
+    
+    config = load_config()
+    config.update({
+        'SHEBANG_URL': url,
+        'SHEBANG_USERNAME': api_token['username'],
+        'SHEBANG_CLIENT_ID': api_token['client_id'],
+        'SHEBANG_CLIENT_SECRET': api_token['client_secret'],
+    })
+    save_config(config)
+    
+    print(f"✓ Logged in as {api_token['username']}")
+    print(f"Scopes: {', '.join(api_token['scopes'])}")
+    print(f"Config saved to {CONFIG_FILE}")
+
 def cmd_login(args):
     """Login and generate API credentials"""
+    if args.device:
+        cmd_device_login(args)
+        return
+    
     print("shebang.run Login")
     print("=" * 50)
     print()
     
-    url = input("Server URL [https://shebang.run]: ").strip() or "https://shebang.run"
+    url = args.url or input("Server URL [https://shebang.run]: ").strip() or "https://shebang.run"
     username = input("Username: ").strip()
     if not username:
         print("Error: Username required", file=sys.stderr)
@@ -937,7 +978,10 @@ def main():
     subparsers = parser.add_subparsers(dest='command', help='Commands')
     
     # Login
-    subparsers.add_parser('login', help='Login and generate API credentials')
+    login_parser = subparsers.add_parser('login', help='Login and generate API credentials')
+    login_parser.add_argument('-d', '--device', action='store_true',
+                              help='Approve the login in a browser instead of typing a password')
+    login_parser.add_argument('--url', help='Server URL (default: prompt)')
     
     # List
     list_parser = subparsers.add_parser('list', help='List scripts')
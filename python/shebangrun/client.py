@@ -140,6 +140,7 @@ class ShebangClient:
             
         self.base_url = f"https://{url}"
         self.token = token
+        self.refresh_token = None
         self.session = requests.Session()
         
         if token:
@@ -209,11 +210,14 @@ class ShebangClient:
         data = response.json()
         if "token" in data:
             self.token = data["token"]
+            self.refresh_token = data.get("refresh_token")
             self.session.headers.update({"Authorization": f"Bearer {self.token}"})
         return data
     
     def login(self, username: str, password: str) -> dict:
-        """Login and get JWT token"""
+        """Login and get JWT token. If the account has two-factor
+        authentication the response has mfa_required set; finish with
+        login_mfa()"""
         url = f"{self.base_url}/api/auth/login"
         response = self.session.post(url, json={
             "username": username,
@@ -223,9 +227,92 @@ class ShebangClient:
         data = response.json()
         if "token" in data:
             self.token = data["token"]
+            self.refresh_token = data.get("refresh_token")
             self.session.headers.update({"Authorization": f"Bearer {self.token}"})
         return data
     
+    def login_mfa(self, mfa_token: str, code: Optional[str] = None,
+                  recovery_code: Optional[str] = None) -> dict:
+        """Complete a two-factor login with an authenticator or recovery code"""
+        url = f"{self.base_url}/api/auth/login/mfa"
+        response = self.session.post(url, json={
+            "mfa_token": mfa_token,
+            "code": code or "",
+            "recovery_code": recovery_code or ""
+        })
+        response.raise_for_status()
+        data = response.json()
+        self.token = data["token"]
+        self.refresh_token = data.get("refresh_token")
+        self.session.headers.update({"Authorization": f"Bearer {self.token}"})
+        return data
+    
+    def refresh(self) -> dict:
+        """Renew the access token with the refresh token from login; the
+        refresh token is rotated on every use"""
+        if not self.refresh_token:
+            raise ValueError("No refresh token; call login() first")
+        url = f"{self.base_url}/api/auth/refresh"
+        response = self.session.post(url, json={"refresh_token": self.refresh_token})
+        response.raise_for_status()
+        data = response.json()
+        self.token = data["token"]
+        self.refresh_token = data["refresh_token"]
+        self.session.headers.update({"Authorization": f"Bearer {self.token}"})
+        return data
+    
+    def logout(self) -> None:
+        """Revoke the current login session"""
+        url = f"{self.base_url}/api/auth/logout"
+        response = self.session.post(url)
+        response.raise_for_status()
+        self.token = None
+        self.refresh_token = None
+        self.session.headers.pop("Authorization", None)
+    
+    def start_device_login(self, client_name: str = "shebang CLI", scopes: Optional[list] = None) -> dict:
+        """Start a browser-assisted login for this machine (OAuth device
+        authorization grant). Show the returned user_code and
+        verification_uri to the user, then call wait_for_device_login()"""
+        url = f"{self.base_url}/api/auth/device/code"
+        data = {"client_id": client_name}
+        if scopes:
+            data["scope"] = " ".join(scopes)
+        response = self.session.post(url, data=data)
+        response.raise_for_status()
+        return response.json()
+    
+    def wait_for_device_login(self, device_code: str, interval: int = 5, expires_in: int = 600) -> dict:
+        """Poll until the user approves or denies the device login. Returns the
+        issued API token (client_id, client_secret, scopes, username) and
+        uses it for this client's requests"""
+        import time
+        url = f"{self.base_url}/api/auth/device/token"
+        deadline = time.time() + expires_in
+        while time.time() < deadline:
+            time.sleep(interval)
+            response = self.session.post(url, data={
+                "grant_type": "urn:ietf:params:oauth:grant-type:device_code",
+                "device_code": device_code,
+            })
+            if response.ok:
+                data = response.json()
+                self.session.auth = (data["client_id"], data["client_secret"])
+                return data
+            error = response.json().get("error") if response.status_code == 400 else None
+            if error == "authorization_pending":
+                continue
+            if error == "slow_down":
+                interval += 5
+                continue
+            if error == "access_denied":
+                raise PermissionError("Device login was denied")
+            if error == "expired_token":
+                break
+            response.raise_for_status()
+            raise RuntimeError(f"Device login failed: {error}")
+        raise TimeoutError("Device login code expired before it was approved")
+    
     # Script Management
     def list_scripts(self) -> list:
         """List user's scripts (requires authentication)"""
@@ -345,10 +432,12 @@ class ShebangClient:
         response = self.session.delete(url)
         response.raise_for_status()
     
-    def create_api_token(self, name: str) -> dict:
+    def create_api_token(self, name: str, scopes: Optional[list] = None) -> dict:
         """Create API token for CLI access"""
         url = f"{self.base_url}/api/account/tokens"
-        response = self.session.post(url, json={"name": name})
+        if not scopes:
+            scopes = ["scripts:write", "keys:write", "secrets:write"]
+        response = self.session.post(url, json={"name": name, "scopes": scopes})
         response.raise_for_status()
         return response.json()
     